@@ -33,7 +33,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
@@ -43,6 +42,7 @@ import (
 
 	"github.com/aclements/go-perf/perffile"
 	"github.com/aclements/go-perf/perfsession"
+	"github.com/aclements/go-perf/perfsession/srccache"
 )
 
 type PC struct {
@@ -51,10 +51,19 @@ type PC struct {
 }
 
 type Agg struct {
-	Mmap         *perfsession.Mmap
+	Mmap *perfsession.Mmap
+
 	Events       uint64
 	Predicted    int64
 	Mispredicted int64
+
+	// Observations is the number of sampled branch records for
+	// this PC, regardless of whether they set
+	// BranchFlagPredicted or BranchFlagMispredicted. It's used
+	// in place of Predicted+Mispredicted as the mispredict rate
+	// denominator on CPUs whose LBR doesn't reliably report both
+	// flags.
+	Observations int64
 }
 
 type pair struct {
@@ -80,6 +89,18 @@ func main() {
 	defer f.Close()
 	s := perfsession.New(f)
 
+	caps := s.CPUInfo.CPUCapabilities
+	switch {
+	case caps.LBRWidth == 0 && s.CPUInfo.Vendor != "":
+		log.Printf("warning: %s family %d model %d has no LBR stack; branch samples will likely be empty", s.CPUInfo.Vendor, s.CPUInfo.Family, s.CPUInfo.Model)
+	case !caps.BranchFlagsReliable:
+		if s.CPUInfo.Vendor != "" {
+			log.Printf("warning: %s family %d model %d's LBR may not reliably report both predicted and mispredicted branches; estimating mispredict rate from branch counts instead", s.CPUInfo.Vendor, s.CPUInfo.Family, s.CPUInfo.Model)
+		} else {
+			log.Printf("warning: unknown CPU (missing or unrecognized CPUID header); assuming its LBR may not reliably report both predicted and mispredicted branches")
+		}
+	}
+
 	agg := make(map[PC]Agg)
 
 	const requiredFormat = perffile.SampleFormatTID | perffile.SampleFormatBranchStack
@@ -126,6 +147,7 @@ func main() {
 			a := agg[pc]
 			a.Events += events
 			a.Mmap = mmap
+			a.Observations++
 			if br.Flags&perffile.BranchFlagMispredicted != 0 {
 				a.Mispredicted++
 			}
@@ -145,7 +167,19 @@ func main() {
 		if a.Events == 0 {
 			continue
 		}
-		rate := float64(a.Mispredicted) / float64(a.Predicted+a.Mispredicted)
+		// On CPUs whose LBR doesn't reliably set
+		// BranchFlagPredicted (see warning above),
+		// Predicted+Mispredicted undercounts the branches we
+		// actually observed, so fall back to weighting by the
+		// number of branch records sampled at this PC instead.
+		denom := a.Predicted + a.Mispredicted
+		if !caps.BranchFlagsReliable {
+			denom = a.Observations
+		}
+		if denom == 0 {
+			continue
+		}
+		rate := float64(a.Mispredicted) / float64(denom)
 		a.Mispredicted = int64(rate * float64(a.Events))
 		a.Predicted = int64(a.Events) - a.Mispredicted
 
@@ -165,6 +199,7 @@ func main() {
 	fmt.Printf("\n")
 
 	// Print branch details.
+	srcCache := srccache.New(64 << 20)
 	var sym perfsession.Symbolic
 	fmt.Printf("%-8s %-24s %16s %s\n", "comm", "PC", "branches", "mispredicts")
 	for _, pair := range pairs {
@@ -172,14 +207,14 @@ func main() {
 		var lines []string
 		if pair.Mmap != nil && perfsession.Symbolize(s, pair.Mmap, pair.PC.PC, &sym) && sym.Line.File != nil {
 			pos = fmt.Sprintf("%s:%d", filepath.Base(sym.Line.File.Name), sym.Line.Line)
-			lines, _ = getLines(sym.Line.File.Name, sym.Line.Line-1, sym.Line.Line+1)
+			lines, _ = srcCache.Lines(sym.Line.File.Name, sym.Line.Line-1, sym.Line.Line+1)
 		} else {
 			pos = fmt.Sprintf("%#-24x", pair.PC.PC)
 			lines = nil
 		}
 
 		fmt.Printf("%-8.8s %-24s %16d %d (%2.1f%%)\n", pair.Comm, pos, pair.Events, pair.Mispredicted, 100*pair.rate)
-		trim := stringCommon(lines)
+		trim := srccache.CommonPrefix(lines)
 		for i, line := range lines {
 			fmt.Printf("%7d %s\n", i+sym.Line.Line-1, line[trim:])
 		}
@@ -209,48 +244,3 @@ func (p pairSorter) Less(i, j int) bool {
 	}
 	return p[i].PC.PC < p[j].PC.PC
 }
-
-func getLines(path string, minLine, maxLine int) ([]string, error) {
-	// TODO: Make a nice line cache API. This isn't the only place
-	// I've needed this.
-
-	lines := make([]string, maxLine-minLine+1)
-
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Skip to minLine.
-	scanner := bufio.NewScanner(file)
-	for i := 0; i < minLine && scanner.Scan(); i++ {
-		// Do nothing
-	}
-
-	for line := minLine; line <= maxLine && scanner.Err() == nil; line++ {
-		lines[line-minLine] = scanner.Text()
-		scanner.Scan()
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return lines, nil
-}
-
-func stringCommon(strs []string) int {
-	if len(strs) == 0 {
-		return 0
-	}
-
-	for i := 0; i < len(strs[0]); i++ {
-		c := strs[0][i]
-		for _, s := range strs {
-			if i == len(s) || s[i] != c {
-				return i
-			}
-		}
-	}
-	return len(strs[0])
-}
@@ -0,0 +1,42 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/elf"
+	"log"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile/symbolize"
+)
+
+// loadFuncTable loads the DWARF function table from the ELF binary
+// at path, sorted by lowpc.
+func loadFuncTable(path string) []symbolize.FuncRange {
+	elff, err := elf.Open(path)
+	if err != nil {
+		log.Fatalf("opening %s: %s", path, err)
+	}
+	defer elff.Close()
+
+	dwarff, err := elff.DWARF()
+	if err != nil {
+		log.Fatalf("reading DWARF from %s: %s", path, err)
+	}
+
+	return symbolize.DwarfFuncTable(dwarff)
+}
+
+// funcForIP returns the name of the function in functab that
+// contains ip, or "" if ip falls outside every known function.
+func funcForIP(functab []symbolize.FuncRange, ip uint64) string {
+	i := sort.Search(len(functab), func(i int) bool {
+		return ip < functab[i].High
+	})
+	if i < len(functab) && functab[i].Low <= ip && ip < functab[i].High {
+		return functab[i].Name
+	}
+	return ""
+}
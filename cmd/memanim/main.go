@@ -4,10 +4,11 @@
 
 // Command memanim creates an animation of memory accesses over time
 // from a "perf mem record" profile. In the animation, the address
-// space is compacted to remove pages that have no recorded references
-// and then mapped on to Hilbert curve so that nearby accesses appear
-// nearby in 2-D space. It is then broken in to panels showing all
-// accesses, L2-and-up accesses, etc.
+// space is compacted (-compact) to remove gaps that have no recorded
+// references and then mapped on to a space-filling curve (-layout,
+// Hilbert by default) so that nearby accesses appear nearby in 2-D
+// space. It is then broken in to panels showing all accesses,
+// L2-and-up accesses, etc.
 //
 // The simplest way to record a memory load profile is "perf mem
 // record <cmd>".
@@ -15,7 +16,7 @@
 // To record only load latency events over a threshold number of
 // cycles, use the following command on Sandy Bridge or later:
 //
-//   perf record -W -d -e cpu/event=0xcd,umask=0x1,ldlat=<thresh>/pp <cmd>
+//	perf record -W -d -e cpu/event=0xcd,umask=0x1,ldlat=<thresh>/pp <cmd>
 //
 // The minimum (and default) latency threshold is 3 cycles.
 //
@@ -24,9 +25,32 @@
 // --count 1 -m 1024.
 //
 // To collect only user-space loads, change pp to ppu.
+//
+// "perf mem record" also captures stores. To sample stores
+// explicitly on Intel, add the MEM_UOPS_RETIRED.ALL_STORES event:
+//
+//	perf record -e cpu/event=0xd0,umask=0x82/pp <cmd>
+//
+// On arm64 with SPE support, "perf record -e arm_spe_0//" captures
+// both loads and stores in a single profile.
+//
+// By default memanim renders both loads and stores on the same
+// Hilbert canvas, drawing stores as a small filled square so they
+// stand out from the single-pixel dot used for loads. Use -kinds to
+// render only a subset of event kinds, e.g. -kinds=store to look for
+// write-heavy hot spots and false sharing in isolation.
+//
+// With -symbols=<binary>, memanim loads the DWARF function table
+// from binary (which must match the profiled executable) and, when
+// -by=pc is also set, draws thin boundary lines between pixels
+// belonging to different functions. -symbols also enables -frames,
+// which writes a sidecar frames.json listing the top functions by
+// event count in each output frame, so the resulting video can be
+// captioned with which function is thrashing which cache level.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
@@ -39,8 +63,11 @@ import (
 	"os"
 	"runtime/pprof"
 	"sort"
+	"strings"
 
+	"github.com/aclements/go-perf/layout"
 	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/symbolize"
 	"github.com/golang/freetype"
 )
 
@@ -49,11 +76,17 @@ const pageBytes = 4096
 func main() {
 	var (
 		flagInput      = flag.String("i", "perf.data", "read memory latency profile from `file`")
-		flagBy         = flag.String("by", "address", "`layout` by \"address\" or \"pc\"")
+		flagBy         = flag.String("by", "address", "lay out by \"address\" or \"pc\"")
 		flagFPS        = flag.Int("fps", 24, "frames per second")
 		flagDilation   = flag.Float64("dilation", 1, "time dilation factor")
 		flagWidth      = flag.Int("w", 512, "output width/height; must be a power of 2")
+		flagOutput     = flag.String("o", "", "write animation to `file` (.mp4 or .webm, piped through ffmpeg; .png for an animated PNG); if empty, dump numbered f*.png frames instead")
 		flagCpuProfile = flag.String("cpuprofile", "", "write cpu profile to file")
+		flagKinds      = flag.String("kinds", "load,store", "comma-separated list of event `kinds` to render: load, store, prefetch")
+		flagSymbols    = flag.String("symbols", "", "load DWARF function table from ELF `binary` to draw function boundaries (requires -by=pc) and enable -frames")
+		flagFrames     = flag.String("frames", "", "write per-frame top-function sidecar to `file` (JSON); requires -symbols")
+		flagLayout     = flag.String("layout", "hilbert", "space-filling `curve` used to arrange addresses on the canvas: hilbert, morton, linear, or paged")
+		flagCompact    = flag.String("compact", "pages", "address compaction `granularity`: pages (4096 bytes), cachelines (64 bytes), or none")
 	)
 	flag.Parse()
 	if flag.NArg() > 0 {
@@ -71,6 +104,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	curve, err := resolveCurve(*flagLayout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	compactBytes, err := resolveCompact(*flagCompact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	kinds := parseKinds(*flagKinds)
+
+	var functab []symbolize.FuncRange
+	if *flagSymbols != "" {
+		functab = loadFuncTable(*flagSymbols)
+	}
+	if *flagFrames != "" && functab == nil {
+		fmt.Fprintln(os.Stderr, "-frames requires -symbols")
+		os.Exit(1)
+	}
+
 	if *flagCpuProfile != "" {
 		f, err := os.Create(*flagCpuProfile)
 		if err != nil {
@@ -85,15 +141,26 @@ func main() {
 	// coloring, but it really isn't obvious. Fade it out at a
 	// certain rate? Shade? Ripples?
 
-	events := parsePerf(*flagInput, *flagBy)
+	events := parsePerf(*flagInput, *flagBy, kinds)
 
 	// Canonicalize the events.
 	imgSize := *flagWidth
-	mapper := newAddrMapper(events, uint64(imgSize*imgSize-1))
+	addrs := make([]uint64, len(events))
+	for i, ev := range events {
+		addrs[i] = ev.addr
+	}
+	mapper := layout.NewAddrMapper(addrs, compactBytes, uint64(imgSize*imgSize-1))
 	normalizeWeight(events)
 	zeroTime(events)
 	lastTime := events[len(events)-1].time
 
+	// The curve needs the compaction granularity in output units
+	// (not input bytes) to keep pages contiguous in -layout=paged.
+	normPageSize := int(float64(compactBytes) * mapper.NormFactor())
+	if normPageSize < 1 {
+		normPageSize = 1
+	}
+
 	// Load font.
 	//
 	// TODO Don't hard-code it's location. Unfortunately, there's
@@ -143,14 +210,14 @@ func main() {
 	// and mark the boundary between all pixels before that break
 	// and after that break).
 	if false {
-		addrStep := int(math.Floor(1 / mapper.normFactor))
-		for pfn := range mapper.pageBase {
+		addrStep := int(math.Floor(1 / mapper.NormFactor()))
+		for _, pfn := range mapper.Pages() {
 			for offset := 0; offset < pageBytes; offset += addrStep {
 				addr := pfn*pageBytes + uint64(offset)
-				x, y := hilbert(imgSize, int(mapper.mapAddr(addr)))
+				x, y := layout.Hilbert(imgSize, int(mapper.MapAddr(addr)))
 				naddr := float64(addr%(1<<48)) / (1 << 48) * 2 * math.Pi
 				cb, cr := math.Cos(naddr), -math.Sin(naddr)
-				//fmt.Println(fmt.Sprintf("%016x", addr), int(mapper.mapAddr(addr)), naddr, cb, cr)
+				//fmt.Println(fmt.Sprintf("%016x", addr), int(mapper.MapAddr(addr)), naddr, cb, cr)
 				r, g, b := color.YCbCrToRGB(127, uint8((cb+1)*127), uint8((cr+1)*127))
 				img.SetNRGBA(x, y, color.NRGBA{r, g, b, 255})
 			}
@@ -158,7 +225,29 @@ func main() {
 		writePNG("addr.png", img)
 	}
 
+	// Find the pixels where one function's range ends and the next
+	// begins, generalizing the >1GB break idea above to function
+	// boundaries. This only makes sense when the canvas is laid
+	// out by PC.
+	var boundaryColor = color.NRGBA{128, 128, 128, 255}
+	var boundaryPts [][2]int
+	if functab != nil && *flagBy == "pc" {
+		for _, fr := range functab {
+			x, y := curve(imgSize, normPageSize, int(mapper.MapAddr(fr.Low)))
+			boundaryPts = append(boundaryPts, [2]int{x, y})
+		}
+	}
+
 	nsPerFrame := int(1000000000 / (float64(*flagFPS) * *flagDilation))
+	nFrames := int(lastTime/uint64(nsPerFrame)) + 1
+
+	sink, err := newFrameSink(*flagOutput, *flagFPS, img.Bounds(), nFrames)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var frameRecords []frameInfo
+
 	lastIndex := 0
 	for frame := 0; ; frame++ {
 		t0 := uint64(frame * nsPerFrame)
@@ -181,7 +270,16 @@ func main() {
 			}
 		}
 
+		// Redraw function boundaries over the faded frame so they
+		// don't fade away with the rest of the canvas.
+		for _, pt := range boundaryPts {
+			for _, levelImg := range levelImgs {
+				levelImg.SetNRGBA(pt[0], pt[1], boundaryColor)
+			}
+		}
+
 		// Draw the events.
+		funcCounts := make(map[string]int)
 		for evIndex, ev := range events[lastIndex:] {
 			if ev.time < t0 {
 				panic("time went backwards")
@@ -191,35 +289,55 @@ func main() {
 				break
 			}
 
-			addr := mapper.mapAddr(ev.addr)
-			x, y := hilbert(imgSize, int(addr))
+			addr := mapper.MapAddr(ev.addr)
+			x, y := curve(imgSize, normPageSize, int(addr))
 			//color := color.NRGBA{R: uint8(ev.weight), G: 0, B: 255 - uint8(ev.weight), A: 255}
 			color := color.NRGBA{0, 0, 0, 255}
 			for level := 0; level <= ev.level; level++ {
-				levelImgs[level].SetNRGBA(x, y, color)
+				plotEvent(levelImgs[level], x, y, ev.kind, color)
 			}
+
+			if functab != nil {
+				if name := funcForIP(functab, ev.ip); name != "" {
+					funcCounts[name]++
+				}
+			}
+		}
+
+		if *flagFrames != "" {
+			frameRecords = append(frameRecords, frameInfo{frame, topFuncs(funcCounts, framesTopN)})
 		}
 
 		// Write the frame out.
-		writePNG(fmt.Sprintf("f%08d.png", frame), img)
+		if err := sink.WriteFrame(img); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	fmt.Printf("%g bytes/pixel\n", 1/mapper.normFactor)
-	fmt.Printf("%g pixels/page\n", mapper.normFactor*pageBytes)
+	if *flagFrames != "" {
+		writeFrames(*flagFrames, frameRecords)
+	}
 
-	fmt.Printf("To combine frames:\n  mencoder 'mf://f*.png' -mf fps=%d -nosound -of lavf -lavfopts format=mp4 -ovc x264 -o out.mp4\n", *flagFPS)
+	if err := sink.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%g bytes/pixel\n", 1/mapper.NormFactor())
+	fmt.Printf("%g pixels/page\n", mapper.NormFactor()*pageBytes)
 }
 
 type event struct {
 	time   uint64
 	addr   uint64
+	ip     uint64
 	weight uint64
 	level  int
+	kind   perffile.DataSrcOp
 }
 
 // parsePerf parses a perf.data profile and returns the cache miss
-// events.
-func parsePerf(fileName, by string) []event {
+// events whose DataSrc.Op is in kinds.
+func parsePerf(fileName, by string, kinds perffile.DataSrcOp) []event {
 	f, err := perffile.Open(fileName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading profile: %s\n", err)
@@ -240,6 +358,9 @@ func parsePerf(fileName, by string) []event {
 			if r.Format&requiredFormat != requiredFormat {
 				break
 			}
+			if r.DataSrc.Op&kinds == 0 {
+				break
+			}
 			level := r.DataSrc.Level
 			if r.DataSrc.Miss {
 				level <<= 1
@@ -248,66 +369,132 @@ func parsePerf(fileName, by string) []event {
 			if byPC {
 				addr = r.IP
 			}
-			events = append(events, event{r.Time, addr, r.Weight, levelToPanel[level]})
+			events = append(events, event{r.Time, addr, r.IP, r.Weight, levelToPanel[level], r.DataSrc.Op})
 		}
 	}
 
 	return events
 }
 
-type addrMapper struct {
-	pageBase   map[uint64]uint64
-	normMax    uint64
-	normFactor float64 // pixels/byte
+// curveFunc computes a pixel coordinate for the compacted linear
+// offset d in an n×n canvas. pageSize is the compaction granularity
+// in output units, which curves that care about page boundaries
+// (such as "paged") use to keep a page's pixels contiguous.
+type curveFunc func(n, pageSize, d int) (x, y int)
+
+// resolveCurve returns the curveFunc named by -layout.
+func resolveCurve(name string) (curveFunc, error) {
+	switch name {
+	case "hilbert":
+		return func(n, pageSize, d int) (int, int) { return layout.Hilbert(n, d) }, nil
+	case "morton":
+		return func(n, pageSize, d int) (int, int) { return layout.Morton(n, d) }, nil
+	case "linear":
+		return func(n, pageSize, d int) (int, int) { return layout.Linear(n, d) }, nil
+	case "paged":
+		return layout.Paged, nil
+	}
+	return nil, fmt.Errorf("-layout must be one of hilbert, morton, linear, paged (got %q)", name)
 }
 
-// newAddrMapper returns an addrMapper that maps addresses in events
-// to a compacted space in the range [0, normMax].
-func newAddrMapper(events []event, normMax uint64) *addrMapper {
-	am := &addrMapper{normMax: normMax}
-
-	// Find all distinct pages and max address.
-	pages := make([]uint64, 0)
-	pageSet := make(map[uint64]bool)
-	maxAddr := uint64(0)
-	for _, ev := range events {
-		page := ev.addr / pageBytes
-		if pageSet[page] {
-			continue
-		}
-		pageSet[page] = true
-		pages = append(pages, page)
+// resolveCompact returns the address compaction granularity, in
+// bytes, named by -compact.
+func resolveCompact(name string) (uint64, error) {
+	switch name {
+	case "pages":
+		return pageBytes, nil
+	case "cachelines":
+		return 64, nil
+	case "none":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("-compact must be one of pages, cachelines, none (got %q)", name)
+}
 
-		if ev.addr > maxAddr {
-			maxAddr = ev.addr
+// parseKinds parses a comma-separated list of event kind names
+// ("load", "store", "prefetch") in to the corresponding DataSrcOp
+// bits.
+func parseKinds(s string) perffile.DataSrcOp {
+	var kinds perffile.DataSrcOp
+	for _, k := range strings.Split(s, ",") {
+		switch strings.TrimSpace(k) {
+		case "load":
+			kinds |= perffile.DataSrcOpLoad
+		case "store":
+			kinds |= perffile.DataSrcOpStore
+		case "prefetch":
+			kinds |= perffile.DataSrcOpPrefetch
+		default:
+			fmt.Fprintf(os.Stderr, "unknown event kind %q\n", k)
+			os.Exit(1)
 		}
 	}
-	sort.Sort(uint64Slice(pages))
+	return kinds
+}
 
-	// Map pages to a compact sequence.
-	am.pageBase = make(map[uint64]uint64, len(pages))
-	for i, page := range pages {
-		am.pageBase[page] = uint64(i) * pageBytes
+// plotEvent draws ev's event marker at (x, y) in img. Stores are
+// drawn as a filled 2x2 square so they're visually distinguishable
+// from the single-pixel dot used for loads and prefetches.
+func plotEvent(img *image.NRGBA, x, y int, kind perffile.DataSrcOp, c color.NRGBA) {
+	img.SetNRGBA(x, y, c)
+	if kind&perffile.DataSrcOpStore == 0 {
+		return
 	}
-
-	// Compute normalization factor.
-	compactMax := am.pageBase[maxAddr/pageBytes] + maxAddr%pageBytes
-	if compactMax <= normMax {
-		am.normFactor = 1
-	} else {
-		am.normFactor = float64(normMax) / float64(compactMax)
+	max := img.Rect.Max
+	if x+1 < max.X {
+		img.SetNRGBA(x+1, y, c)
+	}
+	if y+1 < max.Y {
+		img.SetNRGBA(x, y+1, c)
 	}
+	if x+1 < max.X && y+1 < max.Y {
+		img.SetNRGBA(x+1, y+1, c)
+	}
+}
+
+// framesTopN is the number of hottest functions recorded per frame
+// in the -frames sidecar.
+const framesTopN = 5
+
+// frameInfo is one entry of the -frames sidecar: the top functions
+// by event count in a single output frame.
+type frameInfo struct {
+	Frame int         `json:"frame"`
+	Funcs []frameFunc `json:"funcs"`
+}
+
+type frameFunc struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
 
-	return am
+// topFuncs returns up to n entries of counts, sorted by count,
+// descending.
+func topFuncs(counts map[string]int, n int) []frameFunc {
+	funcs := make([]frameFunc, 0, len(counts))
+	for name, count := range counts {
+		funcs = append(funcs, frameFunc{name, count})
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		return funcs[i].Count > funcs[j].Count
+	})
+	if len(funcs) > n {
+		funcs = funcs[:n]
+	}
+	return funcs
 }
 
-func (am *addrMapper) mapAddr(addr uint64) uint64 {
-	compact := am.pageBase[addr/pageBytes] + addr%pageBytes
-	norm := uint64(float64(compact) * am.normFactor)
-	if norm > am.normMax {
-		norm = am.normMax
+func writeFrames(path string, frames []frameInfo) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(frames); err != nil {
+		log.Fatal(err)
 	}
-	return norm
 }
 
 func normalizeWeight(events []event) {
@@ -342,45 +529,6 @@ func zeroTime(events []event) {
 	}
 }
 
-type uint64Slice []uint64
-
-func (s uint64Slice) Len() int {
-	return len(s)
-}
-
-func (s uint64Slice) Less(i, j int) bool {
-	return s[i] < s[j]
-}
-
-func (s uint64Slice) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-
-// hilbert converts a 1-D point d to a coordinate (x, y) in an nÃ—n
-// Hilbert space.
-func hilbert(n, d int) (x, y int) {
-	// Based on Wikipedia.
-	rot := func(s, x, y, rx, ry int) (int, int) {
-		if ry == 0 {
-			if rx == 1 {
-				x = s - 1 - x
-				y = s - 1 - y
-			}
-			x, y = y, x
-		}
-		return x, y
-	}
-	for s := 1; s < n; s *= 2 {
-		rx := 1 & (d / 2)
-		ry := 1 & (d ^ rx)
-		x, y = rot(s, x, y, rx, ry)
-		x += s * rx
-		y += s * ry
-		d /= 4
-	}
-	return
-}
-
 func writePNG(path string, img image.Image) {
 	f, err := os.Create(path)
 	if err != nil {
@@ -0,0 +1,289 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// frameSink receives the sequence of rendered animation frames and
+// turns them into output.
+type frameSink interface {
+	// WriteFrame appends img as the next frame of the animation.
+	WriteFrame(img image.Image) error
+
+	// Close finishes writing the output and releases any
+	// resources held by the sink. The sink must not be used
+	// after calling Close.
+	Close() error
+}
+
+// newFrameSink creates a frameSink for writing fps frames per second
+// of bounds-sized frames to out. If out is empty, it falls back to
+// the legacy behavior of dumping numbered PNG files to the current
+// directory. nFrames is a hint at the total number of frames that
+// will be written; sinks that must commit to a frame count up front
+// (such as apng) rely on it, so it's fine to overestimate, but it
+// must not be an underestimate.
+func newFrameSink(out string, fps int, bounds image.Rectangle, nFrames int) (frameSink, error) {
+	if out == "" {
+		return &pngSeq{fps: fps}, nil
+	}
+	switch ext := filepath.Ext(out); ext {
+	case ".mp4", ".webm":
+		return newFFmpegPipe(out, fps, bounds)
+	case ".png":
+		return newAPNG(out, fps, nFrames)
+	default:
+		return nil, fmt.Errorf("unrecognized output extension %q (want .mp4, .webm, or .png)", ext)
+	}
+}
+
+// pngSeq is the original frameSink: it dumps each frame as a
+// sequentially numbered PNG file for post-processing with an
+// external tool such as ffmpeg or mencoder.
+type pngSeq struct {
+	fps   int
+	frame int
+}
+
+func (s *pngSeq) WriteFrame(img image.Image) error {
+	path := fmt.Sprintf("f%08d.png", s.frame)
+	s.frame++
+	return writePNG(path, img)
+}
+
+func (s *pngSeq) Close() error {
+	fmt.Printf("To combine frames:\n  mencoder 'mf://f*.png' -mf fps=%d -nosound -of lavf -lavfopts format=mp4 -ovc x264 -o out.mp4\n", s.fps)
+	return nil
+}
+
+// ffmpegPipe is a frameSink that pipes raw RGBA frames directly into
+// ffmpeg's stdin, avoiding an intermediate sequence of PNG files.
+type ffmpegPipe struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	bounds image.Rectangle
+}
+
+func newFFmpegPipe(out string, fps int, bounds image.Rectangle) (*ffmpegPipe, error) {
+	args := []string{
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", bounds.Dx(), bounds.Dy()),
+		"-r", fmt.Sprint(fps),
+		"-i", "-",
+		"-y",
+		out,
+	}
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &ffmpegPipe{cmd: cmd, stdin: stdin, bounds: bounds}, nil
+}
+
+func (s *ffmpegPipe) WriteFrame(img image.Image) error {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		return fmt.Errorf("ffmpegPipe: frame is %T, want *image.NRGBA", img)
+	}
+	if nrgba.Bounds() != s.bounds {
+		return fmt.Errorf("ffmpegPipe: frame bounds %v, want %v", nrgba.Bounds(), s.bounds)
+	}
+	// Write row-by-row in case Stride has padding beyond the
+	// frame's width.
+	rowBytes := s.bounds.Dx() * 4
+	for y := 0; y < s.bounds.Dy(); y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+rowBytes]
+		if _, err := s.stdin.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ffmpegPipe) Close() error {
+	if err := s.stdin.Close(); err != nil {
+		return err
+	}
+	return s.cmd.Wait()
+}
+
+// apng is a frameSink that writes a single animated PNG file, using
+// the standard library's png encoder to produce each frame's image
+// data and adding the APNG chunk framing (acTL/fcTL/fdAT) on top.
+type apng struct {
+	f        *os.File
+	fps      int
+	nFrames  uint32
+	seq      uint32
+	wroteOne bool
+}
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+func newAPNG(out string, fps, nFrames int) (*apng, error) {
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(pngSignature); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &apng{f: f, fps: fps, nFrames: uint32(nFrames)}, nil
+}
+
+func (a *apng) WriteFrame(img image.Image) error {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&buf, img); err != nil {
+		return err
+	}
+	chunks, err := splitPNGChunks(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if !a.wroteOne {
+		for _, c := range chunks {
+			if c.typ == "IHDR" {
+				if err := writePNGChunk(a.f, "IHDR", c.data); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if err := writePNGChunk(a.f, "acTL", actlData(a.nFrames, 0)); err != nil {
+			return err
+		}
+	}
+
+	if err := writePNGChunk(a.f, "fcTL", fctlData(a.seq, img.Bounds(), a.fps)); err != nil {
+		return err
+	}
+	a.seq++
+
+	for _, c := range chunks {
+		if c.typ != "IDAT" {
+			continue
+		}
+		if !a.wroteOne {
+			if err := writePNGChunk(a.f, "IDAT", c.data); err != nil {
+				return err
+			}
+			continue
+		}
+		fdat := make([]byte, 4+len(c.data))
+		binary.BigEndian.PutUint32(fdat, a.seq)
+		copy(fdat[4:], c.data)
+		if err := writePNGChunk(a.f, "fdAT", fdat); err != nil {
+			return err
+		}
+		a.seq++
+	}
+
+	a.wroteOne = true
+	return nil
+}
+
+func (a *apng) Close() error {
+	if err := writePNGChunk(a.f, "IEND", nil); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+func actlData(nFrames, nPlays uint32) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:], nFrames)
+	binary.BigEndian.PutUint32(data[4:], nPlays)
+	return data
+}
+
+func fctlData(seq uint32, b image.Rectangle, fps int) []byte {
+	data := make([]byte, 26)
+	binary.BigEndian.PutUint32(data[0:], seq)
+	binary.BigEndian.PutUint32(data[4:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(data[8:], uint32(b.Dy()))
+	binary.BigEndian.PutUint32(data[12:], 0)           // x_offset
+	binary.BigEndian.PutUint32(data[16:], 0)           // y_offset
+	binary.BigEndian.PutUint16(data[20:], 1)           // delay_num
+	binary.BigEndian.PutUint16(data[22:], uint16(fps)) // delay_den
+	data[24] = 0                                       // dispose_op: APNG_DISPOSE_OP_NONE
+	data[25] = 0                                       // blend_op: APNG_BLEND_OP_SOURCE
+	return data
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// splitPNGChunks parses the chunk stream of a PNG file produced by
+// image/png, skipping the leading signature.
+func splitPNGChunks(b []byte) ([]pngChunk, error) {
+	if len(b) < 8 || !bytes.Equal(b[:8], pngSignature) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	b = b[8:]
+	var chunks []pngChunk
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		n := binary.BigEndian.Uint32(b[0:4])
+		typ := string(b[4:8])
+		if uint32(len(b)-12) < n {
+			return nil, fmt.Errorf("truncated PNG chunk data")
+		}
+		data := append([]byte(nil), b[8:8+n]...)
+		chunks = append(chunks, pngChunk{typ, data})
+		b = b[12+n:]
+	}
+	return chunks, nil
+}
+
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	io.WriteString(crc, typ)
+	crc.Write(data)
+
+	if _, err := io.WriteString(w, typ); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
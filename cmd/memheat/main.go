@@ -14,6 +14,9 @@ import (
 	"os"
 	"path"
 	"sort"
+	"time"
+
+	"github.com/ianlancetaylor/demangle"
 
 	"github.com/aclements/goperf/dwarfx"
 	"github.com/aclements/goperf/perffile"
@@ -35,14 +38,21 @@ type lineStat struct {
 
 func main() {
 	var (
-		flagInput = flag.String("i", "perf.data", "input perf.data file")
-		flagLimit = flag.Int("limit", 30, "output top N functions")
+		flagInput    = flag.String("i", "perf.data", "input perf.data file; may be a local path or an http(s):// or ssh:// URL")
+		flagLimit    = flag.Int("limit", 30, "output top N functions")
+		flagPprof    = flag.String("pprof", "", "write a pprof profile to `file` and exit, instead of rendering the SVG heatmap")
+		flagSymbol   = flag.String("symbol", "short", "demangle C++/Rust symbol names as `style`: raw, short (strip parameters), or full")
+		flagTimeout  = flag.Duration("timeout", 0, "timeout for fetching a remote -i file; 0 means no timeout")
+		flagCacheDir = flag.String("cache-dir", "", "directory to cache fetched remote -i files in; defaults to the system temp dir")
 	)
 	flag.Parse()
 	if flag.NArg() > 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	symbolStyle = *flagSymbol
+	perffile.FetchTimeout = *flagTimeout
+	perffile.FetchCacheDir = *flagCacheDir
 
 	f, err := perffile.Open(*flagInput)
 	if err != nil {
@@ -52,6 +62,11 @@ func main() {
 
 	s := perfsession.New()
 
+	var pprofConv *pprofConverter
+	if *flagPprof != "" {
+		pprofConv = newPprofConverter()
+	}
+
 	// Collect samples by IP (TODO: by (comm, ip) or something)
 	ipToInfo := map[uint64]*lineStat{}
 	rs := f.Records()
@@ -66,6 +81,10 @@ func main() {
 				break
 			}
 
+			if pprofConv != nil {
+				pprofConv.addSample(mmap, r)
+			}
+
 			extra := getMmapExtra(mmap)
 			if extra == nil {
 				break
@@ -86,6 +105,13 @@ func main() {
 		}
 	}
 
+	if pprofConv != nil {
+		if err := writePprof(pprofConv, *flagPprof); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Compute total function weight
 	fnWeight := map[string]uint64{}
 	for _, ls := range ipToInfo {
@@ -329,7 +355,7 @@ func (m *mmapExtra) findIP(ip uint64) (fn string, line *dwarfx.LineEntry) {
 		return ip < m.functab[i].highpc
 	})
 	if i < len(m.functab) && m.functab[i].lowpc <= ip && ip < m.functab[i].highpc {
-		fn = m.functab[i].name
+		fn = demangleName(m.functab[i].name)
 	}
 
 	i = sort.Search(len(m.linetab), func(i int) bool {
@@ -342,6 +368,33 @@ func (m *mmapExtra) findIP(ip uint64) (fn string, line *dwarfx.LineEntry) {
 	return
 }
 
+// symbolStyle is set from -symbol once in main, before any record is
+// read, so demangleName can reach it without threading a style value
+// through every perfsession consumer that calls findIP.
+var symbolStyle string
+
+// demangleName demangles name if it looks like a mangled C++ or Rust
+// (Itanium ABI) symbol, according to symbolStyle: "raw" leaves name
+// untouched, "full" renders the complete signature, and anything else
+// (including the default, "short") strips parameter lists and
+// template arguments for a shorter label. Names demangle doesn't
+// recognize as mangled are returned unchanged.
+func demangleName(name string) string {
+	switch symbolStyle {
+	case "raw":
+		return name
+	case "full":
+		if s, err := demangle.ToString(name); err == nil {
+			return s
+		}
+	default:
+		if s, err := demangle.ToString(name, demangle.NoParams, demangle.NoTemplateParams); err == nil {
+			return s
+		}
+	}
+	return name
+}
+
 func getMmapExtra(mmap *perfsession.Mmap) *mmapExtra {
 	if mmap.Extra != nil {
 		return mmap.Extra.(*mmapExtra)
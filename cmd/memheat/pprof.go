@@ -0,0 +1,119 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	gpprof "github.com/google/pprof/profile"
+
+	ppprof "github.com/aclements/go-perf/perffile/pprof"
+	"github.com/aclements/goperf/dwarfx"
+	"github.com/aclements/goperf/perffile"
+	"github.com/aclements/goperf/perfsession"
+)
+
+// pprofConverter accumulates RecordSamples into a *gpprof.Profile, so
+// the result of a perf.data recording can be explored with "go tool
+// pprof" instead of (or alongside) the SVG heatmap. It caches
+// Locations, Mappings, and Functions by the same keys the heatmap
+// itself uses (bare IP, and Mmap identity), so it stays a single pass
+// over the records rather than a second walk of the file.
+type pprofConverter struct {
+	prof *gpprof.Profile
+
+	functions ppprof.FuncCache
+	mappings  map[*perfsession.Mmap]*gpprof.Mapping
+	locations map[uint64]*gpprof.Location
+}
+
+func newPprofConverter() *pprofConverter {
+	return &pprofConverter{
+		prof: &gpprof.Profile{
+			SampleType: []*gpprof.ValueType{{Type: "memory-latency", Unit: "cycles"}},
+		},
+		mappings:  make(map[*perfsession.Mmap]*gpprof.Mapping),
+		locations: make(map[uint64]*gpprof.Location),
+	}
+}
+
+// addSample records one RecordSample's weight against mmap, the
+// Mmap covering r.IP.
+func (c *pprofConverter) addSample(mmap *perfsession.Mmap, r *perffile.RecordSample) {
+	loc := c.location(mmap, r.IP)
+	c.prof.Sample = append(c.prof.Sample, &gpprof.Sample{
+		Location: []*gpprof.Location{loc},
+		Value:    []int64{int64(r.Weight)},
+	})
+}
+
+// location returns the Location for ip, creating it (and resolving
+// its Mapping and Line, via the same DWARF lookup the heatmap uses)
+// the first time ip is seen.
+func (c *pprofConverter) location(mmap *perfsession.Mmap, ip uint64) *gpprof.Location {
+	if loc, ok := c.locations[ip]; ok {
+		return loc
+	}
+
+	loc := &gpprof.Location{
+		ID:      uint64(len(c.prof.Location)) + 1,
+		Address: ip,
+		Mapping: c.mapping(mmap),
+	}
+
+	if extra := getMmapExtra(mmap); extra != nil {
+		if fn, src := extra.findIP(ip); fn != "" {
+			line := gpprof.Line{Function: c.function(fn, srcFileName(src))}
+			if src != nil {
+				line.Line = int64(src.Line)
+			}
+			loc.Line = []gpprof.Line{line}
+		}
+	}
+
+	c.prof.Location = append(c.prof.Location, loc)
+	c.locations[ip] = loc
+	return loc
+}
+
+func (c *pprofConverter) mapping(mmap *perfsession.Mmap) *gpprof.Mapping {
+	if m, ok := c.mappings[mmap]; ok {
+		return m
+	}
+
+	m := &gpprof.Mapping{
+		ID:      uint64(len(c.prof.Mapping)) + 1,
+		Start:   mmap.Addr,
+		Limit:   mmap.Addr + mmap.Len,
+		Offset:  mmap.FileOffset,
+		File:    mmap.Filename,
+		BuildID: perffile.BuildID(mmap.BuildID).String(),
+	}
+	c.prof.Mapping = append(c.prof.Mapping, m)
+	c.mappings[mmap] = m
+	return m
+}
+
+func (c *pprofConverter) function(name, filename string) *gpprof.Function {
+	return c.functions.Get(c.prof, name, filename)
+}
+
+func srcFileName(src *dwarfx.LineEntry) string {
+	if src == nil {
+		return ""
+	}
+	return src.FileEntry.FileName
+}
+
+// writePprof writes c's accumulated profile to path as gzipped
+// protobuf, for consumption by "go tool pprof" and friends.
+func writePprof(c *pprofConverter, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return c.prof.Write(out)
+}
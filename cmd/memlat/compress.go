@@ -0,0 +1,81 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// negotiateEncoding picks a response content-coding from an
+// Accept-Encoding request header, preferring br over gzip since it
+// generally compresses JSON better. It doesn't parse q-values; it
+// just looks for either coding appearing anywhere in the header,
+// which is enough for the browsers and curl/wget that actually set
+// this header for memlat's UI.
+func negotiateEncoding(acceptEncoding string) string {
+	for _, want := range []string{"br", "gzip"} {
+		for _, got := range strings.Split(acceptEncoding, ",") {
+			if strings.TrimSpace(strings.SplitN(got, ";", 2)[0]) == want {
+				return want
+			}
+		}
+	}
+	return ""
+}
+
+// compressWriter wraps w's body in enc, and closes enc (flushing any
+// buffered output) once the handler is done with it.
+type compressWriter struct {
+	http.ResponseWriter
+	enc io.WriteCloser
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	return c.enc.Write(b)
+}
+
+// startCompression sets up response compression for req, according
+// to its Accept-Encoding header, unless noCompress is set (for
+// debugging). It returns the Writer the handler should encode its
+// response into, and a function the handler must call (typically via
+// defer) once it's done writing, to flush and close the encoder.
+func startCompression(w http.ResponseWriter, req *http.Request, noCompress bool) (io.Writer, func() error) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	if noCompress {
+		return w, func() error { return nil }
+	}
+
+	switch negotiateEncoding(req.Header.Get("Accept-Encoding")) {
+	case "br":
+		w.Header().Set("Content-Encoding", "br")
+		enc := brotli.NewWriter(w)
+		return &compressWriter{w, enc}, enc.Close
+	case "gzip":
+		w.Header().Set("Content-Encoding", "gzip")
+		enc := gzip.NewWriter(w)
+		return &compressWriter{w, enc}, enc.Close
+	default:
+		return w, func() error { return nil }
+	}
+}
+
+// etagFor computes a strong ETag for a heatMapHandler response,
+// from everything that determines its content: the profile's set of
+// build IDs (so the ETag changes if the backing perf.data's binaries
+// do, even under the same filename) and the request's filter,
+// groupBy, and limit.
+func etagFor(db *database, f *filter, groupBy string, limit int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%+v\x00%s\x00%d", db.buildIDFingerprint, *f, groupBy, limit)
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
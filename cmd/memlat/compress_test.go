@@ -0,0 +1,48 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=1.0, gzip;q=0.8", "br"},
+		{"deflate, gzip;q=0.5", "gzip"},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.acceptEncoding); got != c.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", c.acceptEncoding, got, c.want)
+		}
+	}
+}
+
+func TestEtagFor(t *testing.T) {
+	db := &database{buildIDFingerprint: "abc"}
+	f1 := &filter{funcName: "main.f"}
+	f2 := &filter{funcName: "main.g"}
+
+	e1 := etagFor(db, f1, "funcName", 10)
+	e2 := etagFor(db, f1, "funcName", 10)
+	if e1 != e2 {
+		t.Errorf("etagFor is not deterministic: %q != %q", e1, e2)
+	}
+
+	for _, e := range []string{
+		etagFor(db, f2, "funcName", 10),
+		etagFor(db, f1, "fileName", 10),
+		etagFor(db, f1, "funcName", 20),
+	} {
+		if e == e1 {
+			t.Errorf("etagFor(%q) collided with a differing request: %q", e, e1)
+		}
+	}
+}
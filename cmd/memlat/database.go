@@ -5,13 +5,25 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 
 	"github.com/aclements/go-perf/perffile"
 	"github.com/aclements/go-perf/perfsession"
 )
 
+// parserVersion identifies parsePerf's output format. It's folded
+// into Metadata.ProfileFingerprint so a client caching on that
+// fingerprint invalidates itself after a memlat upgrade changes how
+// a perf.data file is interpreted, not just when the file itself
+// changes.
+const parserVersion = "1"
+
 type database struct {
 	// procs maps from PID to information and records for a
 	// process.
@@ -24,12 +36,26 @@ type database struct {
 	// in every record, we canonicalize it to a small identifier.
 	dataSrcs []perffile.DataSrc
 
+	// branchEdges maps branchEdgeIDs to the From/To address pairs
+	// that appear in branch stacks (LBR). As with dataSrcs, a
+	// given profile will generally only exercise a small number
+	// of distinct edges, so records refer to these by ID rather
+	// than storing them directly.
+	branchEdges []branchEdge
+
 	// maxLatency is the maximum latency value across all records
 	// in this database.
 	maxLatency uint32
 
 	// metadata records metadata fields from the profile.
 	metadata Metadata
+
+	// buildIDFingerprint is a stable hash of the profile's build-id
+	// set (f.Meta.BuildIDs), used by heatMapHandler to compute an
+	// ETag that changes if the profile's binaries do, without
+	// hashing the (potentially large) perf.data file on every
+	// request.
+	buildIDFingerprint string
 }
 
 type proc struct {
@@ -37,6 +63,74 @@ type proc struct {
 	comm    string
 	records []record
 	ipInfo  map[uint64]ipInfo
+
+	// ipFrames holds, for IPs where symbolication saw through
+	// inlining, the full inline call stack (innermost first) that
+	// ipInfo's funcName/fileName/line collapse to just the
+	// innermost frame. It's a separate map because a []frame slice
+	// isn't comparable, and ipInfo needs to remain usable as a map
+	// key (e.g. groupBy=annotation in the heatmap handler). Absent
+	// for an ip means its stack is just the one frame already in
+	// ipInfo.
+	ipFrames map[uint64][]frame
+
+	// callchains interns the call stacks seen in this proc's
+	// samples. A record's callchain field indexes in to this
+	// slice.
+	callchains [][]uint64
+	// callchainIdx maps from a callchain's canonical key (see
+	// callchainKey) to its index in callchains, for deduplication.
+	callchainIdx map[string]int
+
+	// idx holds secondary indexes over records, built lazily by
+	// buildIndex the first time db.filter needs them.
+	idx procIndex
+}
+
+// procIndex holds secondary indexes from field values to the indexes
+// of records with that value, letting filter do a targeted lookup
+// instead of a linear scan of every record.
+type procIndex struct {
+	built bool
+
+	byAddress   map[uint64][]int32
+	byFunc      map[string][]int32
+	byOuterFunc map[string][]int32
+	byFile      map[string][]int32
+	byFileLine  map[fileLine][]int32
+	byDataSrc   map[dataSrcID][]int32
+}
+
+type fileLine struct {
+	fileName string
+	line     int
+}
+
+// buildIndex populates p.idx, if it isn't already built.
+func (p *proc) buildIndex() {
+	if p.idx.built {
+		return
+	}
+	idx := &p.idx
+	idx.byAddress = make(map[uint64][]int32)
+	idx.byFunc = make(map[string][]int32)
+	idx.byOuterFunc = make(map[string][]int32)
+	idx.byFile = make(map[string][]int32)
+	idx.byFileLine = make(map[fileLine][]int32)
+	idx.byDataSrc = make(map[dataSrcID][]int32)
+	for i := range p.records {
+		rec := &p.records[i]
+		ri := int32(i)
+		idx.byAddress[rec.address] = append(idx.byAddress[rec.address], ri)
+		idx.byDataSrc[rec.dataSrc] = append(idx.byDataSrc[rec.dataSrc], ri)
+		ipi := p.ipInfo[rec.ip]
+		idx.byFunc[ipi.funcName] = append(idx.byFunc[ipi.funcName], ri)
+		idx.byOuterFunc[ipi.outerFuncName] = append(idx.byOuterFunc[ipi.outerFuncName], ri)
+		idx.byFile[ipi.fileName] = append(idx.byFile[ipi.fileName], ri)
+		fl := fileLine{ipi.fileName, ipi.line}
+		idx.byFileLine[fl] = append(idx.byFileLine[fl], ri)
+	}
+	idx.built = true
 }
 
 type record struct {
@@ -44,22 +138,152 @@ type record struct {
 	address uint64
 	latency uint32
 	dataSrc dataSrcID
+
+	// branchStack is the sequence of branchEdgeIDs recorded in
+	// this sample's branch stack (LBR), most recent branch first,
+	// or nil if the sample has no branch stack.
+	branchStack []branchEdgeID
+
+	// callchain indexes proc.callchains for this record's call
+	// stack, or -1 if the sample has no call chain.
+	callchain int
+}
+
+// branchEdge is a single branch stack (LBR) entry, canonicalized to
+// just the addresses involved.
+type branchEdge struct {
+	from, to uint64
+}
+
+// branchEdgeID is a small integer identifying a branchEdge.
+type branchEdgeID uint32
+
+// hasBranchFrom reports whether r's branch stack contains an edge
+// originating in funcName.
+func (r *record) hasBranchFrom(db *database, proc *proc, funcName string) bool {
+	for _, id := range r.branchStack {
+		if proc.ipInfo[db.branchEdges[id].from].funcName == funcName {
+			return true
+		}
+	}
+	return false
+}
+
+// callchainHasFunc reports whether r's call chain includes a frame in
+// funcName.
+func (r *record) callchainHasFunc(proc *proc, funcName string) bool {
+	if r.callchain < 0 {
+		return false
+	}
+	for _, ip := range proc.callchains[r.callchain] {
+		if ip >= callchainContextMax {
+			// Stack-type marker, not an address.
+			continue
+		}
+		if proc.ipInfo[ip].funcName == funcName {
+			return true
+		}
+	}
+	return false
 }
 
 type ipInfo struct {
 	funcName string
 	fileName string
 	line     int
+
+	// outerFuncName is the name of the non-inlined function
+	// containing this IP. It's the same as funcName unless funcName
+	// was inlined into it, in which case it names the real caller
+	// DWARF recorded the inlining against.
+	outerFuncName string
+}
+
+// frame is one level of a symbolized inline stack, innermost first;
+// see proc.ipFrames.
+type frame struct {
+	funcName string
+	fileName string
+	line     int
+}
+
+// frames returns the symbolized inline stack for ip, innermost
+// first. It always returns at least one frame for an ip that's in
+// p.ipInfo, falling back to that single, non-inlined frame if ip
+// didn't see through any inlining.
+func (p *proc) frames(ip uint64) []frame {
+	if frames, ok := p.ipFrames[ip]; ok {
+		return frames
+	}
+	ipi, ok := p.ipInfo[ip]
+	if !ok {
+		return nil
+	}
+	return []frame{{ipi.funcName, ipi.fileName, ipi.line}}
 }
 
 // dataSrcID is a small integer identifying a perffile.DataSrc.
 type dataSrcID uint32
 
+// callchainContextMax is the smallest RecordSample.Callchain value
+// that's actually a perffile.Callchain* stack-type marker rather than
+// an instruction pointer. It corresponds to PERF_CONTEXT_MAX in
+// tools/perf/util/callchain.h.
+const callchainContextMax = uint64(0) - 4095
+
+// callchainKey returns a key suitable for deduplicating callchain in
+// a map, since []uint64 isn't itself comparable.
+func callchainKey(chain []uint64) string {
+	buf := make([]byte, len(chain)*8)
+	for i, ip := range chain {
+		binary.LittleEndian.PutUint64(buf[i*8:], ip)
+	}
+	return string(buf)
+}
+
+// profileFingerprint hashes fileName's contents together with
+// parserVersion. Reading the whole file again (parsePerf already
+// read it once, through perffile.Open) is wasteful, but this only
+// runs once at startup, and keeps the hash honest against the exact
+// bytes a client might re-fetch.
+func profileFingerprint(fileName string) string {
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(append(raw, parserVersion...))
+	return hex.EncodeToString(h[:])
+}
+
+// buildIDFingerprint returns a stable hash of bids, order-independent
+// so it doesn't change if perf.data happens to record the same
+// build IDs in a different order.
+func buildIDFingerprint(bids []perffile.BuildIDInfo) string {
+	sorted := append([]perffile.BuildIDInfo(nil), bids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Filename != sorted[j].Filename {
+			return sorted[i].Filename < sorted[j].Filename
+		}
+		return sorted[i].PID < sorted[j].PID
+	})
+	h := sha256.New()
+	for _, b := range sorted {
+		fmt.Fprintf(h, "%d:%s:%x\x00", b.PID, b.Filename, []byte(b.BuildID))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 type Metadata struct {
 	Hostname string
 	Arch     string
 	CPUDesc  string   `json:"CPU"`
 	CmdLine  []string `json:"Command line"`
+
+	// ProfileFingerprint is a hash of the input perf.data file's
+	// contents and parserVersion. The front end can use it to
+	// cache-bust: as long as it's unchanged, any response it cached
+	// from this server still reflects the same profile.
+	ProfileFingerprint string `json:"profileFingerprint"`
 }
 
 // parsePerf parses a perf.data profile into a database.
@@ -82,8 +306,11 @@ func parsePerf(fileName string) *database {
 	db.metadata.Arch = f.Meta.Arch
 	db.metadata.CPUDesc = f.Meta.CPUDesc
 	db.metadata.CmdLine = f.Meta.CmdLine
+	db.metadata.ProfileFingerprint = profileFingerprint(fileName)
+	db.buildIDFingerprint = buildIDFingerprint(f.Meta.BuildIDs)
 
 	dataSrc2ID := make(map[perffile.DataSrc]dataSrcID)
+	branchEdge2ID := make(map[branchEdge]branchEdgeID)
 	s := perfsession.New(f)
 
 	numSamples := 0
@@ -143,24 +370,21 @@ func parsePerf(fileName string) *database {
 				db.dataSrcs = append(db.dataSrcs, r.DataSrc)
 			}
 
-			// Create the record.
-			p.records = append(p.records, record{
-				ip:      r.IP,
-				address: r.Addr,
-				latency: uint32(r.Weight),
-				dataSrc: dsID,
-			})
-
-			// Update database stats.
-			if uint32(r.Weight) > db.maxLatency {
-				db.maxLatency = uint32(r.Weight)
-			}
-
-			// Symbolize IP.
-			if _, ok := p.ipInfo[r.IP]; !ok {
+			// symbolizeIP fills in p.ipInfo[ip] the first
+			// time it's called for a given ip. It's also
+			// used below for branch stack and call chain
+			// addresses, which may fall outside r's mmap.
+			symbolizeIP := func(ip uint64) {
+				if _, ok := p.ipInfo[ip]; ok {
+					return
+				}
 				// TODO: Intern strings
 				var symb perfsession.Symbolic
-				if !perfsession.Symbolize(s, mmap, r.IP, &symb) {
+				m := mmap
+				if ip != r.IP {
+					m = pidInfo.LookupMmap(ip)
+				}
+				if m == nil || !perfsession.Symbolize(s, m, ip, &symb) {
 					droppedSymbols++
 				}
 				if symb.FuncName == "" {
@@ -170,12 +394,88 @@ func parsePerf(fileName string) *database {
 				if symb.Line.File != nil && symb.Line.File.Name != "" {
 					fileName = symb.Line.File.Name
 				}
-				p.ipInfo[r.IP] = ipInfo{
-					funcName: symb.FuncName,
-					fileName: fileName,
-					line:     symb.Line.Line,
+				outerFuncName := symb.FuncName
+				if n := len(symb.Frames); n > 0 {
+					outerFuncName = symb.Frames[n-1].FuncName
+				}
+				p.ipInfo[ip] = ipInfo{
+					funcName:      symb.FuncName,
+					fileName:      fileName,
+					line:          symb.Line.Line,
+					outerFuncName: outerFuncName,
+				}
+				if len(symb.Frames) > 1 {
+					frames := make([]frame, len(symb.Frames))
+					for i, sf := range symb.Frames {
+						frames[i].funcName = sf.FuncName
+						if sf.File != nil {
+							frames[i].fileName = sf.File.Name
+						}
+						frames[i].line = sf.Line
+					}
+					if p.ipFrames == nil {
+						p.ipFrames = make(map[uint64][]frame)
+					}
+					p.ipFrames[ip] = frames
+				}
+			}
+
+			// Canonicalize the branch stack (LBR), if any.
+			var branchStack []branchEdgeID
+			if r.Format&perffile.SampleFormatBranchStack != 0 {
+				branchStack = make([]branchEdgeID, len(r.BranchStack))
+				for i, br := range r.BranchStack {
+					edge := branchEdge{br.From, br.To}
+					id, ok := branchEdge2ID[edge]
+					if !ok {
+						id = branchEdgeID(len(db.branchEdges))
+						branchEdge2ID[edge] = id
+						db.branchEdges = append(db.branchEdges, edge)
+					}
+					branchStack[i] = id
+					symbolizeIP(br.From)
+					symbolizeIP(br.To)
+				}
+			}
+
+			// Intern the call chain, if any.
+			callchain := -1
+			if r.Format&perffile.SampleFormatCallchain != 0 && len(r.Callchain) > 0 {
+				if p.callchainIdx == nil {
+					p.callchainIdx = make(map[string]int)
 				}
+				key := callchainKey(r.Callchain)
+				idx, ok := p.callchainIdx[key]
+				if !ok {
+					idx = len(p.callchains)
+					p.callchains = append(p.callchains, append([]uint64(nil), r.Callchain...))
+					p.callchainIdx[key] = idx
+					for _, ip := range r.Callchain {
+						if ip < callchainContextMax {
+							symbolizeIP(ip)
+						}
+					}
+				}
+				callchain = idx
 			}
+
+			// Create the record.
+			p.records = append(p.records, record{
+				ip:          r.IP,
+				address:     r.Addr,
+				latency:     uint32(r.Weight),
+				dataSrc:     dsID,
+				branchStack: branchStack,
+				callchain:   callchain,
+			})
+
+			// Update database stats.
+			if uint32(r.Weight) > db.maxLatency {
+				db.maxLatency = uint32(r.Weight)
+			}
+
+			// Symbolize the sampled IP itself.
+			symbolizeIP(r.IP)
 		}
 	}
 
@@ -202,58 +502,142 @@ type filter struct {
 	line     int // Requires fileName.
 	address  uint64
 	dataSrc  perffile.DataSrc
+
+	// outerFuncName, if non-empty, restricts to records whose IP's
+	// enclosing non-inlined function (ipInfo.outerFuncName) is this
+	// function. Unlike funcName, this matches samples that landed
+	// in a function DWARF says was inlined into outerFuncName, not
+	// just samples directly in outerFuncName's own body.
+	outerFuncName string
+
+	// branchFromFunc, if non-empty, restricts to records whose
+	// branch stack (LBR) contains an edge originating in this
+	// function. This makes it possible to ask "only samples
+	// reached through function X".
+	branchFromFunc string
+
+	// callchainFunc, if non-empty, restricts to records whose
+	// call chain includes a frame in this function.
+	callchainFunc string
 }
 
 // filter invokes cb for every record matching f.
+//
+// filter picks the most selective available secondary index for f
+// (see procIndex) to build a candidate list of records, then checks
+// the remaining predicates against just those candidates rather than
+// scanning every record in the process.
 func (db *database) filter(f *filter, cb func(*proc, *record)) {
 	dsFilter := f.dataSrc != perffile.DataSrc{}
 	filterProc := func(proc *proc) {
 		var ds perffile.DataSrc
 
-		// TODO: Consider creating indexes for some or all of
-		// these. Then just do a list merge of the record
-		// indexes.
-		for i := range proc.records {
+		check := func(rec *record) {
 			// Avoid heap-allocating for passing rec to cb.
-			rec := &proc.records[i]
 			if f.address != 0 && f.address != rec.address {
-				continue
+				return
 			}
 			ipi := proc.ipInfo[rec.ip]
 			if f.funcName != "" && f.funcName != ipi.funcName {
-				continue
+				return
 			}
 			if f.fileName != "" && f.fileName != ipi.fileName {
-				continue
+				return
 			}
 			if f.line != 0 && f.line != ipi.line {
-				continue
-			}
-			if !dsFilter {
-				// Short-circuit dataSrc checking.
-				goto good
-			}
-
-			ds = db.dataSrcs[rec.dataSrc]
-			if f.dataSrc.Op != 0 && f.dataSrc.Op != ds.Op {
-				continue
+				return
 			}
-			if f.dataSrc.Level != 0 && (f.dataSrc.Level != ds.Level || f.dataSrc.Miss != ds.Miss) {
-				continue
+			if f.outerFuncName != "" && f.outerFuncName != ipi.outerFuncName {
+				return
 			}
-			if f.dataSrc.Snoop != 0 && f.dataSrc.Snoop != ds.Snoop {
-				continue
+			if f.branchFromFunc != "" && !rec.hasBranchFrom(db, proc, f.branchFromFunc) {
+				return
 			}
-			if f.dataSrc.Locked != 0 && f.dataSrc.Locked != ds.Locked {
-				continue
+			if f.callchainFunc != "" && !rec.callchainHasFunc(proc, f.callchainFunc) {
+				return
 			}
-			if f.dataSrc.TLB != 0 && f.dataSrc.TLB != ds.TLB {
-				continue
+			if dsFilter {
+				ds = db.dataSrcs[rec.dataSrc]
+				if f.dataSrc.Op != 0 && f.dataSrc.Op != ds.Op {
+					return
+				}
+				if f.dataSrc.Level != 0 && (f.dataSrc.Level != ds.Level || f.dataSrc.Miss != ds.Miss) {
+					return
+				}
+				if f.dataSrc.Snoop != 0 && f.dataSrc.Snoop != ds.Snoop {
+					return
+				}
+				if f.dataSrc.Locked != 0 && f.dataSrc.Locked != ds.Locked {
+					return
+				}
+				if f.dataSrc.TLB != 0 && f.dataSrc.TLB != ds.TLB {
+					return
+				}
 			}
 
-		good:
 			cb(proc, rec)
 		}
+
+		// Plan: pick the most selective index available for
+		// this filter, in roughly increasing order of expected
+		// candidate set size.
+		var candidates []int32
+		haveIndex := true
+		switch {
+		case f.address != 0:
+			proc.buildIndex()
+			candidates = proc.idx.byAddress[f.address]
+		case f.fileName != "" && f.line != 0:
+			proc.buildIndex()
+			candidates = proc.idx.byFileLine[fileLine{f.fileName, f.line}]
+		case f.fileName != "":
+			proc.buildIndex()
+			candidates = proc.idx.byFile[f.fileName]
+		case f.funcName != "":
+			proc.buildIndex()
+			candidates = proc.idx.byFunc[f.funcName]
+		case f.outerFuncName != "":
+			proc.buildIndex()
+			candidates = proc.idx.byOuterFunc[f.outerFuncName]
+		case dsFilter:
+			// The dataSrcID space is small (a given
+			// architecture only generates a handful of
+			// distinct DataSrc values), so it's cheap to
+			// test each one against f.dataSrc and only
+			// scan the records for IDs that match.
+			proc.buildIndex()
+			for id, recs := range proc.idx.byDataSrc {
+				full := db.dataSrcs[id]
+				if f.dataSrc.Op != 0 && f.dataSrc.Op != full.Op {
+					continue
+				}
+				if f.dataSrc.Level != 0 && (f.dataSrc.Level != full.Level || f.dataSrc.Miss != full.Miss) {
+					continue
+				}
+				if f.dataSrc.Snoop != 0 && f.dataSrc.Snoop != full.Snoop {
+					continue
+				}
+				if f.dataSrc.Locked != 0 && f.dataSrc.Locked != full.Locked {
+					continue
+				}
+				if f.dataSrc.TLB != 0 && f.dataSrc.TLB != full.TLB {
+					continue
+				}
+				candidates = append(candidates, recs...)
+			}
+		default:
+			haveIndex = false
+		}
+
+		if haveIndex {
+			for _, i := range candidates {
+				check(&proc.records[i])
+			}
+			return
+		}
+		for i := range proc.records {
+			check(&proc.records[i])
+		}
 	}
 
 	if f.pid == 0 {
@@ -102,9 +102,11 @@ var staticFiles embed.FS
 
 func main() {
 	var (
-		flagInput   = flag.String("i", "perf.data", "read memory latency profile from `file`")
-		flagHttp    = flag.String("http", "localhost:8001", "serve HTTP on `address`")
-		flagDocRoot = flag.String("docroot", "", "alternate `path` to static web resources")
+		flagInput      = flag.String("i", "perf.data", "read memory latency profile from `file`")
+		flagHttp       = flag.String("http", "localhost:8001", "serve HTTP on `address`")
+		flagDocRoot    = flag.String("docroot", "", "alternate `path` to static web resources")
+		flagPprof      = flag.String("pprof", "", "write a pprof profile to `file` and exit, instead of serving HTTP")
+		flagNoCompress = flag.Bool("no-compress", false, "don't gzip/brotli-compress heatmap responses (for debugging)")
 	)
 	flag.Parse()
 	if flag.NArg() > 0 {
@@ -116,6 +118,18 @@ func main() {
 	db := parsePerf(*flagInput)
 	fmt.Fprintln(os.Stderr, "profile loaded")
 
+	if *flagPprof != "" {
+		out, err := os.Create(*flagPprof)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+		if err := db.pprofProfile(&filter{}).Write(out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	mux := http.NewServeMux()
 	if *flagDocRoot == "" {
 		// Use the embedded static assets.
@@ -125,8 +139,9 @@ func main() {
 		// Use assets from the file system.
 		mux.Handle("/", http.FileServer(http.Dir(*flagDocRoot)))
 	}
-	mux.Handle("/h", &heatMapHandler{db})
+	mux.Handle("/h", &heatMapHandler{db, *flagNoCompress})
 	mux.Handle("/metadata", &metadataHandler{*flagInput, db.metadata})
+	mux.Handle("/pprof", &pprofHandler{db})
 
 	fmt.Fprintf(os.Stderr, "serving on %s\n", *flagHttp)
 	if err := http.ListenAndServe(*flagHttp, mux); err != nil {
@@ -134,16 +149,39 @@ func main() {
 	}
 }
 
+// filterFromQuery parses a filter out of the query parameters shared
+// by the heatmap and pprof export handlers.
+func filterFromQuery(qs url.Values) filter {
+	atoi := func(s string) int {
+		x, _ := strconv.Atoi(s)
+		return x
+	}
+	return filter{
+		pid:           atoi(qs.Get("pid")),
+		funcName:      qs.Get("funcName"),
+		outerFuncName: qs.Get("outerFuncName"),
+		fileName:      qs.Get("fileName"),
+		line:          atoi(qs.Get("line")),
+		address:       uint64(atoi(qs.Get("address"))),
+		dataSrc: perffile.DataSrc{
+			Op:     perffile.DataSrcOp(atoi(qs.Get("op"))),
+			Miss:   qs.Get("miss") == "miss",
+			Level:  perffile.DataSrcLevel(atoi(qs.Get("level"))),
+			Snoop:  perffile.DataSrcSnoop(atoi(qs.Get("snoop"))),
+			Locked: perffile.DataSrcLock(atoi(qs.Get("locked"))),
+			TLB:    perffile.DataSrcTLB(atoi(qs.Get("tlb"))),
+		},
+		branchFromFunc: qs.Get("branchFromFunc"),
+		callchainFunc:  qs.Get("callchainFunc"),
+	}
+}
+
 type heatMapHandler struct {
-	db *database
+	db         *database
+	noCompress bool
 }
 
 func (h *heatMapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// TOOD: Include a signature for this profile in the request
-	// and mark the response as cacheable.
-
-	// TODO: Compress the output.
-
 	// Request includes filter, group by. Response: map from group
 	// by to histograms.
 	qs, err := url.ParseQuery(req.URL.RawQuery)
@@ -155,24 +193,18 @@ func (h *heatMapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		x, _ := strconv.Atoi(s)
 		return x
 	}
-	f := filter{
-		pid:      atoi(qs.Get("pid")),
-		funcName: qs.Get("funcName"),
-		fileName: qs.Get("fileName"),
-		line:     atoi(qs.Get("line")),
-		address:  uint64(atoi(qs.Get("address"))),
-		dataSrc: perffile.DataSrc{
-			Op:     perffile.DataSrcOp(atoi(qs.Get("op"))),
-			Miss:   qs.Get("miss") == "miss",
-			Level:  perffile.DataSrcLevel(atoi(qs.Get("level"))),
-			Snoop:  perffile.DataSrcSnoop(atoi(qs.Get("snoop"))),
-			Locked: perffile.DataSrcLock(atoi(qs.Get("locked"))),
-			TLB:    perffile.DataSrcTLB(atoi(qs.Get("tlb"))),
-		},
-	}
+	f := filterFromQuery(qs)
 	groupBy := qs.Get("groupBy")
 	limit := atoi(qs.Get("limit"))
 
+	etag := etagFor(h.db, &f, groupBy, limit)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, must-revalidate")
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Compute the scale for this histogram set.
 	const useLocalScale = false
 	var maxLatency uint32 = 1
@@ -238,6 +270,19 @@ func (h *heatMapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			hist.update(r)
 		}
 
+	case "outerFuncName":
+		groups := make(map[string]*latencyHistogram)
+		agg = func(p *proc, r *record) {
+			outerFuncName := p.ipInfo[r.ip].outerFuncName
+			hist, ok := groups[outerFuncName]
+			if !ok {
+				hist = newHist()
+				hist.OuterFuncName = outerFuncName
+				groups[outerFuncName] = hist
+			}
+			hist.update(r)
+		}
+
 	case "annotation", "line":
 		groups := make(map[ipInfo]*latencyHistogram)
 		agg = func(p *proc, r *record) {
@@ -400,13 +445,17 @@ func (h *heatMapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Construct JSON reply.
 	major, minor := scaler.Ticks(scale.TickOptions{Max: 6})
 	majorX, minorX := vec.Map(scaler.Map, major), vec.Map(scaler.Map, minor)
-	err = json.NewEncoder(w).Encode(struct {
+	out, closeOut := startCompression(w, req, h.noCompress)
+	err = json.NewEncoder(out).Encode(struct {
 		Histograms []*latencyHistogram
 		MaxBin     int
 
 		MajorTicks, MajorTicksX []float64
 		MinorTicksX             []float64
 	}{histograms, maxBin, major, majorX, minorX})
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		log.Print(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -426,12 +475,13 @@ type latencyHistogram struct {
 	group  string
 
 	// Filter specification.
-	PID      int    `json:"pid,omitempty"`
-	Comm     string `json:"comm,omitempty"`
-	FuncName string `json:"funcName,omitempty"`
-	FileName string `json:"fileName,omitempty"`
-	Line     int    `json:"line,omitempty"`
-	Address  uint64 `json:"address,omitempty"`
+	PID           int    `json:"pid,omitempty"`
+	Comm          string `json:"comm,omitempty"`
+	FuncName      string `json:"funcName,omitempty"`
+	OuterFuncName string `json:"outerFuncName,omitempty"`
+	FileName      string `json:"fileName,omitempty"`
+	Line          int    `json:"line,omitempty"`
+	Address       uint64 `json:"address,omitempty"`
 
 	// Data source filter specification.
 	Op     perffile.DataSrcOp    `json:"op,omitempty"`
@@ -573,3 +623,24 @@ func (h *metadataHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// pprofHandler exports the profile, filtered the same way as the
+// heatmap handler, as a gzipped pprof protobuf.
+type pprofHandler struct {
+	db *database
+}
+
+func (h *pprofHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	qs, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f := filterFromQuery(qs)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := h.db.pprofProfile(&f).Write(w); err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
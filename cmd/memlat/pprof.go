@@ -0,0 +1,121 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	gpprof "github.com/google/pprof/profile"
+
+	ppprof "github.com/aclements/go-perf/perffile/pprof"
+)
+
+// pprofProfile converts the records matching f into a pprof Profile,
+// so it can be fed directly to "go tool pprof" or other pprof
+// tooling (Parca, pprof.me, and so on).
+//
+// Each record becomes one Sample with two value columns: "cycles"
+// (the record's memory latency weight) and "samples" (a bare count
+// of 1). A Sample's Location carries the full, already-symbolized
+// inline stack at its IP (see proc.frames), so a sample that landed
+// in a function DWARF says was inlined still attributes to both the
+// inlined function and the function it was inlined into. Each
+// Sample is also labeled with its pid, comm, data source, and
+// address, so pprof's own tag filtering can slice the profile
+// further.
+func (db *database) pprofProfile(f *filter) *gpprof.Profile {
+	prof := &gpprof.Profile{
+		SampleType: []*gpprof.ValueType{
+			{Type: "cycles", Unit: "count"},
+			{Type: "samples", Unit: "count"},
+		},
+	}
+	c := &pprofConverter{
+		db:        db,
+		prof:      prof,
+		locations: make(map[locKey]*gpprof.Location),
+	}
+	db.filter(f, c.addSample)
+	return prof
+}
+
+// pprofConverter holds the state pprofProfile accumulates while it
+// walks the database's filtered records.
+type pprofConverter struct {
+	db   *database
+	prof *gpprof.Profile
+
+	functions ppprof.FuncCache
+	locations map[locKey]*gpprof.Location
+}
+
+// locKey identifies an IP within a specific process. Unlike
+// perffile/pprof, which can assume a single, global address space,
+// memlat's proc.ipInfo (and hence proc.frames) is keyed per-process,
+// so the cache here must be too.
+type locKey struct {
+	proc *proc
+	ip   uint64
+}
+
+func (c *pprofConverter) addSample(p *proc, rec *record) {
+	loc := c.location(p, rec.ip)
+
+	ds := c.db.dataSrcs[rec.dataSrc]
+	labels := map[string][]string{
+		"pid":     {strconv.Itoa(p.pid)},
+		"comm":    {p.comm},
+		"address": {fmt.Sprintf("%#x", rec.address)},
+	}
+	if ds.Op != 0 {
+		labels["data_src_op"] = []string{ds.Op.String()}
+	}
+	if ds.Level != 0 {
+		labels["data_src_level"] = []string{ds.Level.String()}
+		miss := "hit"
+		if ds.Miss {
+			miss = "miss"
+		}
+		labels["miss"] = []string{miss}
+	}
+	if ds.Snoop != 0 {
+		labels["snoop"] = []string{ds.Snoop.String()}
+	}
+	if ds.TLB != 0 {
+		labels["tlb"] = []string{ds.TLB.String()}
+	}
+
+	c.prof.Sample = append(c.prof.Sample, &gpprof.Sample{
+		Location: []*gpprof.Location{loc},
+		Value:    []int64{int64(rec.latency), 1},
+		Label:    labels,
+	})
+}
+
+// location returns the Location for ip in process p, creating it
+// (and the inline stack of Lines it carries) the first time this
+// (p, ip) pair is seen.
+func (c *pprofConverter) location(p *proc, ip uint64) *gpprof.Location {
+	key := locKey{p, ip}
+	if loc, ok := c.locations[key]; ok {
+		return loc
+	}
+
+	frames := p.frames(ip)
+	loc := &gpprof.Location{ID: uint64(len(c.prof.Location)) + 1, Address: ip}
+	loc.Line = make([]gpprof.Line, len(frames))
+	for i, fr := range frames {
+		loc.Line[i] = gpprof.Line{Function: c.function(fr.funcName, fr.fileName), Line: int64(fr.line)}
+	}
+
+	c.prof.Location = append(c.prof.Location, loc)
+	c.locations[key] = loc
+	return loc
+}
+
+func (c *pprofConverter) function(name, file string) *gpprof.Function {
+	return c.functions.Get(c.prof, name, file)
+}
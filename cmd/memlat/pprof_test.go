@@ -0,0 +1,89 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	gpprof "github.com/google/pprof/profile"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func TestPprofProfile(t *testing.T) {
+	db := &database{
+		dataSrcs: []perffile.DataSrc{
+			{Op: perffile.DataSrcOpLoad, Level: perffile.DataSrcLevelL1},
+		},
+		procs: map[int]*proc{
+			123: {
+				pid:  123,
+				comm: "test",
+				ipInfo: map[uint64]ipInfo{
+					0x1000: {funcName: "main.f", fileName: "main.go", line: 10, outerFuncName: "main.g"},
+				},
+				ipFrames: map[uint64][]frame{
+					0x1000: {
+						{funcName: "main.f", fileName: "main.go", line: 10},
+						{funcName: "main.g", fileName: "main.go", line: 20},
+					},
+				},
+				records: []record{
+					{ip: 0x1000, address: 0xdead, latency: 42, dataSrc: 0, callchain: -1},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := db.pprofProfile(&filter{}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := gpprof.Parse(&buf)
+	if err != nil {
+		t.Fatalf("round-tripped profile failed to parse: %s", err)
+	}
+
+	if len(got.Sample) != 1 {
+		t.Fatalf("got %d samples, want 1", len(got.Sample))
+	}
+	s := got.Sample[0]
+
+	if len(s.Value) != 2 || s.Value[0] != 42 || s.Value[1] != 1 {
+		t.Errorf("sample values = %v, want [42 1]", s.Value)
+	}
+
+	if len(s.Location) != 1 {
+		t.Fatalf("got %d locations, want 1", len(s.Location))
+	}
+	lines := s.Location[0].Line
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2 (one per inline frame)", len(lines))
+	}
+	if fn, line := lines[0].Function.Name, lines[0].Line; fn != "main.f" || line != 10 {
+		t.Errorf("innermost line = %s:%d, want main.f:10", fn, line)
+	}
+	if fn, line := lines[1].Function.Name, lines[1].Line; fn != "main.g" || line != 20 {
+		t.Errorf("outer line = %s:%d, want main.g:20", fn, line)
+	}
+
+	wantLabels := map[string]string{
+		"pid":     "123",
+		"comm":    "test",
+		"address": "0xdead",
+		"miss":    "hit",
+	}
+	for k, want := range wantLabels {
+		got := s.Label[k]
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("label %q = %v, want [%q]", k, got, want)
+		}
+	}
+	if len(s.Label["data_src_op"]) != 1 || s.Label["data_src_op"][0] == "" {
+		t.Errorf("label %q missing, want non-empty", "data_src_op")
+	}
+}
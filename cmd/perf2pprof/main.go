@@ -0,0 +1,68 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perf2pprof converts a perf.data profile to the pprof
+// profile.proto format so it can be viewed with "go tool pprof" and
+// other pprof-compatible tooling.
+//
+// Each event recorded in the profile becomes its own sample value
+// column, and each sample's call chain (or, failing that, its
+// instruction pointer) is translated to a pprof location stack,
+// symbolized using the perffile/symbolize package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+	ppprof "github.com/aclements/go-perf/perffile/pprof"
+)
+
+func main() {
+	var (
+		flagInput  = flag.String("i", "perf.data", "input perf.data `file`")
+		flagOutput = flag.String("o", "perf.pprof", "output pprof `file`")
+		flagSyms   = flag.Bool("syms", true, "resolve symbols for each sample's call chain")
+		flagPath   = flag.String("searchpath", "", "colon-separated `path` to search for binaries that aren't at their recorded location")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var opts []ppprof.Option
+	if *flagSyms {
+		var paths []string
+		if *flagPath != "" {
+			paths = strings.Split(*flagPath, ":")
+		}
+		opts = append(opts, ppprof.WithSymbols(paths...))
+	}
+
+	prof, err := ppprof.Convert(f, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(*flagOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	if err := prof.Write(out); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s\n", *flagOutput)
+}
@@ -13,12 +13,14 @@ import (
 	"reflect"
 
 	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/symbolize"
 )
 
 func main() {
 	var (
 		flagInput = flag.String("i", "perf.data", "input perf.data `file`")
 		flagOrder = flag.String("order", "time", "sort `order`; one of: file, time, causal")
+		flagSyms  = flag.Bool("syms", false, "resolve and print symbols for each sample's IP and callchain")
 	)
 	flag.Parse()
 	order, ok := parseOrder(*flagOrder)
@@ -58,6 +60,7 @@ func main() {
 		{"CPUs available", f.Meta.CPUsAvail},
 		{"CPU desc", f.Meta.CPUDesc},
 		{"CPUID", f.Meta.CPUID},
+		{"CPU info", f.Meta.CPUInfo},
 		{"total memory", f.Meta.TotalMem},
 		{"cmdline", f.Meta.CmdLine},
 		{"core groups", f.Meta.CoreGroups},
@@ -65,6 +68,10 @@ func main() {
 		{"NUMA nodes", f.Meta.NUMANodes},
 		{"PMU mappings", f.Meta.PMUMappings},
 		{"groups", f.Meta.Groups},
+		{"cgroups", f.Meta.Cgroups},
+		{"PMU caps", f.Meta.PMUCaps},
+		{"hybrid cores", f.Meta.HybridCores},
+		{"compression", f.Meta.Compression},
 	} {
 		if hdr.val == reflect.Zero(reflect.ValueOf(hdr.val).Type()) {
 			continue
@@ -74,6 +81,14 @@ func main() {
 
 	fmt.Println()
 
+	var syms *symbolize.Symbolizer
+	if *flagSyms {
+		syms, err = symbolize.New(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	rs := f.Records(order)
 	for rs.Next() {
 		fmt.Printf("%v{\n", rs.Record.Type())
@@ -81,8 +96,22 @@ func main() {
 		case *perffile.RecordSample:
 			v := reflect.ValueOf(r).Elem()
 			for _, n := range r.Fields() {
-				f := v.FieldByName(n)
-				fmt.Printf("\t%s,\n", fmtVal(n, f))
+				fv := v.FieldByName(n)
+				fmt.Printf("\t%s,\n", fmtVal(n, fv))
+			}
+			if path, ok := f.Meta.Cgroups[r.CGroup]; ok {
+				fmt.Printf("\tCgroupPath:    %s\n", path)
+			}
+			if syms != nil {
+				printFrame(syms, r.PID, r.CPUMode, r.IP)
+				mode := r.CPUMode
+				for _, ip := range r.Callchain {
+					if m, ok := callchainMode(ip); ok {
+						mode = m
+						continue
+					}
+					printFrame(syms, r.PID, mode, ip)
+				}
 			}
 		default:
 			printFields(reflect.ValueOf(r))
@@ -96,6 +125,37 @@ func main() {
 	}
 }
 
+// callchainMode reports the CPUMode a Callchain* marker switches
+// subsequent IPs to, or false if ip isn't one of those markers.
+func callchainMode(ip uint64) (perffile.CPUMode, bool) {
+	switch ip {
+	case perffile.CallchainHV:
+		return perffile.CPUModeHypervisor, true
+	case perffile.CallchainKernel:
+		return perffile.CPUModeKernel, true
+	case perffile.CallchainUser:
+		return perffile.CPUModeUser, true
+	case perffile.CallchainGuest:
+		return perffile.CPUModeGuestKernel, true
+	case perffile.CallchainGuestKernel:
+		return perffile.CPUModeGuestKernel, true
+	case perffile.CallchainGuestUser:
+		return perffile.CPUModeGuestUser, true
+	}
+	return 0, false
+}
+
+// printFrame resolves ip (sampled in process pid at privilege level
+// mode) via syms and prints the result, or the resolution error.
+func printFrame(syms *symbolize.Symbolizer, pid int, mode perffile.CPUMode, ip uint64) {
+	frame, err := syms.Resolve(pid, mode, ip)
+	if err != nil {
+		fmt.Printf("\t%#x: %v\n", ip, err)
+		return
+	}
+	fmt.Printf("\t%#x: %s %s:%d\n", ip, frame.Func, frame.File, frame.Line)
+}
+
 func parseOrder(order string) (perffile.RecordsOrder, bool) {
 	switch order {
 	case "file":
@@ -0,0 +1,123 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile/symbolize"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+func dwarfLineTable(elff *elf.File, dwarff *dwarf.Data) []*dwarf.LineEntry {
+	out := make([]*dwarf.LineEntry, 0)
+
+	dr := dwarff.Reader()
+	for {
+		ent, err := dr.Next()
+		if ent == nil || err != nil {
+			break
+		}
+
+		if ent.Tag != dwarf.TagCompileUnit {
+			dr.SkipChildren()
+			continue
+		}
+
+		lr, err := dwarff.LineReader(ent)
+		if err != nil {
+			log.Fatal(err)
+		} else if lr == nil {
+			continue
+		}
+
+		for {
+			var lent dwarf.LineEntry
+			err := lr.Next(&lent)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				log.Fatal(err)
+			}
+			out = append(out, &lent)
+		}
+	}
+	return out
+}
+
+// mmapExtra caches the DWARF-derived function and line tables for one
+// binary. It's cached in a Session's Extra map, keyed by filename, so
+// it's loaded at most once no matter how many mappings or samples
+// reference that binary.
+type mmapExtra struct {
+	functab []symbolize.FuncRange
+	linetab []*dwarf.LineEntry
+}
+
+// findIP resolves ip to its enclosing function and source line using
+// m's DWARF tables, or returns the zero FuncRange if ip falls outside
+// any known function.
+func (m *mmapExtra) findIP(ip uint64) (fr symbolize.FuncRange, line *dwarf.LineEntry) {
+	if m.functab == nil || m.linetab == nil {
+		return symbolize.FuncRange{}, nil
+	}
+
+	i := sort.Search(len(m.functab), func(i int) bool {
+		return ip < m.functab[i].High
+	})
+	if i < len(m.functab) && m.functab[i].Low <= ip && ip < m.functab[i].High {
+		fr = m.functab[i]
+	}
+
+	i = sort.Search(len(m.linetab), func(i int) bool {
+		return ip < m.linetab[i].Address
+	})
+	if i != 0 {
+		line = m.linetab[i-1]
+	}
+
+	return
+}
+
+var mmapExtraKey = perfsession.NewExtraKey("perfshell.mmapExtra")
+
+// getMmapExtra returns (loading and caching, if necessary) the DWARF
+// tables for the binary backing mmap. It returns nil if mmap's file
+// can't be opened or has no DWARF info (e.g. it's been stripped).
+func getMmapExtra(session *perfsession.Session, mmap *perfsession.Mmap) *mmapExtra {
+	tables, ok := session.Extra[mmapExtraKey].(map[string]*mmapExtra)
+	if !ok {
+		tables = make(map[string]*mmapExtra)
+		session.Extra[mmapExtraKey] = tables
+	}
+
+	if extra, ok := tables[mmap.Filename]; ok {
+		return extra
+	}
+	tables[mmap.Filename] = nil
+
+	elff, err := elf.Open(mmap.Filename)
+	if err != nil {
+		return nil
+	}
+	defer elff.Close()
+
+	dwarff, err := elff.DWARF()
+	if err != nil {
+		return nil
+	}
+
+	extra := &mmapExtra{
+		functab: symbolize.DwarfFuncTable(dwarff),
+		linetab: dwarfLineTable(elff, dwarff),
+	}
+	tables[mmap.Filename] = extra
+	return extra
+}
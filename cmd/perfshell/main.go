@@ -0,0 +1,133 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command perfshell is an interactive, pprof-style explorer for
+// perf.data recordings.
+//
+// perfshell reads a perf.data file once via perffile.Open, resolves
+// every sample to a function, source file, and line using the same
+// DWARF lookup memheat and memanim use, and then drops into a REPL
+// for exploring the result:
+//
+//	top [N]                  show the top N functions by sample weight
+//	list <regexp>            annotate the source of functions matching regexp
+//	weblist <regexp>         like list, but renders to an HTML file
+//	disasm <fn>              disassemble a function (via objdump)
+//	focus <regexp>           keep only samples in functions matching regexp
+//	ignore <regexp>          drop samples in functions matching regexp
+//	tagfocus PID=<pid>       keep only samples from the given PID
+//	heatmap <fn> > out.svg   render a per-address weight heatmap for fn
+//	reset                    clear all focus/ignore/tagfocus filters
+//	help
+//	quit
+//
+// Filters are composable and accumulate as session state, so each
+// command narrows the trace already held in memory rather than
+// re-reading perf.data from disk.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perfsession"
+)
+
+// sample is one resolved RecordSample: an instruction pointer that's
+// been attributed to a PID, a function, and (if DWARF line info was
+// available) a source file and line.
+type sample struct {
+	pid     int
+	ip      uint64
+	weight  uint64
+	binPath string
+	fn      string
+	file    string
+	line    int
+}
+
+func main() {
+	var (
+		flagInput = flag.String("i", "perf.data", "input perf.data file")
+	)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	f, err := perffile.Open(*flagInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	samples, funcs, err := readSamples(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("perfshell: %d samples loaded from %s\n", len(samples), *flagInput)
+	fmt.Println(`Type "help" for a list of commands.`)
+
+	sh := newShell(samples, funcs, os.Stdout)
+	sh.run(bufio.NewScanner(os.Stdin))
+}
+
+// funcLoc locates a function's code in its binary, for disasm.
+type funcLoc struct {
+	binPath       string
+	lowpc, highpc uint64
+}
+
+// readSamples makes a single pass over f's records, tracking mappings
+// via a perfsession.Session and resolving each RecordSample's IP to a
+// function/file/line using the covering mapping's DWARF info, the
+// same way memheat's main does. It also records, for each distinct
+// function name seen, where to find it for the disasm command.
+func readSamples(f *perffile.File) ([]sample, map[string]funcLoc, error) {
+	s := perfsession.New(f)
+
+	var samples []sample
+	funcs := make(map[string]funcLoc)
+	rs := f.Records()
+	for rs.Next() {
+		r := rs.Record
+		s.Update(r)
+
+		rec, ok := r.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+
+		mmap := s.LookupPID(rec.PID).LookupMmap(rec.IP)
+		if mmap == nil {
+			continue
+		}
+
+		samp := sample{pid: rec.PID, ip: rec.IP, weight: rec.Weight, binPath: mmap.Filename}
+		if extra := getMmapExtra(s, mmap); extra != nil {
+			fr, line := extra.findIP(rec.IP)
+			samp.fn = fr.Name
+			if line != nil {
+				samp.file = line.File.Name
+				samp.line = line.Line
+			}
+			if fr.Name != "" {
+				if _, ok := funcs[fr.Name]; !ok {
+					funcs[fr.Name] = funcLoc{mmap.Filename, fr.Low, fr.High}
+				}
+			}
+		}
+		samples = append(samples, samp)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, nil, err
+	}
+	return samples, funcs, nil
+}
@@ -0,0 +1,359 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// shell holds a loaded trace and the filters the user has
+// accumulated interactively. Every command re-aggregates over
+// samples rather than re-reading perf.data, so narrowing a filter is
+// cheap no matter how large the recording was.
+type shell struct {
+	samples []sample
+	funcs   map[string]funcLoc
+	out     io.Writer
+
+	// focus and ignore are ANDed and NORed, respectively, against
+	// each sample's function name: a sample survives only if it
+	// matches every focus regexp (or there are none) and no ignore
+	// regexp.
+	focus  []*regexp.Regexp
+	ignore []*regexp.Regexp
+
+	// tagPID, if non-zero, restricts samples to one PID, as set by
+	// "tagfocus PID=...".
+	tagPID int
+
+	sourceCache map[string][]string
+}
+
+func newShell(samples []sample, funcs map[string]funcLoc, out io.Writer) *shell {
+	return &shell{samples: samples, funcs: funcs, out: out, sourceCache: make(map[string][]string)}
+}
+
+// run reads commands from scanner until EOF or a "quit" command.
+func (sh *shell) run(scanner *bufio.Scanner) {
+	for {
+		fmt.Fprint(sh.out, "(perfshell) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(sh.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := sh.dispatch(line); err != nil {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+}
+
+func (sh *shell) dispatch(line string) error {
+	fields := strings.Fields(line)
+	cmd, args := fields[0], fields[1:]
+
+	switch cmd {
+	case "top":
+		n := 10
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("top: %w", err)
+			}
+			n = v
+		}
+		return sh.top(n)
+
+	case "list":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: list <regexp>")
+		}
+		return sh.list(args[0], sh.out)
+
+	case "weblist":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: weblist <regexp>")
+		}
+		return sh.weblist(args[0])
+
+	case "disasm":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: disasm <fn>")
+		}
+		return sh.disasm(args[0])
+
+	case "focus":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: focus <regexp>")
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return err
+		}
+		sh.focus = append(sh.focus, re)
+		return nil
+
+	case "ignore":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: ignore <regexp>")
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return err
+		}
+		sh.ignore = append(sh.ignore, re)
+		return nil
+
+	case "tagfocus":
+		if len(args) != 1 || !strings.HasPrefix(args[0], "PID=") {
+			return fmt.Errorf("usage: tagfocus PID=<pid>")
+		}
+		pid, err := strconv.Atoi(strings.TrimPrefix(args[0], "PID="))
+		if err != nil {
+			return fmt.Errorf("tagfocus: %w", err)
+		}
+		sh.tagPID = pid
+		return nil
+
+	case "heatmap":
+		return sh.heatmapCmd(args)
+
+	case "reset":
+		sh.focus = nil
+		sh.ignore = nil
+		sh.tagPID = 0
+		return nil
+
+	case "help":
+		sh.help()
+		return nil
+
+	case "quit", "exit":
+		os.Exit(0)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q (try \"help\")", cmd)
+	}
+}
+
+func (sh *shell) help() {
+	fmt.Fprint(sh.out, `Commands:
+  top [N]                  show the top N functions by sample weight (default 10)
+  list <regexp>             annotate the source of functions matching regexp
+  weblist <regexp>          like list, but renders to an HTML file
+  disasm <fn>               disassemble a function (via objdump)
+  focus <regexp>            keep only samples in functions matching regexp
+  ignore <regexp>           drop samples in functions matching regexp
+  tagfocus PID=<pid>        keep only samples from the given PID
+  heatmap <fn> > out.svg    render a per-address weight heatmap for fn
+  reset                     clear all focus/ignore/tagfocus filters
+  help
+  quit
+`)
+}
+
+// filtered returns the samples that survive sh's current focus,
+// ignore, and tagfocus filters.
+func (sh *shell) filtered() []sample {
+	var out []sample
+samples:
+	for _, s := range sh.samples {
+		if sh.tagPID != 0 && s.pid != sh.tagPID {
+			continue
+		}
+		for _, re := range sh.focus {
+			if !re.MatchString(s.fn) {
+				continue samples
+			}
+		}
+		for _, re := range sh.ignore {
+			if re.MatchString(s.fn) {
+				continue samples
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (sh *shell) top(n int) error {
+	weight := make(map[string]uint64)
+	var total uint64
+	for _, s := range sh.filtered() {
+		weight[s.fn] += s.weight
+		total += s.weight
+	}
+
+	type row struct {
+		fn string
+		w  uint64
+	}
+	rows := make([]row, 0, len(weight))
+	for fn, w := range weight {
+		rows = append(rows, row{fn, w})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].w > rows[j].w })
+	if n > 0 && n < len(rows) {
+		rows = rows[:n]
+	}
+
+	tw := tabwriter.NewWriter(sh.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "weight\t%%\tfunction\n")
+	for _, r := range rows {
+		pct := 0.0
+		if total > 0 {
+			pct = 100 * float64(r.w) / float64(total)
+		}
+		fn := r.fn
+		if fn == "" {
+			fn = "[unknown]"
+		}
+		fmt.Fprintf(tw, "%d\t%.1f%%\t%s\n", r.w, pct, fn)
+	}
+	return tw.Flush()
+}
+
+// linesByFunc groups filtered samples matching pattern by file, then
+// by line, summing their weight at each line.
+func (sh *shell) linesByFunc(pattern string) (map[string]map[int]uint64, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	byFile := make(map[string]map[int]uint64)
+	for _, s := range sh.filtered() {
+		if s.file == "" || !re.MatchString(s.fn) {
+			continue
+		}
+		lines, ok := byFile[s.file]
+		if !ok {
+			lines = make(map[int]uint64)
+			byFile[s.file] = lines
+		}
+		lines[s.line] += s.weight
+	}
+	return byFile, nil
+}
+
+func (sh *shell) list(pattern string, w io.Writer) error {
+	byFile, err := sh.linesByFunc(pattern)
+	if err != nil {
+		return err
+	}
+	if len(byFile) == 0 {
+		fmt.Fprintf(w, "no samples match %q\n", pattern)
+		return nil
+	}
+
+	files := make([]string, 0, len(byFile))
+	for file := range byFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		fmt.Fprintf(w, "ROUTINE ======== %s\n", file)
+		src, err := sh.sourceLines(file)
+		if err != nil {
+			fmt.Fprintf(w, "  (source unavailable: %s)\n", err)
+			continue
+		}
+		lines := byFile[file]
+		lineNums := make([]int, 0, len(lines))
+		for l := range lines {
+			lineNums = append(lineNums, l)
+		}
+		sort.Ints(lineNums)
+		lo, hi := lineNums[0], lineNums[len(lineNums)-1]
+		for l := lo; l <= hi && l <= len(src); l++ {
+			w8 := lines[l]
+			text := ""
+			if l-1 >= 0 && l-1 < len(src) {
+				text = src[l-1]
+			}
+			if w8 > 0 {
+				fmt.Fprintf(w, "%8d %6d: %s\n", w8, l, text)
+			} else {
+				fmt.Fprintf(w, "%8s %6d: %s\n", "", l, text)
+			}
+		}
+	}
+	return nil
+}
+
+func (sh *shell) sourceLines(path string) ([]string, error) {
+	if lines, ok := sh.sourceCache[path]; ok {
+		return lines, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sh.sourceCache[path] = lines
+	return lines, nil
+}
+
+// weblist renders the same annotation as list, but to a standalone
+// HTML file, since this tool has no running web server to push a
+// page to a browser the way pprof's weblist does.
+func (sh *shell) weblist(pattern string) error {
+	tmp, err := os.CreateTemp("", "perfshell-weblist-*.html")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	fmt.Fprintf(tmp, "<html><body><pre>\n")
+	if err := sh.list(pattern, tmp); err != nil {
+		return err
+	}
+	fmt.Fprintf(tmp, "</pre></body></html>\n")
+
+	fmt.Fprintf(sh.out, "wrote %s; open it in a browser to view\n", tmp.Name())
+	return nil
+}
+
+// disasm shells out to objdump, as pprof's own interactive disasm
+// command does, to disassemble just the PC range DWARF attributes to
+// fn.
+func (sh *shell) disasm(fn string) error {
+	loc, ok := sh.funcs[fn]
+	if !ok {
+		return fmt.Errorf("unknown function %q", fn)
+	}
+
+	cmd := exec.Command("objdump", "-d",
+		"--start-address="+fmt.Sprintf("%#x", loc.lowpc),
+		"--stop-address="+fmt.Sprintf("%#x", loc.highpc),
+		loc.binPath)
+	cmd.Stdout = sh.out
+	cmd.Stderr = sh.out
+	return cmd.Run()
+}
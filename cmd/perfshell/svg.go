@@ -0,0 +1,116 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+)
+
+// heatmapCmd parses the "heatmap <fn> [> out.svg]" command and
+// renders to the named file, or to the shell's output if no
+// redirection was given.
+func (sh *shell) heatmapCmd(args []string) error {
+	var fn, outPath string
+	switch {
+	case len(args) == 1:
+		fn = args[0]
+	case len(args) == 3 && args[1] == ">":
+		fn, outPath = args[0], args[2]
+	default:
+		return fmt.Errorf("usage: heatmap <fn> [> out.svg]")
+	}
+
+	w := sh.out
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return sh.writeHeatmap(fn, w)
+}
+
+// writeHeatmap renders an SVG bar-chart of sample weight by address
+// for fn, bucketing its (filtered) samples across its DWARF PC range.
+// This is deliberately simpler than memheat's full heatmap (no
+// source/function margins, no log-scale histograms): it's meant as a
+// quick visual for one function from inside the REPL, not a
+// replacement for the standalone tool.
+func (sh *shell) writeHeatmap(fn string, w io.Writer) error {
+	var matched []sample
+	for _, s := range sh.filtered() {
+		if s.fn == fn {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("no samples for function %q", fn)
+	}
+
+	lowpc, highpc := uint64(0), uint64(0)
+	if loc, ok := sh.funcs[fn]; ok {
+		lowpc, highpc = loc.lowpc, loc.highpc
+	}
+	if highpc <= lowpc {
+		lowpc, highpc = matched[0].ip, matched[0].ip+1
+		for _, s := range matched {
+			if s.ip < lowpc {
+				lowpc = s.ip
+			}
+			if s.ip+1 > highpc {
+				highpc = s.ip + 1
+			}
+		}
+	}
+
+	const buckets = 50
+	weights := make([]uint64, buckets)
+	span := highpc - lowpc
+	for _, s := range matched {
+		b := int(float64(s.ip-lowpc) / float64(span) * buckets)
+		if b >= buckets {
+			b = buckets - 1
+		}
+		weights[b] += s.weight
+	}
+
+	maxWeight := uint64(0)
+	for _, wt := range weights {
+		if wt > maxWeight {
+			maxWeight = wt
+		}
+	}
+
+	const (
+		cellWidth  = 10
+		cellHeight = 20
+		marginLeft = 10
+		marginTop  = 30
+	)
+	width := marginLeft*2 + buckets*cellWidth
+	height := marginTop + cellHeight + 10
+
+	fmt.Fprintf(w, "<?xml version=\"1.0\" standalone=\"no\"?>\n")
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">\n", width, height)
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-family=\"sans-serif\" font-size=\"12\">%s</text>\n",
+		marginLeft, marginTop-10, html.EscapeString(fn))
+	for i, wt := range weights {
+		if wt == 0 {
+			continue
+		}
+		shade := float64(wt) / float64(maxWeight)
+		x := marginLeft + i*cellWidth
+		gb := int(255 * (1 - shade))
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"rgb(255,%d,%d)\"><title>%d</title></rect>\n",
+			x, marginTop, cellWidth, cellHeight, gb, gb, wt)
+	}
+	fmt.Fprintf(w, "</svg>\n")
+	return nil
+}
@@ -31,3 +31,30 @@ const (
 	// DWARF 4
 	lneSetDiscriminator = 4
 )
+
+// DWARF 5 line number program header entry content type codes
+// [DWARF5 6.2.4.1], used in directory_entry_format and
+// file_name_entry_format.
+const (
+	lnctPath           = 0x1
+	lnctDirectoryIndex = 0x2
+	lnctTimestamp      = 0x3
+	lnctSize           = 0x4
+	lnctMD5            = 0x5
+)
+
+// Attribute form encodings used to decode directory_entry_format and
+// file_name_entry_format values [DWARF5 7.5.6]. Only the forms
+// observed in practice for these tables are listed here.
+const (
+	formString   = 0x08
+	formData1    = 0x0b
+	formData2    = 0x05
+	formData4    = 0x06
+	formData8    = 0x07
+	formData16   = 0x1e
+	formUdata    = 0x0f
+	formBlock    = 0x09
+	formStrp     = 0x0e
+	formLineStrp = 0x1f
+)
@@ -7,6 +7,7 @@ package dwarfx
 import (
 	"debug/dwarf"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"path"
 )
@@ -14,8 +15,25 @@ import (
 type LineReader struct {
 	buf buf
 
+	// section is the entire .debug_line section, which Seek and
+	// Reset re-slice r.buf.data from.
+	section []byte
+
+	// debugStr and debugLineStr are the .debug_str and
+	// .debug_line_str sections, used to resolve DW_FORM_strp and
+	// DW_FORM_line_strp values in a DWARF5 header. They may be nil
+	// if the line table doesn't need them (i.e., version < 5).
+	debugStr     []byte
+	debugLineStr []byte
+
+	// compDir is the compilation directory, against which relative
+	// directory and file paths are resolved.
+	compDir string
+
 	// Prologue information
 	version              uint16
+	addressSize          int
+	segmentSelectorSize  int
 	minInstructionLength int
 	maxOpsPerInstruction int
 	defaultIsStmt        bool
@@ -26,13 +44,28 @@ type LineReader struct {
 	directories          []string
 	fileEntries          []*FileEntry
 
+	// programOffset is the section offset of the first opcode of the
+	// statement program, and endOffset is the section offset just
+	// past the end of this compilation unit's line table. Reset seeks
+	// back to programOffset; Seek and SeekPC re-slice r.buf.data from
+	// section[off:endOffset].
+	programOffset dwarf.Offset
+	endOffset     dwarf.Offset
+
+	// initialFileIndex is the default FileIndex at the start of each
+	// sequence: 1 in DWARF2-4 (file index 0 is reserved), 0 in DWARF5
+	// (file index 0 is a normal entry).
+	initialFileIndex int
+
 	state LineEntry
 }
 
 type FileEntry struct {
 	FileName string
-	Mtime    uint64 // Modification time, or 0 if unknown
-	Length   int    // File length, or 0 if unknown
+	Mtime    uint64   // Modification time, or 0 if unknown
+	Length   int      // File length, or 0 if unknown
+	MD5      [16]byte // MD5 checksum of the file, if HasMD5
+	HasMD5   bool
 }
 
 type LineEntry struct {
@@ -50,31 +83,55 @@ type LineEntry struct {
 	Discriminator int  // the block on this source line to which the current instruction belongs
 
 	EndSequence bool // this is one past the last address in the table
+
+	// Offset is the section offset of the opcode that produced this
+	// entry.  Callers that want to resume reading later can save it
+	// as a resume token and pass it to Seek; see Seek for the caveat
+	// about where it's safe to resume from.
+	Offset dwarf.Offset
 }
 
-type dwarf64Format struct{}
+// lineFormat holds the DWARF encoding parameters of a line table: the
+// 32/64-bit DWARF format (detected from the unit length's 0xffffffff
+// escape) and the target's address size (from the DWARF5 header, or
+// from the caller for earlier versions, which don't record it in the
+// line table itself). Unlike a fixed set of ad hoc format structs,
+// lineFormat is populated once at NewLineReader/readPrologue time from
+// the actual data, rather than assumed.
+type lineFormat struct {
+	is64        bool
+	addressSize int
+}
 
-func (dwarf64Format) version() int {
+func (lineFormat) version() int {
 	return 0
 }
 
-func (dwarf64Format) dwarf64() (bool, bool) {
-	return true, true
+func (f lineFormat) dwarf64() (bool, bool) {
+	return f.is64, true
 }
 
-func (dwarf64Format) addrsize() int {
-	return 8
+func (f lineFormat) addrsize() int {
+	return f.addressSize
 }
 
 // NewLineReader returns a new reader for the line table of
 // compilation unit cu.
 //
 // Line tables are per-compilation unit.  cu must be an Entry with tag
-// TagCompileUnit.  line must be the contents of the .debug_line
-// section of the corresponding ELF file.
+// TagCompileUnit.  byteOrder and addressSize must match cu's
+// containing object file (e.g. from its elf.Data/elf.Class or
+// macho.Cpu); addressSize is only used for versions before DWARF5,
+// which carry their own address_size in the line table header itself.
+// line must be the contents of the .debug_line section of the
+// corresponding object file.  debugStr and debugLineStr must be the
+// contents of the .debug_str and .debug_line_str sections,
+// respectively; they're only needed to resolve file and directory
+// names in a DWARF5 line table header and may be passed as nil for an
+// older-version line table.
 //
 // If this compilation unit has no line table, this returns nil, nil.
-func NewLineReader(cu *dwarf.Entry, line []byte) (*LineReader, error) {
+func NewLineReader(cu *dwarf.Entry, byteOrder binary.ByteOrder, addressSize int, line, debugStr, debugLineStr []byte) (*LineReader, error) {
 	off, ok := cu.Val(dwarf.AttrStmtList).(int64)
 	if !ok {
 		// cu has no line table
@@ -86,24 +143,39 @@ func NewLineReader(cu *dwarf.Entry, line []byte) (*LineReader, error) {
 		off = int64(len(line))
 	}
 
-	// TODO: Use correct byte order and format.  The dwarf package
-	// hides this information and it's annoying to dig out
-	// ourselves.
-	buf := makeBuf(nil, binary.LittleEndian, dwarf64Format{}, "line", dwarf.Offset(off), line[off:])
+	// The format (32/64-bit DWARF, address size) isn't known until
+	// readPrologue decodes the unit length and, for DWARF5, the
+	// header's address_size field, so start with a zero-value
+	// lineFormat and let readPrologue fill it in.
+	buf := makeBuf(nil, byteOrder, lineFormat{}, "line", dwarf.Offset(off), line[off:])
 
-	// Compilation directory is implicitly directories[0]
-	r := &LineReader{buf: buf, directories: []string{compDir}}
+	r := &LineReader{buf: buf, section: line, compDir: compDir, addressSize: addressSize, debugStr: debugStr, debugLineStr: debugLineStr}
 
 	// Read the prologue/header and initialize the state machine
 	if err := r.readPrologue(); err != nil {
 		return nil, err
 	}
 
-	// Initialize statement program state
+	// In DWARF2-4, file index 0 is reserved (file numbering starts
+	// at 1); in DWARF5, file index 0 is the primary source file for
+	// the compilation unit, just like every other index.
+	r.initialFileIndex = 1
+	if r.version >= 5 {
+		r.initialFileIndex = 0
+	}
+
+	r.resetState()
+
+	return r, nil
+}
+
+// resetState resets r.state to the default statement program
+// register values [DWARF4 6.2.2], leaving the buffer position alone.
+func (r *LineReader) resetState() {
 	r.state = LineEntry{
 		Address:       0,
 		OpIndex:       0,
-		FileIndex:     1,
+		FileIndex:     r.initialFileIndex,
 		FileEntry:     nil,
 		Line:          1,
 		Column:        0,
@@ -115,26 +187,156 @@ func NewLineReader(cu *dwarf.Entry, line []byte) (*LineReader, error) {
 		Discriminator: 0,
 	}
 	r.updateFileEntry()
+}
 
-	return r, nil
+// Reset repositions the reader at the beginning of the statement
+// program for this compilation unit, as if it had just been returned
+// by NewLineReader.
+func (r *LineReader) Reset() {
+	r.buf.off = r.programOffset
+	r.buf.data = r.section[r.buf.off:r.endOffset]
+	r.buf.err = nil
+	r.resetState()
+}
+
+// Seek repositions the reader at section offset off, which must be
+// the Offset of a LineEntry previously returned by Next, and resets
+// the statement program registers to their default values, as at the
+// start of a new sequence.
+//
+// Seek only reconstructs correct state when off is the Offset of an
+// EndSequence entry (or, equivalently, the start of this line table):
+// those are the only points where the real DWARF state machine itself
+// starts from the default registers. Seeking to an arbitrary
+// mid-sequence offset will produce a reader whose registers don't
+// match what the opcodes there expect.
+func (r *LineReader) Seek(off dwarf.Offset) {
+	r.buf.off = off
+	r.buf.data = r.section[r.buf.off:r.endOffset]
+	r.buf.err = nil
+	r.resetState()
+}
+
+// pos captures enough of the reader's internal state to resume
+// reading later without losing the accumulated statement program
+// registers the way the public Seek does. It's used internally by
+// SeekPC to back up to the row preceding an overshoot.
+type pos struct {
+	off       dwarf.Offset
+	state     LineEntry
+	fileCount int
+}
+
+func (r *LineReader) tell() pos {
+	return pos{r.buf.off, r.state, len(r.fileEntries)}
+}
+
+func (r *LineReader) seekPos(p pos) {
+	r.buf.off = p.off
+	r.buf.data = r.section[r.buf.off:r.endOffset]
+	r.buf.err = nil
+	r.fileEntries = r.fileEntries[:p.fileCount]
+	r.state = p.state
+}
+
+// ErrUnknownPC is returned by SeekPC when pc is not covered by any
+// row of this line table.
+var ErrUnknownPC = errors.New("dwarfx: pc not found in line table")
+
+// SeekPC sets *entry to the row that covers pc: the row r such that
+// r.Address <= pc and pc < the Address of the next row (or pc is
+// before EndSequence of the sequence containing r). It leaves the
+// reader positioned so that a subsequent Next call returns the row
+// after *entry.
+//
+// If pc precedes the reader's current row, SeekPC first calls Reset
+// and scans from the beginning. If pc isn't covered by any row in
+// this line table — it falls in a gap between sequences, or past the
+// last EndSequence — SeekPC returns ErrUnknownPC.
+func (r *LineReader) SeekPC(pc uint64, entry *LineEntry) error {
+	if pc < r.state.Address {
+		r.Reset()
+	}
+
+	cur, err := r.Next()
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		return ErrUnknownPC
+	}
+	if cur.Address > pc {
+		// We started past pc; there's nothing earlier to find.
+		r.Reset()
+		cur, err = r.Next()
+		if err != nil {
+			return err
+		}
+		if cur == nil || cur.Address > pc {
+			return ErrUnknownPC
+		}
+	}
+
+	// Scan forward until we pass pc, then back up to cur.
+	for {
+		p := r.tell()
+		next, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if next == nil || next.Address > pc {
+			if cur.EndSequence {
+				// pc falls in a gap after the end of a sequence.
+				return ErrUnknownPC
+			}
+			*entry = *cur
+			r.seekPos(p)
+			return nil
+		}
+		cur = next
+	}
 }
 
 // readPrologue reads the statement program prologue from r.buf.
 func (r *LineReader) readPrologue() error {
 	buf := &r.buf
 
-	// [DWARF2 6.2.4]
+	// [DWARF2 7.4] The initial length field doubles as the 32/64-bit
+	// DWARF format escape: 0xfffffff0-0xffffffff are reserved, and
+	// 0xffffffff specifically means the real length follows as a
+	// uint64.
 	hdrOffset := buf.off
-	totalLength := dwarf.Offset(buf.uint32())
+	is64 := false
+	lengthField := buf.uint32()
+	var totalLength dwarf.Offset
+	if lengthField == 0xffffffff {
+		is64 = true
+		totalLength = dwarf.Offset(buf.uint64())
+	} else {
+		totalLength = dwarf.Offset(lengthField)
+	}
+	r.endOffset = buf.off + totalLength
 	if totalLength < dwarf.Offset(len(buf.data)) {
 		buf.data = buf.data[:totalLength]
 	}
 	r.version = buf.uint16()
-	if buf.err == nil && (r.version < 2 || r.version > 4) {
+	if buf.err == nil && (r.version < 2 || r.version > 5) {
 		return DecodeError{"line", hdrOffset, fmt.Sprintf("unknown line table version %d", r.version)}
 	}
-	prologueLength := dwarf.Offset(buf.uint32())
-	programOffset := buf.off + prologueLength
+	if r.version >= 5 {
+		// [DWARF5 6.2.4]
+		r.addressSize = int(buf.uint8())
+		r.segmentSelectorSize = int(buf.uint8())
+	}
+	buf.format = lineFormat{is64: is64, addressSize: r.addressSize}
+	var prologueLength dwarf.Offset
+	if is64 {
+		prologueLength = dwarf.Offset(buf.uint64())
+	} else {
+		prologueLength = dwarf.Offset(buf.uint32())
+	}
+	r.programOffset = buf.off + prologueLength
+	programOffset := r.programOffset
 	r.minInstructionLength = int(buf.uint8())
 	if r.version >= 4 {
 		// [DWARF4 6.2.4]
@@ -174,32 +376,39 @@ func (r *LineReader) readPrologue() error {
 		}
 	}
 
-	// Include directories table.  The caller already set
-	// directories[0] to the compilation directory.
-	for {
-		directory := buf.string()
-		if buf.err != nil {
-			return buf.err
-		}
-		if len(directory) == 0 {
-			break
+	if r.version >= 5 {
+		if err := r.readDirsAndFiles5(); err != nil {
+			return err
 		}
-		if !path.IsAbs(directory) {
-			// Relative paths are implicitly relative to
-			// the compilation directory.
-			directory = path.Join(r.directories[0], directory)
+	} else {
+		// Include directories table.  directories[0] is
+		// implicitly the compilation directory.
+		r.directories = []string{r.compDir}
+		for {
+			directory := buf.string()
+			if buf.err != nil {
+				return buf.err
+			}
+			if len(directory) == 0 {
+				break
+			}
+			if !path.IsAbs(directory) {
+				// Relative paths are implicitly relative to
+				// the compilation directory.
+				directory = path.Join(r.directories[0], directory)
+			}
+			r.directories = append(r.directories, directory)
 		}
-		r.directories = append(r.directories, directory)
-	}
 
-	// File name list.  File numbering starts with 1, so leave the
-	// first entry nil.
-	r.fileEntries = make([]*FileEntry, 1)
-	for {
-		if done, err := r.readFileEntry(); err != nil {
-			return err
-		} else if done {
-			break
+		// File name list.  File numbering starts with 1, so leave the
+		// first entry nil.
+		r.fileEntries = make([]*FileEntry, 1)
+		for {
+			if done, err := r.readFileEntry(); err != nil {
+				return err
+			} else if done {
+				break
+			}
 		}
 	}
 
@@ -231,7 +440,7 @@ func (r *LineReader) readFileEntry() (bool, error) {
 	mtime := r.buf.uint()
 	length := int(r.buf.uint())
 
-	r.fileEntries = append(r.fileEntries, &FileEntry{name, mtime, length})
+	r.fileEntries = append(r.fileEntries, &FileEntry{FileName: name, Mtime: mtime, Length: length})
 	return false, nil
 }
 
@@ -291,6 +500,7 @@ var knownOpcodeLengths = map[int]int{
 // step processes the next opcode and updates r.state.  If the opcode
 // emits a row in the line table, this returns the emitted row.
 func (r *LineReader) step() *LineEntry {
+	opcodeOff := r.buf.off
 	opcode := int(r.buf.uint8())
 
 	if opcode >= r.opcodeBase {
@@ -314,7 +524,7 @@ func (r *LineReader) step() *LineEntry {
 			r.state.EndSequence = true
 
 		case lneSetAddress:
-			r.state.Address = r.buf.addr()
+			r.state.Address = r.truncAddr(r.buf.addr())
 
 		case lneDefineFile:
 			if done, err := r.readFileEntry(); err != nil {
@@ -364,7 +574,7 @@ func (r *LineReader) step() *LineEntry {
 		r.advancePC((255 - r.opcodeBase) / r.lineRange)
 
 	case lnsFixedAdvancePC:
-		r.state.Address += uint64(r.buf.uint16())
+		r.state.Address = r.truncAddr(r.state.Address + uint64(r.buf.uint16()))
 
 	// DWARF3 standard opcodes [DWARF3 6.2.5.2]
 	case lnsSetPrologueEnd:
@@ -387,15 +597,32 @@ func (r *LineReader) step() *LineEntry {
 
 emit:
 	result := r.state
-	r.state.BasicBlock = false
-	r.state.PrologueEnd = false
-	r.state.EpilogueBegin = false
-	r.state.Discriminator = 0
+	result.Offset = opcodeOff
+	if result.EndSequence {
+		// The statement program registers reset to their defaults at
+		// the start of each sequence [DWARF4 6.2.2].
+		r.resetState()
+	} else {
+		r.state.BasicBlock = false
+		r.state.PrologueEnd = false
+		r.state.EpilogueBegin = false
+		r.state.Discriminator = 0
+	}
 	return &result
 }
 
 func (r *LineReader) advancePC(opAdvance int) {
 	opIndex := r.state.OpIndex + opAdvance
-	r.state.Address += uint64(r.minInstructionLength * (opIndex / r.maxOpsPerInstruction))
+	r.state.Address = r.truncAddr(r.state.Address + uint64(r.minInstructionLength*(opIndex/r.maxOpsPerInstruction)))
 	r.state.OpIndex = opIndex % r.maxOpsPerInstruction
 }
+
+// truncAddr truncates addr to the target's address width, so PC
+// arithmetic doesn't carry into bits above the address size of a
+// 32-bit target.
+func (r *LineReader) truncAddr(addr uint64) uint64 {
+	if r.addressSize <= 0 || r.addressSize >= 8 {
+		return addr
+	}
+	return addr & (uint64(1)<<(uint(r.addressSize)*8) - 1)
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dwarfx
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"path"
+)
+
+// entryFormat describes one (content_type_code, form_code) pair from a
+// DWARF5 directory_entry_format or file_name_entry_format table
+// [DWARF5 6.2.4.1].
+type entryFormat struct {
+	contentType uint64
+	form        uint64
+}
+
+// readEntryFormat reads a DWARF5 *_entry_format table: a count byte
+// followed by that many (content_type_code, form_code) ULEB128 pairs.
+func (r *LineReader) readEntryFormat() []entryFormat {
+	count := int(r.buf.uint8())
+	formats := make([]entryFormat, count)
+	for i := range formats {
+		formats[i] = entryFormat{r.buf.uint(), r.buf.uint()}
+	}
+	return formats
+}
+
+// readDirsAndFiles5 reads the DWARF5 directory and file name tables:
+// a directory_entry_format/file_name_entry_format descriptor followed
+// by a ULEB128 count and that many entries, each encoded according to
+// the descriptor [DWARF5 6.2.4.1].
+func (r *LineReader) readDirsAndFiles5() error {
+	dirFormat := r.readEntryFormat()
+	dirCount := int(r.buf.uint())
+	r.directories = make([]string, dirCount)
+	for i := range r.directories {
+		dir, _, _, _, _, err := r.readFormattedEntry(dirFormat)
+		if err != nil {
+			return err
+		}
+		r.directories[i] = dir
+	}
+
+	fileFormat := r.readEntryFormat()
+	fileCount := int(r.buf.uint())
+	r.fileEntries = make([]*FileEntry, fileCount)
+	for i := range r.fileEntries {
+		name, dirIndex, mtime, length, md5, err := r.readFormattedEntry(fileFormat)
+		if err != nil {
+			return err
+		}
+		if !path.IsAbs(name) && dirIndex < len(r.directories) {
+			name = path.Join(r.directories[dirIndex], name)
+		}
+		entry := &FileEntry{FileName: name, Mtime: mtime, Length: length}
+		if md5 != nil {
+			entry.HasMD5 = true
+			copy(entry.MD5[:], md5)
+		}
+		r.fileEntries[i] = entry
+	}
+
+	if r.buf.err != nil {
+		return r.buf.err
+	}
+	return nil
+}
+
+// readFormattedEntry reads one row of a DWARF5 directories or
+// file_names table according to format, extracting the fields that
+// FileEntry (and directory resolution) cares about. md5 is nil unless
+// the row carries a DW_LNCT_MD5 field.
+func (r *LineReader) readFormattedEntry(format []entryFormat) (name string, dirIndex int, mtime uint64, length int, md5 []byte, err error) {
+	for _, f := range format {
+		val := r.readFormValue(f.form)
+		if r.buf.err != nil {
+			return "", 0, 0, 0, nil, r.buf.err
+		}
+		switch f.contentType {
+		case lnctPath:
+			name, _ = val.(string)
+		case lnctDirectoryIndex:
+			if v, ok := val.(uint64); ok {
+				dirIndex = int(v)
+			}
+		case lnctTimestamp:
+			mtime, _ = val.(uint64)
+		case lnctSize:
+			if v, ok := val.(uint64); ok {
+				length = int(v)
+			}
+		case lnctMD5:
+			md5, _ = val.([]byte)
+		}
+	}
+	return name, dirIndex, mtime, length, md5, nil
+}
+
+// readFormValue reads a single value encoded with the given DW_FORM
+// code, as used in a DWARF5 line table header's directory and file
+// name tables [DWARF5 7.5.6]. It returns a string, a uint64, or a
+// []byte (for DW_FORM_data16 and DW_FORM_block), depending on form.
+func (r *LineReader) readFormValue(form uint64) interface{} {
+	buf := &r.buf
+	switch form {
+	case formString:
+		return buf.string()
+	case formStrp:
+		return r.lookupStr(r.debugStr, r.readSecOffset())
+	case formLineStrp:
+		return r.lookupStr(r.debugLineStr, r.readSecOffset())
+	case formUdata:
+		return buf.uint()
+	case formData1:
+		return uint64(buf.uint8())
+	case formData2:
+		return uint64(buf.uint16())
+	case formData4:
+		return uint64(buf.uint32())
+	case formData8:
+		return buf.uint64()
+	case formData16:
+		return buf.bytes(16)
+	case formBlock:
+		n := buf.uint()
+		return buf.bytes(int(n))
+	default:
+		buf.err = DecodeError{"line", buf.off, fmt.Sprintf("unsupported form %#x in line table header", form)}
+		return nil
+	}
+}
+
+// readSecOffset reads a section offset (as used by DW_FORM_strp and
+// DW_FORM_line_strp), which is 4 bytes in 32-bit DWARF and 8 bytes in
+// 64-bit DWARF.
+func (r *LineReader) readSecOffset() dwarf.Offset {
+	if is64, _ := r.buf.format.dwarf64(); is64 {
+		return dwarf.Offset(r.buf.uint64())
+	}
+	return dwarf.Offset(r.buf.uint32())
+}
+
+// lookupStr reads a NUL-terminated string out of sec at offset off.
+// sec is typically the .debug_str or .debug_line_str section,
+// depending on which form referenced it.
+func (r *LineReader) lookupStr(sec []byte, off dwarf.Offset) string {
+	if sec == nil || int(off) > len(sec) {
+		r.buf.err = DecodeError{"line", r.buf.off, "string offset out of range"}
+		return ""
+	}
+	end := int(off)
+	for end < len(sec) && sec[end] != 0 {
+		end++
+	}
+	return string(sec[off:end])
+}
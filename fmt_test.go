@@ -1,53 +1,69 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/format"
 	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/aclements/go-perf/internal/bitstringer"
 )
 
 // TestGofmt tests that all files are formatted.
+//
+// This runs go/format.Source in-process rather than shelling out to
+// the gofmt binary, so it works in sandboxes with no PATH and no
+// writable temp directory for "go build".
 func TestGofmt(t *testing.T) {
-	root, fileMap := copyTree(t)
+	_, fileMap := copyTree(t)
 
-	gofmt := exec.Command("gofmt", "-w", ".")
-	gofmt.Dir = root
-	gofmt.Stdout, gofmt.Stderr = os.Stdout, os.Stderr
-	if err := gofmt.Run(); err != nil {
-		t.Fatalf("gofmt failed: %v", err)
+	diffs := false
+	for orig, copy := range fileMap {
+		if filepath.Ext(orig) != ".go" {
+			continue
+		}
+		src, err := os.ReadFile(copy)
+		if err != nil {
+			t.Fatalf("reading %s: %v", copy, err)
+		}
+		formatted, err := format.Source(src)
+		if err != nil {
+			t.Errorf("%s: %v", orig, err)
+			continue
+		}
+		if !bytes.Equal(src, formatted) {
+			t.Errorf("%s is not gofmt clean:\n%s", orig, unifiedDiff(orig, orig+" (gofmt)", src, formatted))
+			diffs = true
+		}
 	}
-
-	// Diff the trees.
-	if diffFiles(t, fileMap) {
+	if diffs {
 		t.Errorf("Files are not gofmt clean. Please run gofmt.")
 	}
 }
 
-// TestGenerated tests that all generated files are up-to-date.
+// TestGenerated tests that all bitstringer-generated files are
+// up-to-date, by calling the bitstringer generator directly as a
+// library rather than running "go generate" (which requires building
+// and exec'ing the bitstringer command).
 func TestGenerated(t *testing.T) {
 	root, fileMap := copyTree(t)
 
-	// Build bitstringer
-	build := exec.Command("go", "build")
-	build.Dir = filepath.Join(root, "cmd/bitstringer")
-	build.Stdout, build.Stderr = os.Stdout, os.Stderr
-	if err := build.Run(); err != nil {
-		t.Fatalf("go build failed: %v", err)
+	dirs, err := findBitstringerDirectives(root)
+	if err != nil {
+		t.Fatalf("scanning for go:generate directives: %v", err)
 	}
 
-	gen := exec.Command("go", "generate", "./...")
-	gen.Dir = root
-	gen.Stdout, gen.Stderr = os.Stdout, os.Stderr
-	if err := gen.Run(); err != nil {
-		t.Fatalf("go generate failed: %v", err)
+	for _, d := range dirs {
+		if err := bitstringer.GenTypes(d.Dir, d.Types, d.Strip, d.Composites); err != nil {
+			t.Errorf("regenerating %s in %s: %v", strings.Join(d.Types, ","), d.Dir, err)
+		}
 	}
 
-	// Diff the trees.
 	if diffFiles(t, fileMap) {
 		t.Errorf("Please run go generate.")
 	}
@@ -122,20 +138,145 @@ func copyFile(src, dst string) error {
 
 func diffFiles(t *testing.T, fileMap map[string]string) bool {
 	diffs := 0
-	for orig, new := range fileMap {
-		diff := exec.Command("diff", "-u", orig, new)
-		diff.Stdout = os.Stdout
-		diff.Stderr = os.Stderr
-		if err := diff.Run(); err != nil {
-			switch err := err.(type) {
-			case *exec.ExitError:
-				if err.ExitCode() == 1 {
-					diffs++
-					continue
+	for orig, copy := range fileMap {
+		origSrc, err := os.ReadFile(orig)
+		if err != nil {
+			t.Fatalf("reading %s: %v", orig, err)
+		}
+		copySrc, err := os.ReadFile(copy)
+		if err != nil {
+			t.Fatalf("reading %s: %v", copy, err)
+		}
+		if !bytes.Equal(origSrc, copySrc) {
+			t.Errorf("%s differs from regenerated output:\n%s", orig, unifiedDiff(orig, copy, origSrc, copySrc))
+			diffs++
+		}
+	}
+	return diffs != 0
+}
+
+// bitstringerDirective is a single "//go:generate bitstringer ..." (or
+// the equivalent "go run .../bitstringer" form) directive found by
+// findBitstringerDirectives.
+type bitstringerDirective struct {
+	Dir        string
+	Types      []string
+	Strip      string
+	Composites string
+}
+
+// findBitstringerDirectives scans every .go file under root for
+// go:generate directives that invoke bitstringer (either via the
+// "-command bitstringer" alias or directly via "go run
+// .../bitstringer/main.go"), and returns one bitstringerDirective per
+// "-type=" they request.
+//
+// It doesn't attempt to handle directives that invoke the unrelated
+// "stringer" tool, or bitstringer's -cheader mode, since nothing in
+// this tree currently uses either via go:generate.
+func findBitstringerDirectives(root string) ([]bitstringerDirective, error) {
+	var dirs []bitstringerDirective
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(d.Name()) != ".go" {
+			return nil
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(src), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "//go:generate ") {
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(line, "//go:generate "))
+			switch {
+			case len(fields) >= 1 && fields[0] == "bitstringer":
+				fields = fields[1:]
+			case len(fields) >= 3 && fields[0] == "go" && fields[1] == "run" && strings.Contains(fields[2], "bitstringer"):
+				fields = fields[3:]
+			default:
+				continue
+			}
+
+			d := bitstringerDirective{Dir: filepath.Dir(path), Composites: "off"}
+			var cheader bool
+			for _, f := range fields {
+				switch {
+				case strings.HasPrefix(f, "-type="):
+					d.Types = strings.Split(strings.TrimPrefix(f, "-type="), ",")
+				case strings.HasPrefix(f, "-strip="):
+					d.Strip = strings.TrimPrefix(f, "-strip=")
+				case strings.HasPrefix(f, "-composites="):
+					d.Composites = strings.TrimPrefix(f, "-composites=")
+				case strings.HasPrefix(f, "-cheader="):
+					cheader = true
 				}
 			}
-			t.Errorf("diff failed: %v", err)
+			if cheader || len(d.Types) == 0 {
+				continue
+			}
+			dirs = append(dirs, d)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// unifiedDiff renders a small in-tree unified diff between a and b,
+// labeled aName and bName, for use in test failure output. It isn't
+// meant to be a complete diff implementation -- just readable enough
+// to show what gofmt or bitstringer would change.
+func unifiedDiff(aName, bName string, a, b []byte) string {
+	aLines := strings.SplitAfter(string(a), "\n")
+	bLines := strings.SplitAfter(string(b), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// aLines[i:] and bLines[j:].
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
 		}
 	}
-	return diffs != 0
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&out, "+%s", ensureNL(bLines[j]))
+			j++
+		default:
+			fmt.Fprintf(&out, "-%s", ensureNL(aLines[i]))
+			i++
+		}
+	}
+	return out.String()
+}
+
+// ensureNL appends a trailing newline to line if it doesn't already
+// have one, which only happens for the last line of a file that
+// itself doesn't end in a newline.
+func ensureNL(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
 }
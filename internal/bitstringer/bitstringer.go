@@ -0,0 +1,352 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bitstringer implements the code generator behind the
+// bitstringer command, so it can also be driven as a library (for
+// example, by tests that want to check generated output is
+// up-to-date without shelling out to `go generate`).
+package bitstringer
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aclements/go-perf/internal/cparse"
+)
+
+// ValidComposites reports whether mode is a valid -composites value.
+func ValidComposites(mode string) bool {
+	switch mode {
+	case "off", "prefer", "only":
+		return true
+	}
+	return false
+}
+
+// GenTypes type-checks the Go package in dir and writes a
+// "<lowercase type>_string.go" file into dir for each of typeNames,
+// each containing a bit-mask String method for that type's
+// constants, as if bitstringer -type=<typeNames> had been run with
+// dir as the working directory.
+func GenTypes(dir string, typeNames []string, strip, compositesMode string) error {
+	if !ValidComposites(compositesMode) {
+		return fmt.Errorf("invalid -composites value %q: must be off, prefer, or only", compositesMode)
+	}
+
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return fmt.Errorf("importing %s: %v", dir, err)
+	}
+
+	paths := prefixDirectory(pkg.Dir, pkg.GoFiles)
+
+	// Parse source files.
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, path := range paths {
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return fmt.Errorf("parsing file %s: %v", path, err)
+		}
+		files = append(files, f)
+	}
+
+	// Type check.
+	conf := types.Config{Importer: importer.Default(), FakeImportC: true}
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+	}
+	typesPkg, err := conf.Check(pkg.ImportPath, fset, files, info)
+	if err != nil {
+		return fmt.Errorf("checking package: %v", err)
+	}
+	scope := typesPkg.Scope()
+
+	// Find the requested Types.
+	name2Type := map[string]types.Type{}
+	consts := map[types.Type][]bitConst{}
+	for _, name := range typeNames {
+		tname, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			return fmt.Errorf("unknown type %q", name)
+		}
+		// Check that it's integral.
+		utype := tname.Type().Underlying()
+		if utype, ok := utype.(*types.Basic); !ok || utype.Info()&types.IsInteger == 0 {
+			return fmt.Errorf("type %q is not an integer type", name)
+		}
+		name2Type[name] = tname.Type()
+		consts[tname.Type()] = nil
+	}
+
+	// Find all constants with each Type.
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		cobj, ok := obj.(*types.Const)
+		if !ok {
+			continue
+		}
+		constList, ok := consts[cobj.Type()]
+		if !ok {
+			continue
+		}
+		constList = append(constList, cobj)
+		consts[cobj.Type()] = constList
+	}
+
+	// Construct String methods.
+	for _, name := range typeNames {
+		fname := filepath.Join(dir, strings.ToLower(name)+"_string.go")
+		f, err := os.Create(fname)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %v", fname, err)
+		}
+		typ := name2Type[name]
+		writeStringer(f, pkg.Name, name, strip, compositesMode, consts[typ])
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error writing %s: %v", fname, err)
+		}
+	}
+	return nil
+}
+
+func prefixDirectory(dir string, names []string) []string {
+	if dir == "." {
+		return names
+	}
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = filepath.Join(dir, name)
+	}
+	return out
+}
+
+// bitConst is the subset of *types.Const that writeStringMethod
+// needs. *types.Const satisfies it directly; headerConst adapts a
+// constant synthesized from a C header (see GenFromCHeader) to it, so
+// both can drive the same String method generator.
+type bitConst interface {
+	Name() string
+	Val() constant.Value
+}
+
+func writeStringer(w io.Writer, pkg, tname, prefix, compositesMode string, consts []bitConst) {
+	if len(consts) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: no consts for type %q\n", tname)
+	}
+
+	fmt.Fprintf(w, `// Code generated by "bitstringer -type=%s"; DO NOT EDIT
+
+package %s
+
+import "strconv"
+
+`, tname, pkg)
+	writeStringMethod(w, tname, prefix, compositesMode, consts)
+}
+
+// writeStringMethod writes the bit-mask String method itself (just
+// the func, not the surrounding package clause and imports), shared
+// by both writeStringer and writeHeaderType.
+func writeStringMethod(w io.Writer, tname, prefix, compositesMode string, consts []bitConst) {
+	fmt.Fprintf(w, "func (i %s) String() string {\n", tname)
+
+	strip := func(s string) string {
+		return strings.TrimPrefix(s, prefix)
+	}
+
+	// Find and format any zero value.
+	zero := constant.MakeInt64(0)
+	zlabel := "0"
+	for _, c := range consts {
+		val := c.Val()
+		if constant.Compare(val, token.EQL, zero) {
+			// Format it.
+			zlabel = strip(c.Name())
+			break
+		}
+	}
+	fmt.Fprintf(w, "\tif i == 0 {\n\t\treturn %q\n\t}\n", zlabel)
+
+	fmt.Fprintf(w, "\ts := \"\"\n")
+
+	if compositesMode == "off" {
+		// The classic algorithm: walk consts in declaration order,
+		// matching any non-zero value that contributes a bit we
+		// haven't already matched. This silently drops composites
+		// like ReadWrite = Read|Write once Read and Write have both
+		// been matched, which is why -composites=prefer exists.
+		have := constant.MakeInt64(0)
+		for _, c := range consts {
+			have2 := constant.BinaryOp(have, token.OR, c.Val())
+			if constant.Compare(have, token.EQL, have2) {
+				continue
+			}
+			have = have2
+			fmt.Fprintf(w, "\tif i&%s != 0 {\n\t\ts += %q\n\t}\n", c.Name(), strip(c.Name())+"|")
+		}
+		fmt.Fprintf(w, `	i &^= %s
+	if i == 0 {
+		return s[:len(s)-1]
+	}
+	return s + "0x" + strconv.FormatUint(uint64(i), 16)
+}
+`, have.ExactString())
+		return
+	}
+
+	// Partition the non-zero consts into atoms (a single bit) and
+	// composites (more than one bit, like ReadWrite = Read|Write).
+	var atoms, composites []bitConst
+	for _, c := range consts {
+		v, ok := constant.Uint64Val(c.Val())
+		if !ok || v == 0 {
+			continue
+		}
+		if bits.OnesCount64(v) == 1 {
+			atoms = append(atoms, c)
+		} else {
+			composites = append(composites, c)
+		}
+	}
+
+	// Match composites first, longest (most bits) before shortest, so
+	// e.g. ReadWrite is preferred over Read|Write and a three-bit
+	// composite is preferred over a two-bit one it contains. Ties
+	// keep declaration order.
+	sort.SliceStable(composites, func(i, j int) bool {
+		vi, _ := constant.Uint64Val(composites[i].Val())
+		vj, _ := constant.Uint64Val(composites[j].Val())
+		return bits.OnesCount64(vi) > bits.OnesCount64(vj)
+	})
+	for _, c := range composites {
+		fmt.Fprintf(w, "\tif i&%s == %s {\n\t\ts += %q\n\t\ti &^= %s\n\t}\n", c.Name(), c.Name(), strip(c.Name())+"|", c.Name())
+	}
+
+	if compositesMode == "prefer" {
+		have := constant.MakeInt64(0)
+		for _, c := range atoms {
+			have2 := constant.BinaryOp(have, token.OR, c.Val())
+			if constant.Compare(have, token.EQL, have2) {
+				continue
+			}
+			have = have2
+			fmt.Fprintf(w, "\tif i&%s != 0 {\n\t\ts += %q\n\t}\n", c.Name(), strip(c.Name())+"|")
+		}
+	}
+
+	// Handle any left-over bits.
+	fmt.Fprintf(w, `	if i == 0 {
+		return s[:len(s)-1]
+	}
+	return s + "0x" + strconv.FormatUint(uint64(i), 16)
+}
+`)
+}
+
+// headerConst adapts an enumerator extracted from a C header (see
+// GenFromCHeader) to the bitConst interface, standing in for a
+// *types.Const when there's no type-checked Go package to read
+// values from.
+type headerConst struct {
+	name string
+	val  constant.Value
+}
+
+func (c headerConst) Name() string        { return c.name }
+func (c headerConst) Val() constant.Value { return c.val }
+
+// GenFromCHeader reads the enumerators tagged ctag out of the C
+// header at headerPath, and writes a synthesized Go type named
+// tname, its constants, and its bit-mask String method to
+// "<strings.ToLower(tname)>_string.go" in dir, in package pkg.
+func GenFromCHeader(dir, pkg, headerPath, ctag, tname, prefix, compositesMode, ccflags string) error {
+	if ctag == "" {
+		return fmt.Errorf("-ctag is required with -cheader")
+	}
+	if tname == "" || strings.Contains(tname, ",") {
+		return fmt.Errorf("-type must name exactly one type with -cheader")
+	}
+	if !ValidComposites(compositesMode) {
+		return fmt.Errorf("invalid -composites value %q: must be off, prefer, or only", compositesMode)
+	}
+
+	hdir, base := filepath.Split(headerPath)
+	env := cparse.BuildEnv{CCArgs: strings.Fields(ccflags)}
+	if hdir != "" {
+		env.CCArgs = append(env.CCArgs, "-I"+filepath.Clean(hdir))
+	}
+	pp, err := cparse.Preprocess(&env, strings.NewReader(fmt.Sprintf("#include %q\n", base)))
+	if err != nil {
+		return fmt.Errorf("preprocessing %s: %v", headerPath, err)
+	}
+	toks, err := cparse.Tokenize(pp)
+	if err != nil {
+		return fmt.Errorf("tokenizing %s: %v", headerPath, err)
+	}
+	allEnums, err := cparse.FindEnums(toks)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", headerPath, err)
+	}
+
+	var consts []bitConst
+	for _, e := range allEnums {
+		if e.Tag.Text != ctag {
+			continue
+		}
+		if e.Int == nil {
+			return fmt.Errorf("%s: %s has no resolvable value", headerPath, e.Ident.Text)
+		}
+		if e.Int.Sign() < 0 {
+			return fmt.Errorf("%s: %s is negative, which doesn't fit %s", headerPath, e.Ident.Text, tname)
+		}
+		consts = append(consts, headerConst{e.Ident.Text, constant.Make(e.Int)})
+	}
+	if len(consts) == 0 {
+		return fmt.Errorf("no enumerators tagged %q in %s", ctag, headerPath)
+	}
+
+	fname := filepath.Join(dir, strings.ToLower(tname)+"_string.go")
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", fname, err)
+	}
+	writeHeaderType(f, pkg, tname, prefix, compositesMode, consts)
+	return f.Close()
+}
+
+// writeHeaderType writes the Go mirror of a C enum synthesized from
+// GenFromCHeader: a "type tname uint64" declaration, one constant per
+// enumerator, and the same bit-mask String method writeStringer
+// would produce for a hand-written version of the same type.
+func writeHeaderType(w io.Writer, pkg, tname, prefix, compositesMode string, consts []bitConst) {
+	fmt.Fprintf(w, `// Code generated by "bitstringer -type=%s -cheader"; DO NOT EDIT
+
+package %s
+
+import "strconv"
+
+type %s uint64
+
+const (
+`, tname, pkg, tname)
+	for _, c := range consts {
+		v, _ := constant.Uint64Val(c.Val())
+		fmt.Fprintf(w, "\t%s %s = %#x\n", c.Name(), tname, v)
+	}
+	fmt.Fprintf(w, ")\n\n")
+	writeStringMethod(w, tname, prefix, compositesMode, consts)
+}
@@ -0,0 +1,365 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cparse
+
+import (
+	"go/token"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Directive describes a preprocessor directive found by
+// ScanDirectives.
+type Directive struct {
+	// Name is the macro name defined by this directive.
+	Name string
+	Pos  token.Position
+}
+
+// condFrame tracks the state of one level of #if/#ifdef/#ifndef
+// nesting.
+type condFrame struct {
+	parentActive bool // whether the enclosing context is active
+	active       bool // whether this branch is currently active
+	taken        bool // whether some branch of this chain has already been taken
+}
+
+// ScanDirectives performs a small, standalone scan of the
+// un-preprocessed C source in r and returns the #define directives
+// it finds, in the order they appear in the source. Unlike
+// FindMacros, which asks the C compiler to preprocess and dump
+// macros (in an order that need not match the source), ScanDirectives
+// never invokes cc, so its output order always matches the source.
+//
+// ScanDirectives folds line continuations and strips block and line
+// comments, and it understands #if/#ifdef/#ifndef/#elif/#else/#endif
+// well enough to skip directives in inactive branches, analogous to
+// how cmd/asm/internal/lex handles conditional assembly. Its
+// handling of #if/#elif expressions is intentionally simple: only
+// defined(NAME), !, &&, || and parentheses are understood; anything
+// else is assumed to be true.
+func ScanDirectives(env *BuildEnv, r io.Reader) ([]Directive, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	folded, lineOf := foldContinuations(src)
+	stripComments(folded)
+
+	defined := map[string]bool{}
+	var stack []condFrame
+	var dirs []Directive
+
+	active := func() bool {
+		return len(stack) == 0 || stack[len(stack)-1].active
+	}
+
+	start := 0
+	for start <= len(folded) {
+		end := start
+		for end < len(folded) && folded[end] != '\n' {
+			end++
+		}
+		line := folded[start:end]
+		lineNo := 0
+		if start < len(lineOf) {
+			lineNo = lineOf[start]
+		} else if len(lineOf) > 0 {
+			lineNo = lineOf[len(lineOf)-1]
+		}
+
+		if word, body, col, ok := parseDirectiveLine(line); ok {
+			switch word {
+			case "ifdef", "ifndef", "if":
+				parentActive := active()
+				cond := false
+				if parentActive {
+					cond = evalCond(word, body, defined)
+				}
+				stack = append(stack, condFrame{parentActive, parentActive && cond, parentActive && cond})
+			case "elif":
+				if len(stack) > 0 {
+					top := &stack[len(stack)-1]
+					if top.taken || !top.parentActive {
+						top.active = false
+					} else {
+						top.active = evalCond("if", body, defined)
+						top.taken = top.taken || top.active
+					}
+				}
+			case "else":
+				if len(stack) > 0 {
+					top := &stack[len(stack)-1]
+					top.active = top.parentActive && !top.taken
+					top.taken = true
+				}
+			case "endif":
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+			case "define":
+				if active() {
+					if name, _ := splitIdent(body); name != "" {
+						defined[name] = true
+						dirs = append(dirs, Directive{
+							Name: name,
+							Pos:  token.Position{Line: lineNo, Column: col},
+						})
+					}
+				}
+			case "undef":
+				if active() {
+					if name, _ := splitIdent(body); name != "" {
+						delete(defined, name)
+					}
+				}
+			}
+		}
+
+		start = end + 1
+	}
+
+	return dirs, nil
+}
+
+// foldContinuations deletes "\\\n" sequences from src, the same as
+// the first two translation phases charReader implements for
+// Tokenize. It returns the folded source along with, for each byte
+// of the result, the 1-based line number of that byte in src.
+func foldContinuations(src []byte) (folded []byte, lineOf []int) {
+	line := 1
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\\' && i+1 < len(src) && src[i+1] == '\n' {
+			line++
+			i++
+			continue
+		}
+		folded = append(folded, src[i])
+		lineOf = append(lineOf, line)
+		if src[i] == '\n' {
+			line++
+		}
+	}
+	return
+}
+
+// stripComments replaces the contents of block and line comments in
+// src with spaces, in place, preserving newlines so line numbers
+// don't shift. It understands string and character literals well
+// enough not to mistake a '/' inside one for the start of a comment.
+func stripComments(src []byte) {
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '*':
+			src[i], src[i+1] = ' ', ' '
+			i += 2
+			for i < len(src) && !(src[i] == '*' && i+1 < len(src) && src[i+1] == '/') {
+				if src[i] != '\n' {
+					src[i] = ' '
+				}
+				i++
+			}
+			if i < len(src) {
+				src[i] = ' '
+			}
+			if i+1 < len(src) {
+				src[i+1] = ' '
+			}
+			i++
+
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				src[i] = ' '
+				i++
+			}
+
+		case src[i] == '"' || src[i] == '\'':
+			term := src[i]
+			i++
+			for i < len(src) && src[i] != term && src[i] != '\n' {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				i++
+			}
+		}
+	}
+}
+
+// parseDirectiveLine checks whether line (a single, comment-free
+// logical line) is a preprocessor directive line. If so, it returns
+// the directive word (e.g., "define"), the rest of the line
+// following the word, and the 1-based column the word starts at.
+func parseDirectiveLine(line []byte) (word, body string, col int, ok bool) {
+	i := 0
+	for i < len(line) && isSpace(line[i]) {
+		i++
+	}
+	if i >= len(line) || line[i] != '#' {
+		return "", "", 0, false
+	}
+	i++
+	for i < len(line) && isSpace(line[i]) {
+		i++
+	}
+	wstart := i
+	for i < len(line) && isIdentByte(line[i]) {
+		i++
+	}
+	word = string(line[wstart:i])
+	switch word {
+	case "define", "undef", "if", "ifdef", "ifndef", "elif", "else", "endif":
+	default:
+		return "", "", 0, false
+	}
+	j := i
+	for j < len(line) && isSpace(line[j]) {
+		j++
+	}
+	return word, string(line[j:]), wstart + 1, true
+}
+
+// evalCond evaluates the condition of an #if/#ifdef/#ifndef/#elif
+// directive whose body is body.
+func evalCond(kind, body string, defined map[string]bool) bool {
+	body = strings.TrimSpace(body)
+	switch kind {
+	case "ifdef":
+		return defined[body]
+	case "ifndef":
+		return !defined[body]
+	default: // "if", "elif"
+		p := &ifExprParser{s: body, defined: defined}
+		return p.parseOr()
+	}
+}
+
+// ifExprParser is a small recursive-descent parser for the subset of
+// #if expressions ScanDirectives understands: defined(NAME) (or
+// defined NAME), !, &&, ||, parentheses, integer literals, and bare
+// identifiers (treated as true if they're a known macro). Anything
+// it can't make sense of is treated as true, erring on the side of
+// not skipping a branch.
+type ifExprParser struct {
+	s       string
+	i       int
+	defined map[string]bool
+}
+
+func (p *ifExprParser) skipSpace() {
+	for p.i < len(p.s) && isSpace(p.s[p.i]) {
+		p.i++
+	}
+}
+
+func (p *ifExprParser) parseOr() bool {
+	v := p.parseAnd()
+	for {
+		p.skipSpace()
+		if strings.HasPrefix(p.s[p.i:], "||") {
+			p.i += 2
+			v = p.parseAnd() || v
+		} else {
+			return v
+		}
+	}
+}
+
+func (p *ifExprParser) parseAnd() bool {
+	v := p.parseUnary()
+	for {
+		p.skipSpace()
+		if strings.HasPrefix(p.s[p.i:], "&&") {
+			p.i += 2
+			v = p.parseUnary() && v
+		} else {
+			return v
+		}
+	}
+}
+
+func (p *ifExprParser) parseUnary() bool {
+	p.skipSpace()
+	if p.i < len(p.s) && p.s[p.i] == '!' {
+		p.i++
+		return !p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *ifExprParser) parsePrimary() bool {
+	p.skipSpace()
+	if p.i < len(p.s) && p.s[p.i] == '(' {
+		p.i++
+		v := p.parseOr()
+		p.skipSpace()
+		if p.i < len(p.s) && p.s[p.i] == ')' {
+			p.i++
+		}
+		return v
+	}
+
+	ident := p.parseIdent()
+	switch {
+	case ident == "":
+		// Couldn't parse anything recognizable (a numeric
+		// expression, a macro call, etc). Be permissive.
+		p.i = len(p.s)
+		return true
+	case ident == "defined":
+		p.skipSpace()
+		paren := p.i < len(p.s) && p.s[p.i] == '('
+		if paren {
+			p.i++
+		}
+		name := p.parseIdent()
+		if paren {
+			p.skipSpace()
+			if p.i < len(p.s) && p.s[p.i] == ')' {
+				p.i++
+			}
+		}
+		return p.defined[name]
+	default:
+		if n, err := strconv.Atoi(ident); err == nil {
+			return n != 0
+		}
+		return p.defined[ident]
+	}
+}
+
+func (p *ifExprParser) parseIdent() string {
+	p.skipSpace()
+	start := p.i
+	for p.i < len(p.s) && isIdentByte(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func isSpace(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func isIdentByte(ch byte) bool {
+	return ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9'
+}
+
+// splitIdent returns the leading identifier of s and the remainder
+// following it.
+func splitIdent(s string) (ident, rest string) {
+	i := 0
+	for i < len(s) && isIdentByte(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -6,16 +6,30 @@ package cparse
 
 import (
 	"fmt"
+	"math/big"
+	"regexp"
 )
 
 type Enum struct {
 	Tag   Tok
 	Ident Tok
+	// Value is the raw initializer tokens following "=", or nil if
+	// this enumerator has no initializer.
+	Value []Tok
+	// Int is Value, best-effort evaluated as an integer constant
+	// expression. It understands integer literals (including
+	// hex/octal and U/L suffixes), references to enumerators
+	// already seen by FindEnums, the C operators <<, |, &, ~, +,
+	// and -, and parentheses. It's nil if Value is empty or if
+	// evaluation failed, for example because Value refers to a
+	// macro FindEnums doesn't know the value of.
+	Int *big.Int
 }
 
 // FindEnums finds top-level enumeration constants in toks.
 func FindEnums(tokens []Tok) ([]Enum, error) {
 	t := toks(tokens)
+	env := map[string]*big.Int{}
 	var enums []Enum
 	for len(t) > 0 {
 		switch {
@@ -37,11 +51,15 @@ func FindEnums(tokens []Tok) ([]Enum, error) {
 					if !ok {
 						return nil, fmt.Errorf("expected identifier")
 					}
-					enums = append(enums, Enum{tag, id})
-					// Consume initializer.
+					e := Enum{Tag: tag, Ident: id}
 					if t.Try(TokOp, "=") {
-						t.SkipBalanced(",", "}")
+						e.Value = t.CaptureBalanced(",", "}")
+						e.Int = evalEnumExpr(e.Value, env)
 					}
+					if e.Int != nil {
+						env[id.Text] = e.Int
+					}
+					enums = append(enums, e)
 					t.Try(TokOp, ",")
 				}
 			}
@@ -51,3 +69,158 @@ func FindEnums(tokens []Tok) ([]Enum, error) {
 	}
 	return enums, nil
 }
+
+// evalEnumExpr evaluates expr as a C integer constant expression,
+// using env to resolve references to previously seen enumerators. It
+// returns nil if expr is empty or if it uses anything evalEnumExpr
+// doesn't understand (such as an unresolved macro).
+func evalEnumExpr(expr []Tok, env map[string]*big.Int) *big.Int {
+	if len(expr) == 0 {
+		return nil
+	}
+	p := &enumExprParser{toks: expr, env: env}
+	v := p.bitOr()
+	if v == nil || len(p.toks) != 0 {
+		// Either evaluation failed, or there are leftover tokens
+		// (e.g. a comma operator) we don't understand.
+		return nil
+	}
+	return v
+}
+
+// enumExprParser is a small recursive-descent parser for the subset
+// of C constant expressions FindEnums can evaluate, following C's
+// usual operator precedence (from loosest to tightest: |, &, <<, +
+// and -, unary operators).
+type enumExprParser struct {
+	toks []Tok
+	env  map[string]*big.Int
+}
+
+func (p *enumExprParser) takeOp(text string) bool {
+	if len(p.toks) > 0 && p.toks[0].Match(TokOp, text) {
+		p.toks = p.toks[1:]
+		return true
+	}
+	return false
+}
+
+func (p *enumExprParser) bitOr() *big.Int {
+	v := p.bitAnd()
+	for v != nil && p.takeOp("|") {
+		rhs := p.bitAnd()
+		if rhs == nil {
+			return nil
+		}
+		v = new(big.Int).Or(v, rhs)
+	}
+	return v
+}
+
+func (p *enumExprParser) bitAnd() *big.Int {
+	v := p.shift()
+	for v != nil && p.takeOp("&") {
+		rhs := p.shift()
+		if rhs == nil {
+			return nil
+		}
+		v = new(big.Int).And(v, rhs)
+	}
+	return v
+}
+
+func (p *enumExprParser) shift() *big.Int {
+	v := p.addSub()
+	for v != nil && p.takeOp("<<") {
+		rhs := p.addSub()
+		if rhs == nil || !rhs.IsUint64() {
+			return nil
+		}
+		v = new(big.Int).Lsh(v, uint(rhs.Uint64()))
+	}
+	return v
+}
+
+func (p *enumExprParser) addSub() *big.Int {
+	v := p.unary()
+	for v != nil {
+		switch {
+		case p.takeOp("+"):
+			rhs := p.unary()
+			if rhs == nil {
+				return nil
+			}
+			v = new(big.Int).Add(v, rhs)
+		case p.takeOp("-"):
+			rhs := p.unary()
+			if rhs == nil {
+				return nil
+			}
+			v = new(big.Int).Sub(v, rhs)
+		default:
+			return v
+		}
+	}
+	return v
+}
+
+func (p *enumExprParser) unary() *big.Int {
+	switch {
+	case p.takeOp("~"):
+		v := p.unary()
+		if v == nil {
+			return nil
+		}
+		return new(big.Int).Not(v)
+	case p.takeOp("-"):
+		v := p.unary()
+		if v == nil {
+			return nil
+		}
+		return new(big.Int).Neg(v)
+	case p.takeOp("+"):
+		return p.unary()
+	default:
+		return p.primary()
+	}
+}
+
+// intSuffix matches the U/L integer suffixes the lexer leaves behind
+// as a separate identifier token immediately after a number (e.g.
+// "1UL" tokenizes as the number "1" followed by the identifier "UL").
+var intSuffix = regexp.MustCompile(`^[uUlL]+$`)
+
+func (p *enumExprParser) primary() *big.Int {
+	if len(p.toks) == 0 {
+		return nil
+	}
+	tok := p.toks[0]
+	switch {
+	case tok.Match(TokOp, "("):
+		p.toks = p.toks[1:]
+		v := p.bitOr()
+		if v == nil || !p.takeOp(")") {
+			return nil
+		}
+		return v
+	case tok.Kind == TokNumber:
+		p.toks = p.toks[1:]
+		v, ok := new(big.Int).SetString(tok.Text, 0)
+		if !ok {
+			return nil
+		}
+		if len(p.toks) > 0 && p.toks[0].Kind == TokIdent && intSuffix.MatchString(p.toks[0].Text) {
+			p.toks = p.toks[1:]
+		}
+		return v
+	case tok.Kind == TokIdent:
+		p.toks = p.toks[1:]
+		v, ok := p.env[tok.Text]
+		if !ok {
+			return nil
+		}
+		return v
+	default:
+		return nil
+	}
+}
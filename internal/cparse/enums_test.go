@@ -5,6 +5,7 @@
 package cparse
 
 import (
+	"math/big"
 	"testing"
 )
 
@@ -28,4 +29,41 @@ func TestFindEnums(t *testing.T) {
 			t.Errorf("expected enum tag.%s, got %v", name, enums[i])
 		}
 	}
+	// A and E have no initializer; B's initializer references C and
+	// D, which aren't enumerators FindEnums can resolve.
+	for i := range enums {
+		if enums[i].Int != nil {
+			t.Errorf("expected enums[%d].Int == nil, got %v", i, enums[i].Int)
+		}
+	}
+	if len(enums[1].Value) == 0 {
+		t.Errorf("expected enums[1].Value to hold B's initializer tokens")
+	}
+}
+
+func TestFindEnumsEval(t *testing.T) {
+	needCC(t)
+
+	pp := preprocess(t, "enum tag { A = 1 << 2, B = 1UL << 3, C = A | B, D = ~A & 0xff, E = C + 1, F = E - A };")
+	toks, err := Tokenize(pp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enums, err := FindEnums(toks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"A": 4, "B": 8, "C": 12, "D": 0xff &^ 4, "E": 13, "F": 9}
+	if len(enums) != len(want) {
+		t.Fatalf("expected %d enums, got %d", len(want), len(enums))
+	}
+	for _, e := range enums {
+		w, ok := want[e.Ident.Text]
+		if !ok {
+			t.Fatalf("unexpected enum %s", e.Ident.Text)
+		}
+		if e.Int == nil || e.Int.Cmp(big.NewInt(w)) != 0 {
+			t.Errorf("%s: expected %d, got %v", e.Ident.Text, w, e.Int)
+		}
+	}
 }
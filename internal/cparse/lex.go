@@ -17,6 +17,12 @@ type Toks struct {
 type Tok struct {
 	Kind TokKind
 	Text string
+	// Line is the 1-based source line this token starts on. Since
+	// Tokenize operates on preprocessed source, and Preprocess
+	// emits "# line file" directives to mark where each chunk of
+	// output came from, Line refers to the original, pre-macro-
+	// expansion source file, not the preprocessed text.
+	Line int
 }
 
 type TokKind uint8
@@ -205,9 +211,9 @@ func Tokenize(src []byte) ([]Tok, error) {
 				buf = append(buf, ch)
 			}
 			if keyTab[string(buf)] {
-				toks = append(toks, Tok{TokKeyword, string(buf)})
+				toks = append(toks, Tok{TokKeyword, string(buf), start.line})
 			} else {
-				toks = append(toks, Tok{TokIdent, string(buf)})
+				toks = append(toks, Tok{TokIdent, string(buf), start.line})
 			}
 
 		case tokTab[ch]&chDigit != 0:
@@ -231,7 +237,7 @@ func Tokenize(src []byte) ([]Tok, error) {
 				}
 				buf = append(buf, ch)
 			}
-			toks = append(toks, Tok{TokNumber, string(buf)})
+			toks = append(toks, Tok{TokNumber, string(buf), start.line})
 
 		case tokTab[ch]&chChars != 0:
 			// Character constant or string literal
@@ -297,9 +303,9 @@ func Tokenize(src []byte) ([]Tok, error) {
 				}
 			}
 			if term == '"' {
-				toks = append(toks, Tok{TokString, string(buf)})
+				toks = append(toks, Tok{TokString, string(buf), start.line})
 			} else {
-				toks = append(toks, Tok{TokChar, string(buf)})
+				toks = append(toks, Tok{TokChar, string(buf), start.line})
 			}
 
 		case tokTab[ch]&chPunct != 0:
@@ -320,7 +326,7 @@ func Tokenize(src []byte) ([]Tok, error) {
 				// Line directive.
 				lineStart, inLine = len(toks), true
 			}
-			toks = append(toks, Tok{TokOp, text})
+			toks = append(toks, Tok{TokOp, text, start.line})
 
 		default:
 			return nil, start.error("unexpected character %q", string(ch))
@@ -378,6 +384,13 @@ func (s *toks) Skip(n int) {
 }
 
 func (s *toks) SkipBalanced(until ...string) {
+	s.CaptureBalanced(until...)
+}
+
+// CaptureBalanced is like SkipBalanced, but returns the skipped
+// tokens instead of discarding them.
+func (s *toks) CaptureBalanced(until ...string) []Tok {
+	var out []Tok
 	level := 0
 	for len(*s) != 0 {
 		next := s.Next()
@@ -385,10 +398,11 @@ func (s *toks) SkipBalanced(until ...string) {
 			// Are we at a terminator?
 			for _, u := range until {
 				if next.Match(TokOp, u) {
-					return
+					return out
 				}
 			}
 		}
+		out = append(out, next)
 		s.Skip(1)
 		if next.Kind == TokOp {
 			switch next.Text {
@@ -399,4 +413,5 @@ func (s *toks) SkipBalanced(until ...string) {
 			}
 		}
 	}
+	return out
 }
@@ -17,14 +17,14 @@ func TestTokenize(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Look for "int fprintf(FILE *".
-	subSeq := []Tok{{TokKeyword, "int"}, {TokIdent, "fprintf"}, {TokOp, "("}, {TokIdent, "FILE"}, {TokOp, "*"}}
+	subSeq := []Tok{{Kind: TokKeyword, Text: "int"}, {Kind: TokIdent, Text: "fprintf"}, {Kind: TokOp, Text: "("}, {Kind: TokIdent, Text: "FILE"}, {Kind: TokOp, Text: "*"}}
 outer:
 	for start := range toks {
 		if len(toks)-start < len(subSeq) {
 			t.Fatal("didn't find fprintf declaration in token stream")
 		}
 		for i, tok := range subSeq {
-			if toks[start+i] != tok {
+			if toks[start+i].Kind != tok.Kind || toks[start+i].Text != tok.Text {
 				continue outer
 			}
 		}
@@ -5,8 +5,10 @@
 package cparse
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"regexp"
@@ -20,20 +22,37 @@ type BuildEnv struct {
 var macroRe = regexp.MustCompile(`^#define ([_a-zA-Z][_a-zA-Z0-9]*)`)
 
 // FindMacros returns the names of all macros defined by the C source
-// in r.
+// in r, in source order. Macros that don't appear directly in r
+// (such as predefined compiler macros) are returned after all
+// macros that do, in the order cc reports them.
 func FindMacros(env *BuildEnv, r io.Reader) ([]string, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the macros actually defined directly in src, in source
+	// order.
+	dirs, err := ScanDirectives(env, bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask cc for the macros it thinks are defined, which also
+	// includes predefined macros (like __STDC__) that didn't come
+	// from src.
 	ccArgs := append([]string(nil), env.CCArgs...)
 	ccArgs = append(ccArgs, "-x", "c", "-E", "-dM", "-")
 	cc := exec.Command("cc", ccArgs...)
-	cc.Stdin = r
+	cc.Stdin = bytes.NewReader(src)
 	cc.Stderr = os.Stderr
 	out, err := cc.Output()
 	if err != nil {
 		return nil, err
 	}
-	var macros []string
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
+	defined := map[string]bool{}
+	var fromCC []string
+	for _, line := range strings.Split(string(out), "\n") {
 		if line == "" {
 			continue
 		}
@@ -41,7 +60,26 @@ func FindMacros(env *BuildEnv, r io.Reader) ([]string, error) {
 		if m == nil {
 			return nil, fmt.Errorf("failed to parse macro %q", line)
 		}
-		macros = append(macros, m[1])
+		defined[m[1]] = true
+		fromCC = append(fromCC, m[1])
+	}
+
+	// Macros that src defines directly come first, in source order;
+	// anything else cc reported (predefined macros) follows, in
+	// cc's order.
+	var macros []string
+	seen := map[string]bool{}
+	for _, d := range dirs {
+		if defined[d.Name] && !seen[d.Name] {
+			macros = append(macros, d.Name)
+			seen[d.Name] = true
+		}
+	}
+	for _, name := range fromCC {
+		if !seen[name] {
+			macros = append(macros, name)
+			seen[name] = true
+		}
 	}
 	return macros, nil
 }
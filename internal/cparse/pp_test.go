@@ -31,6 +31,50 @@ outer:
 	}
 }
 
+func TestScanDirectives(t *testing.T) {
+	src := `#define A 1
+#ifdef A
+#define B 2
+#else
+#define NOTSEEN 1
+#endif
+#ifndef A
+#define NOTSEEN2 1
+#elif defined(B)
+#define C 3
+#endif
+#undef B
+#ifdef B
+#define NOTSEEN3 1
+#endif
+#define D \
+	4
+`
+	dirs, err := ScanDirectives(&defaultEnv, bytes.NewBufferString(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range dirs {
+		got = append(got, d.Name)
+	}
+	want := []string{"A", "B", "C", "D"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if dirs[0].Pos.Line != 1 {
+		t.Errorf("expected A on line 1, got %d", dirs[0].Pos.Line)
+	}
+	if dirs[3].Pos.Line != 16 {
+		t.Errorf("expected D on line 15, got %d", dirs[3].Pos.Line)
+	}
+}
+
 func needCC(t *testing.T) {
 	t.Helper()
 
@@ -18,9 +18,51 @@ import (
 type Extractor struct {
 	Prologue string
 	Names    []string
-	Vals     map[string]interface{}
+
+	// Structs names struct types Extract should introspect, in
+	// addition to the scalar constants named by Names. For each
+	// StructRequest, Extract populates Vals[req.Type] with a
+	// StructLayout.
+	Structs []StructRequest
+
+	// Enums names enum tags (without the leading "enum" keyword)
+	// Extract should introspect. Extract finds each tag's members
+	// by statically parsing Prologue (see FindEnums), then compiles
+	// a program that prints their actual values, so this still
+	// gets the right answer when a member's initializer depends on
+	// something FindEnums can't evaluate, such as a macro or
+	// sizeof. For each tag, Extract populates Vals[tag] with an
+	// EnumValues.
+	Enums []string
+
+	Vals map[string]interface{}
+}
+
+// StructRequest names a struct type Extractor should introspect, and
+// the fields of that type to report the layout of.
+type StructRequest struct {
+	Type   string
+	Fields []string
+}
+
+// FieldLayout is the layout of one field of a StructLayout.
+type FieldLayout struct {
+	Offset int
+	Size   int
+}
+
+// StructLayout is the compiled layout of a struct type, as requested
+// by a StructRequest.
+type StructLayout struct {
+	Size   int
+	Align  int
+	Fields map[string]FieldLayout
 }
 
+// EnumValues maps each member of a C enum to its integer value, as
+// requested by Extractor.Enums.
+type EnumValues map[string]int64
+
 func (e *Extractor) Extract(env *BuildEnv) error {
 	// Other ways to do this:
 	//
@@ -31,9 +73,15 @@ func (e *Extractor) Extract(env *BuildEnv) error {
 	// Extract from object file (requires different object format
 	// readers) or asm.
 
+	enumMembers, err := e.findEnumMembers(env)
+	if err != nil {
+		return err
+	}
+
 	// Construct printer program.
 	src := bytes.NewBufferString(e.Prologue)
 	src.WriteString(`
+#include <stddef.h>
 #include <stdio.h>
 #include <string.h>
 
@@ -52,7 +100,23 @@ void __cparse_pr_uint(unsigned long long x) {
 	printf("uint %llu\n", x);
 }
 void __cparse_pr_str(const char *x) {
-	printf("str %zu %s\n", strlen(x), x);
+	printf("str %zu ", strlen(x));
+	fwrite(x, 1, strlen(x), stdout);
+	putchar('\n');
+}
+
+#define __CPARSE_ENUM(tag, x) _Generic((x), \
+	int                : __cparse_pr_enum_i, \
+	long               : __cparse_pr_enum_i, \
+	long long          : __cparse_pr_enum_i, \
+	unsigned int       : __cparse_pr_enum_u, \
+	unsigned long      : __cparse_pr_enum_u, \
+	unsigned long long : __cparse_pr_enum_u)(tag, #x, (x))
+void __cparse_pr_enum_i(const char *tag, const char *name, long long x) {
+	printf("enum %s %s %lld\n", tag, name, x);
+}
+void __cparse_pr_enum_u(const char *tag, const char *name, unsigned long long x) {
+	printf("enum %s %s %llu\n", tag, name, x);
 }
 
 int main(int argc, char **argv) {
@@ -60,6 +124,18 @@ int main(int argc, char **argv) {
 	for _, n := range e.Names {
 		fmt.Fprintf(src, "__CPARSE_PR(%s);\n", n)
 	}
+	for _, req := range e.Structs {
+		fmt.Fprintf(src, "printf(\"struct %s %%zu %%zu\\n\", sizeof(%s), _Alignof(%s));\n", req.Type, req.Type, req.Type)
+		for _, field := range req.Fields {
+			fmt.Fprintf(src, "printf(\"field %s %s %%zu %%zu\\n\", (size_t)offsetof(%s, %s), sizeof(((%s*)0)->%s));\n",
+				req.Type, field, req.Type, field, req.Type, field)
+		}
+	}
+	for _, tag := range e.Enums {
+		for _, member := range enumMembers[tag] {
+			fmt.Fprintf(src, "__CPARSE_ENUM(%q, %s);\n", tag, member)
+		}
+	}
 	src.WriteString("return 0;\n}\n")
 
 	// Compiler printer.
@@ -90,7 +166,10 @@ int main(int argc, char **argv) {
 
 	// Parse printer output.
 	e.Vals = make(map[string]interface{})
-	for i := 0; len(out) > 0; i++ {
+	structs := make(map[string]StructLayout)
+	enums := make(map[string]EnumValues)
+	namei := 0
+	for len(out) > 0 {
 		sep := strings.Index(out, " ")
 		typ := out[:sep]
 		out = out[sep+1:]
@@ -102,7 +181,8 @@ int main(int argc, char **argv) {
 				panic(err)
 			}
 			out = out[sep+1:]
-			e.Vals[e.Names[i]] = val
+			e.Vals[e.Names[namei]] = val
+			namei++
 		case "uint":
 			sep = strings.Index(out, "\n")
 			val, err := strconv.ParseUint(out[:sep], 10, 0)
@@ -110,13 +190,117 @@ int main(int argc, char **argv) {
 				panic(err)
 			}
 			out = out[sep+1:]
-			e.Vals[e.Names[i]] = uint(val)
+			e.Vals[e.Names[namei]] = uint(val)
+			namei++
 		case "str":
-			panic("not implemented: str")
+			sep = strings.Index(out, " ")
+			n, err := strconv.Atoi(out[:sep])
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			e.Vals[e.Names[namei]] = out[:n]
+			out = out[n+1:] // +1 for the trailing newline
+			namei++
+		case "struct":
+			sep = strings.Index(out, " ")
+			name := out[:sep]
+			out = out[sep+1:]
+			sep = strings.Index(out, " ")
+			size, err := strconv.Atoi(out[:sep])
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			sep = strings.Index(out, "\n")
+			align, err := strconv.Atoi(out[:sep])
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			structs[name] = StructLayout{Size: size, Align: align, Fields: make(map[string]FieldLayout)}
+		case "field":
+			sep = strings.Index(out, " ")
+			structName := out[:sep]
+			out = out[sep+1:]
+			sep = strings.Index(out, " ")
+			field := out[:sep]
+			out = out[sep+1:]
+			sep = strings.Index(out, " ")
+			offset, err := strconv.Atoi(out[:sep])
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			sep = strings.Index(out, "\n")
+			size, err := strconv.Atoi(out[:sep])
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			structs[structName].Fields[field] = FieldLayout{Offset: offset, Size: size}
+		case "enum":
+			sep = strings.Index(out, " ")
+			tag := out[:sep]
+			out = out[sep+1:]
+			sep = strings.Index(out, " ")
+			member := out[:sep]
+			out = out[sep+1:]
+			sep = strings.Index(out, "\n")
+			val, err := strconv.ParseInt(out[:sep], 10, 64)
+			if err != nil {
+				panic(err)
+			}
+			out = out[sep+1:]
+			if enums[tag] == nil {
+				enums[tag] = make(EnumValues)
+			}
+			enums[tag][member] = val
 		default:
 			panic("unexpected type " + typ)
 		}
 	}
+	for _, req := range e.Structs {
+		e.Vals[req.Type] = structs[req.Type]
+	}
+	for _, tag := range e.Enums {
+		e.Vals[tag] = enums[tag]
+	}
 
 	return nil
 }
+
+// findEnumMembers statically parses e.Prologue (after running it
+// through the C preprocessor, so conditionals and macros that expand
+// to enum definitions are resolved) and returns, for each tag in
+// e.Enums, the names of that enum's members in declaration order.
+func (e *Extractor) findEnumMembers(env *BuildEnv) (map[string][]string, error) {
+	if len(e.Enums) == 0 {
+		return nil, nil
+	}
+
+	pp, err := Preprocess(env, strings.NewReader(e.Prologue))
+	if err != nil {
+		return nil, err
+	}
+	toks, err := Tokenize(pp)
+	if err != nil {
+		return nil, err
+	}
+	allEnums, err := FindEnums(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	want := make(map[string]bool, len(e.Enums))
+	for _, tag := range e.Enums {
+		want[tag] = true
+	}
+	members := make(map[string][]string)
+	for _, en := range allEnums {
+		if want[en.Tag.Text] {
+			members[en.Tag.Text] = append(members[en.Tag.Text], en.Ident.Text)
+		}
+	}
+	return members, nil
+}
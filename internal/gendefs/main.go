@@ -14,7 +14,10 @@ import (
 	"go/token"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"unicode"
 
@@ -32,6 +35,55 @@ func main() {
 	}
 }
 
+// loadConsts preprocesses and extracts the enum and macro constants
+// declared by the C source csrc under env, in source order: macro
+// constants are interleaved with the enum constants by their
+// position in csrc, so a header that intersperses #define's among
+// enum members produces constants in the same order as the C
+// source. Macros that don't have a position in csrc (e.g. predefined
+// compiler macros) sort after everything else.
+func loadConsts(env *cparse.BuildEnv, csrc []byte) ([]cparse.Enum, error) {
+	pp, err := cparse.Preprocess(env, bytes.NewBuffer(csrc))
+	if err != nil {
+		return nil, err
+	}
+	toks, err := cparse.Tokenize(pp)
+	if err != nil {
+		return nil, err
+	}
+
+	macros, err := cparse.FindMacros(env, bytes.NewBuffer(csrc))
+	if err != nil {
+		return nil, err
+	}
+	consts, err := cparse.FindEnums(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := cparse.ScanDirectives(env, bytes.NewBuffer(csrc))
+	if err != nil {
+		return nil, err
+	}
+	macroLine := map[string]int{}
+	for _, d := range dirs {
+		if _, ok := macroLine[d.Name]; !ok {
+			macroLine[d.Name] = d.Pos.Line
+		}
+	}
+	for _, m := range macros {
+		line, ok := macroLine[m]
+		if !ok {
+			line = math.MaxInt32
+		}
+		consts = append(consts, cparse.Enum{Ident: cparse.Tok{Text: m, Line: line}})
+	}
+	sort.SliceStable(consts, func(i, j int) bool {
+		return consts[i].Ident.Line < consts[j].Ident.Line
+	})
+	return consts, nil
+}
+
 func process(path string) {
 	src, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -46,6 +98,8 @@ func process(path string) {
 
 	// Extract directives.
 	var defs []*def
+	var tables []*tableDef
+	var targets []target
 	csrc := new(bytes.Buffer)
 	for _, cg := range f.Comments {
 		for _, c := range cg.List {
@@ -58,9 +112,19 @@ func process(path string) {
 				fmt.Fprintf(csrc, "%s\n", c.Text[sp:len(c.Text)-2])
 			} else if cmd == "gendefs" {
 				defs = append(defs, parseDef(c))
+			} else if cmd == "gendefs:table" {
+				tables = append(tables, parseTableDef(c, filepath.Dir(path)))
+			} else if cmd == "gendefs:target" {
+				targets = append(targets, parseTarget(c))
 			}
 		}
 	}
+	if len(targets) == 0 {
+		// Without any declared targets, behave exactly as if there
+		// were one implicit target using only -ccflags, and no
+		// build tag.
+		targets = []target{{}}
+	}
 	// Attach declaration blocks to def directives.
 	defsTodo := defs
 	for _, decl := range f.Decls {
@@ -86,35 +150,18 @@ func process(path string) {
 		log.Fatalf("%s: def without a declaration", fset.Position(defsTodo[0].Pos))
 	}
 
-	// Get identifier names from C code.
-	env := cparse.BuildEnv{CCArgs: strings.Fields(*ccflags)}
-	pp, err := cparse.Preprocess(&env, bytes.NewBuffer(csrc.Bytes()))
-	if err != nil {
-		log.Fatal(err)
-	}
-	toks, err := cparse.Tokenize(pp)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// TODO: Macros aren't in source order. :( Maybe I need to
-	// sort them by value? Or do my own pre-processor scan just to
-	// get the names (and hope that ignoring other pre-processor
-	// directives is okay)?
-	macros, err := cparse.FindMacros(&env, bytes.NewBuffer(csrc.Bytes()))
+	// Get identifier names from the C code, using the first target
+	// to decide which C names match each def. The remaining targets
+	// are assumed to define the same names; only their values may
+	// differ.
+	baseCCArgs := strings.Fields(*ccflags)
+	env0 := cparse.BuildEnv{CCArgs: append(append([]string(nil), baseCCArgs...), targets[0].CCArgs...)}
+	consts, err := loadConsts(&env0, csrc.Bytes())
 	if err != nil {
 		log.Fatal(err)
 	}
-	consts, err := cparse.FindEnums(toks)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, m := range macros {
-		consts = append(consts, cparse.Enum{Ident: cparse.Tok{Text: m}})
-	}
 
-	// Extract values of defs.
-	ex := cparse.Extractor{Prologue: csrc.String()}
+	var defNames []string
 	for _, def := range defs {
 		for i, c := range consts {
 			id := c.Ident.Text
@@ -128,7 +175,7 @@ func process(path string) {
 			_, ok2 := def.CIdent(id)
 			if ok1 && ok2 {
 				def.Names = append(def.Names, id)
-				ex.Names = append(ex.Names, id)
+				defNames = append(defNames, id)
 			}
 		}
 		if def.OmitMax && len(def.Names) > 0 {
@@ -136,7 +183,7 @@ func process(path string) {
 				log.Fatalf("%s: final name is %s, expected *_MAX", fset.Position(def.Pos), last)
 			}
 			def.Names = def.Names[:len(def.Names)-1]
-			ex.Names = ex.Names[:len(ex.Names)-1]
+			defNames = defNames[:len(defNames)-1]
 		}
 
 		if len(def.Names) == 0 {
@@ -144,30 +191,56 @@ func process(path string) {
 		}
 	}
 
-	if err := ex.Extract(&env); err != nil {
-		log.Fatal(err)
+	// Extract def values once per target.
+	valsByTarget := make([]map[string]interface{}, len(targets))
+	for i, tgt := range targets {
+		env := env0
+		if i > 0 {
+			env = cparse.BuildEnv{CCArgs: append(append([]string(nil), baseCCArgs...), tgt.CCArgs...)}
+		}
+		ex := cparse.Extractor{Prologue: csrc.String(), Names: append([]string(nil), defNames...)}
+		if err := ex.Extract(&env); err != nil {
+			log.Fatal(err)
+		}
+		valsByTarget[i] = ex.Vals
+	}
+
+	// gendefs:table directives aren't split by target; resolve them
+	// against the first target only.
+	if len(tables) > 0 {
+		tex := cparse.Extractor{Prologue: csrc.String()}
+		for _, td := range tables {
+			tex.Names = append(tex.Names, td.cNames()...)
+		}
+		if err := tex.Extract(&env0); err != nil {
+			log.Fatal(err)
+		}
+		for _, td := range tables {
+			td.resolve(tex.Vals)
+		}
 	}
 
 	// Replace decls.
 	var edits []Edit
+	neededImports := map[string]bool{}
 	filePos := func(pos token.Pos) int {
 		return fset.Position(pos).Offset
 	}
+	// targetCode[i] accumulates const blocks (and stringers) for
+	// names whose value differs for targets[i]; targetImports[i]
+	// tracks the imports those need. Nothing is written for a
+	// target whose code stays empty, which is always the case for
+	// the implicit single target used when no //gendefs:target
+	// directives appear.
+	targetCode := make([]bytes.Buffer, len(targets))
+	targetImports := make([]map[string]bool, len(targets))
+	for i := range targetImports {
+		targetImports[i] = map[string]bool{}
+	}
 	for _, def := range defs {
 		// Delete the const block.
 		lparen := filePos(def.Decl.Lparen)
 		rparen := filePos(def.Decl.Rparen)
-		edit := Edit{Pos: lparen + 1, Del: rparen - lparen - 1}
-		insert := new(bytes.Buffer)
-
-		// Translate values to expressions.
-		var vals []interface{}
-		for _, name := range def.Names {
-			vals = append(vals, ex.Vals[name])
-		}
-
-		// Clean up value sequence.
-		valExprs := cleanVals(vals)
 
 		// Collect comments on existing values. We do this
 		// straight from the text to avoid depending on how
@@ -200,43 +273,250 @@ func process(path string) {
 			prevEnd = end + lineLen + 1 // Skip newline
 		}
 
-		var prevType string
-		for i, name := range def.Names {
-			suff, _ := def.CIdent(name)
-			goName := def.GoPrefix + cNameToGo(suff)
-
-			// Emit doc comment.
-			if text, ok := docText[goName]; ok {
-				fmt.Fprintf(insert, "\n%s", text)
+		// Split def.Names into ones whose value is the same for
+		// every target, which stay in this file, and ones that
+		// differ, which move into per-target files.
+		var sharedNames, splitNames []string
+		for _, name := range def.Names {
+			same := true
+			for i := 1; i < len(targets); i++ {
+				if !valEqual(valsByTarget[0][name], valsByTarget[i][name]) {
+					same = false
+					break
+				}
 			}
-
-			// Emit name.
-			fmt.Fprintf(insert, "\n\t%s", goName)
-
-			// Emit type.
-			if def.GoType != prevType {
-				fmt.Fprintf(insert, " %s", def.GoType)
-				prevType = def.GoType
+			if same {
+				sharedNames = append(sharedNames, name)
+			} else {
+				splitNames = append(splitNames, name)
 			}
+		}
 
-			// Emit value.
-			if valExprs[i] != nil {
-				fmt.Fprintf(insert, "=")
-				printer.Fprint(insert, fset, valExprs[i])
-			}
+		sharedVals := valsFor(sharedNames, valsByTarget[0])
+		body, sharedGoNames := genConstBody(def, sharedNames, sharedVals, docText, lineText, fset)
+		edits = append(edits, Edit{Pos: lparen + 1, Del: rparen - lparen - 1, Insert: []byte(body)})
+
+		if def.Stringer != "" && len(splitNames) == 0 {
+			neededImports["strconv"] = true
+			stringer := genDefStringer(def, sharedGoNames, sharedVals, fset)
+			edits = append(edits, Edit{Pos: filePos(def.Decl.End()), Insert: []byte("\n\n" + stringer)})
+		}
 
-			// Emit line comment.
-			if text, ok := lineText[goName]; ok {
-				fmt.Fprintf(insert, "%s", text)
+		// For names that differ by target, emit a const block (and,
+		// if this def has a Stringer, a String method covering all
+		// of its values) into each target's own file.
+		if len(splitNames) > 0 {
+			allGoNames := defGoNames(def, def.Names)
+			for i := range targets {
+				splitVals := valsFor(splitNames, valsByTarget[i])
+				body, _ := genConstBody(def, splitNames, splitVals, docText, lineText, fset)
+				fmt.Fprintf(&targetCode[i], "const (%s)\n\n", body)
+
+				if def.Stringer != "" {
+					targetImports[i]["strconv"] = true
+					allVals := valsFor(def.Names, valsByTarget[i])
+					stringer := genDefStringer(def, allGoNames, allVals, fset)
+					fmt.Fprintf(&targetCode[i], "%s\n\n", stringer)
+				}
 			}
 		}
+	}
+
+	for _, td := range tables {
+		neededImports["math/bits"] = true
+		edits = append(edits, Edit{Pos: filePos(td.End), Insert: []byte("\n\n" + td.gen())})
+	}
 
-		fmt.Fprintf(insert, "\n")
-		edit.Insert = insert.Bytes()
-		edits = append(edits, edit)
+	var imports []string
+	for path := range neededImports {
+		if !hasImport(f, path) {
+			imports = append(imports, path)
+		}
+	}
+	sort.Strings(imports)
+	for _, path := range imports {
+		edits = append(edits, Edit{Pos: filePos(f.Name.End()), Insert: []byte(fmt.Sprintf("\n\nimport %q", path))})
 	}
 
 	fmt.Printf("%s", format(DoEdit(src, edits)))
+
+	for i, tgt := range targets {
+		if targetCode[i].Len() == 0 {
+			continue
+		}
+		writeTargetFile(path, f.Name.Name, tgt, targetCode[i].String(), targetImports[i])
+	}
+}
+
+// valsFor looks up each of names in vals, in order.
+func valsFor(names []string, vals map[string]interface{}) []interface{} {
+	out := make([]interface{}, len(names))
+	for i, name := range names {
+		out[i] = vals[name]
+	}
+	return out
+}
+
+// valEqual reports whether the constant values a and b (as produced
+// by cparse.Extractor) are the same.
+func valEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case int:
+		bv, ok := b.(int)
+		return ok && av == bv
+	case uint:
+		bv, ok := b.(uint)
+		return ok && av == bv
+	default:
+		return a == b
+	}
+}
+
+// defGoNames computes the Go constant names for the given C names
+// under def, without emitting any code.
+func defGoNames(def *def, names []string) []string {
+	goNames := make([]string, len(names))
+	for i, name := range names {
+		suff, _ := def.CIdent(name)
+		goNames[i] = def.GoPrefix + cNameToGo(suff)
+	}
+	return goNames
+}
+
+// genConstBody renders the body of a const block (the text between
+// its parens) for the Go names derived from def and names, with the
+// corresponding vals, carrying over any doc and line comments from
+// docText and lineText (keyed by Go name, as collected from the
+// original declaration this def replaces).
+func genConstBody(def *def, names []string, vals []interface{}, docText, lineText map[string][]byte, fset *token.FileSet) (body string, goNames []string) {
+	valExprs := cleanVals(vals)
+
+	insert := new(bytes.Buffer)
+	var prevType string
+	goNames = make([]string, len(names))
+	for i, name := range names {
+		suff, _ := def.CIdent(name)
+		goName := def.GoPrefix + cNameToGo(suff)
+		goNames[i] = goName
+
+		// Emit doc comment.
+		if text, ok := docText[goName]; ok {
+			fmt.Fprintf(insert, "\n%s", text)
+		}
+
+		// Emit name.
+		fmt.Fprintf(insert, "\n\t%s", goName)
+
+		// Emit type.
+		if def.GoType != prevType {
+			fmt.Fprintf(insert, " %s", def.GoType)
+			prevType = def.GoType
+		}
+
+		// Emit value.
+		if valExprs[i] != nil {
+			fmt.Fprintf(insert, "=")
+			printer.Fprint(insert, fset, valExprs[i])
+		}
+
+		// Emit line comment.
+		if text, ok := lineText[goName]; ok {
+			fmt.Fprintf(insert, "%s", text)
+		}
+	}
+	fmt.Fprintf(insert, "\n")
+	return insert.String(), goNames
+}
+
+// genDefStringer builds the String method for def's Stringer style,
+// for the given Go names and their values.
+func genDefStringer(def *def, goNames []string, vals []interface{}, fset *token.FileSet) string {
+	intVals := make([]int64, len(vals))
+	for i, v := range vals {
+		intVals[i] = toInt64(v)
+	}
+	switch def.Stringer {
+	case "simple":
+		return genStringer(def.GoType, goNames, intVals)
+	case "bitflags":
+		return genBitStringer(def.GoType, goNames, intVals)
+	default:
+		log.Fatalf("%s: unknown -stringer style %q", fset.Position(def.Pos), def.Stringer)
+		panic("unreachable")
+	}
+}
+
+// writeTargetFile writes the generated code for tgt (const blocks
+// and, if needed, String methods) to its own build-tagged file,
+// named after basePath and tgt's GOOS/GOARCH (e.g. "foo.go" and
+// linux/amd64 produce "foo_linux_amd64.go").
+func writeTargetFile(basePath, pkgName string, tgt target, code string, imports map[string]bool) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Code generated by gendefs. DO NOT EDIT.\n\n")
+	fmt.Fprintf(buf, "//go:build %s && %s\n\n", tgt.GOOS, tgt.GOARCH)
+	fmt.Fprintf(buf, "package %s\n", pkgName)
+
+	var imps []string
+	for path := range imports {
+		imps = append(imps, path)
+	}
+	sort.Strings(imps)
+	for _, path := range imps {
+		fmt.Fprintf(buf, "\nimport %q\n", path)
+	}
+
+	fmt.Fprintf(buf, "\n%s", code)
+
+	dir, base := filepath.Split(basePath)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	outPath := filepath.Join(dir, fmt.Sprintf("%s_%s_%s.go", base, tgt.GOOS, tgt.GOARCH))
+	if err := ioutil.WriteFile(outPath, format(buf.Bytes()), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func hasImport(f *ast.File, path string) bool {
+	for _, imp := range f.Imports {
+		if strings.Trim(imp.Path.Value, `"`) == path {
+			return true
+		}
+	}
+	return false
+}
+
+func toInt64(lit interface{}) int64 {
+	switch v := lit.(type) {
+	case int:
+		return int64(v)
+	case uint:
+		return int64(v)
+	default:
+		log.Fatalf("unhandled constant type %T", lit)
+		panic("unreachable")
+	}
+}
+
+// target is a "//gendefs:target GOOS/GOARCH [ccflags...]" directive.
+// Each one causes process to run the whole extraction pipeline again
+// with an extra set of cc flags, so constants that depend on
+// GOOS/GOARCH (syscall numbers, ioctl codes, and the like) can be
+// generated correctly for every target from a single def.
+type target struct {
+	GOOS, GOARCH string
+	CCArgs       []string
+}
+
+func parseTarget(c *ast.Comment) target {
+	args := strings.Fields(c.Text)[1:]
+	if len(args) < 1 {
+		log.Fatalf("%s: gendefs:target wants a GOOS/GOARCH argument", c.Text)
+	}
+	osArch := args[0]
+	slash := strings.IndexByte(osArch, '/')
+	if slash < 0 {
+		log.Fatalf("%s: gendefs:target wants GOOS/GOARCH, got %q", c.Text, osArch)
+	}
+	return target{GOOS: osArch[:slash], GOARCH: osArch[slash+1:], CCArgs: args[1:]}
 }
 
 type def struct {
@@ -246,6 +526,11 @@ type def struct {
 	GoType   string
 	Omit     map[string]bool
 	OmitMax  bool
+	// Stringer is "" (no stringer generated), "simple" (a
+	// stringer.go-style packed-string/index-table String
+	// method), or "bitflags" (a bitstringer-style String method
+	// that ORs together matching flag names).
+	Stringer string
 	Pos      token.Pos
 	Decl     *ast.GenDecl
 	Names    []string
@@ -272,6 +557,10 @@ func parseDef(c *ast.Comment) *def {
 			args = args[1:]
 		case arg == "-omit-max":
 			d.OmitMax = true
+		case arg == "-stringer":
+			d.Stringer = "simple"
+		case strings.HasPrefix(arg, "-stringer="):
+			d.Stringer = strings.TrimPrefix(arg, "-stringer=")
 		case arg[0] == '-':
 			log.Fatalf("unknown directive flag %s", arg)
 		default:
@@ -428,6 +717,90 @@ func cNameToGo(c string) string {
 	return string(out)
 }
 
+// genStringer builds a stringer-style String method for an
+// enumeration type named goType, whose constants are named and
+// valued by the parallel slices names and vals. It uses the same
+// packed-string / index-table technique as the stringer tool: values
+// are split into maximal runs of consecutive integers, each run gets
+// a name table and a table of byte offsets into it, and a value
+// outside every run falls back to "goType(N)".
+func genStringer(goType string, names []string, vals []int64) string {
+	type run struct {
+		names []string
+		vals  []int64
+	}
+	var runs []run
+	for i, v := range vals {
+		if n := len(runs); n > 0 && v == runs[n-1].vals[len(runs[n-1].vals)-1]+1 {
+			runs[n-1].names = append(runs[n-1].names, names[i])
+			runs[n-1].vals = append(runs[n-1].vals, v)
+			continue
+		}
+		runs = append(runs, run{[]string{names[i]}, []int64{v}})
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "const (\n")
+	for i, r := range runs {
+		fmt.Fprintf(buf, "\t_%s_name_%d = %q\n", goType, i, strings.Join(r.names, ""))
+	}
+	fmt.Fprintf(buf, ")\n\nvar (\n")
+	for i, r := range runs {
+		off := 0
+		fmt.Fprintf(buf, "\t_%s_index_%d = [...]uint8{0", goType, i)
+		for _, n := range r.names {
+			off += len(n)
+			fmt.Fprintf(buf, ", %d", off)
+		}
+		fmt.Fprintf(buf, "}\n")
+	}
+	fmt.Fprintf(buf, ")\n\nfunc (i %s) String() string {\n\tswitch {\n", goType)
+	for i, r := range runs {
+		lo, hi := r.vals[0], r.vals[len(r.vals)-1]
+		if lo == hi {
+			fmt.Fprintf(buf, "\tcase i == %d:\n", lo)
+		} else {
+			fmt.Fprintf(buf, "\tcase %d <= i && i <= %d:\n", lo, hi)
+		}
+		if lo != 0 {
+			fmt.Fprintf(buf, "\t\ti -= %d\n", lo)
+		}
+		fmt.Fprintf(buf, "\t\treturn _%s_name_%d[_%s_index_%d[i]:_%s_index_%d[i+1]]\n", goType, i, goType, i, goType, i)
+	}
+	fmt.Fprintf(buf, "\tdefault:\n\t\treturn %q + strconv.FormatInt(int64(i), 10) + \")\"\n\t}\n}\n", goType+"(")
+	return buf.String()
+}
+
+// genBitStringer builds a bitstringer-style String method for a
+// bit-mask type named goType, ORing together the names of set flags
+// and formatting any unrecognized remaining bits in hex.
+func genBitStringer(goType string, names []string, vals []int64) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "func (i %s) String() string {\n", goType)
+
+	zero := "0"
+	for i, v := range vals {
+		if v == 0 {
+			zero = names[i]
+			break
+		}
+	}
+	fmt.Fprintf(buf, "\tif i == 0 {\n\t\treturn %q\n\t}\n\ts := \"\"\n", zero)
+
+	var have int64
+	for i, v := range vals {
+		if v == 0 || have&v == v {
+			// Zero, or already covered by an earlier flag
+			// (e.g., an alias).
+			continue
+		}
+		have |= v
+		fmt.Fprintf(buf, "\tif i&%s != 0 {\n\t\ts += %q\n\t}\n", names[i], names[i]+"|")
+	}
+	fmt.Fprintf(buf, "\ti &^= %d\n\tif i == 0 {\n\t\treturn s[:len(s)-1]\n\t}\n\treturn s + \"0x\" + strconv.FormatUint(uint64(i), 16)\n}\n", have)
+	return buf.String()
+}
+
 func format(src []byte) []byte {
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, "<output>", src, parser.ParseComments)
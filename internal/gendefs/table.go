@@ -0,0 +1,177 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tableField is a named sub-field of a tableRow's matched value, such
+// as an opcode or register packed into a PMU config word. Mask is
+// resolved from CName (a C macro or enum member, evaluated the same
+// way as a def's values) after parsing.
+type tableField struct {
+	Name  string
+	CName string
+	Mask  uint64
+}
+
+// tableRow is one entry of a table directive: a value x matches this
+// row when x&Mask == Value, and each Field can then be extracted from
+// x by masking and shifting.
+type tableRow struct {
+	Name   string
+	Mask   uint64
+	Value  uint64
+	Fields []tableField
+}
+
+// tableDef is a "//gendefs:table <csv-file> <GoType>" directive. It
+// reads a mask/value/fields table out of a CSV file and emits a
+// decode table and Decode function named GoType, inserted right
+// after the directive.
+type tableDef struct {
+	GoType string
+	End    token.Pos // where to insert the generated code
+	Rows   []tableRow
+}
+
+// parseTableDef parses a "//gendefs:table <csv-file> <GoType>"
+// directive and loads its CSV file, which is resolved relative to
+// dir (the directory of the source file the directive appears in).
+//
+// The CSV has a header row followed by one row per table entry:
+// name, mask, value, fields. mask and value are literal integers (as
+// accepted by strconv.ParseUint with base 0, so either decimal or
+// 0x-prefixed hex). fields is optional and, if present, is a
+// semicolon-separated list of name=CExpr pairs, where CExpr is a C
+// macro or enum member giving that field's bitmask within value.
+func parseTableDef(c *ast.Comment, dir string) *tableDef {
+	args := strings.Fields(c.Text)[1:]
+	if len(args) != 2 {
+		log.Fatalf("%s: gendefs:table wants 2 arguments (csv-file, GoType), got %d", c.Text, len(args))
+	}
+	csvPath := filepath.Join(dir, args[0])
+	td := &tableDef{GoType: args[1], End: c.End()}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		log.Fatalf("gendefs:table: %v", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		log.Fatalf("gendefs:table: reading %s: %v", csvPath, err)
+	}
+	if len(records) < 2 {
+		log.Fatalf("gendefs:table: %s has no entries", csvPath)
+	}
+	for _, rec := range records[1:] { // Skip the header row.
+		if len(rec) != 4 {
+			log.Fatalf("gendefs:table: %s: want 4 columns (name, mask, value, fields), got %d", csvPath, len(rec))
+		}
+		row := tableRow{Name: strings.TrimSpace(rec[0])}
+		if row.Mask, err = strconv.ParseUint(strings.TrimSpace(rec[1]), 0, 64); err != nil {
+			log.Fatalf("gendefs:table: %s: bad mask for %s: %v", csvPath, row.Name, err)
+		}
+		if row.Value, err = strconv.ParseUint(strings.TrimSpace(rec[2]), 0, 64); err != nil {
+			log.Fatalf("gendefs:table: %s: bad value for %s: %v", csvPath, row.Name, err)
+		}
+		if fields := strings.TrimSpace(rec[3]); fields != "" {
+			for _, fld := range strings.Split(fields, ";") {
+				eq := strings.IndexByte(fld, '=')
+				if eq < 0 {
+					log.Fatalf("gendefs:table: %s: malformed field %q for %s; want name=CExpr", csvPath, fld, row.Name)
+				}
+				row.Fields = append(row.Fields, tableField{Name: fld[:eq], CName: fld[eq+1:]})
+			}
+		}
+		td.Rows = append(td.Rows, row)
+	}
+	return td
+}
+
+// cNames returns every C expression td needs resolved, to be merged
+// into a cparse.Extractor's Names alongside any def directives in
+// the same file.
+func (td *tableDef) cNames() []string {
+	var names []string
+	for _, row := range td.Rows {
+		for _, f := range row.Fields {
+			names = append(names, f.CName)
+		}
+	}
+	return names
+}
+
+// resolve fills in each field's Mask from vals, as produced by a
+// cparse.Extractor whose Names included td.cNames().
+func (td *tableDef) resolve(vals map[string]interface{}) {
+	for i := range td.Rows {
+		for j := range td.Rows[i].Fields {
+			f := &td.Rows[i].Fields[j]
+			switch v := vals[f.CName].(type) {
+			case int:
+				f.Mask = uint64(v)
+			case uint:
+				f.Mask = uint64(v)
+			default:
+				log.Fatalf("gendefs:table: %s did not resolve to an integer constant", f.CName)
+			}
+		}
+	}
+}
+
+// gen emits the Go source for td's decode table and Decode function.
+func (td *tableDef) gen() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "type %sFieldSpec struct {\n\tName string\n\tMask uint64\n}\n\n", td.GoType)
+	fmt.Fprintf(buf, "type %sEntry struct {\n\tName   string\n\tMask   uint64\n\tValue  uint64\n\tFields []%sFieldSpec\n}\n\n", td.GoType, td.GoType)
+
+	fmt.Fprintf(buf, "var %sTable = []%sEntry{\n", td.GoType, td.GoType)
+	for _, row := range td.Rows {
+		fmt.Fprintf(buf, "\t{Name: %q, Mask: %#x, Value: %#x", row.Name, row.Mask, row.Value)
+		if len(row.Fields) > 0 {
+			fmt.Fprintf(buf, ", Fields: []%sFieldSpec{", td.GoType)
+			for i, field := range row.Fields {
+				if i > 0 {
+					fmt.Fprintf(buf, ", ")
+				}
+				fmt.Fprintf(buf, "{Name: %q, Mask: %#x}", field.Name, field.Mask)
+			}
+			fmt.Fprintf(buf, "}")
+		}
+		fmt.Fprintf(buf, "},\n")
+	}
+	fmt.Fprintf(buf, "}\n\n")
+
+	fmt.Fprintf(buf, "// Decode%s scans %sTable for an entry matching x and, if found,\n", td.GoType, td.GoType)
+	fmt.Fprintf(buf, "// returns its name and the values of its fields, extracted by masking\n")
+	fmt.Fprintf(buf, "// and shifting x. ok is false if no entry matches.\n")
+	fmt.Fprintf(buf, "func Decode%s(x uint64) (name string, fields map[string]uint64, ok bool) {\n", td.GoType)
+	fmt.Fprintf(buf, "\tfor _, e := range %sTable {\n", td.GoType)
+	fmt.Fprintf(buf, "\t\tif x&e.Mask != e.Value {\n\t\t\tcontinue\n\t\t}\n")
+	fmt.Fprintf(buf, "\t\tif len(e.Fields) == 0 {\n\t\t\treturn e.Name, nil, true\n\t\t}\n")
+	fmt.Fprintf(buf, "\t\tout := make(map[string]uint64, len(e.Fields))\n")
+	fmt.Fprintf(buf, "\t\tfor _, f := range e.Fields {\n")
+	fmt.Fprintf(buf, "\t\t\tshift := uint(bits.TrailingZeros64(f.Mask))\n")
+	fmt.Fprintf(buf, "\t\t\tout[f.Name] = (x & f.Mask) >> shift\n")
+	fmt.Fprintf(buf, "\t\t}\n")
+	fmt.Fprintf(buf, "\t\treturn e.Name, out, true\n")
+	fmt.Fprintf(buf, "\t}\n\treturn \"\", nil, false\n}\n")
+	return buf.String()
+}
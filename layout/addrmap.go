@@ -0,0 +1,92 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layout
+
+import "sort"
+
+// An AddrMapper maps a sparse set of addresses, grouped into
+// page-sized chunks, on to a compact range [0, NormMax]. Pages that
+// never appear in the mapped set contribute no space to the output
+// range, so the mapping makes the best use of a small, fixed output
+// range (such as the width of a space-filling curve) regardless of
+// how sparse or spread out the input addresses are.
+type AddrMapper struct {
+	pageSize   uint64
+	pageBase   map[uint64]uint64
+	normMax    uint64
+	normFactor float64 // output units per byte
+}
+
+// NewAddrMapper returns an AddrMapper that maps addresses appearing
+// in addrs to a compacted space in the range [0, normMax]. pageSize is
+// the granularity at which addresses are grouped for compaction; it
+// need not be the host's actual page size, though it usually matches
+// it.
+func NewAddrMapper(addrs []uint64, pageSize uint64, normMax uint64) *AddrMapper {
+	am := &AddrMapper{pageSize: pageSize, normMax: normMax}
+
+	// Find all distinct pages and the max address.
+	pages := make([]uint64, 0)
+	pageSet := make(map[uint64]bool)
+	maxAddr := uint64(0)
+	for _, addr := range addrs {
+		page := addr / pageSize
+		if pageSet[page] {
+			continue
+		}
+		pageSet[page] = true
+		pages = append(pages, page)
+
+		if addr > maxAddr {
+			maxAddr = addr
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	// Map pages to a compact sequence.
+	am.pageBase = make(map[uint64]uint64, len(pages))
+	for i, page := range pages {
+		am.pageBase[page] = uint64(i) * pageSize
+	}
+
+	// Compute normalization factor.
+	compactMax := am.pageBase[maxAddr/pageSize] + maxAddr%pageSize
+	if compactMax <= normMax {
+		am.normFactor = 1
+	} else {
+		am.normFactor = float64(normMax) / float64(compactMax)
+	}
+
+	return am
+}
+
+// NormFactor returns the number of output units per input byte, as
+// computed from the address set passed to NewAddrMapper.
+func (am *AddrMapper) NormFactor() float64 {
+	return am.normFactor
+}
+
+// Pages returns the distinct pages (addr/pageSize, for the pageSize
+// passed to NewAddrMapper) present in the address set passed to
+// NewAddrMapper, in no particular order.
+func (am *AddrMapper) Pages() []uint64 {
+	pages := make([]uint64, 0, len(am.pageBase))
+	for page := range am.pageBase {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// MapAddr maps addr in to the AddrMapper's compacted output range.
+// addr must fall on a page that appeared in the address set passed to
+// NewAddrMapper; otherwise it maps as if it were on page 0.
+func (am *AddrMapper) MapAddr(addr uint64) uint64 {
+	compact := am.pageBase[addr/am.pageSize] + addr%am.pageSize
+	norm := uint64(float64(compact) * am.normFactor)
+	if norm > am.normMax {
+		norm = am.normMax
+	}
+	return norm
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layout
+
+import "math"
+
+// Morton converts a 1-D point d, 0 <= d < n*n, to a coordinate (x, y)
+// in an n×n Z-order (Morton order) curve, where n is a power of 2.
+// Morton maps d to (x, y) by de-interleaving d's bits: the even bits
+// become x and the odd bits become y. It's cheaper to compute than
+// Hilbert, but doesn't preserve locality as well (it has long jumps
+// at every power-of-2 boundary).
+func Morton(n, d int) (x, y int) {
+	return int(compactBitsEven(uint32(d))), int(compactBitsEven(uint32(d >> 1)))
+}
+
+// compactBitsEven extracts the even bits of d (bit 0, bit 2, bit 4,
+// ...) and packs them together in to the low bits of the result.
+func compactBitsEven(d uint32) uint32 {
+	d &= 0x55555555
+	d = (d | (d >> 1)) & 0x33333333
+	d = (d | (d >> 2)) & 0x0f0f0f0f
+	d = (d | (d >> 4)) & 0x00ff00ff
+	d = (d | (d >> 8)) & 0x0000ffff
+	return d
+}
+
+// Linear converts a 1-D point d, 0 <= d < n*n, to a coordinate (x, y)
+// in an n×n row-major raster, where n is a power of 2. This preserves
+// no 2-D locality at all (points that are close on the line can be a
+// full row apart on the raster), but it's useful as a baseline or
+// when the 1-D order itself (e.g. address order) is what matters.
+func Linear(n, d int) (x, y int) {
+	return d % n, d / n
+}
+
+// Paged converts a 1-D point d, 0 <= d < n*n, to a coordinate (x, y)
+// in an n×n raster, keeping each pageSize-sized chunk of d
+// contiguous as a square tile of its own, tiled in row-major order
+// across the raster. Unlike Hilbert, Morton, or Linear, a page's
+// layout within its tile doesn't depend on its neighbors, so a given
+// page always looks the same regardless of what else was sampled;
+// this makes it easier to compare the same page across runs, at the
+// cost of locality between pages.
+//
+// pageSize must be a perfect square no larger than n*n.
+func Paged(n, pageSize, d int) (x, y int) {
+	tile := int(math.Sqrt(float64(pageSize)))
+	if tile == 0 {
+		tile = 1
+	}
+	tilesPerRow := n / tile
+
+	page, offset := d/pageSize, d%pageSize
+	tileX, tileY := offset%tile, offset/tile
+	pageCol, pageRow := page%tilesPerRow, page/tilesPerRow
+
+	return pageCol*tile + tileX, pageRow*tile + tileY
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package layout
+
+import "testing"
+
+// checkBijection checks that f(n, d) for 0 <= d < n*n covers every
+// point of an n×n raster exactly once.
+func checkBijection(t *testing.T, n int, f func(n, d int) (x, y int)) {
+	t.Helper()
+	have := make([]bool, n*n)
+	for d := 0; d < n*n; d++ {
+		x, y := f(n, d)
+		if x < 0 || x >= n || y < 0 || y >= n {
+			t.Fatalf("d=%d mapped out of bounds: (%d, %d)", d, x, y)
+		}
+		if have[x+y*n] {
+			t.Fatalf("d=%d mapped to already-used point (%d, %d)", d, x, y)
+		}
+		have[x+y*n] = true
+	}
+}
+
+func TestMorton(t *testing.T) {
+	checkBijection(t, 64, Morton)
+}
+
+func TestLinear(t *testing.T) {
+	checkBijection(t, 64, Linear)
+}
+
+func TestPaged(t *testing.T) {
+	const n, pageSize = 64, 16
+	checkBijection(t, n, func(n, d int) (int, int) { return Paged(n, pageSize, d) })
+}
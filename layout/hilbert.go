@@ -0,0 +1,38 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package layout provides space-filling curves and other address-space
+// layout helpers for visualizing large, sparse address ranges (such as
+// a process's memory accesses) in a compact 2-D image.
+package layout
+
+// Hilbert converts a 1-D point d, 0 <= d < n*n, to a coordinate (x, y)
+// in an n×n Hilbert curve, where n is a power of 2. Points that are
+// close together on the curve (that is, with nearby d) map to
+// coordinates that are close together in 2-D space, which makes the
+// Hilbert curve useful for laying out a linear address range so that
+// spatial locality in the visualization reflects locality in the
+// original address space.
+func Hilbert(n, d int) (x, y int) {
+	// Based on Wikipedia.
+	rot := func(s, x, y, rx, ry int) (int, int) {
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+		return x, y
+	}
+	for s := 1; s < n; s *= 2 {
+		rx := 1 & (d / 2)
+		ry := 1 & (d ^ rx)
+		x, y = rot(s, x, y, rx, ry)
+		x += s * rx
+		y += s * ry
+		d /= 4
+	}
+	return
+}
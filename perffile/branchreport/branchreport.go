@@ -0,0 +1,198 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package branchreport aggregates RecordSample.BranchStack entries
+// by branch type and source/target symbol, so questions like "where
+// are my expensive indirect calls" or "which syscalls dominate" can
+// be answered directly from LBR data, without a separate trace.
+package branchreport
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/symbolize"
+)
+
+// A Filter reports whether a branch of the given type should be
+// counted by an Analyzer. A nil Filter counts every branch.
+type Filter func(perffile.BranchType) bool
+
+// OnlyTypes returns a Filter that accepts exactly the given branch
+// types, e.g. OnlyTypes(perffile.BranchTypeIndCall) to look only at
+// indirect calls, or OnlyTypes(perffile.BranchTypeCondRet) for
+// conditional returns.
+func OnlyTypes(types ...perffile.BranchType) Filter {
+	set := make(map[perffile.BranchType]bool, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+	return func(t perffile.BranchType) bool { return set[t] }
+}
+
+// Key identifies one row of a branch-type report: a kind of branch
+// between a particular pair of symbols.
+type Key struct {
+	Type perffile.BranchType
+
+	// From and To are the resolved symbol names of the branch's
+	// source and target, or a "0x%x"-formatted address if no
+	// Symbolizer was given to New or the address couldn't be
+	// resolved.
+	From, To string
+}
+
+// Stats accumulates the branches recorded under one Key.
+type Stats struct {
+	// Count is the number of BranchRecords seen for this Key.
+	Count int64
+
+	// Mispredicts is how many of those branches had
+	// BranchFlagMispredicted set.
+	Mispredicts int64
+
+	// Cycles is the sum of BranchRecord.Cycles (cycles since the
+	// previous branch) across every branch under this Key, or 0 if
+	// the event didn't record cycle counts.
+	Cycles uint64
+}
+
+// MispredictRate returns s.Mispredicts / s.Count, or 0 if Count is 0.
+func (s Stats) MispredictRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Mispredicts) / float64(s.Count)
+}
+
+// CyclesPerBranch returns s.Cycles / s.Count, or 0 if Count is 0.
+//
+// This is the closest approximation to "instructions per branch"
+// available from a BranchRecord: LBR gives the cycle count since the
+// previous branch, not an instruction count, so a lower
+// CyclesPerBranch indicates a denser run of branches (e.g. a tight
+// loop) without actually counting instructions.
+func (s Stats) CyclesPerBranch() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Cycles) / float64(s.Count)
+}
+
+// An Analyzer aggregates BranchStack entries in to per-Key Stats.
+//
+// The zero Analyzer is not usable; create one with New.
+type Analyzer struct {
+	sym    *symbolize.Symbolizer
+	filter Filter
+	stats  map[Key]*Stats
+}
+
+// New creates an Analyzer. If sym is non-nil, branch endpoints are
+// resolved to symbol names through it; otherwise (or if a lookup
+// fails) they're reported as hex addresses. If filter is non-nil,
+// only branches it accepts are counted; pass nil to count every
+// branch.
+func New(sym *symbolize.Symbolizer, filter Filter) *Analyzer {
+	return &Analyzer{sym: sym, filter: filter, stats: make(map[Key]*Stats)}
+}
+
+// Add folds every entry of r.BranchStack in to a, resolving From/To
+// against r.PID, r.CPUMode, and r.Time.
+func (a *Analyzer) Add(r *perffile.RecordSample) {
+	for _, br := range r.BranchStack {
+		if a.filter != nil && !a.filter(br.Type) {
+			continue
+		}
+
+		key := Key{
+			Type: br.Type,
+			From: a.symName(r, br.From),
+			To:   a.symName(r, br.To),
+		}
+		s := a.stats[key]
+		if s == nil {
+			s = &Stats{}
+			a.stats[key] = s
+		}
+		s.Count++
+		if br.Flags&perffile.BranchFlagMispredicted != 0 {
+			s.Mispredicts++
+		}
+		s.Cycles += uint64(br.Cycles)
+	}
+}
+
+func (a *Analyzer) symName(r *perffile.RecordSample, ip uint64) string {
+	if a.sym != nil {
+		if frame, err := a.sym.Resolve(r.PID, r.CPUMode, ip, r.Time); err == nil && frame.Func != "" {
+			return frame.Func
+		}
+	}
+	return fmt.Sprintf("0x%x", ip)
+}
+
+// A Row is one ranked entry of a Report.
+type Row struct {
+	Key
+	Stats
+}
+
+// Report returns every Key Add has accumulated Stats for, sorted by
+// Count, most frequent first.
+func (a *Analyzer) Report() []Row {
+	rows := make([]Row, 0, len(a.stats))
+	for k, s := range a.stats {
+		rows = append(rows, Row{k, *s})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		// Break ties deterministically so Report's output doesn't
+		// depend on map iteration order.
+		if rows[i].Type != rows[j].Type {
+			return rows[i].Type < rows[j].Type
+		}
+		if rows[i].From != rows[j].From {
+			return rows[i].From < rows[j].From
+		}
+		return rows[i].To < rows[j].To
+	})
+	return rows
+}
+
+// ByType returns Stats aggregated across every Key sharing a
+// BranchType, sorted by Count, most frequent first. This answers
+// "which kinds of branches dominate" without breaking results down
+// by symbol.
+func (a *Analyzer) ByType() []TypeRow {
+	byType := make(map[perffile.BranchType]*Stats)
+	var order []perffile.BranchType
+	for k, s := range a.stats {
+		t := byType[k.Type]
+		if t == nil {
+			t = &Stats{}
+			byType[k.Type] = t
+			order = append(order, k.Type)
+		}
+		t.Count += s.Count
+		t.Mispredicts += s.Mispredicts
+		t.Cycles += s.Cycles
+	}
+
+	rows := make([]TypeRow, len(order))
+	for i, t := range order {
+		rows[i] = TypeRow{Type: t, Stats: *byType[t]}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Count > rows[j].Count })
+	return rows
+}
+
+// A TypeRow is one ranked entry of ByType.
+type TypeRow struct {
+	Type perffile.BranchType
+	Stats
+}
@@ -15,6 +15,18 @@ func (b *bufDecoder) skip(n int) {
 	b.buf = b.buf[n:]
 }
 
+// chain splits off the next n bytes of b as their own slice sharing
+// b's backing array, and advances b past them. It's meant for
+// splicing a decoder for one buffer into a decoder for another (such
+// as a decompressed PERF_RECORD_COMPRESSED payload that itself
+// contains a run of records) without copying the combined bytes into
+// one contiguous buffer.
+func (b *bufDecoder) chain(n int) []byte {
+	x := b.buf[:n]
+	b.buf = b.buf[n:]
+	return x
+}
+
 func (b *bufDecoder) bytes(x []byte) {
 	copy(x, b.buf)
 	b.buf = b.buf[len(x):]
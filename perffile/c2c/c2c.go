@@ -0,0 +1,229 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package c2c detects cache-to-cache contention and false sharing
+// from perf.data samples, the same analysis "perf c2c" performs.
+//
+// When two CPUs repeatedly fight over the same cache line, a core
+// that owns the line in Modified state has to transfer it to another
+// core that wants to read or write it; DataSrc.Snoop records this as
+// a "snoop hit modified" (HITM). Grouping samples by the cache line
+// their PhysAddr falls in, and looking at which offsets within that
+// line each contending thread actually touched, tells true sharing
+// (several threads hammering the very same field) apart from false
+// sharing (threads touching unrelated fields that just happen to
+// share a line).
+package c2c
+
+import (
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// DefaultLineSize is the cache line size Analyzer uses when New is
+// given a lineSize of 0. 64 bytes is the line size of every x86 and
+// most ARM64 CPUs; pass the real line size explicitly on a CPU where
+// that doesn't hold.
+const DefaultLineSize = 64
+
+// An Access is a single sample's contribution to a cache line's
+// contention, in the form Analyzer records it.
+type Access struct {
+	TID, CPU int
+
+	// Offset is the byte offset of the access within its cache
+	// line.
+	Offset int
+
+	Op perffile.DataSrcOp // load, store, or prefetch
+
+	// HITM is true if this access triggered a snoop hit on a
+	// modified line (DataSrcSnoopHitM) in another core's cache:
+	// the telltale sign of cache-to-cache contention.
+	HITM bool
+
+	// Remote is true if the line causing the HITM was homed on a
+	// remote node (DataSrc.Remote), i.e. this was a cross-socket
+	// transfer rather than one within a single node.
+	Remote bool
+
+	// Weight is the sample's latency, in cycles, or 0 if the event
+	// didn't record one (SampleFormatWeight/WeightStruct).
+	Weight uint64
+}
+
+// A Line is the raw record of every Access Analyzer has seen for one
+// cache line, in the order they were added.
+type Line struct {
+	// PhysAddr is the cache-line-aligned base address of this
+	// line.
+	PhysAddr uint64
+
+	Accesses []Access
+}
+
+// Loads returns the number of load accesses recorded for l.
+func (l *Line) Loads() int { return l.count(perffile.DataSrcOpLoad) }
+
+// Stores returns the number of store accesses recorded for l.
+func (l *Line) Stores() int { return l.count(perffile.DataSrcOpStore) }
+
+func (l *Line) count(op perffile.DataSrcOp) int {
+	n := 0
+	for _, a := range l.Accesses {
+		if a.Op&op != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// HITMs returns the number of local (same-node) and remote
+// (cross-node) HITM accesses recorded for l.
+func (l *Line) HITMs() (local, remote int) {
+	for _, a := range l.Accesses {
+		if !a.HITM {
+			continue
+		}
+		if a.Remote {
+			remote++
+		} else {
+			local++
+		}
+	}
+	return local, remote
+}
+
+// TIDs returns the sorted, deduplicated set of thread IDs that
+// accessed l.
+func (l *Line) TIDs() []int {
+	seen := make(map[int]bool)
+	var tids []int
+	for _, a := range l.Accesses {
+		if !seen[a.TID] {
+			seen[a.TID] = true
+			tids = append(tids, a.TID)
+		}
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// OffsetTIDs returns, for each offset within l that was accessed, the
+// sorted, deduplicated set of thread IDs that accessed it. An offset
+// touched by multiple TIDs is a sign of true sharing at that offset;
+// a line with many offsets each touched by a single TID, but
+// contended as a whole, is a sign of false sharing instead.
+func (l *Line) OffsetTIDs() map[int][]int {
+	seen := make(map[int]map[int]bool)
+	for _, a := range l.Accesses {
+		tids := seen[a.Offset]
+		if tids == nil {
+			tids = make(map[int]bool)
+			seen[a.Offset] = tids
+		}
+		tids[a.TID] = true
+	}
+	out := make(map[int][]int, len(seen))
+	for offset, tids := range seen {
+		var list []int
+		for tid := range tids {
+			list = append(list, tid)
+		}
+		sort.Ints(list)
+		out[offset] = list
+	}
+	return out
+}
+
+// An Analyzer groups RecordSample.PhysAddr-bearing samples by cache
+// line and accumulates each line's contention record.
+//
+// The zero Analyzer is not usable; create one with New.
+type Analyzer struct {
+	lineSize uint64
+	lines    map[uint64]*Line
+}
+
+// New creates an Analyzer that groups addresses in to lineSize-byte
+// cache lines. If lineSize is 0, DefaultLineSize is used.
+func New(lineSize uint64) *Analyzer {
+	if lineSize == 0 {
+		lineSize = DefaultLineSize
+	}
+	return &Analyzer{lineSize: lineSize, lines: make(map[uint64]*Line)}
+}
+
+// Add records r's contribution to its cache line's contention
+// record, and reports whether it did so. A sample is ignored (and
+// Add returns false) unless it has SampleFormatDataSrc and
+// SampleFormatPhysAddr; SampleFormatAddr additionally determines the
+// access's offset within the line (without it, the offset is always
+// reported as 0, which only affects OffsetTIDs, not line-level
+// totals).
+func (a *Analyzer) Add(r *perffile.RecordSample) bool {
+	if r.Format&perffile.SampleFormatDataSrc == 0 || r.Format&perffile.SampleFormatPhysAddr == 0 {
+		return false
+	}
+	if r.DataSrc.Op&(perffile.DataSrcOpLoad|perffile.DataSrcOpStore|perffile.DataSrcOpPrefetch) == 0 {
+		return false
+	}
+
+	base := r.PhysAddr &^ (a.lineSize - 1)
+	line := a.lines[base]
+	if line == nil {
+		line = &Line{PhysAddr: base}
+		a.lines[base] = line
+	}
+
+	offset := 0
+	if r.Format&perffile.SampleFormatAddr != 0 {
+		offset = int(r.Addr & (a.lineSize - 1))
+	}
+
+	weight := r.Weight
+	if weight == 0 && r.Format&perffile.SampleFormatWeightStruct != 0 {
+		weight = uint64(r.Weights.Var1)
+	}
+
+	line.Accesses = append(line.Accesses, Access{
+		TID:    r.TID,
+		CPU:    int(r.CPU),
+		Offset: offset,
+		Op:     r.DataSrc.Op,
+		HITM:   r.DataSrc.Snoop&perffile.DataSrcSnoopHitM != 0,
+		Remote: r.DataSrc.Remote,
+		Weight: weight,
+	})
+	return true
+}
+
+// Lines returns every cache line Add has recorded an access for, in
+// no particular order. Use Report for a ranked summary.
+func (a *Analyzer) Lines() []*Line {
+	lines := make([]*Line, 0, len(a.lines))
+	for _, l := range a.lines {
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// Report returns every contended line (one with at least one HITM
+// access), ranked by total HITM count, most contended first.
+func (a *Analyzer) Report() []*Line {
+	var lines []*Line
+	for _, l := range a.lines {
+		local, remote := l.HITMs()
+		if local+remote > 0 {
+			lines = append(lines, l)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		li, ri := lines[i].HITMs()
+		lj, rj := lines[j].HITMs()
+		return li+ri > lj+rj
+	})
+	return lines
+}
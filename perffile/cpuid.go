@@ -0,0 +1,150 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CPUInfo is a decoded form of FileMeta.CPUID, the vendor-specific
+// CPU identification string perf records for the profiled machine.
+//
+// On x86, Family, Model, and Stepping come directly from the CPUID
+// instruction's family/model/stepping fields. On arm64, which has no
+// equivalent concept, they're repurposed to hold the MIDR_EL1 part
+// number, implementer code, and variant/revision, respectively.
+type CPUInfo struct {
+	Vendor   string
+	Family   int
+	Model    int
+	Stepping int
+	Features CPUFeatures
+}
+
+// CPUFeatures is a bitset of CPU features inferred from a CPUInfo's
+// vendor, family, and model, in the style of Go's internal/cpu
+// package. Unlike internal/cpu, which detects features by executing
+// CPUID/reading MIDR_EL1 on the running machine, this has to infer
+// them from the handful of fields perf records in a profile, so it
+// only covers features whose presence is fully determined by
+// family/model and isn't a general CPUID feature database.
+type CPUFeatures uint32
+
+const (
+	FeatureAVX2 CPUFeatures = 1 << iota
+	FeatureBMI2
+	FeaturePMUv3
+)
+
+func (f CPUFeatures) HasAVX2() bool  { return f&FeatureAVX2 != 0 }
+func (f CPUFeatures) HasBMI2() bool  { return f&FeatureBMI2 != 0 }
+func (f CPUFeatures) HasPMUv3() bool { return f&FeaturePMUv3 != 0 }
+
+// parseCPUID decodes a FileMeta.CPUID string recorded for the given
+// FileMeta.Arch into a CPUInfo. It reports false if cpuid is empty or
+// in a format this package doesn't recognize.
+func parseCPUID(arch, cpuid string) (CPUInfo, bool) {
+	if cpuid == "" {
+		return CPUInfo{}, false
+	}
+	if strings.HasPrefix(arch, "aarch64") || strings.HasPrefix(arch, "arm64") {
+		return parseCPUIDARM64(cpuid)
+	}
+	return parseCPUIDX86(cpuid)
+}
+
+// parseCPUIDX86 decodes the x86 CPUID string perf writes, a
+// comma-separated "vendor,family,model,stepping" such as
+// "GenuineIntel,6,69,1".
+func parseCPUIDX86(cpuid string) (CPUInfo, bool) {
+	parts := strings.Split(cpuid, ",")
+	if len(parts) < 4 {
+		return CPUInfo{}, false
+	}
+	family, err1 := strconv.Atoi(parts[1])
+	model, err2 := strconv.Atoi(parts[2])
+	stepping, err3 := strconv.Atoi(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return CPUInfo{}, false
+	}
+	return CPUInfo{
+		Vendor:   parts[0],
+		Family:   family,
+		Model:    model,
+		Stepping: stepping,
+		Features: x86Features(parts[0], family, model),
+	}, true
+}
+
+// parseCPUIDARM64 decodes the arm64 CPUID string perf writes, a
+// comma-separated MIDR_EL1 "implementer,variant,architecture,part,revision"
+// such as "0x41,0x1,0xf,0xd0c,0x1".
+func parseCPUIDARM64(cpuid string) (CPUInfo, bool) {
+	parts := strings.Split(cpuid, ",")
+	if len(parts) < 5 {
+		return CPUInfo{}, false
+	}
+	implementer, err1 := strconv.ParseInt(parts[0], 0, 64)
+	part, err2 := strconv.ParseInt(parts[3], 0, 64)
+	revision, err3 := strconv.ParseInt(parts[4], 0, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return CPUInfo{}, false
+	}
+	return CPUInfo{
+		Vendor:   armImplementerName(int(implementer)),
+		Family:   int(part),
+		Model:    int(implementer),
+		Stepping: int(revision),
+		// perf_event_open requires a PMUv3-compatible PMU on
+		// arm64, so every core perf can profile has one.
+		Features: FeaturePMUv3,
+	}, true
+}
+
+func armImplementerName(id int) string {
+	switch id {
+	case 0x41:
+		return "ARM"
+	case 0x42:
+		return "Broadcom"
+	case 0x43:
+		return "Cavium"
+	case 0x48:
+		return "HiSilicon"
+	case 0x4e:
+		return "Nvidia"
+	case 0x51:
+		return "Qualcomm"
+	case 0x53:
+		return "Samsung"
+	case 0x61:
+		return "Apple"
+	}
+	return "unknown"
+}
+
+// x86Features returns the subset of CPUFeatures this package can
+// infer purely from an x86 CPU's vendor, family, and model. This
+// covers only a few widely-deployed features used to tell older and
+// newer cores apart (such as distinguishing P-cores from E-cores on
+// hybrid systems); it's not a general CPUID feature database.
+func x86Features(vendor string, family, model int) CPUFeatures {
+	var f CPUFeatures
+	switch vendor {
+	case "GenuineIntel":
+		// Haswell (06_3CH) and later support AVX2 and BMI2.
+		if family == 6 && model >= 0x3C {
+			f |= FeatureAVX2 | FeatureBMI2
+		}
+	case "AuthenticAMD":
+		// Excavator (family 0x15, model >= 0x60) and all
+		// Zen-and-later (family >= 0x17) support AVX2 and BMI2.
+		if family > 0x15 || (family == 0x15 && model >= 0x60) {
+			f |= FeatureAVX2 | FeatureBMI2
+		}
+	}
+	return f
+}
@@ -1,5 +1,14 @@
 package perffile
 
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 /*gendefs:C
 #include <include/uapi/linux/perf_event.h>
 */
@@ -29,10 +38,38 @@ type EventGeneric struct {
 	// described by Type and ID.
 	//
 	// In perf_event_attr, this corresponds to
-	// perf_event_attr.config1 and config2.
+	// perf_event_attr.config1, config2, and config3.
 	Config []uint64
 }
 
+// pmuTypeShift is PERF_PMU_TYPE_SHIFT: on hybrid (heterogeneous-core)
+// systems, a hardware or hw-cache event's PMU is selected by the
+// upper 32 bits of config (see EventGeneric.PMUType), rather than by
+// Type itself, so perf_type_id can stay PERF_TYPE_HARDWARE or
+// PERF_TYPE_HW_CACHE regardless of which core type the event counts
+// on.
+const pmuTypeShift = 32
+
+// PMUType returns the PMU type ID encoded in the upper 32 bits of
+// g.ID, and whether one is present. This only applies to
+// EventTypeHardware and EventTypeHWCache events on a hybrid system
+// such as Intel Alder Lake; resolve the returned PMUTypeID to a PMU
+// name (such as "cpu_core" or "cpu_atom") via
+// FileMeta.HybridCores or FileMeta.PMUMappings.
+func (g EventGeneric) PMUType() (typ PMUTypeID, ok bool) {
+	if g.Type != EventTypeHardware && g.Type != EventTypeHWCache {
+		return 0, false
+	}
+	typ = PMUTypeID(g.ID >> pmuTypeShift)
+	return typ, typ != 0
+}
+
+// HardwareID returns g.ID with any PMU type ID (see PMUType) masked
+// out, leaving just the underlying perf_hw_id or perf_hw_cache_id.
+func (g EventGeneric) HardwareID() uint64 {
+	return g.ID & (1<<pmuTypeShift - 1)
+}
+
 // Decode decodes a generic event g into a specific event type.
 func (g *EventGeneric) Decode() Event {
 	switch g.Type {
@@ -47,9 +84,10 @@ func (g *EventGeneric) Decode() Event {
 
 	case EventTypeHWCache:
 		return EventHWCache{
-			HWCache(g.ID),
-			HWCacheOp(g.ID >> 8),
-			HWCacheResult(g.ID >> 16),
+			Level:   HWCache(g.ID),
+			Op:      HWCacheOp(g.ID >> 8),
+			Result:  HWCacheResult(g.ID >> 16),
+			PMUType: uint32(g.ID >> pmuTypeShift),
 		}
 
 	case EventTypeRaw:
@@ -63,6 +101,15 @@ func (g *EventGeneric) Decode() Event {
 		}
 	}
 
+	if device, ok := lookupPMUType(g.Type); ok {
+		return PMUEvent{
+			Device: device,
+			Type:   g.Type,
+			ID:     g.ID,
+			Config: g.Config,
+		}
+	}
+
 	return eventUnknown{*g}
 }
 
@@ -140,10 +187,15 @@ type EventHWCache struct {
 	Level  HWCache
 	Op     HWCacheOp
 	Result HWCacheResult
+
+	// PMUType is the PMU type ID this event counts on, or 0 if
+	// unspecified; see EventGeneric.PMUType. This only applies on
+	// a hybrid (P-core/E-core) system.
+	PMUType uint32
 }
 
 func (e EventHWCache) Generic() EventGeneric {
-	id := uint64(e.Level) | uint64(e.Op)<<8 | uint64(e.Result)<<16
+	id := uint64(e.Level) | uint64(e.Op)<<8 | uint64(e.Result)<<16 | uint64(e.PMUType)<<pmuTypeShift
 	return EventGeneric{Type: EventTypeHWCache, ID: id}
 }
 
@@ -234,3 +286,247 @@ const (
 	BreakpointOpRW              = BreakpointOpR | BreakpointOpW
 	BreakpointOpX               = 4
 )
+
+// EventTypePMU marks the dynamic range of EventType values assigned
+// by the kernel to individual PMUs, such as uncore or SPE PMUs.
+// Unlike the other EventType constants above, there's no single
+// fixed type number here: each PMU's type is assigned at boot and
+// published in /sys/bus/event_source/devices/<name>/type. ResolvePMU
+// reads that file to build a PMUEvent with the right EventType, and
+// Decode consults the PMUs it has seen to recognize them again.
+//
+// This corresponds to the use of "type" in struct perf_pmu from the
+// kernel's tools/perf/util/pmu.h.
+const EventTypePMU EventType = 1<<32 - 1
+
+// PMUEvent represents an event resolved against a PMU described in
+// /sys/bus/event_source/devices, such as an uncore or SPE event.
+// Construct one with ResolvePMU rather than directly.
+type PMUEvent struct {
+	// Device is the PMU's sysfs name, e.g. "uncore_imc_0" or
+	// "arm_spe_0".
+	Device string
+	// Fields gives the resolved value of each format field that
+	// was set, keyed by field name, e.g. {"event": 0x04, "umask":
+	// 0x04}.
+	Fields map[string]uint64
+
+	Type   EventType
+	ID     uint64
+	Config []uint64
+}
+
+func (e PMUEvent) Generic() EventGeneric {
+	return EventGeneric{Type: e.Type, ID: e.ID, Config: e.Config}
+}
+
+// PMUName returns the sysfs device name of e's PMU, e.g.
+// "uncore_imc_0".
+func (e PMUEvent) PMUName() string {
+	return e.Device
+}
+
+// pmuSysfsDir is the base of the kernel's PMU description hierarchy.
+// It's a var so tests can point it elsewhere.
+var pmuSysfsDir = "/sys/bus/event_source/devices"
+
+// pmuTypes records the EventType discovered for each PMU device that
+// ResolvePMU has looked up, so that EventGeneric.Decode can recognize
+// a previously-resolved PMUEvent's type again.
+var pmuTypes = struct {
+	mu    sync.Mutex
+	byTyp map[EventType]string
+}{byTyp: make(map[EventType]string)}
+
+func registerPMUType(device string, typ EventType) {
+	pmuTypes.mu.Lock()
+	defer pmuTypes.mu.Unlock()
+	pmuTypes.byTyp[typ] = device
+}
+
+func lookupPMUType(typ EventType) (device string, ok bool) {
+	pmuTypes.mu.Lock()
+	defer pmuTypes.mu.Unlock()
+	device, ok = pmuTypes.byTyp[typ]
+	return
+}
+
+// ResolvePMU resolves a symbolic PMU event specification, such as
+// "uncore_imc_0/cas_count_read/" or "arm_spe_0/ts_enable=1/", in to
+// an Event the same way the perf command line does. name has the
+// form "device/terms/", where device is a PMU's name under
+// /sys/bus/event_source/devices and terms is a comma-separated list
+// of either a name defined in device's events/ directory (such as
+// "cas_count_read") or a literal field=value assignment (such as
+// "ts_enable=1"); the two kinds of term can be mixed.
+//
+// ResolvePMU reads device's "type" file for the EventType to use,
+// and, for each resolved field=value term, reads device's
+// format/<field> file (e.g. "config:0-7") to find which bits of
+// EventGeneric.ID/Config the value belongs in.
+func ResolvePMU(name string) (Event, error) {
+	device, terms, err := splitPMUSpec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, err := readPMUType(device)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := expandPMUTerms(device, terms)
+	if err != nil {
+		return nil, err
+	}
+
+	var words [3]uint64
+	for field, val := range fields {
+		format, err := readPMUFormat(device, field)
+		if err != nil {
+			return nil, err
+		}
+		format.pack(&words, val)
+	}
+
+	registerPMUType(device, typ)
+
+	return PMUEvent{
+		Device: device,
+		Fields: fields,
+		Type:   typ,
+		ID:     words[0],
+		Config: []uint64{words[1], words[2]},
+	}, nil
+}
+
+// splitPMUSpec splits a PMU event spec of the form "device/terms" or
+// "device/terms/" in to its device and terms parts.
+func splitPMUSpec(name string) (device, terms string, err error) {
+	name = strings.TrimSuffix(name, "/")
+	i := strings.IndexByte(name, '/')
+	if i < 0 {
+		return "", "", fmt.Errorf("perffile: PMU event %q must have the form device/event/", name)
+	}
+	return name[:i], name[i+1:], nil
+}
+
+// expandPMUTerms resolves the comma-separated terms of a PMU event
+// spec for device in to a set of field=value assignments, expanding
+// any named events (device/events/<name>) along the way.
+func expandPMUTerms(device, terms string) (map[string]uint64, error) {
+	fields := make(map[string]uint64)
+	for _, term := range strings.Split(terms, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		if i := strings.IndexByte(term, '='); i >= 0 {
+			field, valStr := term[:i], term[i+1:]
+			val, err := strconv.ParseUint(valStr, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("perffile: bad value %q for %s/%s: %s", valStr, device, field, err)
+			}
+			fields[field] = val
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(pmuSysfsDir, device, "events", term))
+		if err != nil {
+			return nil, fmt.Errorf("perffile: unknown PMU event %s/%s/: %s", device, term, err)
+		}
+		named, err := expandPMUTerms(device, strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		for field, val := range named {
+			fields[field] = val
+		}
+	}
+	return fields, nil
+}
+
+func readPMUType(device string) (EventType, error) {
+	data, err := ioutil.ReadFile(filepath.Join(pmuSysfsDir, device, "type"))
+	if err != nil {
+		return 0, fmt.Errorf("perffile: unknown PMU %q: %s", device, err)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("perffile: bad type for PMU %q: %s", device, err)
+	}
+	return EventType(n), nil
+}
+
+// pmuFormat describes where a field's value is packed in to the raw
+// config words of an event, as read from a PMU's
+// format/<field> file, e.g. "config:0-7" or "config1:4,8-15".
+type pmuFormat struct {
+	word int // 0 = EventGeneric.ID (config), 1 = Config[0] (config1), 2 = Config[1] (config2)
+	bits []pmuBitRange
+}
+
+// pmuBitRange is an inclusive bit range [lo, hi] in to which
+// successive low bits of a field's value are packed.
+type pmuBitRange struct {
+	lo, hi uint
+}
+
+func readPMUFormat(device, field string) (pmuFormat, error) {
+	data, err := ioutil.ReadFile(filepath.Join(pmuSysfsDir, device, "format", field))
+	if err != nil {
+		return pmuFormat{}, fmt.Errorf("perffile: unknown field %s/%s: %s", device, field, err)
+	}
+	return parsePMUFormat(device, field, strings.TrimSpace(string(data)))
+}
+
+func parsePMUFormat(device, field, spec string) (pmuFormat, error) {
+	word, bitsStr, ok := splitOnColon(spec)
+	if !ok {
+		return pmuFormat{}, fmt.Errorf("perffile: bad format spec %q for %s/%s", spec, device, field)
+	}
+
+	var f pmuFormat
+	switch word {
+	case "config":
+		f.word = 0
+	case "config1":
+		f.word = 1
+	case "config2":
+		f.word = 2
+	default:
+		return pmuFormat{}, fmt.Errorf("perffile: bad format word %q for %s/%s", word, device, field)
+	}
+
+	for _, r := range strings.Split(bitsStr, ",") {
+		var lo, hi uint
+		if n, _ := fmt.Sscanf(r, "%d-%d", &lo, &hi); n == 2 {
+		} else if n, _ := fmt.Sscanf(r, "%d", &lo); n == 1 {
+			hi = lo
+		} else {
+			return pmuFormat{}, fmt.Errorf("perffile: bad bit range %q for %s/%s", r, device, field)
+		}
+		f.bits = append(f.bits, pmuBitRange{lo, hi})
+	}
+	return f, nil
+}
+
+func splitOnColon(s string) (before, after string, ok bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// pack scatters val's low bits across f's bit ranges (lowest range
+// first) and ORs them in to the appropriate word of words.
+func (f pmuFormat) pack(words *[3]uint64, val uint64) {
+	for _, r := range f.bits {
+		n := r.hi - r.lo + 1
+		mask := uint64(1)<<n - 1
+		words[f.word] |= (val & mask) << r.lo
+		val >>= n
+	}
+}
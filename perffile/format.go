@@ -5,6 +5,7 @@
 package perffile
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -77,6 +78,33 @@ const (
 	featureBranchStack
 	featurePMUMappings
 	featureGroupDesc
+
+	// featureCompressed is HEADER_COMPRESSED, given an explicit
+	// value for the same reason as featureCgroups below.
+	featureCompressed feature = 31
+
+	// featureCgroups is HEADER_CGROUP. It's given an explicit value
+	// rather than continuing the iota sequence above because
+	// upstream perf appends new feature bits to the end of this
+	// enum to keep existing perf.data files' feature bitmaps
+	// compatible, and several features between HEADER_GROUP_DESC
+	// and HEADER_CGROUP (HEADER_AUXTRACE, HEADER_STAT,
+	// HEADER_CACHE, and so on) aren't implemented by this package.
+	featureCgroups feature = 32
+
+	// featurePMUCaps and featureHybridTopology are HEADER_PMU_CAPS
+	// and HEADER_HYBRID_TOPOLOGY, given explicit values for the
+	// same reason as featureCgroups above.
+	featurePMUCaps        feature = 33
+	featureHybridTopology feature = 34
+
+	// featureCPUPMUCaps, featureClockID, and featureClockData are
+	// HEADER_CPU_PMU_CAPS, HEADER_CLOCKID, and HEADER_CLOCK_DATA,
+	// given explicit values for the same reason as featureCgroups
+	// above.
+	featureCPUPMUCaps feature = 35
+	featureClockID    feature = 36
+	featureClockData  feature = 37
 )
 
 // perf_file_attr from tools/perf/util/header.c
@@ -105,7 +133,7 @@ type eventAttrV0 struct {
 }
 
 // eventAttrVN is the on-disk latest version of the perf_event_attr
-// structure (currently version 7).
+// structure (currently version 8).
 type eventAttrVN struct {
 	eventAttrV0
 
@@ -138,6 +166,9 @@ type eventAttrVN struct {
 
 	// ABI v7
 	SigData uint64 // User-provided data passed in sigcontext to SIGTRAP.
+
+	// ABI v8
+	Config3 uint64 // Additional generic event configuration, alongside config1/config2.
 }
 
 // TODO: Make public
@@ -175,6 +206,12 @@ const (
 // An EventID combined with an EventType describes a specific event.
 type EventID uint64
 
+// A PMUTypeID is the kernel's numerical identifier for a PMU, as
+// assigned dynamically at boot and published in
+// /sys/bus/event_source/devices/<name>/type. Resolve one to a PMU
+// name via FileMeta.PMUMappings.
+type PMUTypeID uint32
+
 // EventAttr describes an event and how that event should be recorded.
 //
 // This corresponds to the perf_event_attr struct from
@@ -184,6 +221,18 @@ type EventAttr struct {
 	// sampled.
 	Event Event
 
+	// Name is this event's human-readable name (such as "cycles"
+	// or "cache-misses"), or "" if the profile has no
+	// HEADER_EVENT_DESC section.
+	Name string
+
+	// IDs is the set of SampleIDs perf recorded for this event
+	// (one per CPU/thread it was scheduled on), matching
+	// RecordCommon.ID. It's nil if the profile has no
+	// HEADER_EVENT_DESC section. Use File.AttrByID to go the other
+	// way, from a SampleID back to its EventAttr.
+	IDs []uint64
+
 	// SamplePeriod, if non-zero, is the approximate number of
 	// events between each sample.
 	//
@@ -253,6 +302,23 @@ type EventAttr struct {
 	// SampleMaxStack is the maximum number of frame pointers in a
 	// callchain. Should be < /proc/sys/kernel/perf_event_max_stack.
 	SampleMaxStack uint16
+
+	// SigData is user-provided data delivered in siginfo_t's
+	// si_perf_data when EventFlagSigtrap sends a synchronous
+	// SIGTRAP for this event, or 0 if unused.
+	SigData uint64
+}
+
+// PMUType returns the PMU type ID encoded in a's Event, and whether
+// one is present; see EventGeneric.PMUType.
+func (a *EventAttr) PMUType() (PMUTypeID, bool) {
+	return a.Event.Generic().PMUType()
+}
+
+// HardwareID returns a's Event with any PMU type ID (see PMUType)
+// masked out; see EventGeneric.HardwareID.
+func (a *EventAttr) HardwareID() uint64 {
+	return a.Event.Generic().HardwareID()
 }
 
 // A SampleFormat is a bitmask of the fields recorded by a sample.
@@ -433,6 +499,8 @@ const (
 	EventFlagNamespaces
 	// Include ksymbol events.
 	EventFlagKsymbol
+	// Include BPF program load/unload events.
+	EventFlagBPFEvent
 	// Generate aux records instead of events.
 	EventFlagAuxOutput
 	// Include cgroup events.
@@ -447,6 +515,14 @@ const (
 	EventFlagRemoveOnExec
 	// Send synchronous SIGTRAP on event.
 	EventFlagSigtrap
+	// User space controls AUX tracing via ioctl(PERF_EVENT_IOC_PAUSE_OUTPUT).
+	EventFlagAuxAction
+	// AUX area tracing starts paused, waiting for PERF_EVENT_IOC_PAUSE_OUTPUT(0) to resume.
+	EventFlagAuxStartPaused
+	// This event pauses AUX area tracing when it occurs (requires EventFlagAuxAction).
+	EventFlagAuxPause
+	// This event resumes AUX area tracing when it occurs (requires EventFlagAuxAction).
+	EventFlagAuxResume
 
 	eventFlagPreciseShift = 15
 	eventFlagPreciseMask  = 0x3 << eventFlagPreciseShift
@@ -569,6 +645,19 @@ const (
 	recordTypeEventUpdate
 	recordTypeTimeConv
 	recordTypeHeaderFeature
+
+	// recordTypeCompressed is PERF_RECORD_COMPRESSED: its payload is
+	// a zstd-compressed run of records (see FileMeta.Compression),
+	// which Records.Next decompresses and splices into the record
+	// stream rather than returning directly.
+	recordTypeCompressed
+
+	// recordTypeCompressed2 is PERF_RECORD_COMPRESSED2, given an
+	// explicit value for the same reason as featureCgroups in
+	// meta.go: several record types between PERF_RECORD_COMPRESSED
+	// and PERF_RECORD_COMPRESSED2 aren't implemented by this
+	// package. It's handled identically to recordTypeCompressed.
+	recordTypeCompressed2 RecordType = 87
 )
 
 // PERF_RECORD_MISC_* from include/uapi/linux/perf_event.h
@@ -901,7 +990,7 @@ type KsymbolFlags uint64
 
 const (
 	// Ksymbol was unregistered.
-	KsymbolFlagUnregister KsymbolFlags = iota
+	KsymbolFlagUnregister KsymbolFlags = 1 << iota
 )
 
 // RecordBPFEvent records BPF program load/unload information.
@@ -911,7 +1000,7 @@ type RecordBPFEvent struct {
 	EventType BPFEventType
 	Flags     BPFEventFlags
 	ID        uint32
-	Tag       uint64
+	Tag       [8]byte
 }
 
 func (r *RecordBPFEvent) Type() RecordType {
@@ -937,7 +1026,7 @@ type BPFEventFlags uint16
 type RecordCGroup struct {
 	RecordCommon
 
-	ID   uint32
+	ID   uint64
 	Path string
 }
 
@@ -974,11 +1063,34 @@ func (r *RecordAuxOutputHardwareID) Type() RecordType {
 	return RecordTypeAuxOutputHardwareID
 }
 
+// AuxtraceKind identifies the format of the AUX area trace data
+// described by a RecordAuxtraceInfo, such as Intel PT or ARM
+// CoreSight ETM.
+//
+// See enum auxtrace_type in tools/perf/util/auxtrace.h.
+type AuxtraceKind uint32
+
+//go:generate stringer -type=AuxtraceKind
+
+const (
+	AuxtraceKindUnknown    AuxtraceKind = 0
+	AuxtraceKindIntelPT    AuxtraceKind = 1
+	AuxtraceKindIntelBTS   AuxtraceKind = 2
+	AuxtraceKindCSETM      AuxtraceKind = 3
+	AuxtraceKindARMSPE     AuxtraceKind = 4
+	AuxtraceKindS390CPUMSF AuxtraceKind = 5
+	AuxtraceKindCSETE      AuxtraceKind = 6
+)
+
 type RecordAuxtraceInfo struct {
 	RecordCommon
 
-	Kind uint32
+	Kind AuxtraceKind
 
+	// Priv is Kind's remaining, kind-specific payload, not yet
+	// decoded. An AuxtraceDecoder registered for Kind (see
+	// RegisterAuxtraceDecoder) turns this into a usable value via
+	// DecodeInfo; RecordAuxtrace.Decoded does this automatically.
 	Priv []uint64
 }
 
@@ -1007,12 +1119,104 @@ type RecordAuxtrace struct {
 	// Data is the raw auxiliary data. The encoding of this
 	// depends on the latest RecordAuxtraceInfo.
 	Data []byte
+
+	// info is the RecordAuxtraceInfo that was most recently read
+	// before this record in file order, which describes how to
+	// interpret Data. File.AuxTraces sets this; records returned
+	// directly from Records.Next don't have it.
+	info *RecordAuxtraceInfo
+
+	decodedOnce bool
+	decoded     AuxtracePackets
+	decodeErr   error
 }
 
 func (r *RecordAuxtrace) Type() RecordType {
 	return RecordTypeAuxtrace
 }
 
+// Decoded decodes r.Data using the AuxtraceDecoder registered (via
+// RegisterAuxtraceDecoder) for the Kind of the RecordAuxtraceInfo that
+// applies to r, caching the result so repeated calls are free. It
+// only works for a RecordAuxtrace returned by File.AuxTraces, since
+// that's what resolves which RecordAuxtraceInfo applies; it returns an
+// error for one returned directly by Records.Next.
+func (r *RecordAuxtrace) Decoded() (AuxtracePackets, error) {
+	if r.decodedOnce {
+		return r.decoded, r.decodeErr
+	}
+	r.decodedOnce = true
+
+	if r.info == nil {
+		r.decodeErr = fmt.Errorf("perffile: RecordAuxtrace has no associated RecordAuxtraceInfo; use File.AuxTraces")
+		return nil, r.decodeErr
+	}
+	dec, ok := auxtraceDecoders[r.info.Kind]
+	if !ok {
+		r.decodeErr = fmt.Errorf("perffile: no AuxtraceDecoder registered for %v", r.info.Kind)
+		return nil, r.decodeErr
+	}
+	info, err := dec.DecodeInfo(r.info.Priv)
+	if err != nil {
+		r.decodeErr = fmt.Errorf("perffile: decoding %v auxtrace info: %w", r.info.Kind, err)
+		return nil, r.decodeErr
+	}
+	r.decoded, err = dec.DecodePackets(bytes.NewReader(r.Data), info)
+	r.decodeErr = err
+	return r.decoded, r.decodeErr
+}
+
+// An AuxtraceDecoder decodes the AUX area trace format identified by
+// an AuxtraceKind, turning a RecordAuxtraceInfo's raw Priv payload and
+// a RecordAuxtrace's raw Data into structured packets. Packages that
+// implement a decoder for a trace format register it with
+// RegisterAuxtraceDecoder, typically from an init function.
+type AuxtraceDecoder interface {
+	// DecodeInfo decodes the kind-specific payload of a
+	// RecordAuxtraceInfo.Priv into a value that DecodePackets uses
+	// to interpret the trace data that follows it.
+	DecodeInfo(priv []uint64) (any, error)
+
+	// DecodePackets decodes the raw AUX trace bytes read from r, as
+	// described by info (the result of a prior DecodeInfo call),
+	// into an AuxtracePackets iterator.
+	DecodePackets(r io.Reader, info any) (AuxtracePackets, error)
+}
+
+// AuxtracePackets iterates over the packets an AuxtraceDecoder
+// decoded from a RecordAuxtrace's raw Data.
+type AuxtracePackets interface {
+	// Next advances to the next packet and reports whether there is
+	// one. It returns false at the end of the stream or after an
+	// error, which Err then reports.
+	Next() bool
+
+	// Packet returns the packet most recently decoded by Next. Its
+	// concrete type is specific to the AuxtraceDecoder that
+	// produced it.
+	Packet() any
+
+	// Err returns the first error encountered by Next, if any.
+	Err() error
+}
+
+// auxtraceDecoders maps an AuxtraceKind to the AuxtraceDecoder
+// RecordAuxtrace.Decoded uses to decode it.
+var auxtraceDecoders = make(map[AuxtraceKind]AuxtraceDecoder)
+
+// RegisterAuxtraceDecoder registers dec as the AuxtraceDecoder for AUX
+// trace streams of the given kind, for use by RecordAuxtrace.Decoded.
+// It's meant to be called from the init function of a package that
+// implements a decoder for that kind, such as perffile/intelpt, so
+// that perffile itself doesn't have to depend on every trace format's
+// decoding logic.
+//
+// A later call for the same kind replaces any decoder registered
+// earlier.
+func RegisterAuxtraceDecoder(kind AuxtraceKind, dec AuxtraceDecoder) {
+	auxtraceDecoders[kind] = dec
+}
+
 // A RecordSample records a profiling sample event.
 //
 // Typically only a subset of the fields are used. Which fields are
@@ -0,0 +1,253 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package intelpt is a perffile.AuxtraceDecoder for the Intel
+// Processor Trace (Intel PT) AUX area format, registered under
+// perffile.AuxtraceKindIntelPT.
+//
+// This only recognizes enough of the packet framing to exercise the
+// perffile.AuxtraceDecoder interface: PSB (packet stream boundary),
+// the TIP family (TIP, TIP.PGE, TIP.PGD, FUP) and their IP
+// compression scheme, and short TNT (taken/not-taken). It does not
+// decode MTC/CYC timing packets, long TNT, PIP, VMCS, or any of the
+// other packets Intel PT defines, and because the full packet length
+// table isn't implemented, it scans for recognized headers rather
+// than strictly walking the stream packet-by-packet: bytes that don't
+// match a recognized header are skipped one at a time as the payload
+// or padding of some other, unrecognized packet. See the Intel SDM,
+// volume 3, chapter "Intel Processor Trace" for the full format, and
+// perffile/auxtrace.intelPTDecoder for the analogous (IP-only)
+// decoder used by that package's Merge.
+package intelpt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+func init() {
+	perffile.RegisterAuxtraceDecoder(perffile.AuxtraceKindIntelPT, decoder{})
+}
+
+// Kind identifies the type of a decoded Packet.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindPSB
+	KindTIP
+	KindFUP
+	KindTNT
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindPSB:
+		return "PSB"
+	case KindTIP:
+		return "TIP"
+	case KindFUP:
+		return "FUP"
+	case KindTNT:
+		return "TNT"
+	default:
+		return "Unknown"
+	}
+}
+
+// A Packet is one decoded Intel PT packet.
+type Packet struct {
+	Kind Kind
+
+	// IP is the target address carried by a TIP or FUP packet. It's
+	// zero if the packet's IP compression field indicated the IP is
+	// out of context (not reconstructible from this stream alone).
+	IP uint64
+
+	// Taken holds the taken (true) / not-taken (false) outcomes
+	// carried by a TNT packet, oldest first.
+	Taken []bool
+}
+
+// Info is the Intel PT-specific payload of a RecordAuxtraceInfo, as
+// decoded by decoder.DecodeInfo. The real payload (see the
+// intel_pt_auxtrace_info layout in tools/perf/util/intel-pt.c)
+// encodes PMU configuration and the TSC-to-perf-clock conversion
+// parameters; this skeleton keeps only the raw words so a caller can
+// get at them until those fields are decoded individually.
+type Info struct {
+	Raw []uint64
+}
+
+type decoder struct{}
+
+func (decoder) DecodeInfo(priv []uint64) (any, error) {
+	return &Info{Raw: append([]uint64(nil), priv...)}, nil
+}
+
+func (decoder) DecodePackets(r io.Reader, info any) (perffile.AuxtracePackets, error) {
+	if _, ok := info.(*Info); !ok {
+		return nil, fmt.Errorf("intelpt: DecodePackets called with non-Intel-PT info %T", info)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &packets{data: data}, nil
+}
+
+// psbPattern is the 16-byte Packet Stream Boundary pattern: eight
+// repetitions of the 2-byte sequence 0x02, 0x82.
+var psbPattern = [16]byte{
+	0x02, 0x82, 0x02, 0x82, 0x02, 0x82, 0x02, 0x82,
+	0x02, 0x82, 0x02, 0x82, 0x02, 0x82, 0x02, 0x82,
+}
+
+// tipOpcode identifies one of the TIP-family packets by the low 5
+// bits of its header byte; the high 3 bits give the IP compression
+// field (see ipBytes).
+type tipOpcode byte
+
+const (
+	opTIPPGD tipOpcode = 0x01 // TIP.PGD: target IP, tracing disabled
+	opTIP    tipOpcode = 0x0d // TIP: target IP of an indirect branch
+	opTIPPGE tipOpcode = 0x11 // TIP.PGE: target IP, tracing enabled
+	opFUP    tipOpcode = 0x1d // FUP: flow update IP (e.g. before an async event)
+)
+
+// ipBytes maps the 3-bit IP compression field of a TIP-family header
+// to the number of payload bytes that follow.
+func ipBytes(field byte) int {
+	switch field {
+	case 0:
+		return 0 // no payload; IP is out of context
+	case 1:
+		return 2
+	case 2:
+		return 4
+	case 3, 4:
+		return 6
+	case 6:
+		return 8
+	default:
+		return -1 // reserved
+	}
+}
+
+// decodeIP combines a TIP-family packet's payload with last (the
+// previously reconstructed IP) according to its IP compression field.
+func decodeIP(field byte, payload []byte, last uint64) uint64 {
+	var v uint64
+	for i := len(payload) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(payload[i])
+	}
+	switch field {
+	case 1:
+		return last&^0xffff | v
+	case 2:
+		return last&^0xffffffff | v
+	case 3:
+		// Sign-extend from bit 47, per the canonical-address form
+		// used by this compression level.
+		if v&(1<<47) != 0 {
+			v |= ^uint64(0) << 48
+		}
+		return v
+	case 4:
+		return last&^0xffffffffffff | v
+	case 6:
+		return v
+	default:
+		return last
+	}
+}
+
+// decodeTNT decodes the taken/not-taken bits packed into a short TNT
+// header byte. Bit 0 marks the packet as TNT; scanning down from bit
+// 7, the highest set bit is a stop marker, and every bit below it
+// (down to bit 1) is a taken (1) or not-taken (0) outcome, oldest
+// first.
+func decodeTNT(b byte) []bool {
+	stop := -1
+	for pos := 7; pos >= 1; pos-- {
+		if b&(1<<uint(pos)) != 0 {
+			stop = pos
+			break
+		}
+	}
+	if stop < 0 {
+		return nil
+	}
+	taken := make([]bool, 0, stop-1)
+	for pos := stop - 1; pos >= 1; pos-- {
+		taken = append(taken, b&(1<<uint(pos)) != 0)
+	}
+	return taken
+}
+
+// packets implements perffile.AuxtracePackets over a decoded Intel PT
+// byte stream.
+type packets struct {
+	data   []byte
+	pos    int
+	lastIP uint64
+	cur    Packet
+	err    error
+}
+
+func (p *packets) Next() bool {
+	for p.pos < len(p.data) {
+		if p.pos+16 <= len(p.data) && bytes.Equal(p.data[p.pos:p.pos+16], psbPattern[:]) {
+			p.cur = Packet{Kind: KindPSB}
+			p.pos += 16
+			return true
+		}
+
+		b := p.data[p.pos]
+		field := b >> 5
+		switch tipOpcode(b & 0x1f) {
+		case opTIP, opTIPPGE, opTIPPGD, opFUP:
+			n := ipBytes(field)
+			if n < 0 || p.pos+1+n > len(p.data) {
+				// Malformed or truncated packet; give up rather
+				// than misinterpret trailing bytes.
+				return false
+			}
+			kind := KindTIP
+			if tipOpcode(b&0x1f) == opFUP {
+				kind = KindFUP
+			}
+			ip := p.lastIP
+			if n > 0 {
+				ip = decodeIP(field, p.data[p.pos+1:p.pos+1+n], p.lastIP)
+				p.lastIP = ip
+			}
+			p.cur = Packet{Kind: kind, IP: ip}
+			p.pos += 1 + n
+			return true
+		}
+
+		if b&1 == 1 {
+			p.cur = Packet{Kind: KindTNT, Taken: decodeTNT(b)}
+			p.pos++
+			return true
+		}
+
+		// Not a recognized header; treat as payload/padding of some
+		// other packet this decoder doesn't parse.
+		p.pos++
+	}
+	return false
+}
+
+func (p *packets) Packet() any {
+	return p.cur
+}
+
+func (p *packets) Err() error {
+	return p.err
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package lbrstitch reconstructs call stacks deeper than the
+// hardware's last-branch-record (LBR) depth by stitching the branch
+// stacks of consecutive samples on the same thread together.
+//
+// An LBR-based RecordSample.BranchStack only records the last few
+// dozen branches before the sample, which often isn't enough to
+// reconstruct a full call stack. But if samples are frequent enough
+// that consecutive samples' branch windows overlap, the branches that
+// fell out of one sample's window are still present, in full, at the
+// tail of the next sample's window (indexed by BranchHWIndex, the
+// hardware's raw, ever-increasing branch counter). Folding the
+// intervening calls and returns into a running per-thread call stack
+// lets a Stitcher extend each sample's Callchain with frames the LBR
+// itself never captured.
+package lbrstitch
+
+import "github.com/aclements/go-perf/perffile"
+
+// A Stitcher stitches RecordSample.BranchStack windows across
+// consecutive samples on the same TID to reconstruct call stack
+// frames deeper than any single sample's hardware branch stack, and
+// augments each sample's Callchain with the frames it reconstructs.
+//
+// The zero Stitcher is not usable; create one with New.
+type Stitcher struct {
+	tids map[int]*tidHistory
+}
+
+// tidHistory is the per-TID state threaded between consecutive
+// samples.
+type tidHistory struct {
+	// branchStack and hwIndex are the BranchStack and BranchHWIndex
+	// of the most recent sample seen on this TID for which they
+	// were available, so the next sample can detect the overlap
+	// between the two hardware branch windows. branchStack is nil
+	// if the most recent sample had no usable branch stack (in
+	// which case there's nothing to stitch the next sample
+	// against).
+	branchStack []perffile.BranchRecord
+	hwIndex     int64
+
+	// calls is the stack of call sites folded from the branches
+	// that fell out of consecutive samples' overlapping windows but
+	// weren't matched by a later return, oldest unmatched call
+	// first. These are the frames the LBR-truncated Callchain never
+	// captured; Update appends them to each sample's Callchain,
+	// most recent (innermost) first.
+	calls []uint64
+}
+
+// New creates a Stitcher with no TID history.
+func New() *Stitcher {
+	return &Stitcher{tids: make(map[int]*tidHistory)}
+}
+
+// Update processes r, threading lbrstitch's per-TID state through it.
+//
+// For a *perffile.RecordSample with a usable BranchHWIndex (as
+// recorded when EventAttr.BranchSampleType&BranchSampleHWIndex is
+// set), Update stitches its BranchStack against the previous sample
+// seen on the same TID and appends any call frames it can reconstruct
+// to r.Callchain, innermost first, preserving whatever CallchainUser
+// and other markers r.Callchain already had.
+//
+// For a *perffile.RecordExit, or a *perffile.RecordComm with Exec
+// set, Update forgets that TID's history: the next sample on a reused
+// TID, or past an exec, can't be assumed to pick up where the last
+// one left off.
+func (s *Stitcher) Update(r perffile.Record) {
+	switch r := r.(type) {
+	case *perffile.RecordSample:
+		s.stitch(r)
+	case *perffile.RecordExit:
+		delete(s.tids, r.TID)
+	case *perffile.RecordComm:
+		if r.Exec {
+			delete(s.tids, r.TID)
+		}
+	}
+}
+
+func (s *Stitcher) stitch(r *perffile.RecordSample) {
+	if r.BranchHWIndex < 0 || len(r.BranchStack) == 0 {
+		// No usable hardware index (-1 means unsupported), or no
+		// branch stack at all: there's nothing to stitch this
+		// sample against, and nothing for the *next* sample to
+		// stitch against either.
+		delete(s.tids, r.TID)
+		return
+	}
+
+	h := s.tids[r.TID]
+	if h != nil && h.branchStack != nil {
+		// BranchStack[i] corresponds to hardware branch counter
+		// hwIndex-i, so the two windows overlap iff the current
+		// sample's most recent branch (counter r.BranchHWIndex) falls
+		// within the previous sample's window.
+		gap := r.BranchHWIndex - h.hwIndex
+		switch {
+		case gap < 0:
+			// The hardware counter went backwards, e.g. from a
+			// context switch between samples; the two windows can't
+			// be related, so drop whatever call history was pending
+			// and start fresh from this sample.
+			h.calls = nil
+		case gap < int64(len(h.branchStack)):
+			// Entries at indices gap..len(h.branchStack)-1 are older
+			// than anything in the current window: they're branches
+			// that happened strictly between the two samples. Fold
+			// them into the call history, oldest first.
+			older := h.branchStack[gap:]
+			for i := len(older) - 1; i >= 0; i-- {
+				br := older[i]
+				if br.Flags&(perffile.BranchFlagInTransaction|perffile.BranchFlagAbort) != 0 {
+					continue
+				}
+				switch br.Type {
+				case perffile.BranchTypeCall, perffile.BranchTypeIndCall, perffile.BranchTypeCondCall:
+					h.calls = append(h.calls, br.From)
+				case perffile.BranchTypeRet, perffile.BranchTypeCondRet:
+					if len(h.calls) > 0 {
+						h.calls = h.calls[:len(h.calls)-1]
+					}
+				}
+			}
+		default:
+			// The windows didn't overlap at all: the gap between
+			// samples is wider than the previous sample's branch
+			// stack, so there's a span of untraced branches we can't
+			// account for. Drop the pending call history rather than
+			// report a call stack we can't be sure is accurate.
+			h.calls = nil
+		}
+	}
+
+	if h == nil {
+		h = &tidHistory{}
+		s.tids[r.TID] = h
+	}
+	for i := len(h.calls) - 1; i >= 0; i-- {
+		r.Callchain = append(r.Callchain, h.calls[i])
+	}
+	h.branchStack = r.BranchStack
+	h.hwIndex = r.BranchHWIndex
+}
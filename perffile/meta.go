@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 )
 
 type FileMeta struct {
@@ -52,6 +53,11 @@ type FileMeta struct {
 	// stepping, such as "GenuineIntel,6,69,1".
 	CPUID string
 
+	// CPUInfo is CPUID decoded into a structured form, or the zero
+	// CPUInfo if CPUID couldn't be parsed. File.New populates this
+	// from CPUID once Arch is known.
+	CPUInfo CPUInfo
+
 	// TotalMem is the total memory in bytes of the machine that
 	// recorded this profile, or 0 if unknown.
 	TotalMem int64
@@ -79,6 +85,63 @@ type FileMeta struct {
 	// Groups is the descriptions of each perf event group in this
 	// profile, or nil if unknown.
 	Groups []GroupDesc
+
+	// Cgroups maps from cgroup ID to cgroup path (such as
+	// "/user.slice") for the cgroups referenced by RecordCGroup and
+	// RecordSample.CGroup, or nil if unknown. It's populated from
+	// HEADER_CGROUP, which perf records when run with
+	// --all-cgroups.
+	Cgroups map[uint64]string
+
+	// PMUCaps maps from PMU name (such as "cpu" or "cpu_core") to
+	// that PMU's capability strings, such as
+	// {"max_precise": "3"}, or nil if unknown. It's populated from
+	// HEADER_PMU_CAPS.
+	PMUCaps map[string]map[string]string
+
+	// CPUPMUCaps maps from capability name to value (such as
+	// {"max_precise": "3"}) for the default "cpu" PMU, or nil if
+	// unknown. It's populated from HEADER_CPU_PMU_CAPS. Unlike
+	// PMUCaps, which names each PMU, this predates hybrid
+	// (HybridCores) and dynamic PMU support, so it only ever
+	// describes the one PMU perf assumed existed.
+	CPUPMUCaps map[string]string
+
+	// ClockID is the clockid (as in clock_gettime(2), such as
+	// CLOCK_MONOTONIC) used for this profile's Time fields when
+	// EventFlagClockID is set, or 0 if unknown. It's populated
+	// from HEADER_CLOCKID.
+	ClockID int64
+
+	// ClockData correlates this profile's sample clock (see
+	// ClockID) with wall-clock time, so Time fields can be
+	// converted to a real timestamp. It's the zero ClockData if
+	// unknown. It's populated from HEADER_CLOCK_DATA.
+	ClockData ClockData
+
+	// HybridCores describes the PMUs of a heterogeneous (hybrid)
+	// system such as Intel Alder Lake, where "cpu_core" (P-cores)
+	// and "cpu_atom" (E-cores) expose different events through
+	// separate PMUs, or nil if this isn't a hybrid system. It's
+	// populated from HEADER_HYBRID_TOPOLOGY, with each entry's
+	// Capabilities resolved from PMUCaps once both are known.
+	HybridCores []HybridCoreSet
+
+	// Compression describes how this profile's mmap ring buffer
+	// records were compressed, or the zero CompressionInfo if it
+	// wasn't recorded with compression (such as perf record -z).
+	// Records transparently decompresses PERF_RECORD_COMPRESSED and
+	// PERF_RECORD_COMPRESSED2 records using this information, so
+	// callers don't usually need to consult it directly. It's
+	// populated from HEADER_COMPRESSED.
+	Compression CompressionInfo
+
+	// eventDescs holds the raw per-event Name and SampleIDs parsed
+	// from HEADER_EVENT_DESC, in the same order File's EventAttrs
+	// were written. File.New consumes this to populate
+	// EventAttr.Name and EventAttr.IDs, so it's not kept around
+	// afterward.
+	eventDescs []eventDesc
 }
 
 // A BuildIDInfo records the mapping between a single build ID and the
@@ -111,33 +174,119 @@ type NUMANode struct {
 
 // A GroupDesc describes a group of PMU events that are scheduled
 // together.
-//
-// TODO: Are Leader and NumMembers attribute IDs? If so, we should
-// probably map them to *EventAttrs to make this useful.
 type GroupDesc struct {
-	Name       string
+	Name string
+
+	// Leader and NumMembers are the index into File.Events of the
+	// group's leader event and the number of events in the group
+	// (including the leader).
 	Leader     int
 	NumMembers int
+
+	// LeaderAttr and Members resolve Leader and NumMembers into
+	// the File's EventAttrs: Members is File.Events[Leader :
+	// Leader+NumMembers] and LeaderAttr is Members[0]. They're nil
+	// until File.New has read the full set of EventAttrs.
+	LeaderAttr *EventAttr
+	Members    []*EventAttr
+}
+
+// A HybridCoreSet describes the CPUs backed by a single PMU on a
+// heterogeneous (hybrid) system, where different PMUs (and hence
+// different HybridCoreSets) can expose different events and
+// capabilities for the same event ID.
+type HybridCoreSet struct {
+	// PMUName is this PMU's name, such as "cpu_core" or "cpu_atom".
+	PMUName string
+
+	// CPUs is the set of CPUs backed by this PMU.
+	CPUs CPUSet
+
+	// Capabilities is this PMU's capability map, resolved from
+	// FileMeta.PMUCaps, or nil if FileMeta has no HEADER_PMU_CAPS
+	// section for this PMU.
+	Capabilities map[string]string
+}
+
+// A CompressionType identifies the compression algorithm used to
+// encode PERF_RECORD_COMPRESSED and PERF_RECORD_COMPRESSED2 records.
+type CompressionType uint32
+
+// CompressionZstd is currently the only CompressionType perf
+// supports.
+const CompressionZstd CompressionType = 1
+
+// A CompressionInfo describes the compression parameters perf used
+// when recording with compression enabled (such as perf record -z).
+type CompressionInfo struct {
+	// Version is the HEADER_COMPRESSED section's own format
+	// version.
+	Version uint32
+
+	// Type is the compression algorithm in use.
+	Type CompressionType
+
+	// Level is the compression level perf was asked to use.
+	Level uint32
+
+	// Ratio is the compression ratio perf observed while recording,
+	// as a percentage (so 400 means the compressed data is about a
+	// quarter of the uncompressed size).
+	Ratio uint32
+
+	// MMapLen is the size in bytes of the mmap ring buffer perf
+	// compressed records out of.
+	MMapLen uint32
+}
+
+// A ClockData correlates a profile's sample clock with wall-clock
+// time, as recorded in HEADER_CLOCK_DATA.
+type ClockData struct {
+	// Version is the HEADER_CLOCK_DATA section's own format
+	// version.
+	Version uint32
+
+	// ClockID is the clockid (as in clock_gettime(2)) this data
+	// was captured from; matches FileMeta.ClockID.
+	ClockID uint32
+
+	// WallClockNS is a wall-clock (CLOCK_REALTIME) timestamp, in
+	// nanoseconds since the epoch.
+	WallClockNS uint64
+
+	// ClockIDNS is the same instant as WallClockNS, but read from
+	// ClockID's clock, in nanoseconds. Time fields can be
+	// converted to wall-clock time via WallClockNS + (Time -
+	// ClockIDNS).
+	ClockIDNS uint64
 }
 
 var featureParsers = map[feature]func(*FileMeta, bufDecoder) error{
-	featureBuildID:      (*FileMeta).parseBuildID,
-	featureHostname:     stringFeature("Hostname"),
-	featureOSRelease:    stringFeature("OSRelease"),
-	featureVersion:      stringFeature("Version"),
-	featureArch:         stringFeature("Arch"),
-	featureNrCpus:       (*FileMeta).parseNrCPUs,
-	featureCPUDesc:      stringFeature("CPUDesc"),
-	featureCPUID:        stringFeature("CPUID"),
-	featureTotalMem:     (*FileMeta).parseTotalMem,
-	featureCmdline:      (*FileMeta).parseCmdLine,
-	featureCPUTopology:  (*FileMeta).parseCPUTopology,
-	featureNUMATopology: (*FileMeta).parseNUMATopology,
-	featurePMUMappings:  (*FileMeta).parsePMUMappings,
-	featureGroupDesc:    (*FileMeta).parseGroupDesc,
+	featureBuildID:        (*FileMeta).parseBuildID,
+	featureHostname:       stringFeature("Hostname"),
+	featureOSRelease:      stringFeature("OSRelease"),
+	featureVersion:        stringFeature("Version"),
+	featureArch:           stringFeature("Arch"),
+	featureNrCpus:         (*FileMeta).parseNrCPUs,
+	featureCPUDesc:        stringFeature("CPUDesc"),
+	featureCPUID:          stringFeature("CPUID"),
+	featureTotalMem:       (*FileMeta).parseTotalMem,
+	featureCmdline:        (*FileMeta).parseCmdLine,
+	featureCPUTopology:    (*FileMeta).parseCPUTopology,
+	featureNUMATopology:   (*FileMeta).parseNUMATopology,
+	featurePMUMappings:    (*FileMeta).parsePMUMappings,
+	featureGroupDesc:      (*FileMeta).parseGroupDesc,
+	featureEventDesc:      (*FileMeta).parseEventDesc,
+	featureCgroups:        (*FileMeta).parseCgroups,
+	featurePMUCaps:        (*FileMeta).parsePMUCaps,
+	featureHybridTopology: (*FileMeta).parseHybridTopology,
+	featureCompressed:     (*FileMeta).parseCompressed,
+	featureCPUPMUCaps:     (*FileMeta).parseCPUPMUCaps,
+	featureClockID:        (*FileMeta).parseClockID,
+	featureClockData:      (*FileMeta).parseClockData,
 }
 
-func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
+func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt, order binary.ByteOrder) error {
 	parser := featureParsers[f]
 	if parser == nil {
 		return nil
@@ -148,7 +297,7 @@ func (m *FileMeta) parse(f feature, sec fileSection, r io.ReaderAt) error {
 	if err != nil {
 		return err
 	}
-	bd := bufDecoder{data, binary.LittleEndian}
+	bd := bufDecoder{data, order}
 
 	// Parse the section.
 	return parser(m, bd)
@@ -199,13 +348,30 @@ func (m *FileMeta) parseCmdLine(bd bufDecoder) error {
 	return nil
 }
 
-// TODO: Implement featureEventDesc. This isn't useful unless we also
-// expose attribute IDs or something to make it possible to match up
-// the event descriptions with the samples. Probably we should hide
-// this as a feature section and just expose the set of events in the
-// file, augmented with the string names from this section if
-// available. As far as I can tell, the string name is the *only*
-// thing this section adds over the EventAttrs in the file header.
+// eventDesc is the raw per-event record parsed from
+// HEADER_EVENT_DESC: a human-readable name and the set of SampleIDs
+// perf assigned to this event (one per CPU/thread it was scheduled
+// on, matching RecordCommon.ID).
+type eventDesc struct {
+	name string
+	ids  []uint64
+}
+
+func (m *FileMeta) parseEventDesc(bd bufDecoder) error {
+	nr := bd.u32()
+	attrSize := bd.u32()
+	m.eventDescs = make([]eventDesc, nr)
+	for i := uint32(0); i < nr; i++ {
+		// The perf_event_attr here duplicates the one already
+		// read from the file's attr section; skip over it.
+		bd.skip(int(attrSize))
+		ids := make([]uint64, bd.u32())
+		name := bd.lenString()
+		bd.u64s(ids)
+		m.eventDescs[i] = eventDesc{name, ids}
+	}
+	return nil
+}
 
 func (m *FileMeta) parseCPUTopology(bd bufDecoder) error {
 	var err error
@@ -255,6 +421,83 @@ func (m *FileMeta) parsePMUMappings(bd bufDecoder) error {
 	return nil
 }
 
+func (m *FileMeta) parseCgroups(bd bufDecoder) error {
+	count := bd.u64()
+	m.Cgroups = map[uint64]string{}
+	for i := uint64(0); i < count; i++ {
+		id := bd.u64()
+		m.Cgroups[id] = bd.lenString()
+	}
+	return nil
+}
+
+func (m *FileMeta) parsePMUCaps(bd bufDecoder) error {
+	nrPMUs := bd.u32()
+	m.PMUCaps = map[string]map[string]string{}
+	for i := uint32(0); i < nrPMUs; i++ {
+		name := bd.lenString()
+		caps := map[string]string{}
+		for n := bd.u32(); n > 0; n-- {
+			// Each capability is a single "key=value" string.
+			kv := bd.lenString()
+			if eq := strings.IndexByte(kv, '='); eq >= 0 {
+				caps[kv[:eq]] = kv[eq+1:]
+			}
+		}
+		m.PMUCaps[name] = caps
+	}
+	return nil
+}
+
+func (m *FileMeta) parseHybridTopology(bd bufDecoder) error {
+	var err error
+	nrPMUs := bd.u32()
+	m.HybridCores = make([]HybridCoreSet, nrPMUs)
+	for i := uint32(0); i < nrPMUs; i++ {
+		name := bd.lenString()
+		m.HybridCores[i].PMUName = name
+		m.HybridCores[i].CPUs, err = parseCPUSet(bd.lenString())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FileMeta) parseCompressed(bd bufDecoder) error {
+	m.Compression.Version = bd.u32()
+	m.Compression.Type = CompressionType(bd.u32())
+	m.Compression.Level = bd.u32()
+	m.Compression.Ratio = bd.u32()
+	m.Compression.MMapLen = bd.u32()
+	return nil
+}
+
+func (m *FileMeta) parseCPUPMUCaps(bd bufDecoder) error {
+	m.CPUPMUCaps = map[string]string{}
+	for n := bd.u32(); n > 0; n-- {
+		// Each capability is a single "key=value" string.
+		kv := bd.lenString()
+		if eq := strings.IndexByte(kv, '='); eq >= 0 {
+			m.CPUPMUCaps[kv[:eq]] = kv[eq+1:]
+		}
+	}
+	return nil
+}
+
+func (m *FileMeta) parseClockID(bd bufDecoder) error {
+	m.ClockID = int64(bd.u64())
+	return nil
+}
+
+func (m *FileMeta) parseClockData(bd bufDecoder) error {
+	m.ClockData.Version = bd.u32()
+	m.ClockData.ClockID = bd.u32()
+	m.ClockData.WallClockNS = bd.u64()
+	m.ClockData.ClockIDNS = bd.u64()
+	return nil
+}
+
 func (m *FileMeta) parseGroupDesc(bd bufDecoder) error {
 	count := bd.u32()
 	m.Groups = []GroupDesc{}
@@ -0,0 +1,39 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// TestParseCompressed feeds parseCompressed a hand-built
+// HEADER_COMPRESSED section, in the on-disk version/type/level/
+// ratio/mmap_len layout perf writes, independent of whether Writer
+// happens to produce the same bytes.
+func TestParseCompressed(t *testing.T) {
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(buf[0:], 1)                       // version
+	binary.LittleEndian.PutUint32(buf[4:], uint32(CompressionZstd)) // type
+	binary.LittleEndian.PutUint32(buf[8:], 3)                       // level
+	binary.LittleEndian.PutUint32(buf[12:], 400)                    // ratio
+	binary.LittleEndian.PutUint32(buf[16:], 1<<20)                  // mmap_len
+
+	var m FileMeta
+	if err := m.parseCompressed(bufDecoder{buf, binary.LittleEndian}); err != nil {
+		t.Fatalf("parseCompressed: %v", err)
+	}
+
+	want := CompressionInfo{
+		Version: 1,
+		Type:    CompressionZstd,
+		Level:   3,
+		Ratio:   400,
+		MMapLen: 1 << 20,
+	}
+	if m.Compression != want {
+		t.Errorf("Compression = %+v, want %+v", m.Compression, want)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// RecordsParallelOptions configures File.RecordsParallel.
+type RecordsParallelOptions struct {
+	// Workers is the number of goroutines used to read and decode
+	// records concurrently. If zero, it defaults to
+	// runtime.GOMAXPROCS(0).
+	Workers int
+
+	// Unordered delivers records in whatever order the worker
+	// goroutines happen to finish decoding them, rather than
+	// reassembling file order. This avoids the memory ParallelRecords
+	// otherwise spends reordering results, at the cost of giving up
+	// any ordering guarantee between records (including between a
+	// RecordComm and the RecordSamples it logically precedes).
+	Unordered bool
+}
+
+// A ParallelRecords is a parallel-decoding alternative to Records,
+// returned by File.RecordsParallel. Where Records reads and decodes
+// one record at a time into a handful of structs it reuses across
+// calls, ParallelRecords divides a file's records across worker
+// goroutines that read each record's bytes into its own slab (from a
+// pool, sized to the record) and decode it into a freshly allocated
+// Record that doesn't alias any other in-flight record. A caller done
+// with a Record can return its slab to the pool with Release.
+//
+// ParallelRecords requires random access to the underlying file (so
+// it can't be used on a pipe-mode File) and doesn't yet support files
+// containing PERF_RECORD_COMPRESSED(2) or PERF_RECORD_AUXTRACE
+// records, both of which carry payload bytes outside the record
+// header's length field; RecordsParallel returns an error for those.
+//
+// Typical usage is
+//
+//	rs := file.RecordsParallel(perffile.RecordsParallelOptions{})
+//	defer rs.Close()
+//	for rs.Next() {
+//	  switch r := rs.Record.(type) {
+//	  case *perffile.RecordSample:
+//	    ...
+//	  }
+//	  rs.Release(rs.Record)
+//	}
+//	if rs.Err() { ... }
+type ParallelRecords struct {
+	// Record is the current record, as with Records.Record. Unlike
+	// Records, this never aliases a struct a later call to Next will
+	// overwrite; it's only ever invalidated by Release.
+	Record Record
+
+	pool *slabPool
+
+	raw  chan parallelResult
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	unordered bool
+	pending   map[int]parallelResult
+	next      int
+
+	slabsMu sync.Mutex
+	slabs   map[Record]slabHandle
+
+	err error
+}
+
+// recordLoc is the file offset and total on-disk size (header
+// included) of one record, as found by indexRecords.
+type recordLoc struct {
+	offset int64
+	size   int
+}
+
+// indexRecords scans f's data section for record boundaries without
+// decoding any record bodies, for RecordsParallel to divide among its
+// workers. It returns an error if f is pipe-mode, or if it finds a
+// record type RecordsParallel doesn't support (see ParallelRecords).
+func (f *File) indexRecords() ([]recordLoc, error) {
+	if f.pipe != nil {
+		return nil, fmt.Errorf("perffile: RecordsParallel doesn't support pipe-mode files")
+	}
+
+	sr := newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))
+	var locs []recordLoc
+	var hdrBuf [8]byte
+	for {
+		pos, _ := sr.Seek(0, 1)
+		if _, err := io.ReadFull(sr, hdrBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		typ := RecordType(f.order.Uint32(hdrBuf[:4]))
+		size := f.order.Uint16(hdrBuf[6:8])
+		if size < 8 {
+			return nil, fmt.Errorf("perffile: corrupt record at offset %d: size %d is too small", pos, size)
+		}
+
+		switch typ {
+		case recordTypeCompressed, recordTypeCompressed2:
+			return nil, fmt.Errorf("perffile: RecordsParallel doesn't support compressed perf.data files; use Records instead")
+		case RecordTypeAuxtrace:
+			return nil, fmt.Errorf("perffile: RecordsParallel doesn't support files containing RecordAuxtrace records yet; use Records instead")
+		}
+
+		if _, err := sr.Seek(int64(size)-8, 1); err != nil {
+			return nil, err
+		}
+		locs = append(locs, recordLoc{offset: pos + int64(f.hdr.Data.Offset), size: int(size)})
+	}
+	return locs, nil
+}
+
+// parallelResult is what a worker goroutine sends back for one
+// record: either a decoded Record and the slab backing it, or an
+// error, tagged with idx (the record's position in the file-order
+// index indexRecords built) so ParallelRecords.Next can restore file
+// order when !Unordered.
+type parallelResult struct {
+	idx    int
+	rec    Record
+	buf    []byte
+	bucket int
+	err    error
+}
+
+// RecordsParallel returns a parallel-decoding iterator over the
+// records in f; see ParallelRecords. The caller must call Close when
+// done with the returned *ParallelRecords, whether or not it was
+// iterated to completion, to let its worker goroutines exit.
+func (f *File) RecordsParallel(opts RecordsParallelOptions) *ParallelRecords {
+	locs, err := f.indexRecords()
+	if err != nil {
+		return &ParallelRecords{err: err}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(locs) {
+		workers = len(locs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &ParallelRecords{
+		pool:      newSlabPool(),
+		raw:       make(chan parallelResult, 2*workers),
+		done:      make(chan struct{}),
+		unordered: opts.Unordered,
+		pending:   make(map[int]parallelResult),
+		slabs:     make(map[Record]slabHandle),
+	}
+
+	p.wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go p.worker(f, w, workers, locs)
+	}
+	go func() {
+		p.wg.Wait()
+		close(p.raw)
+	}()
+
+	return p
+}
+
+// worker decodes the records in locs[id], locs[id+workers],
+// locs[id+2*workers], ... Round-robin assignment, rather than giving
+// each worker one contiguous run of locs, keeps all workers making
+// file-order progress together, which bounds how many out-of-order
+// results Next has to buffer to restore file order; the tradeoff is
+// that a worker's own reads aren't to contiguous file regions.
+func (p *ParallelRecords) worker(f *File, id, workers int, locs []recordLoc) {
+	defer p.wg.Done()
+
+	send := func(res parallelResult) bool {
+		select {
+		case p.raw <- res:
+			return true
+		case <-p.done:
+			if res.buf != nil {
+				p.pool.put(res.buf, res.bucket)
+			}
+			return false
+		}
+	}
+
+	for i := id; i < len(locs); i += workers {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		loc := locs[i]
+		buf, bucket := p.pool.get(loc.size)
+		if _, err := f.r.ReadAt(buf, loc.offset); err != nil {
+			send(parallelResult{idx: i, err: err})
+			return
+		}
+
+		var hdr recordHeader
+		hdr.Type = RecordType(f.order.Uint32(buf))
+		hdr.Misc = recordMisc(f.order.Uint16(buf[4:6]))
+		hdr.Size = f.order.Uint16(buf[6:8])
+		common := RecordCommon{Offset: loc.offset}
+
+		// A fresh *Records per record, rather than one shared by
+		// this worker's whole run, so decodeRecord's cached
+		// recordMmap/recordComm/... fields never get reused for two
+		// records we might deliver concurrently.
+		rec := (&Records{f: f}).decodeRecord(&bufDecoder{buf[8:], f.order}, hdr, common)
+		if rec == nil {
+			send(parallelResult{idx: i, err: fmt.Errorf("perffile: decoding record at offset %d", loc.offset)})
+			return
+		}
+
+		if !send(parallelResult{idx: i, rec: rec, buf: buf, bucket: bucket}) {
+			return
+		}
+	}
+}
+
+// Next fetches the next record into p.Record. It returns true if
+// successful, and false if it reaches the end of the record stream or
+// encounters an error (see Err).
+func (p *ParallelRecords) Next() bool {
+	if p.err != nil || p.raw == nil {
+		return false
+	}
+	for {
+		if !p.unordered {
+			if res, ok := p.pending[p.next]; ok {
+				delete(p.pending, p.next)
+				p.next++
+				return p.accept(res)
+			}
+		}
+
+		res, ok := <-p.raw
+		if !ok {
+			if len(p.pending) != 0 {
+				p.err = fmt.Errorf("perffile: internal error: parallel record stream ended with records still missing")
+			}
+			return false
+		}
+		if p.unordered {
+			return p.accept(res)
+		}
+		p.pending[res.idx] = res
+	}
+}
+
+func (p *ParallelRecords) accept(res parallelResult) bool {
+	if res.err != nil {
+		p.err = res.err
+		return false
+	}
+	p.Record = res.rec
+	p.slabsMu.Lock()
+	p.slabs[res.rec] = slabHandle{res.buf, res.bucket}
+	p.slabsMu.Unlock()
+	return true
+}
+
+// Release returns the slab backing rec (a Record previously returned
+// through p.Record) to the pool RecordsParallel's workers draw from.
+// rec and anything it points into (such as a RecordUnknown.Data, or
+// other []byte-valued fields read directly from the slab) must not be
+// used again after Release.
+//
+// Release is a no-op if rec wasn't produced by this ParallelRecords,
+// or has already been released.
+func (p *ParallelRecords) Release(rec Record) {
+	p.slabsMu.Lock()
+	h, ok := p.slabs[rec]
+	if ok {
+		delete(p.slabs, rec)
+	}
+	p.slabsMu.Unlock()
+	if ok {
+		p.pool.put(h.buf, h.bucket)
+	}
+}
+
+// Err returns the first error encountered by ParallelRecords.
+func (p *ParallelRecords) Err() error {
+	return p.err
+}
+
+// Close signals RecordsParallel's worker goroutines to stop and waits
+// for them to exit. It's safe to call Close after Next has already
+// returned false, and to call it more than once.
+func (p *ParallelRecords) Close() {
+	if p.done == nil {
+		return
+	}
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	// Drain p.raw so any worker blocked sending its next result (and
+	// thus not yet watching p.done) can finish and exit.
+	for range p.raw {
+	}
+}
+
+// slabHandle identifies the pool and bucket a []byte slab returned by
+// slabPool.get came from, so it can be returned with slabPool.put.
+type slabHandle struct {
+	buf    []byte
+	bucket int
+}
+
+// slabBucketSizes are the size classes slabPool pools []byte buffers
+// in. Record bodies range from a handful of bytes (RecordExit) to
+// RecordSample, which can be large with a deep call chain or branch
+// stack; bucketing by size (rather than one pool of worst-case-sized
+// buffers) keeps small, common records from paying for memory sized
+// for the largest record in the file. A record's on-disk size is
+// capped at 65535 bytes by recordHeader.Size being a uint16 (larger
+// payloads, like RecordAuxtrace's, are carried out of band, which is
+// exactly why RecordsParallel doesn't support them yet).
+var slabBucketSizes = [...]int{32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+type slabPool struct {
+	pools [len(slabBucketSizes)]sync.Pool
+}
+
+func newSlabPool() *slabPool {
+	return &slabPool{}
+}
+
+func bucketFor(n int) int {
+	for i, sz := range slabBucketSizes {
+		if n <= sz {
+			return i
+		}
+	}
+	return len(slabBucketSizes) - 1
+}
+
+// get returns a []byte of length n, either reused from the pool or
+// freshly allocated, along with the bucket to pass back to put.
+func (p *slabPool) get(n int) ([]byte, int) {
+	bucket := bucketFor(n)
+	if v := p.pools[bucket].Get(); v != nil {
+		buf := v.([]byte)
+		return buf[:n], bucket
+	}
+	return make([]byte, slabBucketSizes[bucket])[:n], bucket
+}
+
+// put returns buf, previously obtained from get with the same bucket,
+// to the pool.
+func (p *slabPool) put(buf []byte, bucket int) {
+	p.pools[bucket].Put(buf[:cap(buf)])
+}
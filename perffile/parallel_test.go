@@ -0,0 +1,92 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"testing"
+)
+
+// genSampleFile builds an in-memory perf.data file containing n
+// RecordSamples under a single EventAttr, for benchmarking the
+// Records and RecordsParallel iterators against each other.
+func genSampleFile(t testing.TB, n int) []byte {
+	t.Helper()
+
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime | SampleFormatCPU | SampleFormatPeriod,
+	}
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		sample := &RecordSample{
+			RecordCommon: RecordCommon{EventAttr: attr, Time: uint64(i)},
+			IP:           0x1000 + uint64(i),
+			Period:       1,
+		}
+		sample.PID, sample.TID = 1, 1
+		sample.CPU = uint32(i % 8)
+		if err := w.WriteRecord(sample); err != nil {
+			t.Fatalf("WriteRecord: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return sw.buf
+}
+
+func BenchmarkRecords(b *testing.B) {
+	data := genSampleFile(b, 100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := New(bytes.NewReader(data))
+		if err != nil {
+			b.Fatalf("New: %v", err)
+		}
+		rs := f.Records(RecordsFileOrder)
+		n := 0
+		for rs.Next() {
+			n++
+		}
+		if err := rs.Err(); err != nil {
+			b.Fatalf("Records: %v", err)
+		}
+		if n != 100000 {
+			b.Fatalf("got %d records, want 100000", n)
+		}
+	}
+}
+
+func BenchmarkRecordsParallel(b *testing.B) {
+	data := genSampleFile(b, 100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := New(bytes.NewReader(data))
+		if err != nil {
+			b.Fatalf("New: %v", err)
+		}
+		rs := f.RecordsParallel(RecordsParallelOptions{})
+		n := 0
+		for rs.Next() {
+			rs.Release(rs.Record)
+			n++
+		}
+		if err := rs.Err(); err != nil {
+			b.Fatalf("RecordsParallel: %v", err)
+		}
+		rs.Close()
+		if n != 100000 {
+			b.Fatalf("got %d records, want 100000", n)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PipeReaderOptions configures NewPipeReader.
+type PipeReaderOptions struct {
+	// OnEventAttr, if non-nil, is called each time Records.Next
+	// parses a new recordTypeAttr record out of the stream, before
+	// Next returns, with the newly discovered EventAttr. This lets a
+	// long-running consumer react to an event type appearing
+	// mid-stream (for example, to start tracking per-event state)
+	// without having to notice the change by diffing File.Events
+	// after every record.
+	//
+	// OnEventAttr is called from within Next, so it must not call
+	// back into the same Records.
+	OnEventAttr func(*EventAttr)
+}
+
+// NewPipeReader reads a "perf.data pipe" stream, such as the output
+// of "perf record -o -", from r.
+//
+// Unlike New, which requires a seekable io.ReaderAt so it can read
+// the Attrs section and feature sections out of the file's trailer up
+// front, a pipe-mode stream has no trailer: perf instead synthesizes
+// recordTypeAttr and recordTypeHeaderFeature records and writes them
+// inline, ahead of the samples they describe. Records.Next applies
+// these to the returned File as it encounters them (so Events and
+// Meta fill in gradually over the course of iteration) rather than
+// returning them as Records, exactly as if they were the header
+// sections of a regular perf.data file. opts.OnEventAttr, if set, is
+// notified synchronously as each one arrives.
+//
+// Because the returned File isn't backed by a seekable input,
+// (*File).Records only supports RecordsFileOrder; RecordsCausalOrder
+// and RecordsTimeOrder require re-reading the input in a different
+// order, which isn't possible on a pipe.
+func NewPipeReader(r io.Reader, opts PipeReaderOptions) (*File, error) {
+	pr := &pipeReaderAt{r: r}
+	file := &File{
+		r:           pr,
+		pipe:        pr,
+		order:       binary.LittleEndian,
+		Events:      make([]*EventAttr, 0),
+		idToAttr:    make(map[attrID]*EventAttr),
+		onEventAttr: opts.OnEventAttr,
+	}
+	// Treat the whole stream as one Data section starting at offset
+	// 0, with a size too large to ever be reached; there's no
+	// trailer to bound it with a real size, and Records.Next
+	// terminates on EOF regardless.
+	file.hdr.Data = fileSection{Offset: 0, Size: 1 << 62}
+	return file, nil
+}
+
+// A pipeReaderAt adapts a plain, non-seekable io.Reader to the
+// io.ReaderAt that File and its bufferedSectionReader expect, so
+// NewPipeReader can reuse the same Records/Next implementation as a
+// regular file. It only supports the sequential, monotonically
+// increasing reads that iterating in RecordsFileOrder actually
+// performs; anything else is a bug, not a recoverable error.
+type pipeReaderAt struct {
+	r   io.Reader
+	pos int64
+}
+
+func (p *pipeReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off != p.pos {
+		return 0, fmt.Errorf("perffile: pipe-mode input read out of order (at %d, requested %d); only sequential reads are supported", p.pos, off)
+	}
+	n, err := io.ReadFull(p.r, buf)
+	p.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		// io.ReadFull reports a short read as ErrUnexpectedEOF, but
+		// the io.ReaderAt contract (unlike io.Reader) calls for plain
+		// EOF here: bufferedSectionReader's fixed-size read-ahead
+		// routinely asks for more than remains of a finite pipe (the
+		// common case once the producer closes its end), and that's
+		// not an error, just the end of the stream.
+		err = io.EOF
+	}
+	return n, err
+}
+
+// applyPipeAttr decodes a recordTypeAttr record's payload (an
+// eventAttrVN followed by a packed array of u64 SampleIDs, in place
+// of the fileSection of IDs a regular perf.data file points an attr
+// at) and adds it to r.f.Events, exactly as the Attrs and ID sections
+// of a regular file's header do in New.
+func (r *Records) applyPipeAttr(data []byte) bool {
+	fa := new(fileAttr)
+	br := bytes.NewReader(data)
+	if err := readEventAttr(br, fa, binary.LittleEndian); err != nil {
+		r.err = fmt.Errorf("perffile: decoding pipe-mode event attr: %w", err)
+		return false
+	}
+
+	ids := data[len(data)-br.Len():]
+	if len(ids)%8 != 0 {
+		r.err = fmt.Errorf("perffile: pipe-mode event attr has trailing %d bytes of IDs, not a multiple of 8", len(ids))
+		return false
+	}
+	fa.Attr.IDs = make([]uint64, len(ids)/8)
+	for i := range fa.Attr.IDs {
+		fa.Attr.IDs[i] = binary.LittleEndian.Uint64(ids[i*8:])
+	}
+
+	f := r.f
+	f.attrs = append(f.attrs, fa)
+	f.Events = append(f.Events, &fa.Attr)
+	for _, id := range fa.Attr.IDs {
+		f.idToAttr[attrID(id)] = &fa.Attr
+	}
+
+	if len(f.attrs) == 1 {
+		f.sampleIDOffset = fa.Attr.SampleFormat.sampleIDOffset()
+		f.recordIDOffset = fa.Attr.SampleFormat.recordIDOffset()
+		f.sampleIDAll = fa.Attr.Flags&EventFlagSampleIDAll != 0
+	} else if err := f.checkAttrConsistency(&fa.Attr); err != nil {
+		// Unlike New, which can check every attr before parsing any
+		// records, a pipe-mode stream can only be checked as each
+		// recordTypeAttr record arrives, potentially after samples
+		// from earlier events have already been parsed against the
+		// offsets established above.
+		r.err = fmt.Errorf("perffile: %w", err)
+		return false
+	}
+
+	if f.onEventAttr != nil {
+		f.onEventAttr(&fa.Attr)
+	}
+	return true
+}
+
+// applyPipeFeature decodes a recordTypeHeaderFeature record's payload
+// (a feature ID followed by that feature's data, in the same format
+// as the data a regular perf.data file's feature section points at)
+// and applies it to r.f.Meta, exactly as the feature sections of a
+// regular file's trailer do in New.
+func (r *Records) applyPipeFeature(data []byte) bool {
+	if len(data) < 8 {
+		r.err = fmt.Errorf("perffile: truncated pipe-mode feature record")
+		return false
+	}
+	bit := feature(binary.LittleEndian.Uint64(data))
+	parser := featureParsers[bit]
+	if parser == nil {
+		return true
+	}
+	if err := parser(&r.f.Meta, bufDecoder{data[8:], binary.LittleEndian}); err != nil {
+		r.err = fmt.Errorf("perffile: decoding pipe-mode feature %d: %w", bit, err)
+		return false
+	}
+	r.f.finalizeMeta()
+	return true
+}
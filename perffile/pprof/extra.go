@@ -0,0 +1,192 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"encoding/binary"
+
+	gpprof "github.com/google/pprof/profile"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// WithGroupReads enables per-event sample values for samples taken
+// from an event group (see EventAttr.ReadFormat and
+// RecordSample.SampleRead), rather than only recording a value under
+// the event that actually triggered the sample.
+//
+// This requires ReadFormatID to have been set when the group was
+// recorded, so each Count in SampleRead carries the EventAttr it
+// belongs to; without that, there's no way to tell which of the
+// profile's SampleType columns a given Count corresponds to, and
+// WithGroupReads has no effect.
+func WithGroupReads() Option {
+	return func(c *converter) {
+		c.groupReads = true
+	}
+}
+
+// WithDataSrc adds a value column per DataSrcLevelNum (the combined
+// cache/memory level a load or store was satisfied from) for samples
+// recorded with SampleFormatDataSrc, weighted by Weight (or 1 if the
+// event didn't record a latency weight). This turns a memory-latency
+// profile in to something that reads like a heap profile: instead of
+// "where did this many bytes get allocated", it's "where did this
+// many cycles of memory latency come from, broken down by cache
+// level".
+func WithDataSrc() Option {
+	return func(c *converter) {
+		c.dataSrc = true
+	}
+}
+
+// WithOffCPU reconstructs off-CPU time samples from a sched:sched_switch
+// tracepoint captured with a callchain (e.g. "perf record -e
+// sched:sched_switch -g"). Convert treats each such RecordSample as
+// the stack of the thread being switched out, and once that thread is
+// switched back in, emits a synthetic sample over that stack whose
+// value is the elapsed off-CPU time in nanoseconds, under a sample
+// value column named valueType (conventionally "offcpu-time" with
+// unit "nanoseconds").
+//
+// This only understands the common sched_switch tracepoint layout
+// (the same across kernels that support PERF_SAMPLE_RAW tracepoints);
+// if the recording's tracepoint format differs, samples that don't
+// parse are silently skipped.
+func WithOffCPU(valueType string) Option {
+	return func(c *converter) {
+		c.offCPU = &offCPUState{
+			valueType: valueType,
+			blocked:   make(map[int]offCPUBlock),
+		}
+	}
+}
+
+// addDataSrcSample accumulates r's DataSrc-weighted contribution;
+// the per-(level) totals are flushed into the profile once Convert
+// has read every record, since the full set of levels seen (and
+// hence the SampleType columns to add) isn't known until then.
+func (c *converter) addDataSrcSample(r *perffile.RecordSample, locs []*gpprof.Location) {
+	if r.Format&perffile.SampleFormatDataSrc == 0 {
+		return
+	}
+	weight := int64(1)
+	if r.Format&(perffile.SampleFormatWeight|perffile.SampleFormatWeightStruct) != 0 && r.Weight != 0 {
+		weight = int64(r.Weight)
+	}
+	c.dataSrcSamples = append(c.dataSrcSamples, dataSrcSample{
+		locs:  locs,
+		level: r.DataSrc.LevelNum,
+		value: weight,
+	})
+}
+
+// dataSrcSample is one sample's contribution to a WithDataSrc
+// breakdown, recorded by addDataSrcSample and materialized into
+// profile Samples by finishDataSrc once every level that appears
+// anywhere in the file is known.
+type dataSrcSample struct {
+	locs  []*gpprof.Location
+	level perffile.DataSrcLevelNum
+	value int64
+}
+
+// finishDataSrc emits one Sample per recorded dataSrcSample, with a
+// SampleType column per distinct DataSrcLevelNum seen across the
+// whole file.
+func (c *converter) finishDataSrc() {
+	if !c.dataSrc {
+		return
+	}
+	levelIdx := make(map[perffile.DataSrcLevelNum]int)
+	base := len(c.prof.SampleType)
+	for _, s := range c.dataSrcSamples {
+		if _, ok := levelIdx[s.level]; ok {
+			continue
+		}
+		levelIdx[s.level] = base + len(levelIdx)
+		c.prof.SampleType = append(c.prof.SampleType, &gpprof.ValueType{
+			Type: "datasrc-" + s.level.String(),
+			Unit: "cycles",
+		})
+	}
+	for _, s := range c.dataSrcSamples {
+		values := make([]int64, len(c.prof.SampleType))
+		values[levelIdx[s.level]] = s.value
+		c.prof.Sample = append(c.prof.Sample, &gpprof.Sample{Location: s.locs, Value: values})
+	}
+}
+
+// offCPUState tracks, per TID, when a thread was last switched out,
+// so that when it's switched back in WithOffCPU can attribute the
+// intervening time to the stack it was switched out on.
+type offCPUState struct {
+	valueType string
+	typeIdx   int
+
+	blocked map[int]offCPUBlock
+}
+
+// offCPUBlock records the moment and stack at which a thread was
+// switched off-CPU.
+type offCPUBlock struct {
+	time uint64
+	locs []*gpprof.Location
+}
+
+// schedSwitchCommonLen is the size of the tracepoint common header
+// (common_type, common_flags, common_preempt_count, common_pid) that
+// precedes every tracepoint's own fields in RecordSample.Raw.
+const schedSwitchCommonLen = 8
+
+// parseSchedSwitch decodes the fixed portion of a sched:sched_switch
+// tracepoint payload (prev_pid and next_pid; the comm/prio/state
+// fields in between aren't needed here) from raw, or reports ok ==
+// false if raw is too short to be this tracepoint.
+func parseSchedSwitch(raw []byte) (prevPID, nextPID int, ok bool) {
+	// Layout after the common header: char prev_comm[16]; pid_t
+	// prev_pid; int prev_prio; long prev_state; char
+	// next_comm[16]; pid_t next_pid; int next_prio.
+	const prevPIDOff = schedSwitchCommonLen + 16
+	const nextPIDOff = prevPIDOff + 4 + 4 + 8 + 16
+	if len(raw) < nextPIDOff+4 {
+		return 0, 0, false
+	}
+	prevPID = int(int32(binary.LittleEndian.Uint32(raw[prevPIDOff:])))
+	nextPID = int(int32(binary.LittleEndian.Uint32(raw[nextPIDOff:])))
+	return prevPID, nextPID, true
+}
+
+// addOffCPUSample processes a single sched:sched_switch sample: if
+// the thread being switched in was previously recorded as blocked,
+// this emits an off-CPU sample over the stack it blocked on; it then
+// records the thread being switched out as newly blocked here.
+func (c *converter) addOffCPUSample(r *perffile.RecordSample, locs []*gpprof.Location) {
+	if r.Format&perffile.SampleFormatRaw == 0 {
+		return
+	}
+	prevPID, nextPID, ok := parseSchedSwitch(r.Raw)
+	if !ok {
+		return
+	}
+
+	if block, ok := c.offCPU.blocked[nextPID]; ok {
+		delete(c.offCPU.blocked, nextPID)
+		if r.Time > block.time {
+			c.emitOffCPU(block.locs, r.Time-block.time)
+		}
+	}
+
+	c.offCPU.blocked[prevPID] = offCPUBlock{time: r.Time, locs: locs}
+}
+
+// emitOffCPU appends a single off-CPU Sample of the given duration
+// (in nanoseconds) over locs. Convert allocates the off-CPU
+// SampleType column up front, so this only needs to fill it in.
+func (c *converter) emitOffCPU(locs []*gpprof.Location, nanos uint64) {
+	values := make([]int64, len(c.prof.SampleType))
+	values[c.offCPU.typeIdx] = int64(nanos)
+	c.prof.Sample = append(c.prof.Sample, &gpprof.Sample{Location: locs, Value: values})
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	gpprof "github.com/google/pprof/profile"
+)
+
+// A FuncCache interns gpprof.Functions by (name, filename), so a
+// symbolizer that resolves the same function from many samples (or
+// many tools building up the same *gpprof.Profile) can share one
+// Function instead of each appending its own duplicate. It factors
+// out the (name, filename) -> *gpprof.Function bookkeeping that used
+// to be hand-rolled, identically, by this package's own converter and
+// by cmd/memlat and cmd/memheat.
+//
+// The zero value is ready to use.
+type FuncCache struct {
+	byKey map[funcCacheKey]*gpprof.Function
+}
+
+type funcCacheKey struct {
+	name, filename string
+}
+
+// Get returns the Function named name in filename, appending a new
+// one to prof.Function (and caching it in c) the first time this
+// (name, filename) pair is seen.
+func (c *FuncCache) Get(prof *gpprof.Profile, name, filename string) *gpprof.Function {
+	if c.byKey == nil {
+		c.byKey = make(map[funcCacheKey]*gpprof.Function)
+	}
+	key := funcCacheKey{name, filename}
+	if fn, ok := c.byKey[key]; ok {
+		return fn
+	}
+	fn := &gpprof.Function{
+		ID:         uint64(len(prof.Function)) + 1,
+		Name:       name,
+		SystemName: name,
+		Filename:   filename,
+	}
+	prof.Function = append(prof.Function, fn)
+	c.byKey[key] = fn
+	return fn
+}
@@ -0,0 +1,389 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pprof converts a perffile.File into a github.com/google/pprof
+// profile.Profile, so a perf.data recording can be consumed directly
+// by "go tool pprof" and the rest of the pprof tooling (weblist,
+// flamegraph, and so on) without going through "perf script".
+//
+// This package builds an in-memory *profile.Profile using the real
+// google/pprof package, which makes it straightforward to merge,
+// filter, or otherwise post-process the result with that package's
+// own tools before writing it out.
+package pprof
+
+import (
+	"fmt"
+
+	gpprof "github.com/google/pprof/profile"
+
+	"github.com/aclements/go-perf/perffile"
+	"github.com/aclements/go-perf/perffile/symbolize"
+)
+
+// An Option configures Convert.
+type Option func(*converter)
+
+// WithSymbols enables symbolication of sample addresses using the
+// symbolize package, so Locations carry function names, source
+// files, and line numbers instead of just raw addresses. paths is a
+// fallback search path for binaries that can't be found via their
+// recorded path or perf's build-ID cache (see
+// symbolize.Symbolizer.AddSearchPath).
+//
+// Without this option, Convert doesn't symbolize at all: Locations
+// still carry Mapping and Address, but no Line information. With it,
+// each distinct (PID, address) pair is resolved at most once, lazily,
+// the first time a sample references it, rather than eagerly
+// resolving every mapped binary up front.
+func WithSymbols(paths ...string) Option {
+	return func(c *converter) {
+		c.searchPaths = append(c.searchPaths, paths...)
+	}
+}
+
+// Convert reads every record in f and returns it as a pprof Profile.
+//
+// Each event in f.Events becomes its own sample value column, named
+// after EventAttr.Name. Each RecordSample's call chain (or its bare
+// instruction pointer, if it has no call chain) becomes a Location
+// stack, with context markers such as PERF_CONTEXT_KERNEL stripped
+// out first. Mapping.File and .BuildID are attributed from the MMAP2
+// record covering each address, falling back to f.Meta.BuildIDs for
+// mappings that only got a build ID in the HEADER_BUILD_ID feature
+// section.
+func Convert(f *perffile.File, opts ...Option) (*gpprof.Profile, error) {
+	c := &converter{
+		f:         f,
+		prof:      &gpprof.Profile{},
+		attrIndex: make(map[*perffile.EventAttr]int),
+		buildIDs:  make(map[buildIDKey]perffile.BuildID),
+		mmaps:     make(map[int][]*perffile.RecordMmap),
+		mappings:  make(map[mappingKey]*gpprof.Mapping),
+		locations: make(map[locKey]*gpprof.Location),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	for i, attr := range f.Events {
+		name := attr.Name
+		if name == "" {
+			name = fmt.Sprintf("event%d", i)
+		}
+		c.prof.SampleType = append(c.prof.SampleType, &gpprof.ValueType{Type: name, Unit: "count"})
+		c.attrIndex[attr] = i
+	}
+
+	for _, b := range f.Meta.BuildIDs {
+		c.buildIDs[buildIDKey{b.PID, b.Filename}] = b.BuildID
+	}
+
+	if c.offCPU != nil {
+		// Added up front, even though no off-CPU samples may exist
+		// yet, so every Sample appended before the first one has a
+		// slot for it.
+		c.offCPU.typeIdx = len(c.prof.SampleType)
+		c.prof.SampleType = append(c.prof.SampleType, &gpprof.ValueType{
+			Type: c.offCPU.valueType,
+			Unit: "nanoseconds",
+		})
+	}
+
+	if len(c.searchPaths) > 0 {
+		sym, err := symbolize.New(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range c.searchPaths {
+			sym.AddSearchPath(p)
+		}
+		c.sym = sym
+	}
+
+	rs := f.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *perffile.RecordMmap:
+			// Kernel and module mappings are always recorded
+			// under PID -1, regardless of which process was
+			// running.
+			c.mmaps[r.PID] = append(c.mmaps[r.PID], r)
+
+		case *perffile.RecordSample:
+			if err := c.addSample(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+
+	// WithDataSrc's SampleType columns aren't known until every
+	// record has been read (they depend on which DataSrcLevelNums
+	// actually appear), so its Samples are materialized here rather
+	// than as each RecordSample is read.
+	c.finishDataSrc()
+
+	// Samples recorded before the columns above were appended are
+	// short a value slot for each; pad them out to the final width
+	// so every Sample.Value has the same length as SampleType, as
+	// the pprof format requires.
+	for _, s := range c.prof.Sample {
+		for len(s.Value) < len(c.prof.SampleType) {
+			s.Value = append(s.Value, 0)
+		}
+	}
+
+	return c.prof, nil
+}
+
+type buildIDKey struct {
+	pid      int
+	filename string
+}
+
+type mappingKey struct {
+	start, limit, offset uint64
+	filename             string
+}
+
+type locKey struct {
+	pid int
+	ip  uint64
+}
+
+// A converter holds the state Convert accumulates while it reads
+// through a perffile.File's records.
+type converter struct {
+	f    *perffile.File
+	prof *gpprof.Profile
+
+	searchPaths []string
+	sym         *symbolize.Symbolizer
+
+	attrIndex map[*perffile.EventAttr]int
+	buildIDs  map[buildIDKey]perffile.BuildID
+
+	// mmaps holds, for each PID, the mappings seen so far in file
+	// order.
+	mmaps map[int][]*perffile.RecordMmap
+
+	mappings  map[mappingKey]*gpprof.Mapping
+	functions FuncCache
+	locations map[locKey]*gpprof.Location
+
+	// groupReads is set by WithGroupReads.
+	groupReads bool
+
+	// dataSrc is set by WithDataSrc; matching samples accumulate in
+	// dataSrcSamples until Convert can see every DataSrcLevelNum
+	// across the file and assign each one a SampleType column.
+	dataSrc        bool
+	dataSrcSamples []dataSrcSample
+
+	// offCPU is non-nil when WithOffCPU is set.
+	offCPU *offCPUState
+}
+
+func (c *converter) addSample(r *perffile.RecordSample) error {
+	idx, ok := c.attrIndex[r.EventAttr]
+	if !ok {
+		// A sample for an event this profile didn't declare; skip
+		// it rather than guess which value column it belongs in.
+		return nil
+	}
+
+	var ips []chainIP
+	if r.Format&perffile.SampleFormatCallchain != 0 {
+		// A Callchain mixes several logical stacks (e.g. a kernel
+		// stack followed by the user stack it interrupted),
+		// delimited by CallchainKernel/CallchainUser/... markers
+		// rather than real addresses; track which stack we're in
+		// so each IP resolves against the right mapping, not just
+		// the sample's own CPUMode.
+		mode := r.CPUMode
+		for _, ip := range r.Callchain {
+			if m, ok := callchainMode(ip); ok {
+				mode = m
+				continue
+			}
+			ips = append(ips, chainIP{ip, mode})
+		}
+	} else if r.Format&perffile.SampleFormatIP != 0 {
+		ips = []chainIP{{r.IP, r.CPUMode}}
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+
+	locs := make([]*gpprof.Location, len(ips))
+	for i, ip := range ips {
+		loc, err := c.location(r.PID, ip.mode, ip.ip, r.Time)
+		if err != nil {
+			return err
+		}
+		locs[i] = loc
+	}
+
+	values := make([]int64, len(c.prof.SampleType))
+	values[idx] = sampleValue(r)
+
+	if c.groupReads && r.Format&perffile.SampleFormatRead != 0 {
+		for _, count := range r.SampleRead {
+			attr := count.EventAttr
+			if attr == nil || attr == r.EventAttr {
+				// No per-count attribution (ReadFormatID wasn't
+				// set), or this is just the sampled event's own
+				// count, which is already covered by value above.
+				continue
+			}
+			if gi, ok := c.attrIndex[attr]; ok {
+				values[gi] = int64(count.Value)
+			}
+		}
+	}
+
+	c.prof.Sample = append(c.prof.Sample, &gpprof.Sample{Location: locs, Value: values})
+
+	if c.dataSrc {
+		c.addDataSrcSample(r, locs)
+	}
+
+	if c.offCPU != nil {
+		c.addOffCPUSample(r, locs)
+	}
+
+	return nil
+}
+
+// chainIP is one resolved address from a RecordSample's Callchain,
+// tagged with the privilege level its stack marker selected.
+type chainIP struct {
+	ip   uint64
+	mode perffile.CPUMode
+}
+
+// callchainMode returns the CPUMode a Callchain stack-boundary
+// marker switches to, or ok == false if ip is an ordinary address
+// rather than a marker.
+func callchainMode(ip uint64) (mode perffile.CPUMode, ok bool) {
+	switch ip {
+	case perffile.CallchainKernel, perffile.CallchainGuestKernel:
+		return perffile.CPUModeKernel, true
+	case perffile.CallchainUser, perffile.CallchainGuestUser:
+		return perffile.CPUModeUser, true
+	case perffile.CallchainGuest:
+		return perffile.CPUModeGuestKernel, true
+	case perffile.CallchainHV:
+		return perffile.CPUModeHypervisor, true
+	default:
+		return 0, false
+	}
+}
+
+// sampleValue returns the weight a RecordSample contributes to its
+// own event's sample value column: its period, if recorded, or a
+// bare event count otherwise.
+func sampleValue(r *perffile.RecordSample) int64 {
+	if r.Format&perffile.SampleFormatPeriod != 0 && r.Period != 0 {
+		return int64(r.Period)
+	}
+	return 1
+}
+
+// location returns the Location for address ip sampled in process
+// pid at privilege level cpuMode, creating it (and resolving its
+// Mapping and, if symbolication is enabled, its Line) if this is the
+// first time this address has been seen.
+//
+// time is the sample's own RecordCommon.Time, used only to
+// disambiguate a JIT'd BPF program address from another program that
+// reused the same address at a different point in the recording (see
+// symbolize.Symbolizer.Resolve). Location caches by (pid, ip) alone,
+// so if such an address is ever resolved twice, whichever program was
+// live the first time wins for the rest of the profile; this matches
+// how mapping lookups already treat reused user addresses.
+func (c *converter) location(pid int, cpuMode perffile.CPUMode, ip, time uint64) (*gpprof.Location, error) {
+	key := locKey{pid, ip}
+	if loc, ok := c.locations[key]; ok {
+		return loc, nil
+	}
+
+	loc := &gpprof.Location{ID: uint64(len(c.prof.Location)) + 1, Address: ip}
+	if mmap := c.findMmap(pid, cpuMode, ip); mmap != nil {
+		loc.Mapping = c.mapping(mmap)
+	}
+
+	if c.sym != nil {
+		if frame, err := c.sym.Resolve(pid, cpuMode, ip, time); err == nil && frame.Func != "" {
+			loc.Line = []gpprof.Line{{
+				Function: c.function(frame.Func, frame.File),
+				Line:     int64(frame.Line),
+			}}
+		}
+	}
+
+	c.prof.Location = append(c.prof.Location, loc)
+	c.locations[key] = loc
+	return loc, nil
+}
+
+func (c *converter) findMmap(pid int, cpuMode perffile.CPUMode, ip uint64) *perffile.RecordMmap {
+	switch cpuMode {
+	case perffile.CPUModeKernel, perffile.CPUModeHypervisor, perffile.CPUModeGuestKernel:
+		return c.findMmapIn(-1, ip)
+	}
+	if m := c.findMmapIn(pid, ip); m != nil {
+		return m
+	}
+	// Fall back to the kernel's mappings, e.g. for a vDSO mapped
+	// into every process.
+	return c.findMmapIn(-1, ip)
+}
+
+func (c *converter) findMmapIn(pid int, ip uint64) *perffile.RecordMmap {
+	// Search newest-first, since a later mapping at an address
+	// supersedes an earlier one that was never explicitly unmapped
+	// (perf.data doesn't record munmaps).
+	maps := c.mmaps[pid]
+	for i := len(maps) - 1; i >= 0; i-- {
+		if m := maps[i]; m.Addr <= ip && ip < m.Addr+m.Len {
+			return m
+		}
+	}
+	return nil
+}
+
+func (c *converter) mapping(r *perffile.RecordMmap) *gpprof.Mapping {
+	key := mappingKey{r.Addr, r.Addr + r.Len, r.FileOffset, r.Filename}
+	if m, ok := c.mappings[key]; ok {
+		return m
+	}
+
+	buildID := perffile.BuildID(r.BuildID)
+	if len(buildID) == 0 {
+		buildID = c.buildIDs[buildIDKey{r.PID, r.Filename}]
+	}
+	if len(buildID) == 0 {
+		buildID = c.buildIDs[buildIDKey{-1, r.Filename}]
+	}
+
+	m := &gpprof.Mapping{
+		ID:      uint64(len(c.prof.Mapping)) + 1,
+		Start:   r.Addr,
+		Limit:   r.Addr + r.Len,
+		Offset:  r.FileOffset,
+		File:    r.Filename,
+		BuildID: buildID.String(),
+	}
+	c.prof.Mapping = append(c.prof.Mapping, m)
+	c.mappings[key] = m
+	return m
+}
+
+func (c *converter) function(name, filename string) *gpprof.Function {
+	return c.functions.Get(c.prof, name, filename)
+}
@@ -10,7 +10,6 @@ import (
 	"io"
 	"os"
 	"reflect"
-	"sort"
 )
 
 // TODO: Type for file format errors.
@@ -30,13 +29,36 @@ type File struct {
 	closer io.Closer
 	hdr    fileHeader
 
-	attrs    []fileAttr
+	// order is the byte order this file's header, attrs, feature
+	// sections, and records are encoded in, as detected from the
+	// file's magic ("PERFILE2" for little endian, "2ELIFREP" for
+	// big endian).
+	order binary.ByteOrder
+
+	// attrs holds the EventAttrs backing Events, as *fileAttr rather
+	// than fileAttr so that the pipe-mode reader can append to it as
+	// recordTypeAttr records arrive without invalidating the
+	// pointers already handed out in Events and idToAttr.
+	attrs    []*fileAttr
 	idToAttr map[attrID]*EventAttr
 
+	// pipe is non-nil for a File opened with NewPipeReader, in which
+	// case r and hdr are backed by pipeReaderAt rather than a real
+	// seekable file.
+	pipe *pipeReaderAt
+
+	// onEventAttr, if non-nil, is called by a pipe-mode File as each
+	// new EventAttr is discovered. See PipeReaderOptions.OnEventAttr.
+	onEventAttr func(*EventAttr)
+
 	sampleIDOffset int // byte offset of AttrID in sample
 
 	sampleIDAll    bool // non-samples have sample_id trailer
 	recordIDOffset int  // byte offset of AttrID in non-sample, from end
+
+	// timeIndex is the index RecordsFrom uses to seek by time-stamp,
+	// set by BuildTimeIndex or SetTimeIndex.
+	timeIndex *TimeIndex
 }
 
 // New reads a "perf.data" file from r.
@@ -52,23 +74,26 @@ func New(r io.ReaderAt) (*File, error) {
 	// See perf_session__read_header in tools/perf/util/header.c
 
 	sr := io.NewSectionReader(r, 0, 1024)
-	if err := binary.Read(sr, binary.LittleEndian, &file.hdr); err != nil {
+	var magic [8]byte
+	if _, err := io.ReadFull(sr, magic[:]); err != nil {
 		return nil, err
 	}
-	switch string(file.hdr.Magic[:]) {
+	switch string(magic[:]) {
 	case "PERFILE2":
-		// Version 2, little endian.
-		break
+		file.order = binary.LittleEndian
 	case "2ELIFREP":
-		// Version 2, big endian.
-		//
-		// TODO: Support big endian profiles.
-		return nil, fmt.Errorf("big endian profiles not supported")
+		file.order = binary.BigEndian
 	case "PERFFILE":
 		// Version 1 file.
 		return nil, fmt.Errorf("version 1 profiles not supported")
 	default:
-		return nil, fmt.Errorf("bad or unsupported file magic %q", string(file.hdr.Magic[:]))
+		return nil, fmt.Errorf("bad or unsupported file magic %q", string(magic[:]))
+	}
+	if _, err := sr.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(sr, file.order, &file.hdr); err != nil {
+		return nil, err
 	}
 	if file.hdr.Size != uint64(binary.Size(&file.hdr)) {
 		return nil, fmt.Errorf("bad header size %d", file.hdr.Size)
@@ -92,10 +117,11 @@ func New(r io.ReaderAt) (*File, error) {
 	} else if nAttrs > 64*1024 {
 		return nil, fmt.Errorf("too many attrs or bad attr size")
 	}
-	file.attrs = make([]fileAttr, nAttrs)
+	file.attrs = make([]*fileAttr, nAttrs)
 	attrSR := file.hdr.Attrs.sectionReader(r)
 	for i := 0; i < nAttrs; i++ {
-		if err := readFileAttr(attrSR, &file.attrs[i]); err != nil {
+		file.attrs[i] = new(fileAttr)
+		if err := readFileAttr(attrSR, file.attrs[i], file.order); err != nil {
 			return nil, err
 		}
 		file.Events = append(file.Events, &file.attrs[i].Attr)
@@ -105,7 +131,7 @@ func New(r io.ReaderAt) (*File, error) {
 	file.idToAttr = make(map[attrID]*EventAttr)
 	for _, attr := range file.attrs {
 		var ids []attrID
-		if err := readSlice(attr.IDs.sectionReader(r), &ids); err != nil {
+		if err := readSlice(attr.IDs.sectionReader(r), &ids, file.order); err != nil {
 			return nil, err
 		}
 		for _, id := range ids {
@@ -123,31 +149,9 @@ func New(r io.ReaderAt) (*File, error) {
 		if len(file.idToAttr) == 0 {
 			return nil, fmt.Errorf("file has multiple EventAttrs, but no IDs")
 		}
-		for _, attr := range file.attrs {
-			// See perf_evlist__valid_sample_type.
-			x := attr.Attr.SampleFormat.sampleIDOffset()
-			if x == -1 {
-				return nil, fmt.Errorf("multiple events, but samples have no event ID field")
-			} else if file.sampleIDOffset != x {
-				return nil, fmt.Errorf("events have incompatible ID offsets %d and %d", file.sampleIDOffset, x)
-			}
-
-			x = attr.Attr.SampleFormat.recordIDOffset()
-			if x == -1 {
-				return nil, fmt.Errorf("multiple events, but records have no event ID field")
-			} else if file.recordIDOffset != x {
-				return nil, fmt.Errorf("records have incompatible ID offsets %d and %d", file.recordIDOffset, x)
-			}
-
-			// See perf_evlist__valid_sample_id_all.
-			idAll := attr.Attr.Flags&EventFlagSampleIDAll != 0
-			if file.sampleIDAll != idAll {
-				return nil, fmt.Errorf("events have incompatible SampleIDAll flags")
-			}
-
-			// See perf_evlist__valid_read_format.
-			if firstEvent.ReadFormat != attr.Attr.ReadFormat {
-				return nil, fmt.Errorf("events have incompatible read formats")
+		for _, attr := range file.attrs[1:] {
+			if err := file.checkAttrConsistency(&attr.Attr); err != nil {
+				return nil, err
 			}
 		}
 		if firstEvent.SampleFormat&SampleFormatRead != 0 &&
@@ -163,20 +167,119 @@ func New(r io.ReaderAt) (*File, error) {
 			continue
 		}
 		sec := fileSection{}
-		if err := binary.Read(sr, binary.LittleEndian, &sec); err != nil {
+		if err := binary.Read(sr, file.order, &sec); err != nil {
 			return nil, err
 		}
-		file.Meta.parse(bit, sec, file.r)
+		file.Meta.parse(bit, sec, file.r, file.order)
 	}
 
+	file.finalizeMeta()
+
 	return file, nil
 }
 
+// finalizeMeta resolves the parts of File.Meta and Events that depend
+// on feature sections and attrs having been fully loaded, which for a
+// regular perf.data file happens once, here at the end of New. The
+// pipe-mode reader instead calls this after every recordTypeAttr or
+// recordTypeHeaderFeature record, since it can't know when (or
+// whether) the last one has arrived; doing so is harmless, since
+// everything here is idempotent.
+func (f *File) finalizeMeta() {
+	// Populate EventAttr.Name and .IDs from HEADER_EVENT_DESC, if
+	// present. This assumes eventDescs is in the same order as
+	// Events, which matches how perf itself writes this section.
+	for i, ed := range f.Meta.eventDescs {
+		if i >= len(f.Events) {
+			break
+		}
+		f.Events[i].Name = ed.name
+		f.Events[i].IDs = ed.ids
+	}
+	f.Meta.eventDescs = nil
+
+	// Resolve GroupDesc.Leader/NumMembers into EventAttr pointers
+	// now that f.Events is complete.
+	for i := range f.Meta.Groups {
+		g := &f.Meta.Groups[i]
+		if g.Leader < 0 || g.Leader+g.NumMembers > len(f.Events) {
+			continue
+		}
+		g.Members = f.Events[g.Leader : g.Leader+g.NumMembers]
+		g.LeaderAttr = g.Members[0]
+	}
+
+	// Decode CPUID into CPUInfo now that Arch is known.
+	f.Meta.CPUInfo, _ = parseCPUID(f.Meta.Arch, f.Meta.CPUID)
+
+	// Resolve each HybridCoreSet's Capabilities from PMUCaps.
+	for i := range f.Meta.HybridCores {
+		hc := &f.Meta.HybridCores[i]
+		hc.Capabilities = f.Meta.PMUCaps[hc.PMUName]
+	}
+}
+
+// checkAttrConsistency checks that attr's sample format is compatible
+// with f.sampleIDOffset, f.recordIDOffset, f.sampleIDAll, and the read
+// format of f.attrs[0], which New (and, incrementally, the pipe-mode
+// reader) derives from the first event attr a file or stream
+// declares. It returns an error describing the first incompatibility
+// found, or nil if attr is compatible.
+//
+// Note that this permits attr's SampleFormat to otherwise differ
+// arbitrarily from the first event's, such as recording a different
+// set of registers or omitting the callchain: only the fields that
+// determine where the sample_id/id is actually located, and how it's
+// decoded, need to agree. In particular, events that all set
+// SampleFormatIdentifier always agree here, since that flag pins the
+// ID to a fixed offset regardless of a sample format's other bits
+// (see SampleFormat.sampleIDOffset and .recordIDOffset), which is how
+// "perf record -e {a,b}:S" traces with heterogeneous sample formats
+// stay parseable.
+func (f *File) checkAttrConsistency(attr *EventAttr) error {
+	// See perf_evlist__valid_sample_type.
+	x := attr.SampleFormat.sampleIDOffset()
+	if x == -1 {
+		return fmt.Errorf("multiple events, but samples have no event ID field")
+	} else if f.sampleIDOffset != x {
+		return fmt.Errorf("events have incompatible ID offsets %d and %d", f.sampleIDOffset, x)
+	}
+
+	x = attr.SampleFormat.recordIDOffset()
+	if x == -1 {
+		return fmt.Errorf("multiple events, but records have no event ID field")
+	} else if f.recordIDOffset != x {
+		return fmt.Errorf("records have incompatible ID offsets %d and %d", f.recordIDOffset, x)
+	}
+
+	// See perf_evlist__valid_sample_id_all.
+	if idAll := attr.Flags&EventFlagSampleIDAll != 0; f.sampleIDAll != idAll {
+		return fmt.Errorf("events have incompatible SampleIDAll flags")
+	}
+
+	// See perf_evlist__valid_read_format.
+	if f.attrs[0].Attr.ReadFormat != attr.ReadFormat {
+		return fmt.Errorf("events have incompatible read formats")
+	}
+
+	return nil
+}
+
 // Open opens the named "perf.data" file using os.Open.
 //
+// If name is a URL with a scheme registered via RegisterFetcher (http,
+// https, and ssh are registered by default), Open fetches it into a
+// local cache directory first, transparently decompressing it if it
+// ends in .gz or .zst. See FetchTimeout and FetchCacheDir to control
+// this behavior.
+//
 // The caller must call f.Close() on the returned file when it is
 // done.
 func Open(name string) (*File, error) {
+	name, err := fetch(name)
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
@@ -190,12 +293,25 @@ func Open(name string) (*File, error) {
 	return ff, nil
 }
 
-func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
+func readFileAttr(sr *io.SectionReader, fa *fileAttr, order binary.ByteOrder) error {
 	// See read_attr in tools/perf/util/header.c.
+	if err := readEventAttr(sr, fa, order); err != nil {
+		return err
+	}
 
+	// Finally, read IDs fileSection, which follows the eventAttr.
+	return binary.Read(sr, order, &fa.IDs)
+}
+
+// readEventAttr reads a single on-disk perf_event_attr, encoded in
+// order, from r in to fa.Attr. It's shared by readFileAttr, which
+// reads the fileSection of IDs that follows an attr in a regular
+// perf.data file, and the pipe-mode reader, where an attr is instead
+// followed by an inline array of IDs.
+func readEventAttr(r io.Reader, fa *fileAttr, order binary.ByteOrder) error {
 	// Read the common prefix of all event attr versions.
 	var attr eventAttrVN
-	if err := binary.Read(sr, binary.LittleEndian, &attr.eventAttrV0); err != nil {
+	if err := binary.Read(r, order, &attr.eventAttrV0); err != nil {
 		return err
 	}
 	if attr.Size == 0 {
@@ -211,7 +327,7 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 		rattr := reflect.ValueOf(&attr).Elem()
 		for i := 1; i < rattr.NumField() && left > 0; i++ {
 			field := rattr.Field(i).Addr().Interface()
-			err := binary.Read(sr, binary.LittleEndian, field)
+			err := binary.Read(r, order, field)
 			if err != nil {
 				return err
 			}
@@ -220,8 +336,16 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	}
 
 	// Convert on-disk perf_event_attr in to EventAttr.
-	fa.Attr.Type = attr.Type
-	fa.Attr.Config[0] = attr.Config
+	var g EventGeneric
+	g.Type = attr.Type
+	if attr.Type == EventTypeBreakpoint {
+		g.ID = uint64(attr.BPType)
+		g.Config = []uint64{attr.BPAddrOrConfig1, attr.BPLenOrConfig2}
+	} else {
+		g.ID = attr.Config
+		g.Config = []uint64{attr.BPAddrOrConfig1, attr.BPLenOrConfig2, attr.Config3}
+	}
+	fa.Attr.Event = g.Decode()
 	if attr.Flags&EventFlagFreq == 0 {
 		fa.Attr.SamplePeriod = attr.SamplePeriodOrFreq
 	} else {
@@ -236,20 +360,14 @@ func readFileAttr(sr *io.SectionReader, fa *fileAttr) error {
 	} else {
 		fa.Attr.WakeupWatermark = attr.WakeupEventsOrWatermark
 	}
-	fa.Attr.BPType = attr.BPType
-	if attr.Type == EventTypeBreakpoint {
-		fa.Attr.BPAddr = attr.BPAddrOrConfig1
-		fa.Attr.BPLen = attr.BPLenOrConfig2
-	} else {
-		fa.Attr.Config[1] = attr.BPAddrOrConfig1
-		fa.Attr.Config[2] = attr.BPLenOrConfig2
-	}
+	fa.Attr.BranchSampleType = attr.BranchSampleType
 	fa.Attr.SampleRegsUser = attr.SampleRegsUser
 	fa.Attr.SampleStackUser = attr.SampleStackUser
+	fa.Attr.SampleRegsIntr = attr.SampleRegsIntr
 	fa.Attr.AuxWatermark = attr.AuxWatermark
-
-	// Finally, read IDs fileSection, which follows the eventAttr.
-	return binary.Read(sr, binary.LittleEndian, &fa.IDs)
+	fa.Attr.SampleMaxStack = attr.SampleMaxStack
+	fa.Attr.SigData = attr.SigData
+	return nil
 }
 
 // Close closes the File.
@@ -265,10 +383,111 @@ func (f *File) Close() error {
 	return err
 }
 
-// readSlice reads an entire section into a slice.  v must be a
-// pointer to a slice; the slice itself may be nil.  The section size
-// must be an exact multiple of the size of the element type of v.
-func readSlice(sr *io.SectionReader, v interface{}) error {
+// AttrByID returns the EventAttr whose set of SampleIDs includes id,
+// typically a RecordCommon.ID value, or nil if id doesn't belong to
+// any event in this profile.
+func (f *File) AttrByID(id uint64) *EventAttr {
+	return f.idToAttr[attrID(id)]
+}
+
+// An AuxTrace is one logical AUX-area trace stream: the
+// RecordAuxtrace chunks captured on a single CPU or thread, along
+// with the RecordAuxtraceInfo that describes how to decode them and
+// the RecordAux and RecordItraceStart records observed on the same
+// CPU/thread, which mark ring-buffer boundaries and trace restarts
+// within the stream.
+type AuxTrace struct {
+	// CPU and TID identify the stream, matching RecordAuxtrace.CPU
+	// and .TID. Exactly one is meaningful, depending on whether the
+	// trace was recorded per-CPU or per-thread.
+	CPU uint32
+	TID int
+
+	// Info describes the trace format shared by all of Traces; see
+	// RecordAuxtraceInfo.Kind and RecordAuxtrace.Decoded.
+	Info *RecordAuxtraceInfo
+
+	// Traces are this stream's RecordAuxtrace chunks, in file
+	// order. Each is already associated with Info, so calling
+	// Decoded on one doesn't require going through AuxTraces again.
+	Traces []*RecordAuxtrace
+
+	// Aux are the RecordAux records observed for this stream, in
+	// file order.
+	Aux []*RecordAux
+
+	// ItraceStarts are the RecordItraceStart records observed for
+	// this stream, in file order.
+	ItraceStarts []*RecordItraceStart
+}
+
+// auxTraceKey identifies an AuxTrace's stream the same way perf
+// itself groups RecordAuxtrace chunks: by whichever of CPU or TID is
+// meaningful for how the trace was recorded.
+type auxTraceKey struct {
+	cpu uint32
+	tid int
+}
+
+// AuxTraces reads every record in f and groups the PERF_RECORD_AUX,
+// PERF_RECORD_ITRACE_START, and PERF_RECORD_AUXTRACE records it
+// contains into per-CPU/per-thread AuxTrace streams, each tagged with
+// the RecordAuxtraceInfo that was most recently read before it in
+// file order.
+//
+// Unlike Records, AuxTraces must read the whole file up front, since
+// the chunks belonging to one stream may be interleaved in the file
+// with chunks belonging to others and can only be grouped once
+// everything has been seen.
+func (f *File) AuxTraces() ([]*AuxTrace, error) {
+	streams := make(map[auxTraceKey]*AuxTrace)
+	var order []*AuxTrace
+	stream := func(cpu uint32, tid int) *AuxTrace {
+		key := auxTraceKey{cpu, tid}
+		at, ok := streams[key]
+		if !ok {
+			at = &AuxTrace{CPU: cpu, TID: tid}
+			streams[key] = at
+			order = append(order, at)
+		}
+		return at
+	}
+
+	var curInfo *RecordAuxtraceInfo
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordAuxtraceInfo:
+			curInfo = r
+
+		case *RecordAuxtrace:
+			r.info = curInfo
+			at := stream(r.CPU, r.TID)
+			if at.Info == nil {
+				at.Info = curInfo
+			}
+			at.Traces = append(at.Traces, r)
+
+		case *RecordAux:
+			at := stream(r.CPU, r.TID)
+			at.Aux = append(at.Aux, r)
+
+		case *RecordItraceStart:
+			at := stream(r.CPU, r.TID)
+			at.ItraceStarts = append(at.ItraceStarts, r)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// readSlice reads an entire section, encoded in order, into a slice.
+// v must be a pointer to a slice; the slice itself may be nil.  The
+// section size must be an exact multiple of the size of the element
+// type of v.
+func readSlice(sr *io.SectionReader, v interface{}, order binary.ByteOrder) error {
 	// Figure out slice value size
 	vt := reflect.TypeOf(v)
 	if vt.Kind() != reflect.Ptr || vt.Elem().Kind() != reflect.Slice {
@@ -285,7 +504,7 @@ func readSlice(sr *io.SectionReader, v interface{}) error {
 	reflect.ValueOf(v).Elem().Set(reflect.MakeSlice(vt.Elem(), nelem, nelem))
 
 	// Read in to slice
-	return binary.Read(sr, binary.LittleEndian, v)
+	return binary.Read(sr, order, v)
 }
 
 //go:generate stringer -type=RecordsOrder
@@ -309,8 +528,8 @@ const (
 
 	// RecordsTimeOrder requests records in time-stamp order. This
 	// is the most expensive iteration order because it requires
-	// buffering and/or re-reading potentially large sections of
-	// the input file in order to sort the records.
+	// buffering and re-reading the input file in order to sort the
+	// records; see roundOrder for how that buffering is bounded.
 	RecordsTimeOrder
 )
 
@@ -319,58 +538,27 @@ const (
 // records in this File. Callers should choose the least
 // resource-intensive iteration order that satisfies their needs.
 func (f *File) Records(order RecordsOrder) *Records {
+	if f.pipe != nil && (order == RecordsCausalOrder || order == RecordsTimeOrder) {
+		// Both orders require seeking back through the input to
+		// re-read it in sorted order, which isn't possible on the
+		// pipe NewPipeReader is streaming from.
+		return &Records{err: fmt.Errorf("perffile: RecordsCausalOrder and RecordsTimeOrder aren't supported on a pipe-mode File")}
+	}
+
 	if order == RecordsCausalOrder || order == RecordsTimeOrder {
-		// Sort the records by making two passes: first record
-		// the offsets and time-stamps of all records, then
-		// sort this by time-stamp and re-read in the new
-		// offset order.
-		//
-		// See process_finished_round in session.c for how
-		// perf does this. process_finished_round uses a
-		// special flush event; however, I've never actually
-		// observed in a perf.data file, so I think perf may
-		// be reading and sorting the whole file looking for a
-		// flush.
-
-		// TODO: Optimize the first pass to decode only the
-		// record length and time-stamp.
-
-		// TODO: Optimize IO on the second pass by keeping
-		// track of the non-monotonic boundaries and
-		// performing separately buffered reads of each
-		// sub-stream.
-
-		rs := f.Records(RecordsFileOrder)
-		pos, ts := make([]int64, 0), make([]uint64, 0)
-		for rs.Next() {
-			c := rs.Record.Common()
-			pos = append(pos, c.Offset)
-			ts = append(ts, c.Time)
-		}
-		if rs.Err() != nil {
-			return &Records{err: rs.Err()}
+		// Discover the replay order with roundOrder, which groups
+		// records by CPU (or pid/tid) and drains them in time order
+		// on each PERF_RECORD_FINISHED_ROUND, the same bounded-memory
+		// algorithm perf itself uses; see process_finished_round in
+		// session.c. A file with no FINISHED_ROUND records (some
+		// perf versions never emit them) just never drains before
+		// EOF, which amounts to sorting the whole file at once.
+		pos, err := f.roundOrder()
+		if err != nil {
+			return &Records{err: err}
 		}
-		sort.Stable(&timeSorter{pos, ts})
 		return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r)), order: pos}
 	}
 
 	return &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))}
 }
-
-type timeSorter struct {
-	pos []int64
-	ts  []uint64
-}
-
-func (s *timeSorter) Len() int {
-	return len(s.pos)
-}
-
-func (s *timeSorter) Less(i, j int) bool {
-	return s.ts[i] < s.ts[j]
-}
-
-func (s *timeSorter) Swap(i, j int) {
-	s.pos[i], s.pos[j] = s.pos[j], s.pos[i]
-	s.ts[i], s.ts[j] = s.ts[j], s.ts[i]
-}
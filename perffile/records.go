@@ -8,6 +8,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // A Records is an iterator over the records in a "perf.data" file.
@@ -38,9 +40,35 @@ type Records struct {
 	// records are read in this order.
 	order []int64
 
+	// merge is non-nil for a Records returned by MergeRecords, in
+	// which case Next delegates to nextMerge instead of reading from
+	// sr: f, sr, order, buf, and pending are unused.
+	merge *recordMerger
+
 	// Read buffer.  Reused (and resized) by Next.
 	buf []byte
 
+	// pending holds the not-yet-returned sub-records spliced from a
+	// decompressed PERF_RECORD_COMPRESSED or PERF_RECORD_COMPRESSED2
+	// payload. When pending.buf is non-empty, Next serves the next
+	// record from here instead of from sr.
+	pending bufDecoder
+
+	// pendingOffset is the RecordCommon.Offset reported for records
+	// served from pending: the file offset of the compressed
+	// wrapper record they were spliced from, since the sub-records
+	// have no individual offsets of their own.
+	pendingOffset int64
+
+	// pendingBuf is the scratch buffer decompress decodes
+	// PERF_RECORD_COMPRESSED(2) payloads into. Reused (and resized)
+	// by decompress.
+	pendingBuf []byte
+
+	// zstdDec is the zstd decoder used by decompress. It's created
+	// lazily since most profiles aren't recorded with compression.
+	zstdDec *zstd.Decoder
+
 	// Cache for common record types
 	recordMmap          RecordMmap
 	recordComm          RecordComm
@@ -70,6 +98,10 @@ func (r *Records) Next() bool {
 		return false
 	}
 
+	if r.merge != nil {
+		return r.nextMerge()
+	}
+
 	if r.order != nil {
 		if len(r.order) == 0 {
 			return false
@@ -82,30 +114,111 @@ func (r *Records) Next() bool {
 		}
 	}
 
-	var common RecordCommon
-	offset, _ := r.sr.Seek(0, 1)
-	common.Offset = offset + int64(r.f.hdr.Data.Offset)
-
-	// Read record header
-	var hdr recordHeader
-	if err := binary.Read(r.sr, binary.LittleEndian, &hdr); err != nil {
-		if err != io.EOF {
-			r.err = err
-		}
+	hdr, common, bd, ok := r.nextRaw()
+	if !ok {
 		return false
 	}
 
-	// Read record data
-	rlen := int(hdr.Size - 8)
-	if rlen > len(r.buf) {
-		r.buf = make([]byte, rlen)
-	}
-	var bd = &bufDecoder{r.buf[:rlen], binary.LittleEndian}
-	if _, err := io.ReadFull(r.sr, bd.buf); err != nil {
-		r.err = err
+	r.Record = r.decodeRecord(bd, hdr, common)
+	if r.err != nil {
 		return false
 	}
+	return true
+}
+
+// nextRaw reads the next record's header and body bytes in file
+// order, transparently splicing in sub-records from a decompressed
+// PERF_RECORD_COMPRESSED(2) payload and applying (rather than
+// returning) the pipe-mode recordTypeAttr and recordTypeHeaderFeature
+// records exactly as Next does. It's factored out of Next so
+// roundOrder's discovery pass can read the same record stream Next
+// does without paying for a full decodeRecord of every record.
+//
+// It returns ok == false at EOF or on error; see r.err.
+func (r *Records) nextRaw() (hdr recordHeader, common RecordCommon, bd *bufDecoder, ok bool) {
+	for {
+		if len(r.pending.buf) > 0 {
+			// Serve the next record spliced in from a
+			// decompressed PERF_RECORD_COMPRESSED(2)
+			// payload.
+			common.Offset = r.pendingOffset
+			hdr.Type = RecordType(r.pending.order.Uint32(r.pending.buf))
+			hdr.Misc = recordMisc(r.pending.order.Uint16(r.pending.buf[4:]))
+			hdr.Size = r.pending.order.Uint16(r.pending.buf[6:])
+			if int(hdr.Size) < 8 || int(hdr.Size) > len(r.pending.buf) {
+				r.err = fmt.Errorf("corrupt record in decompressed HEADER_COMPRESSED payload")
+				return hdr, common, nil, false
+			}
+			r.pending.skip(8)
+			bd = &bufDecoder{r.pending.chain(int(hdr.Size) - 8), r.pending.order}
+		} else {
+			offset, _ := r.sr.Seek(0, 1)
+			common.Offset = offset + int64(r.f.hdr.Data.Offset)
+
+			// Read record header
+			if err := binary.Read(r.sr, r.f.order, &hdr); err != nil {
+				if err != io.EOF {
+					r.err = err
+				}
+				return hdr, common, nil, false
+			}
+
+			// Read record data
+			rlen := int(hdr.Size - 8)
+			if rlen > len(r.buf) {
+				r.buf = make([]byte, rlen)
+			}
+			bd = &bufDecoder{r.buf[:rlen], r.f.order}
+			if _, err := io.ReadFull(r.sr, bd.buf); err != nil {
+				r.err = err
+				return hdr, common, nil, false
+			}
+		}
+
+		switch hdr.Type {
+		case recordTypeCompressed, recordTypeCompressed2:
+			if !r.decompress(bd, common.Offset) {
+				return hdr, common, nil, false
+			}
+			continue
+
+		case recordTypeAttr:
+			// Only emitted in pipe-mode input (see
+			// NewPipeReader), where it takes the place of the
+			// Attrs section of a regular perf.data file's
+			// header: apply it to r.f and move on to the next
+			// record rather than returning it, just like the
+			// header events a regular perf.data file's trailer
+			// expands into never show up as Records either.
+			if !r.applyPipeAttr(bd.buf) {
+				return hdr, common, nil, false
+			}
+			continue
+
+		case recordTypeHeaderFeature:
+			// As with recordTypeAttr, only used in pipe-mode
+			// input, taking the place of a regular file's
+			// feature sections.
+			if !r.applyPipeFeature(bd.buf) {
+				return hdr, common, nil, false
+			}
+			continue
+		}
+		return hdr, common, bd, true
+	}
+}
 
+// decodeRecord parses the body bytes in bd (for the record described
+// by hdr and common) into the corresponding Record type. It's the
+// part of Next that's also reused, with a private *Records as the
+// receiver, by RecordsParallel's workers; in that use, hdr and common
+// are local to the call and bd's backing array isn't shared with any
+// other in-flight record, so the Record decodeRecord returns doesn't
+// alias anything Next's caller could be holding onto concurrently.
+//
+// decodeRecord reports errors via r.err, the same as the rest of
+// this file's parse* methods.
+func (r *Records) decodeRecord(bd *bufDecoder, hdr recordHeader, common RecordCommon) Record {
 	// Parse common sample_id fields
 	if r.f.sampleIDAll && hdr.Type != RecordTypeSample && hdr.Type < recordTypeUserStart {
 		// mmap records in the prologue don't have eventAttrs
@@ -121,81 +234,77 @@ func (r *Records) Next() bool {
 	default:
 		// As far as I can tell, RecordTypeRead can never
 		// appear in a perf.data file.
-		r.Record = &RecordUnknown{hdr, common, bd.buf}
+		return &RecordUnknown{hdr, common, bd.buf}
 
 	case RecordTypeMmap:
-		r.Record = r.parseMmap(bd, &hdr, &common, false)
+		return r.parseMmap(bd, &hdr, &common, false)
 
 	case RecordTypeLost:
-		r.Record = r.parseLost(bd, &hdr, &common)
+		return r.parseLost(bd, &hdr, &common)
 
 	case RecordTypeComm:
-		r.Record = r.parseComm(bd, &hdr, &common)
+		return r.parseComm(bd, &hdr, &common)
 
 	case RecordTypeExit:
-		r.Record = r.parseExit(bd, &hdr, &common)
+		return r.parseExit(bd, &hdr, &common)
 
 	case RecordTypeThrottle:
-		r.Record = r.parseThrottle(bd, &hdr, &common, true)
+		return r.parseThrottle(bd, &hdr, &common, true)
 
 	case RecordTypeUnthrottle:
-		r.Record = r.parseThrottle(bd, &hdr, &common, false)
+		return r.parseThrottle(bd, &hdr, &common, false)
 
 	case RecordTypeFork:
-		r.Record = r.parseFork(bd, &hdr, &common)
+		return r.parseFork(bd, &hdr, &common)
 
 	case RecordTypeSample:
-		r.Record = r.parseSample(bd, &hdr, &common)
+		return r.parseSample(bd, &hdr, &common)
 
 	case recordTypeMmap2:
-		r.Record = r.parseMmap(bd, &hdr, &common, true)
+		return r.parseMmap(bd, &hdr, &common, true)
 
 	case RecordTypeAux:
-		r.Record = r.parseAux(bd, &hdr, &common)
+		return r.parseAux(bd, &hdr, &common)
 
 	case RecordTypeItraceStart:
-		r.Record = r.parseItraceStart(bd, &hdr, &common)
+		return r.parseItraceStart(bd, &hdr, &common)
 
 	case RecordTypeLostSamples:
-		r.Record = r.parseLostSamples(bd, &hdr, &common)
+		return r.parseLostSamples(bd, &hdr, &common)
 
 	case RecordTypeSwitch:
-		r.Record = r.parseSwitch(bd, &hdr, &common)
+		return r.parseSwitch(bd, &hdr, &common)
 
 	case RecordTypeSwitchCPUWide:
-		r.Record = r.parseSwitchCPUWide(bd, &hdr, &common)
+		return r.parseSwitchCPUWide(bd, &hdr, &common)
 
 	case RecordTypeNamespaces:
-		r.Record = r.parseNamespaces(bd, &hdr, &common)
+		return r.parseNamespaces(bd, &hdr, &common)
 
 	case RecordTypeKsymbol:
-		r.Record = r.parseKsymbol(bd, &hdr, &common)
+		return r.parseKsymbol(bd, &hdr, &common)
 
 	case RecordTypeBPFEvent:
-		r.Record = r.parseBPFEvent(bd, &hdr, &common)
+		return r.parseBPFEvent(bd, &hdr, &common)
 
 	case RecordTypeCGroup:
-		r.Record = r.parseCGroup(bd, &hdr, &common)
+		return r.parseCGroup(bd, &hdr, &common)
 
 	case RecordTypeTextPoke:
-		r.Record = r.parseTextPoke(bd, &hdr, &common)
+		return r.parseTextPoke(bd, &hdr, &common)
 
 	case RecordTypeAuxOutputHardwareID:
-		r.Record = r.parseAuxOutputHardwareID(bd, &hdr, &common)
+		return r.parseAuxOutputHardwareID(bd, &hdr, &common)
 
 	case RecordTypeAuxtraceInfo:
-		r.Record = r.parseAuxtraceInfo(bd, &hdr, &common)
+		return r.parseAuxtraceInfo(bd, &hdr, &common)
 
 	case RecordTypeAuxtrace:
 		// Note: This appears to be the only record type that
 		// has additional payload data following it that isn't
 		// included in the header size.
-		r.Record = r.parseAuxtrace(bd, &hdr, &common)
-	}
-	if r.err != nil {
-		return false
+		return r.parseAuxtrace(bd, &hdr, &common)
 	}
-	return true
 }
 
 func (r *Records) getAttr(id attrID, nilOk bool) *EventAttr {
@@ -427,14 +536,14 @@ func (r *Records) parseBPFEvent(bd *bufDecoder, hdr *recordHeader, common *Recor
 	o.EventType = BPFEventType(bd.u16())
 	o.Flags = BPFEventFlags(bd.u16())
 	o.ID = bd.u32()
-	o.Tag = bd.u64()
+	bd.bytes(o.Tag[:])
 
 	return o
 }
 
 func (r *Records) parseCGroup(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
 	o := &RecordCGroup{RecordCommon: *common}
-	o.ID = bd.u32()
+	o.ID = bd.u64()
 	o.Path = bd.cstring()
 
 	return o
@@ -463,9 +572,8 @@ func (r *Records) parseAuxOutputHardwareID(bd *bufDecoder, hdr *recordHeader, co
 
 func (r *Records) parseAuxtraceInfo(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
 	o := &RecordAuxtraceInfo{RecordCommon: *common}
-	o.Kind = bd.u32()
+	o.Kind = AuxtraceKind(bd.u32())
 	bd.u32() // Alignment
-	// TODO: Decode remainder according to Kind
 	o.Priv = make([]uint64, len(bd.buf)/8)
 	bd.u64s(o.Priv)
 	return o
@@ -484,6 +592,55 @@ func (r *Records) parseAuxtrace(bd *bufDecoder, hdr *recordHeader, common *Recor
 	return o
 }
 
+// scanTime fills in common's Format, Time, CPU, PID, TID, and
+// StreamID fields -- the same fields decodeRecord's preamble and
+// parseSample decode -- without parsing any type-specific payload.
+// roundOrder uses this on its discovery pass so it doesn't pay for a
+// full parseSample (in particular, its Callchain, Raw, and
+// BranchStack, the expensive part of decoding a RecordSample) just to
+// learn a record's timestamp.
+//
+// Errors are reported via r.err, as with the rest of this file's
+// parse* methods. bd is left in an unspecified position; scanTime is
+// only ever used in place of decodeRecord, never alongside it.
+func (r *Records) scanTime(bd *bufDecoder, hdr recordHeader, common RecordCommon) RecordCommon {
+	if r.f.sampleIDAll && hdr.Type != RecordTypeSample && hdr.Type < recordTypeUserStart {
+		r.parseCommon(bd, &common, hdr.Type == RecordTypeMmap)
+		return common
+	}
+	if hdr.Type != RecordTypeSample {
+		return common
+	}
+
+	// Mirror parseSample's field order up through CPU, which is as
+	// far as roundOrder needs; Period and everything after it
+	// (ReadFormat, Callchain, Raw, BranchStack, ...) is exactly the
+	// part a full decode spends most of its time on and roundOrder
+	// doesn't need at all.
+	if r.f.sampleIDOffset == -1 {
+		common.ID = 0
+	} else {
+		common.ID = attrID(bd.order.Uint64(bd.buf[r.f.sampleIDOffset:]))
+	}
+	attr := r.getAttr(common.ID, false)
+	if attr == nil {
+		return common
+	}
+	t := attr.SampleFormat
+	common.Format = t
+	bd.u64If(t&SampleFormatIdentifier != 0)
+	bd.u64If(t&SampleFormatIP != 0)
+	common.PID = int(bd.i32If(t&SampleFormatTID != 0))
+	common.TID = int(bd.i32If(t&SampleFormatTID != 0))
+	common.Time = bd.u64If(t&SampleFormatTime != 0)
+	bd.u64If(t&SampleFormatAddr != 0)
+	bd.u64If(t&SampleFormatID != 0)
+	common.StreamID = bd.u64If(t&SampleFormatStreamID != 0)
+	common.CPU = bd.u32If(t&SampleFormatCPU != 0)
+	bd.u32If(t&SampleFormatCPU != 0) // Res
+	return common
+}
+
 func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordCommon) Record {
 	o := &r.recordSample
 	o.RecordCommon = *common
@@ -669,6 +826,33 @@ func (r *Records) parseSample(bd *bufDecoder, hdr *recordHeader, common *RecordC
 	return o
 }
 
+// decompress inflates the zstd-compressed payload of a
+// PERF_RECORD_COMPRESSED or PERF_RECORD_COMPRESSED2 record into
+// r.pendingBuf and points r.pending at the result, so the next
+// iteration of Next's read loop serves its sub-records one at a time
+// before falling back to r.sr. offset is the wrapper record's own
+// RecordCommon.Offset, reported for every sub-record it contains.
+func (r *Records) decompress(bd *bufDecoder, offset int64) bool {
+	if r.zstdDec == nil {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.zstdDec = dec
+	}
+
+	out, err := r.zstdDec.DecodeAll(bd.buf, r.pendingBuf[:0])
+	if err != nil {
+		r.err = fmt.Errorf("decompressing HEADER_COMPRESSED payload: %w", err)
+		return false
+	}
+	r.pendingBuf = out
+	r.pending = bufDecoder{out, bd.order}
+	r.pendingOffset = offset
+	return true
+}
+
 func (r *Records) parseReadFormat(bd *bufDecoder, f ReadFormat, out *[]Count) {
 	n := 1
 	if f&ReadFormatGroup != 0 {
@@ -0,0 +1,158 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import "container/heap"
+
+// roundOrder computes the replay order File.Records uses for
+// RecordsCausalOrder and RecordsTimeOrder. It implements the same
+// algorithm perf itself uses to bound the memory this requires (see
+// process_finished_round in tools/perf/util/session.c): group records
+// into per-CPU queues (or, when CPU isn't sampled, per-(pid,tid)
+// queues) as they're read in file order, and whenever a
+// PERF_RECORD_FINISHED_ROUND marker is seen, drain every record whose
+// time is no later than the minimum "most recently queued" time
+// across all non-empty queues, in time order, via a heap over the
+// queues' heads.
+//
+// A file with no FINISHED_ROUND markers never drains before EOF, so
+// this degenerates to buffering every record and heap-sorting all of
+// them at once: the same result the old whole-file sort produced,
+// without a second, separate code path to get there.
+//
+// Records with no timestamp (EventAttr.SampleFormat lacks
+// SampleFormatTime) can't be placed by time; they're queued in
+// arrival order and flushed, still in arrival order, alongside
+// whichever round they arrived in.
+func (f *File) roundOrder() ([]int64, error) {
+	scan := &Records{f: f, sr: newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))}
+
+	queues := make(map[int64]*roundQueue)
+	var untimed []int64
+	var order []int64
+	var seq int64
+	h := &roundHeap{}
+
+	drain := func(minEnd uint64) {
+		for h.Len() > 0 && (*h)[0].time <= minEnd {
+			key := (*h)[0].key
+			q := queues[key]
+			order = append(order, q.offsets[0])
+			q.offsets, q.times, q.seqs = q.offsets[1:], q.times[1:], q.seqs[1:]
+			if len(q.offsets) > 0 {
+				(*h)[0] = roundHeapItem{time: q.times[0], seq: q.seqs[0], key: key}
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+				delete(queues, key)
+			}
+		}
+	}
+
+	for {
+		hdr, common, bd, ok := scan.nextRaw()
+		if !ok {
+			break
+		}
+
+		if hdr.Type == recordTypeFinishedRound {
+			minEnd := ^uint64(0)
+			for _, q := range queues {
+				if t := q.times[len(q.times)-1]; t < minEnd {
+					minEnd = t
+				}
+			}
+			if len(queues) > 0 {
+				drain(minEnd)
+			}
+			order = append(order, untimed...)
+			untimed = untimed[:0]
+			continue
+		}
+
+		common = scan.scanTime(bd, hdr, common)
+		if scan.err != nil {
+			return nil, scan.err
+		}
+
+		if common.Format&SampleFormatTime == 0 {
+			untimed = append(untimed, common.Offset)
+			continue
+		}
+
+		var key int64
+		switch {
+		case common.Format&SampleFormatCPU != 0:
+			key = int64(common.CPU)
+		case common.Format&SampleFormatTID != 0:
+			key = int64(common.PID)<<32 | int64(uint32(common.TID))
+		default:
+			// No way to group this record with its
+			// causally-related peers; treat it as its own
+			// single-record queue.
+			key = -1
+		}
+
+		q, ok := queues[key]
+		if !ok {
+			q = &roundQueue{}
+			queues[key] = q
+		}
+		q.offsets = append(q.offsets, common.Offset)
+		q.times = append(q.times, common.Time)
+		q.seqs = append(q.seqs, seq)
+		seq++
+		if len(q.offsets) == 1 {
+			heap.Push(h, roundHeapItem{time: q.times[0], seq: q.seqs[0], key: key})
+		}
+	}
+	if scan.err != nil {
+		return nil, scan.err
+	}
+
+	// Drain whatever's left at EOF: either the tail after the last
+	// FINISHED_ROUND, or, if the file never had one, every record in
+	// the file.
+	drain(^uint64(0))
+	order = append(order, untimed...)
+	return order, nil
+}
+
+// roundQueue is one grouping key's queue of not-yet-drained records,
+// in file arrival order.
+type roundQueue struct {
+	offsets []int64
+	times   []uint64
+	seqs    []int64
+}
+
+// roundHeapItem is the head of one roundQueue, as tracked by the
+// min-heap roundOrder drains from.
+type roundHeapItem struct {
+	time uint64
+	seq  int64 // breaks ties in file arrival order, like sort.Stable did
+	key  int64
+}
+
+type roundHeap []roundHeapItem
+
+func (h roundHeap) Len() int { return len(h) }
+func (h roundHeap) Less(i, j int) bool {
+	if h[i].time != h[j].time {
+		return h[i].time < h[j].time
+	}
+	return h[i].seq < h[j].seq
+}
+func (h roundHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *roundHeap) Push(x any) { *h = append(*h, x.(roundHeapItem)) }
+
+func (h *roundHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildRoundSortFile hand-assembles a minimal little-endian perf.data
+// file whose Data section interleaves two CPUs' RecordSamples the way
+// perf's own per-CPU mmap buffers do: each CPU's samples are written
+// in its own time order, but the two CPUs interleave out of global
+// time order. If withFinishedRound is set, each flush is marked with
+// a PERF_RECORD_FINISHED_ROUND, as real perf.data files (mostly) are;
+// round 1 leaves one sample (cpu 0 at time 30) undrained because it's
+// later than the other queue's last sample, and round 2 leaves a
+// sample on cpu 1 undrained for roundOrder's final, end-of-file drain
+// to pick up. If withFinishedRound is unset, the same records appear
+// with no round markers at all, exercising roundOrder's fallback to
+// one big end-of-file drain.
+func buildRoundSortFile(t *testing.T, withFinishedRound bool) []byte {
+	t.Helper()
+	order := binary.LittleEndian
+
+	var attr eventAttrVN
+	attr.Type = EventTypeHardware
+	attr.Size = uint32(binary.Size(eventAttrVN{}))
+	attr.Config = 0 // PERF_COUNT_HW_CPU_CYCLES
+	attr.SampleFormat = SampleFormatTID | SampleFormatTime | SampleFormatCPU
+	attrSize := binary.Size(eventAttrVN{}) + binary.Size(fileSection{})
+
+	sample := func(cpu uint32, time uint64) []byte {
+		var rec bytes.Buffer
+		binary.Write(&rec, order, int32(1))  // pid
+		binary.Write(&rec, order, int32(1))  // tid
+		binary.Write(&rec, order, time)      // time
+		binary.Write(&rec, order, cpu)       // cpu
+		binary.Write(&rec, order, uint32(0)) // res
+		hdr := recordHeader{Type: RecordTypeSample, Size: uint16(8 + rec.Len())}
+		var out bytes.Buffer
+		binary.Write(&out, order, &hdr)
+		out.Write(rec.Bytes())
+		return out.Bytes()
+	}
+	finishedRound := func() []byte {
+		hdr := recordHeader{Type: recordTypeFinishedRound, Size: 8}
+		var out bytes.Buffer
+		binary.Write(&out, order, &hdr)
+		return out.Bytes()
+	}
+
+	var data bytes.Buffer
+	// Round 1: cpu 0 at 10, 30; cpu 1 at 5, 20.
+	data.Write(sample(0, 10))
+	data.Write(sample(1, 5))
+	data.Write(sample(0, 30))
+	data.Write(sample(1, 20))
+	if withFinishedRound {
+		data.Write(finishedRound())
+	}
+	// Round 2: cpu 0 at 40; cpu 1 at 50.
+	data.Write(sample(0, 40))
+	data.Write(sample(1, 50))
+	if withFinishedRound {
+		data.Write(finishedRound())
+	}
+
+	var hdr fileHeader
+	copy(hdr.Magic[:], "PERFILE2")
+	hdr.Size = uint64(binary.Size(hdr))
+	hdr.AttrSize = uint64(attrSize)
+	hdr.Attrs = fileSection{Offset: uint64(hdr.Size), Size: uint64(attrSize)}
+	hdr.Data = fileSection{Offset: hdr.Attrs.Offset + hdr.Attrs.Size + 8, Size: uint64(data.Len())}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, &hdr)
+	binary.Write(buf, order, &attr)
+	binary.Write(buf, order, &fileSection{Offset: uint64(buf.Len()) + uint64(binary.Size(fileSection{})), Size: 8})
+	binary.Write(buf, order, attrID(1))
+	buf.Write(data.Bytes())
+
+	return buf.Bytes()
+}
+
+func checkRoundSortOrder(t *testing.T, data []byte) {
+	t.Helper()
+	f, err := New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	rs := f.Records(RecordsTimeOrder)
+	var times []uint64
+	for rs.Next() {
+		s, ok := rs.Record.(*RecordSample)
+		if !ok {
+			continue
+		}
+		times = append(times, s.Time)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+
+	want := []uint64{5, 10, 20, 30, 40, 50}
+	if len(times) != len(want) {
+		t.Fatalf("got %d samples %v, want %d %v", len(times), times, len(want), want)
+	}
+	for i := range want {
+		if times[i] != want[i] {
+			t.Errorf("times = %v, want %v", times, want)
+			break
+		}
+	}
+}
+
+func TestRoundSort(t *testing.T) {
+	checkRoundSortOrder(t, buildRoundSortFile(t, true))
+}
+
+// TestRoundSortNoFinishedRound checks that a file with no
+// PERF_RECORD_FINISHED_ROUND records (some perf versions never emit
+// them) still sorts correctly: roundOrder should just never drain
+// before the end-of-file fallback drain.
+func TestRoundSortNoFinishedRound(t *testing.T) {
+	checkRoundSortOrder(t, buildRoundSortFile(t, false))
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symbolize
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// bpfRange records that the address range [Lo, Hi) held the kernel
+// symbol Name from Start until End (or indefinitely, if still open
+// when the file ended), as announced by a pair of RecordKsymbol
+// register/unregister events. Kernel JIT and out-of-line code
+// reuses the same address ranges over a recording's lifetime far
+// more readily than user mappings do, so, unlike findMmapIn's
+// newest-mapping-wins search, looking a range up requires the
+// sample's own time to pick the right one.
+type bpfRange struct {
+	Lo, Hi     uint64
+	Name       string
+	Start, End uint64 // End is ^uint64(0) while still live
+}
+
+func (b *bpfRange) contains(ip, time uint64) bool {
+	return b.Lo <= ip && ip < b.Hi && b.Start <= time && time < b.End
+}
+
+// updateKsymbol folds a RecordKsymbol in to s.bpfRanges: a
+// registration opens a new range (pending its eventual
+// unregistration), and an unregistration closes whichever range is
+// still open at that address.
+//
+// Only KsymbolTypeBpf and KsymbolTypeOol symbols are tracked; other
+// kinds (e.g. plain module symbols) aren't dynamic in the same way
+// and this package has no other use for them.
+func (s *Symbolizer) updateKsymbol(r *perffile.RecordKsymbol) {
+	if r.KsymType != perffile.KsymbolTypeBpf && r.KsymType != perffile.KsymbolTypeOol {
+		return
+	}
+
+	if r.Flags&perffile.KsymbolFlagUnregister != 0 {
+		if open, ok := s.bpfOpen[r.Addr]; ok {
+			open.End = r.Time
+			delete(s.bpfOpen, r.Addr)
+		}
+		return
+	}
+
+	rng := &bpfRange{
+		Lo:    r.Addr,
+		Hi:    r.Addr + uint64(r.Len),
+		Name:  r.Name,
+		Start: r.Time,
+		End:   ^uint64(0),
+	}
+	s.bpfRanges = append(s.bpfRanges, *rng)
+	if s.bpfOpen == nil {
+		s.bpfOpen = make(map[uint64]*bpfRange)
+	}
+	// Index the slice element, not rng itself, so later updates
+	// (End) land in s.bpfRanges where resolveBPF looks for them.
+	s.bpfOpen[r.Addr] = &s.bpfRanges[len(s.bpfRanges)-1]
+}
+
+// updateBPFEvent records a ProgLoad's tag so resolveBPF can attach
+// the program's ID to a matching ksymbol.
+func (s *Symbolizer) updateBPFEvent(r *perffile.RecordBPFEvent) {
+	if r.EventType != perffile.BPFEventTypeProgLoad {
+		return
+	}
+	s.bpfProgs[r.Tag] = r
+}
+
+// bpfKsymPrefix is the prefix the kernel gives every JIT'd BPF
+// program's ksymbol name: "bpf_prog_" followed by the program's
+// 8-byte tag in hex, then "_" and the program's own name.
+const bpfKsymPrefix = "bpf_prog_"
+
+// resolveBPF looks up the kernel symbol live at (ip, time) among the
+// ranges recorded from RecordKsymbol, and reports its name (and, if
+// a matching ProgLoad was seen, its program ID).
+func (s *Symbolizer) resolveBPF(ip, time uint64) (Frame, bool) {
+	for i := range s.bpfRanges {
+		rng := &s.bpfRanges[i]
+		if !rng.contains(ip, time) {
+			continue
+		}
+		frame := Frame{Func: rng.Name}
+		if tag, ok := bpfTagFromKsymName(rng.Name); ok {
+			if prog, ok := s.bpfProgs[tag]; ok {
+				frame.BPFProgID = prog.ID
+			}
+		}
+		return frame, true
+	}
+	return Frame{}, false
+}
+
+// bpfTagFromKsymName extracts the 8-byte program tag from a ksymbol
+// name of the form "bpf_prog_<32 hex digits>_<name>", or reports ok
+// == false if name doesn't have that shape.
+func bpfTagFromKsymName(name string) (tag [8]byte, ok bool) {
+	rest := strings.TrimPrefix(name, bpfKsymPrefix)
+	if rest == name || len(rest) < 16 {
+		return tag, false
+	}
+	raw, err := hex.DecodeString(rest[:16])
+	if err != nil || len(raw) != 8 {
+		return tag, false
+	}
+	copy(tag[:], raw)
+	return tag, true
+}
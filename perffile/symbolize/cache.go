@@ -0,0 +1,68 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symbolize
+
+import "container/list"
+
+// frameCacheSize bounds how many resolved (binary, address) -> Frame
+// entries frameCache retains. Call chains overwhelmingly revisit a
+// small set of hot symbols (loop bodies, recursive calls, common
+// library functions), so a modest LRU avoids re-walking a binary's
+// DWARF or symbol table for addresses Resolve has already seen,
+// without growing unboundedly over a long-running profile.
+const frameCacheSize = 4096
+
+// frameCacheKey identifies a previously resolved address within a
+// specific binary; the same virtual address means different things
+// in different binaries.
+type frameCacheKey struct {
+	bin  *binFile
+	addr uint64
+}
+
+// frameCache is a fixed-size LRU cache from frameCacheKey to the
+// Frame Resolve previously resolved it to.
+type frameCache struct {
+	cap   int
+	ll    *list.List // of *frameCacheEntry, most recently used at the front
+	index map[frameCacheKey]*list.Element
+}
+
+type frameCacheEntry struct {
+	key   frameCacheKey
+	frame Frame
+}
+
+func newFrameCache(cap int) *frameCache {
+	return &frameCache{
+		cap:   cap,
+		ll:    list.New(),
+		index: make(map[frameCacheKey]*list.Element),
+	}
+}
+
+func (c *frameCache) get(key frameCacheKey) (Frame, bool) {
+	elem, ok := c.index[key]
+	if !ok {
+		return Frame{}, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*frameCacheEntry).frame, true
+}
+
+func (c *frameCache) put(key frameCacheKey, frame Frame) {
+	if elem, ok := c.index[key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*frameCacheEntry).frame = frame
+		return
+	}
+	elem := c.ll.PushFront(&frameCacheEntry{key, frame})
+	c.index[key] = elem
+	if c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.index, oldest.Value.(*frameCacheEntry).key)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symbolize
+
+import "github.com/aclements/go-perf/perffile"
+
+// A SymbolizedFrame pairs one RecordSample given to Symbolize with the
+// resolved Frame for its leaf instruction pointer.
+type SymbolizedFrame struct {
+	Sample *perffile.RecordSample
+	Frame  Frame
+
+	// Err is the error Resolve returned for Sample.IP, or nil if it
+	// resolved successfully.
+	Err error
+}
+
+// Symbolize resolves the leaf IP of every RecordSample in records, in
+// order, using s's caches; any other Record type is skipped. It's a
+// convenience for callers that already have records buffered, such as
+// from ParallelRecords or a TimeIndex-bounded range, over calling
+// Resolve in a loop themselves.
+func (s *Symbolizer) Symbolize(records []perffile.Record) []SymbolizedFrame {
+	out := make([]SymbolizedFrame, 0, len(records))
+	for _, rec := range records {
+		sample, ok := rec.(*perffile.RecordSample)
+		if !ok {
+			continue
+		}
+		frame, err := s.Resolve(sample.PID, sample.CPUMode, sample.IP, sample.Time)
+		out = append(out, SymbolizedFrame{sample, frame, err})
+	}
+	return out
+}
+
+// SymbolizedRecords streams the records from an underlying
+// *perffile.Records, resolving each RecordSample's leaf IP as it's
+// returned, rather than requiring the caller to buffer records up
+// front for Symbolize. Construct one with Symbolizer.Stream.
+type SymbolizedRecords struct {
+	rs *perffile.Records
+	s  *Symbolizer
+
+	// Frame is the resolved Frame for the current record's leaf IP,
+	// valid after Next returns true if Record() is a
+	// *perffile.RecordSample. It's the zero Frame for any other
+	// record type.
+	Frame Frame
+
+	// FrameErr is the error Resolve returned while resolving Frame,
+	// or nil.
+	FrameErr error
+}
+
+// Stream returns a SymbolizedRecords that resolves each RecordSample
+// read from rs as it's iterated.
+func (s *Symbolizer) Stream(rs *perffile.Records) *SymbolizedRecords {
+	return &SymbolizedRecords{rs: rs, s: s}
+}
+
+// Next advances to the next record, as Records.Next does, additionally
+// populating Frame and FrameErr when Record() is a *RecordSample.
+func (sr *SymbolizedRecords) Next() bool {
+	if !sr.rs.Next() {
+		return false
+	}
+	sr.Frame, sr.FrameErr = Frame{}, nil
+	if sample, ok := sr.rs.Record.(*perffile.RecordSample); ok {
+		sr.Frame, sr.FrameErr = sr.s.Resolve(sample.PID, sample.CPUMode, sample.IP, sample.Time)
+	}
+	return true
+}
+
+// Record returns the current record, as with Records.Record.
+func (sr *SymbolizedRecords) Record() perffile.Record {
+	return sr.rs.Record
+}
+
+// Err returns the first error encountered by the underlying Records.
+func (sr *SymbolizedRecords) Err() error {
+	return sr.rs.Err()
+}
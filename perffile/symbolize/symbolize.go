@@ -0,0 +1,519 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package symbolize resolves sample addresses to function names,
+// source files, and line numbers.
+//
+// Unlike perfsession's symbolizer, which is woven into Session's
+// incremental per-object Extra state, a Symbolizer is a standalone
+// object: it's seeded directly from a perffile.File's FileMeta and
+// MMAP/MMAP2 records, and answers one-off Resolve queries without the
+// caller needing to maintain any session state of its own.
+package symbolize
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// A Frame describes the source-level location an instruction address
+// resolved to.
+type Frame struct {
+	// Func is the name of the function containing the address, or
+	// "" if it couldn't be determined.
+	Func string
+
+	// File and Line are the source file and line number
+	// containing the address, or "", 0 if they couldn't be
+	// determined (for example, because the binary has no line
+	// number information).
+	File string
+	Line int
+
+	// BPFProgID is the BPF program ID (from RecordBPFEvent.ID) that
+	// Func resolved in to, or 0 if Func didn't come from a JIT'd BPF
+	// program. It's only ever set when the program's ProgLoad event
+	// was seen and its tag could be matched against Func's "bpf_prog_"
+	// ksymbol name, even though Func itself is available whenever the
+	// address falls in a live BPF ksymbol range.
+	BPFProgID uint32
+}
+
+// A Symbolizer resolves sample and callchain addresses from a single
+// perf.data file to Frames, using the file's BuildIDInfo and MMAP
+// records to locate the binaries those addresses came from.
+type Symbolizer struct {
+	buildIDs   []perffile.BuildIDInfo
+	searchPath []string
+	buildIDDir string
+
+	// mmaps holds, for each PID, the mappings seen in file order.
+	// Kernel and module mappings are keyed under PID -1, since
+	// they're visible to every process.
+	mmaps map[int][]*perffile.RecordMmap
+
+	// bins caches the symbolization data for each binary,
+	// keyed by the path it was loaded from. A nil entry records
+	// that loading previously failed.
+	bins map[string]*binFile
+
+	// cache is an LRU over addresses Resolve has already resolved
+	// within a binary, since call chains overwhelmingly revisit the
+	// same hot symbols.
+	cache *frameCache
+
+	// bpfRanges records the live address range of every dynamically
+	// JIT'd or out-of-line kernel symbol seen in a RecordKsymbol
+	// (BPF programs and "ool" trampolines), across however many
+	// times that address range was reused over the file's lifetime.
+	bpfRanges []bpfRange
+
+	// bpfOpen holds the in-progress bpfRanges entry for each
+	// address still awaiting its KsymbolFlagUnregister, keyed by
+	// Addr, so that event can fill in its End time.
+	bpfOpen map[uint64]*bpfRange
+
+	// bpfProgs maps a BPF program's tag (as embedded in the
+	// "bpf_prog_<tag>_<name>" ksymbol name the kernel assigns it) to
+	// the RecordBPFEvent that loaded it, so Resolve can report the
+	// program's ID alongside its name.
+	bpfProgs map[[8]byte]*perffile.RecordBPFEvent
+}
+
+// New creates a Symbolizer for f. It scans f's records for
+// FileMeta.BuildIDs and MMAP/MMAP2 records describing the files
+// mapped into each process, so callers typically only need to create
+// one Symbolizer per file rather than feeding it records themselves.
+//
+// By default, a Symbolizer locates binaries using perf's build-ID
+// cache under $HOME/.debug; use SetBuildIDCache to override this, and
+// AddSearchPath to add fallback directories to search by file name.
+func New(f *perffile.File) (*Symbolizer, error) {
+	s := &Symbolizer{
+		buildIDs:   f.Meta.BuildIDs,
+		buildIDDir: defaultBuildIDDir(),
+		mmaps:      make(map[int][]*perffile.RecordMmap),
+		bins:       make(map[string]*binFile),
+		cache:      newFrameCache(frameCacheSize),
+		bpfProgs:   make(map[[8]byte]*perffile.RecordBPFEvent),
+	}
+
+	rs := f.Records(perffile.RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *perffile.RecordMmap:
+			s.update(r)
+		case *perffile.RecordKsymbol:
+			s.updateKsymbol(r)
+		case *perffile.RecordBPFEvent:
+			s.updateBPFEvent(r)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func defaultBuildIDDir() string {
+	// See set_buildid_dir in tools/perf/util/config.c.
+	u, err := user.Current()
+	if err != nil {
+		return ".debug"
+	}
+	return fmt.Sprintf("%s/.debug", u.HomeDir)
+}
+
+// AddSearchPath adds dir to the list of directories Resolve searches,
+// by base file name, when a binary can't be found via the build-ID
+// cache or its original recorded path.
+func (s *Symbolizer) AddSearchPath(dir string) {
+	s.searchPath = append(s.searchPath, dir)
+}
+
+// SetBuildIDCache sets the root of perf's build-ID cache (normally
+// $HOME/.debug) that Resolve searches for binaries by build ID.
+func (s *Symbolizer) SetBuildIDCache(dir string) {
+	s.buildIDDir = dir
+}
+
+func (s *Symbolizer) update(r *perffile.RecordMmap) {
+	// The kernel and its modules are recorded with PID -1, so no
+	// special-casing is needed to separate them from user mappings.
+	s.mmaps[r.PID] = append(s.mmaps[r.PID], r)
+}
+
+// Resolve resolves the instruction address ip, sampled in process pid
+// at privilege level cpuMode at the given sample time (RecordCommon.Time),
+// to the function, file, and line it came from. It returns an error
+// only if ip couldn't be attributed to any mapped binary or live BPF
+// symbol, or that binary couldn't be opened or parsed; a resolved
+// binary with incomplete information (e.g., no line table) is not an
+// error, and simply leaves the corresponding Frame fields zero.
+//
+// time disambiguates addresses that were reused by different JIT'd
+// BPF programs over the life of the recording (see RecordKsymbol);
+// binary symbolization, which isn't time-sensitive, ignores it.
+func (s *Symbolizer) Resolve(pid int, cpuMode perffile.CPUMode, ip, time uint64) (Frame, error) {
+	if frame, ok := s.resolveBPF(ip, time); ok {
+		return frame, nil
+	}
+
+	mmap := s.findMmap(pid, cpuMode, ip)
+	if mmap == nil {
+		return Frame{}, fmt.Errorf("no mapping found for PID %d, IP %#x", pid, ip)
+	}
+
+	bin, err := s.binary(mmap.Filename)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	addr := ip
+	if bin.fileOffset {
+		addr = ip - mmap.Addr + mmap.FileOffset
+	}
+
+	key := frameCacheKey{bin, addr}
+	if frame, ok := s.cache.get(key); ok {
+		return frame, nil
+	}
+	frame := bin.resolve(addr)
+	s.cache.put(key, frame)
+	return frame, nil
+}
+
+func (s *Symbolizer) findMmap(pid int, cpuMode perffile.CPUMode, ip uint64) *perffile.RecordMmap {
+	switch cpuMode {
+	case perffile.CPUModeKernel, perffile.CPUModeHypervisor, perffile.CPUModeGuestKernel:
+		// Kernel and module mappings are always recorded under
+		// PID -1, regardless of which process was running.
+		return s.findMmapIn(-1, ip)
+	}
+	if m := s.findMmapIn(pid, ip); m != nil {
+		return m
+	}
+	// Fall back to the kernel's mappings, e.g. for a vDSO mapped
+	// into every process.
+	return s.findMmapIn(-1, ip)
+}
+
+func (s *Symbolizer) findMmapIn(pid int, ip uint64) *perffile.RecordMmap {
+	// Search newest-first, since a later mapping at an address
+	// supersedes an earlier one that was never explicitly
+	// unmapped (perf.data doesn't record munmaps).
+	maps := s.mmaps[pid]
+	for i := len(maps) - 1; i >= 0; i-- {
+		m := maps[i]
+		if m.Addr <= ip && ip < m.Addr+m.Len {
+			return m
+		}
+	}
+	return nil
+}
+
+// binary returns the cached symbolization data for the binary
+// recorded under filename, loading and caching it if necessary.
+func (s *Symbolizer) binary(filename string) (*binFile, error) {
+	path, err := s.findBinary(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if bin, ok := s.bins[path]; ok {
+		if bin == nil {
+			return nil, fmt.Errorf("previously failed to symbolize %s", path)
+		}
+		return bin, nil
+	}
+
+	bin, err := loadBinary(path)
+	if err != nil {
+		s.bins[path] = nil
+		return nil, err
+	}
+	s.bins[path] = bin
+	return bin, nil
+}
+
+// findBinary locates the on-disk binary that was mapped under
+// filename, trying the build-ID cache first, then the search path (by
+// base name), then filename itself.
+func (s *Symbolizer) findBinary(filename string) (string, error) {
+	if path, ok := s.findByBuildID(filename); ok {
+		return path, nil
+	}
+	for _, dir := range s.searchPath {
+		path := filepath.Join(dir, filepath.Base(filename))
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return filename, nil
+	}
+	return "", fmt.Errorf("can't find binary for %s", filename)
+}
+
+func (s *Symbolizer) findByBuildID(filename string) (string, bool) {
+	for _, bid := range s.buildIDs {
+		if bid.Filename != filename {
+			continue
+		}
+		hex := bid.BuildID.String()
+		if len(hex) < 2 {
+			continue
+		}
+		path := fmt.Sprintf("%s/.build-id/%s/%s/elf", s.buildIDDir, hex[:2], hex[2:])
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// binFile holds the symbolization data lazily parsed from one on-disk
+// binary.
+type binFile struct {
+	// funcs and lines are derived from DWARF or, failing that, the
+	// ELF symbol table. They're nil if gosym is non-nil instead.
+	funcs []funcRange
+	lines []dwarf.LineEntry
+
+	// gosym is the pclntab-derived symbol table used for Go
+	// binaries with no DWARF info (for example, stripped with
+	// -ldflags=-w), or nil.
+	gosym *gosym.Table
+
+	// fileOffset indicates that addresses in funcs (or gosym) are
+	// ELF file offsets rather than virtual addresses, as is the
+	// case for position-independent binaries (ET_DYN), whose
+	// symbol values are section-relative.
+	fileOffset bool
+}
+
+func loadBinary(path string) (*binFile, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer ef.Close()
+
+	if ef.Type == elf.ET_EXEC && ef.Section(".debug_info") != nil {
+		if dwarff, err := ef.DWARF(); err == nil {
+			return &binFile{funcs: dwarfFuncTable(dwarff), lines: dwarfLineTable(dwarff)}, nil
+		}
+	}
+
+	if tab, ok := gosymTable(ef); ok {
+		return &binFile{gosym: tab}, nil
+	}
+
+	funcs, fileOffset := elfFuncTable(path, ef)
+	return &binFile{funcs: funcs, fileOffset: fileOffset}, nil
+}
+
+// gosymTable builds a debug/gosym symbol table from ef's pclntab, for
+// Go binaries that have no DWARF info.
+func gosymTable(ef *elf.File) (*gosym.Table, bool) {
+	pclntab := ef.Section(".gopclntab")
+	if pclntab == nil {
+		return nil, false
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return nil, false
+	}
+
+	textStart := uint64(0)
+	if text := ef.Section(".text"); text != nil {
+		textStart = text.Addr
+	}
+	if syms, err := ef.Symbols(); err == nil {
+		for _, sym := range syms {
+			if sym.Name == "runtime.text" {
+				textStart = sym.Value
+				break
+			}
+		}
+	}
+
+	lt := gosym.NewLineTable(data, textStart)
+	tab, err := gosym.NewTable(nil, lt)
+	if err != nil {
+		return nil, false
+	}
+	return tab, true
+}
+
+func (b *binFile) resolve(addr uint64) Frame {
+	var frame Frame
+
+	if b.gosym != nil {
+		file, line, fn := b.gosym.PCToLine(addr)
+		if fn != nil {
+			frame.Func = fn.Name
+			frame.File = file
+			frame.Line = line
+		}
+		return frame
+	}
+
+	i := sort.Search(len(b.funcs), func(i int) bool { return addr < b.funcs[i].highpc })
+	if i < len(b.funcs) && b.funcs[i].lowpc <= addr {
+		frame.Func = b.funcs[i].name
+	}
+
+	if i := sort.Search(len(b.lines), func(i int) bool { return addr < b.lines[i].Address }); i != 0 {
+		le := b.lines[i-1]
+		if !le.EndSequence {
+			if le.File != nil {
+				frame.File = le.File.Name
+			}
+			frame.Line = le.Line
+		}
+	}
+
+	return frame
+}
+
+type funcRange struct {
+	name          string
+	lowpc, highpc uint64
+}
+
+func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
+	var out []funcRange
+	for _, fr := range DwarfFuncTable(dwarff) {
+		out = append(out, funcRange{fr.Name, fr.Low, fr.High})
+	}
+	return out
+}
+
+// A FuncRange is the PC range of a single function, as recorded in
+// DWARF.
+type FuncRange struct {
+	Name      string
+	Low, High uint64
+}
+
+// DwarfFuncTable walks dwarff's DW_TAG_subprogram entries and returns
+// their PC ranges, sorted by low PC. It's exported so that other
+// tools which derive a symbol table directly from an ELF binary's
+// DWARF (rather than going through a full Symbolizer) don't each need
+// their own copy of this walk, e.g. cmd/memanim and cmd/perfshell.
+func DwarfFuncTable(dwarff *dwarf.Data) []FuncRange {
+	var out []FuncRange
+	r := dwarff.Reader()
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil {
+			break
+		}
+		if ent.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		name, ok := ent.Val(dwarf.AttrName).(string)
+		if !ok {
+			continue
+		}
+		lowpc, ok := ent.Val(dwarf.AttrLowpc).(uint64)
+		if !ok {
+			continue
+		}
+		var highpc uint64
+		switch v := ent.Val(dwarf.AttrHighpc).(type) {
+		case uint64:
+			highpc = v
+		case int64:
+			highpc = lowpc + uint64(v)
+		default:
+			continue
+		}
+		out = append(out, FuncRange{name, lowpc, highpc})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Low < out[j].Low })
+	return out
+}
+
+func dwarfLineTable(dwarff *dwarf.Data) []dwarf.LineEntry {
+	var out []dwarf.LineEntry
+	dr := dwarff.Reader()
+	for {
+		ent, err := dr.Next()
+		if ent == nil || err != nil {
+			break
+		}
+		if ent.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+		lr, err := dwarff.LineReader(ent)
+		if err != nil || lr == nil {
+			continue
+		}
+		for {
+			var le dwarf.LineEntry
+			if err := lr.Next(&le); err != nil {
+				break // io.EOF or a malformed line table
+			}
+			out = append(out, le)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+func elfFuncTable(path string, ef *elf.File) (out []funcRange, fileOffset bool) {
+	switch ef.Type {
+	case elf.ET_EXEC:
+		fileOffset = false
+	case elf.ET_DYN:
+		// Symbol values are section-relative; translate them
+		// to file offsets below.
+		fileOffset = true
+	default:
+		return nil, false
+	}
+
+	syms, err := ef.Symbols()
+	if err != nil {
+		return nil, false
+	}
+	for _, sym := range syms {
+		if elf.SymType(sym.Info&0xf) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		lowpc := sym.Value
+		if fileOffset {
+			if int(sym.Section) >= len(ef.Sections) {
+				continue
+			}
+			sec := ef.Sections[sym.Section]
+			lowpc = lowpc - sec.Addr + sec.Offset
+		}
+		out = append(out, funcRange{sym.Name, lowpc, lowpc + sym.Size})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].lowpc < out[j].lowpc })
+
+	// Assign highpcs to symbols that don't have them.
+	for i := range out {
+		if out[i].highpc == out[i].lowpc {
+			if i == len(out)-1 {
+				out[i].highpc++
+			} else {
+				out[i].highpc = out[i+1].lowpc
+			}
+		}
+	}
+
+	return out, fileOffset
+}
@@ -0,0 +1,264 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A TimeIndex is a sparse, time-sorted index into the records of a
+// File, built by BuildTimeIndex and consumed by RecordsFrom to jump
+// near a given timestamp without decoding everything before it.
+type TimeIndex struct {
+	entries []timeIndexEntry
+}
+
+type timeIndexEntry struct {
+	time   uint64
+	offset int64 // RecordCommon.Offset of the indexed record
+}
+
+// BuildTimeIndex walks f once in file order, recording the (Time,
+// Offset) of every stride'th record, and attaches the result to f as
+// the index RecordsFrom uses. It also returns the index, so callers
+// that want to reuse it across runs can persist it with
+// TimeIndex.WriteFile and restore it later with ReadTimeIndexFile and
+// File.SetTimeIndex instead of paying BuildTimeIndex's cost again.
+//
+// stride trades index size for RecordsFrom's linear-scan cost: a
+// stride of 1 indexes every record (an exact but large index); larger
+// strides index less often, so RecordsFrom may have to scan past more
+// records to reach the requested time. stride must be at least 1.
+//
+// BuildTimeIndex isn't supported on a pipe-mode File.
+func (f *File) BuildTimeIndex(stride int) (*TimeIndex, error) {
+	if stride < 1 {
+		return nil, fmt.Errorf("perffile: BuildTimeIndex stride must be at least 1, got %d", stride)
+	}
+	if f.pipe != nil {
+		return nil, fmt.Errorf("perffile: BuildTimeIndex isn't supported on a pipe-mode File")
+	}
+
+	rs := f.Records(RecordsFileOrder)
+	var entries []timeIndexEntry
+	for i := 0; rs.Next(); i++ {
+		if i%stride == 0 {
+			c := rs.Record.Common()
+			entries = append(entries, timeIndexEntry{c.Time, c.Offset})
+		}
+	}
+	if rs.Err() != nil {
+		return nil, rs.Err()
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].time < entries[j].time })
+	ti := &TimeIndex{entries}
+	f.timeIndex = ti
+	return ti, nil
+}
+
+// SetTimeIndex attaches ti, previously returned by f.BuildTimeIndex or
+// read back with ReadTimeIndexFile, as the index f.RecordsFrom uses.
+// It's the caller's responsibility to ensure ti was built from f
+// itself (or an identical copy of it); SetTimeIndex has no way to
+// check this.
+func (f *File) SetTimeIndex(ti *TimeIndex) {
+	f.timeIndex = ti
+}
+
+// timeIndexMagic identifies the sidecar file format WriteFile writes
+// and ReadTimeIndexFile reads, conventionally named with a
+// ".perftimeidx" extension.
+const timeIndexMagic = "PERFTIDX"
+
+const timeIndexVersion = 1
+
+// WriteFile writes ti to path as a sidecar index file that
+// ReadTimeIndexFile can read back later, so the cost of walking the
+// whole perf.data file in BuildTimeIndex doesn't have to be paid again
+// for the same file.
+func (ti *TimeIndex) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var hdr [16]byte
+	copy(hdr[:8], timeIndexMagic)
+	binary.LittleEndian.PutUint32(hdr[8:12], timeIndexVersion)
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(ti.entries)))
+	if _, err := f.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16*len(ti.entries))
+	for i, e := range ti.entries {
+		binary.LittleEndian.PutUint64(buf[i*16:], e.time)
+		binary.LittleEndian.PutUint64(buf[i*16+8:], uint64(e.offset))
+	}
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ReadTimeIndexFile reads back a TimeIndex previously written by
+// TimeIndex.WriteFile. Attach the result to the File it was built
+// from with File.SetTimeIndex before calling RecordsFrom.
+func ReadTimeIndexFile(path string) (*TimeIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return nil, fmt.Errorf("perffile: reading time index header: %w", err)
+	}
+	if string(hdr[:8]) != timeIndexMagic {
+		return nil, fmt.Errorf("perffile: %s is not a time index file", path)
+	}
+	if version := binary.LittleEndian.Uint32(hdr[8:12]); version != timeIndexVersion {
+		return nil, fmt.Errorf("perffile: %s has unsupported time index version %d", path, version)
+	}
+	count := binary.LittleEndian.Uint32(hdr[12:16])
+
+	buf := make([]byte, 16*count)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil, fmt.Errorf("perffile: reading time index entries: %w", err)
+	}
+
+	entries := make([]timeIndexEntry, count)
+	for i := range entries {
+		entries[i].time = binary.LittleEndian.Uint64(buf[i*16:])
+		entries[i].offset = int64(binary.LittleEndian.Uint64(buf[i*16+8:]))
+	}
+	return &TimeIndex{entries}, nil
+}
+
+// RecordsFrom returns an iterator, in file order, over f's records
+// starting from the first one at or after time. It requires a
+// TimeIndex to have been attached to f with BuildTimeIndex or
+// SetTimeIndex: RecordsFrom binary-searches the index for the latest
+// indexed record at or before time, then linearly scans forward from
+// there (decoding, but discarding, any intervening records) to find
+// the exact starting point, so it doesn't have to decode the whole
+// file prefix to jump into the middle of a large trace.
+//
+// If no record's Time is >= time, the returned Records reaches EOF
+// (Next returns false, Err returns nil) without yielding anything.
+func (f *File) RecordsFrom(time uint64) *Records {
+	if f.pipe != nil {
+		return &Records{err: fmt.Errorf("perffile: RecordsFrom isn't supported on a pipe-mode File")}
+	}
+	ti := f.timeIndex
+	if ti == nil {
+		return &Records{err: fmt.Errorf("perffile: RecordsFrom requires a TimeIndex; call BuildTimeIndex or SetTimeIndex first")}
+	}
+
+	entries := ti.entries
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].time > time })
+	var start int64
+	if i > 0 {
+		start = entries[i-1].offset
+	} else if len(entries) > 0 {
+		start = entries[0].offset
+	} else {
+		start = int64(f.hdr.Data.Offset)
+	}
+
+	sr := newBufferedSectionReader(f.hdr.Data.sectionReader(f.r))
+	if _, err := sr.Seek(start-int64(f.hdr.Data.Offset), 0); err != nil {
+		return &Records{err: err}
+	}
+
+	scan := &Records{f: f, sr: sr}
+	for scan.Next() {
+		if scan.Record.Common().Time >= time {
+			break
+		}
+	}
+	if scan.Err() != nil {
+		return &Records{err: scan.Err()}
+	}
+	if scan.Record == nil || scan.Record.Common().Time < time {
+		// Reached EOF before finding a record at or after time.
+		return &Records{f: f, sr: sr}
+	}
+
+	// Re-seek to the start of the record the scan stopped on, so the
+	// returned iterator's first Next() decodes it fresh rather than
+	// skipping the one already consumed while searching.
+	if _, err := sr.Seek(scan.Record.Common().Offset-int64(f.hdr.Data.Offset), 0); err != nil {
+		return &Records{err: err}
+	}
+	return &Records{f: f, sr: sr}
+}
+
+// MergeRecords returns an iterator over the records in files, merged
+// in monotonically increasing Time order using a min-heap over each
+// file's RecordsTimeOrder iterator. This lets tools correlate traces
+// from parallel "perf record" runs on multiple machines or cgroups
+// without manually interleaving their files.
+//
+// MergeRecords doesn't support pipe-mode files, since RecordsTimeOrder
+// doesn't.
+func MergeRecords(files ...*File) *Records {
+	m := &recordMerger{}
+	for _, f := range files {
+		rs := f.Records(RecordsTimeOrder)
+		if rs.Next() {
+			heap.Push(m, rs)
+		} else if rs.Err() != nil {
+			return &Records{err: rs.Err()}
+		}
+	}
+	return &Records{merge: m}
+}
+
+// recordMerger is a container/heap of per-file Records iterators,
+// ordered by the Time of each iterator's current Record.
+type recordMerger []*Records
+
+func (m recordMerger) Len() int { return len(m) }
+func (m recordMerger) Less(i, j int) bool {
+	return m[i].Record.Common().Time < m[j].Record.Common().Time
+}
+func (m recordMerger) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+
+func (m *recordMerger) Push(x any) { *m = append(*m, x.(*Records)) }
+
+func (m *recordMerger) Pop() any {
+	old := *m
+	n := len(old)
+	item := old[n-1]
+	*m = old[:n-1]
+	return item
+}
+
+// nextMerge implements Next for a Records returned by MergeRecords.
+func (r *Records) nextMerge() bool {
+	if len(*r.merge) == 0 {
+		return false
+	}
+	top := (*r.merge)[0]
+	r.Record = top.Record
+	if top.Next() {
+		heap.Fix(r.merge, 0)
+	} else if top.Err() != nil {
+		r.err = top.Err()
+		return false
+	} else {
+		heap.Pop(r.merge)
+	}
+	return true
+}
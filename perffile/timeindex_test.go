@@ -0,0 +1,155 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// writeTimedSamples builds an in-memory perf.data file with n
+// RecordSamples, timestamped i*10, and returns it along with the
+// *File read back from it.
+func writeTimedSamples(t *testing.T, n int) *File {
+	t.Helper()
+
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		sample := &RecordSample{
+			RecordCommon: RecordCommon{EventAttr: attr, Time: uint64(i * 10)},
+			IP:           0x1000 + uint64(i),
+		}
+		sample.PID, sample.TID = 1, 1
+		if err := w.WriteRecord(sample); err != nil {
+			t.Fatalf("WriteRecord: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := New(bytes.NewReader(sw.buf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return f
+}
+
+func TestRecordsFrom(t *testing.T) {
+	f := writeTimedSamples(t, 100)
+
+	if _, err := f.BuildTimeIndex(7); err != nil {
+		t.Fatalf("BuildTimeIndex: %v", err)
+	}
+
+	for _, want := range []uint64{0, 5, 10, 235, 500, 991, 10000} {
+		rs := f.RecordsFrom(want)
+		if !rs.Next() {
+			if err := rs.Err(); err != nil {
+				t.Fatalf("RecordsFrom(%d): %v", want, err)
+			}
+			if want <= 990 {
+				t.Fatalf("RecordsFrom(%d): found nothing, want a record", want)
+			}
+			continue
+		}
+		got := rs.Record.Common().Time
+		if got < want || got-want >= 10 {
+			t.Errorf("RecordsFrom(%d) = %d, want in [%d, %d)", want, got, want, want+10)
+		}
+	}
+}
+
+func TestRecordsFromRoundTrip(t *testing.T) {
+	f := writeTimedSamples(t, 20)
+
+	ti, err := f.BuildTimeIndex(1)
+	if err != nil {
+		t.Fatalf("BuildTimeIndex: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.perftimeidx")
+	if err := ti.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ti2, err := ReadTimeIndexFile(path)
+	if err != nil {
+		t.Fatalf("ReadTimeIndexFile: %v", err)
+	}
+
+	f2 := writeTimedSamples(t, 20)
+	f2.SetTimeIndex(ti2)
+
+	rs := f2.RecordsFrom(105)
+	if !rs.Next() {
+		t.Fatalf("RecordsFrom(105): %v", rs.Err())
+	}
+	if got := rs.Record.Common().Time; got != 110 {
+		t.Errorf("RecordsFrom(105) = %d, want 110", got)
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	mkFile := func(times ...uint64) *File {
+		sw := &sectionWriter{}
+		w, err := NewWriter(sw, []*EventAttr{attr})
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+		for _, ts := range times {
+			sample := &RecordSample{RecordCommon: RecordCommon{EventAttr: attr, Time: ts}}
+			sample.PID, sample.TID = 1, 1
+			if err := w.WriteRecord(sample); err != nil {
+				t.Fatalf("WriteRecord: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		f, err := New(bytes.NewReader(sw.buf))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return f
+	}
+
+	f1 := mkFile(10, 30, 50)
+	f2 := mkFile(5, 20, 40, 60)
+
+	var got []uint64
+	rs := MergeRecords(f1, f2)
+	for rs.Next() {
+		got = append(got, rs.Record.Common().Time)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("MergeRecords: %v", err)
+	}
+
+	want := []uint64{5, 10, 20, 30, 40, 50, 60}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,753 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Writer writes a "perf.data" file, either in the regular file
+// format (NewWriter) or in the streaming pipe-mode format read by
+// NewPipeReader (NewPipeWriter).
+//
+// Writer supports only the subset of the perf.data format needed to
+// synthesize a profile from another source, such as converting a
+// profile from a different format or stitching together a profile
+// from eBPF or JIT-recorded events: the header and attr sections,
+// RecordMmap, RecordComm, RecordFork, RecordExit, RecordSample,
+// RecordAux, RecordSwitch, RecordSwitchCPUWide, RecordKsymbol, and a
+// handful of feature sections describing the host. It does not
+// support every record and feature type that Open can parse.
+//
+// Records must be written in the order returned by WriteRecord; it is
+// the caller's responsibility to write them in an order consistent
+// with the order it intends readers to consume them in (see
+// RecordsCausalOrder and RecordsTimeOrder).
+type Writer struct {
+	w     io.Writer
+	ws    io.WriteSeeker // non-nil in file mode; nil in pipe mode
+	pipe  bool
+	attrs []*EventAttr
+
+	meta FileMeta
+
+	dataLen int64
+
+	// compressBuf accumulates record bytes for the next
+	// PERF_RECORD_COMPRESSED2 block when compression is enabled by
+	// SetCompression, or is nil if compression is disabled.
+	compressBuf   *bytes.Buffer
+	compressLen   int64 // total uncompressed bytes flushed so far
+	compressedLen int64 // total compressed bytes flushed so far
+	zstdEnc       *zstd.Encoder
+
+	err error
+}
+
+// NewWriter creates a Writer that emits a perf.data file to w, which
+// must support seeking so the Writer can patch up the header and
+// feature sections after the data is written.
+//
+// attrs describes the events that will appear in records written to
+// the returned Writer. RecordSamples passed to WriteRecord must have
+// their EventAttr set to one of these (by pointer identity).
+func NewWriter(w io.WriteSeeker, attrs []*EventAttr) (*Writer, error) {
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("perffile: Writer requires at least one EventAttr")
+	}
+
+	wr := &Writer{w: w, ws: w, attrs: attrs}
+
+	// Reserve space for the file header. The real header is
+	// written by Close, once we know the final section sizes.
+	hdrSize := int64(binary.Size(fileHeader{}))
+	if _, err := w.Seek(hdrSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Write the attr section: one fileAttr per EventAttr. Each
+	// fileAttr's IDs section is left zeroed here and patched in by
+	// Close once the per-attr ID arrays have been written.
+	for _, attr := range attrs {
+		if err := wr.writeEventAttr(attr); err != nil {
+			return nil, err
+		}
+	}
+
+	return wr, nil
+}
+
+// NewPipeWriter creates a Writer that emits a perf.data pipe-mode
+// stream to w, the counterpart to NewPipeReader. w need not support
+// seeking: rather than patching up a header and feature sections
+// after the fact, the returned Writer synthesizes recordTypeAttr
+// records up front (one per attr, written here) and
+// recordTypeHeaderFeature records inline when Close is called,
+// exactly as "perf record -o -" does.
+//
+// As with NewWriter, attrs describes the events that will appear in
+// records written to the returned Writer.
+func NewPipeWriter(w io.Writer, attrs []*EventAttr) (*Writer, error) {
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("perffile: Writer requires at least one EventAttr")
+	}
+
+	wr := &Writer{w: w, pipe: true, attrs: attrs}
+	for i, attr := range attrs {
+		if err := wr.writePipeAttr(attr, attrID(i+1)); err != nil {
+			return nil, err
+		}
+	}
+	return wr, nil
+}
+
+// eventAttrBytes encodes attr as an on-disk eventAttrVN, the common
+// representation shared by a regular file's attr section
+// (writeEventAttr) and a pipe-mode recordTypeAttr record
+// (writePipeAttr).
+func eventAttrBytes(attr *EventAttr) ([]byte, error) {
+	g := attr.Event.Generic()
+
+	var out eventAttrVN
+	out.Type = g.Type
+	out.Size = uint32(binary.Size(out))
+	if attr.Flags&EventFlagFreq == 0 {
+		out.SamplePeriodOrFreq = attr.SamplePeriod
+	} else {
+		out.SamplePeriodOrFreq = attr.SampleFreq
+	}
+	out.SampleFormat = attr.SampleFormat
+	out.ReadFormat = attr.ReadFormat
+	out.Flags = attr.Flags | (EventFlags(attr.Precise) << eventFlagPreciseShift)
+	if attr.Flags&EventFlagWakeupWatermark == 0 {
+		out.WakeupEventsOrWatermark = attr.WakeupEvents
+	} else {
+		out.WakeupEventsOrWatermark = attr.WakeupWatermark
+	}
+	if g.Type == EventTypeBreakpoint {
+		out.BPType = uint32(g.ID)
+	} else {
+		out.Config = g.ID
+	}
+	if len(g.Config) > 0 {
+		out.BPAddrOrConfig1 = g.Config[0]
+	}
+	if len(g.Config) > 1 {
+		out.BPLenOrConfig2 = g.Config[1]
+	}
+	if len(g.Config) > 2 {
+		out.Config3 = g.Config[2]
+	}
+	out.BranchSampleType = attr.BranchSampleType
+	out.SampleRegsUser = attr.SampleRegsUser
+	out.SampleStackUser = attr.SampleStackUser
+	out.SampleRegsIntr = attr.SampleRegsIntr
+	out.AuxWatermark = attr.AuxWatermark
+	out.SampleMaxStack = attr.SampleMaxStack
+	out.SigData = attr.SigData
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, &out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *Writer) writeEventAttr(attr *EventAttr) error {
+	data, err := eventAttrBytes(attr)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+
+	// IDs section: this EventAttr claims exactly one attrID,
+	// written immediately after all fileAttr entries (see Close).
+	return binary.Write(w.w, binary.LittleEndian, &fileSection{})
+}
+
+// writePipeAttr emits attr as a pipe-mode recordTypeAttr record: the
+// same eventAttrVN that a regular file's attr section holds, followed
+// by the one attrID Writer assigns it, in place of the fileSection of
+// IDs a regular file points at instead (see applyPipeAttr).
+func (w *Writer) writePipeAttr(attr *EventAttr, id attrID) error {
+	data, err := eventAttrBytes(attr)
+	if err != nil {
+		return err
+	}
+	b := &recordBuf{order: binary.LittleEndian, buf: data}
+	b.u64(uint64(id))
+	return w.write(recordTypeAttr, 0, b)
+}
+
+// writerAttrID returns the synthetic attrID Writer assigned to attr,
+// or ok == false if attr is not one of the EventAttrs this Writer was
+// created with.
+func (w *Writer) writerAttrID(attr *EventAttr) (id attrID, ok bool) {
+	for i, a := range w.attrs {
+		if a == attr {
+			return attrID(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+// WriteRecord writes a single record to the perf.data file. r must be
+// one of the record types named in the Writer doc comment.
+func (w *Writer) WriteRecord(r Record) error {
+	if w.err != nil {
+		return w.err
+	}
+	switch r := r.(type) {
+	case *RecordMmap:
+		w.err = w.writeMmap(r)
+	case *RecordComm:
+		w.err = w.writeComm(r)
+	case *RecordSample:
+		w.err = w.writeSample(r)
+	case *RecordFork:
+		w.err = w.writeFork(r)
+	case *RecordExit:
+		w.err = w.writeExit(r)
+	case *RecordAux:
+		w.err = w.writeAux(r)
+	case *RecordSwitch:
+		w.err = w.writeSwitch(r)
+	case *RecordSwitchCPUWide:
+		w.err = w.writeSwitchCPUWide(r)
+	case *RecordKsymbol:
+		w.err = w.writeKsymbol(r)
+	default:
+		w.err = fmt.Errorf("perffile: Writer does not support %T records", r)
+	}
+	if w.err == nil && w.compressBuf != nil && w.compressBuf.Len() >= compressFlushThreshold {
+		w.err = w.flushCompressed()
+	}
+	return w.err
+}
+
+// compressFlushThreshold is how many bytes of buffered records
+// SetCompression accumulates before compressing and emitting them as
+// a PERF_RECORD_COMPRESSED2 block. It's kept well under maxRecordBody
+// so that even incompressible input still fits in one record.
+const compressFlushThreshold = 32 << 10
+
+// recordBuf accumulates the body of a single record before it's
+// prefixed with a recordHeader and written out.
+type recordBuf struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (b *recordBuf) u32(x uint32) {
+	var tmp [4]byte
+	b.order.PutUint32(tmp[:], x)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *recordBuf) i32(x int32) { b.u32(uint32(x)) }
+
+func (b *recordBuf) u64(x uint64) {
+	var tmp [8]byte
+	b.order.PutUint64(tmp[:], x)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+func (b *recordBuf) cstring(s string) {
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	for len(b.buf)%8 != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// writeCommon appends the sample_id trailer used by non-sample
+// records when EventFlagSampleIDAll is set on the first attr.
+func (w *Writer) writeCommon(b *recordBuf, pid, tid int, t uint64, id attrID, streamID uint64, cpu uint32) {
+	if w.attrs[0].Flags&EventFlagSampleIDAll == 0 {
+		return
+	}
+	format := w.attrs[0].SampleFormat
+	if format&SampleFormatTID != 0 {
+		b.i32(int32(pid))
+		b.i32(int32(tid))
+	}
+	if format&SampleFormatTime != 0 {
+		b.u64(t)
+	}
+	if format&SampleFormatID != 0 {
+		b.u64(uint64(id))
+	}
+	if format&SampleFormatStreamID != 0 {
+		b.u64(streamID)
+	}
+	if format&SampleFormatCPU != 0 {
+		b.u32(cpu)
+		b.u32(0)
+	}
+}
+
+func (w *Writer) write(typ RecordType, misc recordMisc, b *recordBuf) error {
+	hdr := recordHeader{Type: typ, Misc: misc, Size: uint16(8 + len(b.buf))}
+	if w.compressBuf != nil {
+		if err := binary.Write(w.compressBuf, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		_, err := w.compressBuf.Write(b.buf)
+		return err
+	}
+	return w.writeRaw(&hdr, b.buf)
+}
+
+// writeRaw writes hdr and its body directly to the underlying
+// stream, bypassing compressBuf; it's used both for uncompressed
+// records and to emit the PERF_RECORD_COMPRESSED2 wrapper itself.
+func (w *Writer) writeRaw(hdr *recordHeader, body []byte) error {
+	if err := binary.Write(w.w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	n, err := w.w.Write(body)
+	w.dataLen += int64(8 + n)
+	return err
+}
+
+// SetCompression enables zstd compression of this Writer's data
+// section, as produced by perf record -z/--compression-level.
+// Subsequent records passed to WriteRecord are buffered and flushed
+// as PERF_RECORD_COMPRESSED2 blocks (one at Close, and one each time
+// the buffer grows past compressFlushThreshold) instead of being
+// written directly, and Close additionally emits the HEADER_COMPRESSED
+// feature describing the compression in use.
+//
+// level is perf's own notion of the zstd compression level (as
+// passed to --compression-level); it's recorded in the
+// HEADER_COMPRESSED feature for readers' information, but otherwise
+// just selects the closest zstd.EncoderLevel.
+func (w *Writer) SetCompression(level uint32) error {
+	if w.compressBuf != nil {
+		return fmt.Errorf("perffile: SetCompression already called")
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(compressionEncoderLevel(level)))
+	if err != nil {
+		return err
+	}
+	w.zstdEnc = enc
+	w.compressBuf = new(bytes.Buffer)
+	w.meta.Compression = CompressionInfo{Version: 1, Type: CompressionZstd, Level: level}
+	return nil
+}
+
+// compressionEncoderLevel maps perf's 1-22 zstd compression level
+// (as passed to --compression-level) to the nearest zstd.EncoderLevel,
+// since the zstd package doesn't expose arbitrary numeric levels.
+func compressionEncoderLevel(level uint32) zstd.EncoderLevel {
+	switch {
+	case level <= 1:
+		return zstd.SpeedFastest
+	case level <= 9:
+		return zstd.SpeedDefault
+	case level <= 19:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// maxRecordBody is the largest body a single record (including a
+// PERF_RECORD_COMPRESSED2 block) can hold: recordHeader.Size is a
+// uint16 covering the whole record.
+const maxRecordBody = 1<<16 - 1 - 8
+
+// flushCompressed compresses and emits any buffered records as a
+// single PERF_RECORD_COMPRESSED2 record, and updates
+// w.meta.Compression.Ratio to reflect what was written. It's a no-op
+// if compression isn't enabled or nothing is buffered.
+func (w *Writer) flushCompressed() error {
+	if w.compressBuf == nil || w.compressBuf.Len() == 0 {
+		return nil
+	}
+	orig := w.compressBuf.Bytes()
+	compressed := w.zstdEnc.EncodeAll(orig, nil)
+
+	if len(compressed) > maxRecordBody {
+		// Compression didn't help enough to fit the block in a
+		// single record; write the original records uncompressed
+		// rather than risk truncating Size.
+		n, err := w.w.Write(orig)
+		w.dataLen += int64(n)
+		w.compressBuf.Reset()
+		return err
+	}
+
+	w.compressLen += int64(len(orig))
+	w.compressedLen += int64(len(compressed))
+	if w.compressedLen > 0 {
+		w.meta.Compression.Ratio = uint32(w.compressLen * 100 / w.compressedLen)
+	}
+
+	hdr := recordHeader{Type: recordTypeCompressed2, Size: uint16(8 + len(compressed))}
+	if err := w.writeRaw(&hdr, compressed); err != nil {
+		return err
+	}
+	w.compressBuf.Reset()
+	return nil
+}
+
+// writeMmap always emits the extended ("mmap2") record form, which is
+// what lets it carry Major/Minor/Ino/Prot/Flags.
+func (w *Writer) writeMmap(r *RecordMmap) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.i32(int32(r.PID))
+	b.i32(int32(r.TID))
+	b.u64(r.Addr)
+	b.u64(r.Len)
+	b.u64(r.FileOffset)
+	b.u32(r.Major)
+	b.u32(r.Minor)
+	b.u64(r.Ino)
+	b.u64(r.InoGeneration)
+	b.u32(r.Prot)
+	b.u32(r.Flags)
+	b.cstring(r.Filename)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	var misc recordMisc
+	if r.Data {
+		misc |= recordMiscMmapData
+	}
+	return w.write(recordTypeMmap2, misc, b)
+}
+
+func (w *Writer) writeComm(r *RecordComm) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.i32(int32(r.PID))
+	b.i32(int32(r.TID))
+	b.cstring(r.Comm)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	var misc recordMisc
+	if r.Exec {
+		misc |= recordMiscCommExec
+	}
+	return w.write(RecordTypeComm, misc, b)
+}
+
+func (w *Writer) writeFork(r *RecordFork) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.i32(int32(r.PID))
+	b.i32(int32(r.PPID))
+	b.i32(int32(r.TID))
+	b.i32(int32(r.PTID))
+	b.u64(r.Time)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	return w.write(RecordTypeFork, 0, b)
+}
+
+func (w *Writer) writeExit(r *RecordExit) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.i32(int32(r.PID))
+	b.i32(int32(r.PPID))
+	b.i32(int32(r.TID))
+	b.i32(int32(r.PTID))
+	b.u64(r.Time)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	return w.write(RecordTypeExit, 0, b)
+}
+
+func (w *Writer) writeSample(r *RecordSample) error {
+	id, ok := w.writerAttrID(r.EventAttr)
+	if !ok {
+		return fmt.Errorf("perffile: RecordSample.EventAttr is not one of the Writer's EventAttrs")
+	}
+	format := r.EventAttr.SampleFormat
+
+	b := &recordBuf{order: binary.LittleEndian}
+	if format&SampleFormatIdentifier != 0 {
+		b.u64(uint64(id))
+	}
+	if format&SampleFormatIP != 0 {
+		b.u64(r.IP)
+	}
+	if format&SampleFormatTID != 0 {
+		b.i32(int32(r.PID))
+		b.i32(int32(r.TID))
+	}
+	if format&SampleFormatTime != 0 {
+		b.u64(r.Time)
+	}
+	if format&SampleFormatAddr != 0 {
+		b.u64(r.Addr)
+	}
+	if format&SampleFormatID != 0 {
+		b.u64(uint64(id))
+	}
+	if format&SampleFormatStreamID != 0 {
+		b.u64(r.StreamID)
+	}
+	if format&SampleFormatCPU != 0 {
+		b.u32(r.CPU)
+		b.u32(r.Res)
+	}
+	if format&SampleFormatPeriod != 0 {
+		b.u64(r.Period)
+	}
+	if format&SampleFormatRaw != 0 {
+		b.u32(uint32(len(r.Raw)))
+		b.buf = append(b.buf, r.Raw...)
+	}
+
+	var misc recordMisc
+	misc |= recordMisc(r.CPUMode)
+	if r.ExactIP {
+		misc |= recordMiscExactIP
+	}
+	return w.write(RecordTypeSample, misc, b)
+}
+
+func (w *Writer) writeAux(r *RecordAux) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.u64(r.Offset)
+	b.u64(r.Size)
+	b.u64(uint64(r.Flags) | uint64(r.PMUFormat)<<8)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	return w.write(RecordTypeAux, 0, b)
+}
+
+func (w *Writer) writeSwitch(r *RecordSwitch) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	var misc recordMisc
+	if r.Out {
+		misc |= recordMiscSwitchOut
+	}
+	return w.write(RecordTypeSwitch, misc, b)
+}
+
+func (w *Writer) writeSwitchCPUWide(r *RecordSwitchCPUWide) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.i32(int32(r.SwitchPID))
+	b.i32(int32(r.SwitchTID))
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	var misc recordMisc
+	if r.Out {
+		misc |= recordMiscSwitchOut
+	}
+	if r.Preempt {
+		misc |= recordMiscSwitchOutPreempt
+	}
+	return w.write(RecordTypeSwitchCPUWide, misc, b)
+}
+
+func (w *Writer) writeKsymbol(r *RecordKsymbol) error {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.u64(r.Addr)
+	b.u32(r.Len)
+	b.buf = append(b.buf, 0, 0) // KsymType is a u16, but recordBuf has no u16 helper
+	b.order.PutUint16(b.buf[len(b.buf)-2:], uint16(r.KsymType))
+	b.u64(uint64(r.Flags))
+	b.cstring(r.Name)
+	id, _ := w.writerAttrID(r.EventAttr)
+	w.writeCommon(b, r.PID, r.TID, r.Time, id, r.StreamID, r.CPU)
+	return w.write(RecordTypeKsymbol, 0, b)
+}
+
+// stringFeatureBytes encodes a feature string section: a uint32
+// length followed by the NUL-terminated string, padded to 8 bytes.
+func stringFeatureBytes(s string) []byte {
+	b := &recordBuf{order: binary.LittleEndian}
+	b.u32(uint32(len(s) + 1))
+	b.cstring(s)
+	return b.buf
+}
+
+// SetHostname sets the HEADER_HOSTNAME feature written by Close.
+func (w *Writer) SetHostname(hostname string) { w.meta.Hostname = hostname }
+
+// SetArch sets the HEADER_ARCH feature written by Close.
+func (w *Writer) SetArch(arch string) { w.meta.Arch = arch }
+
+// SetCPUDesc sets the HEADER_CPUDESC feature written by Close.
+func (w *Writer) SetCPUDesc(desc string) { w.meta.CPUDesc = desc }
+
+// SetCmdLine sets the HEADER_CMDLINE feature written by Close.
+func (w *Writer) SetCmdLine(args []string) { w.meta.CmdLine = args }
+
+// A featureSec is a feature section's decoded bit and encoded data,
+// shared by Close's file-mode feature directory and its pipe-mode
+// recordTypeHeaderFeature records.
+type featureSec struct {
+	bit  feature
+	data []byte
+}
+
+// features returns the feature sections described by w.meta, in the
+// same encoding New's feature parsers expect on the read side.
+func (w *Writer) features() []featureSec {
+	var feats []featureSec
+	if w.meta.Hostname != "" {
+		feats = append(feats, featureSec{featureHostname, stringFeatureBytes(w.meta.Hostname)})
+	}
+	if w.meta.Arch != "" {
+		feats = append(feats, featureSec{featureArch, stringFeatureBytes(w.meta.Arch)})
+	}
+	if w.meta.CPUDesc != "" {
+		feats = append(feats, featureSec{featureCPUDesc, stringFeatureBytes(w.meta.CPUDesc)})
+	}
+	if w.meta.CmdLine != nil {
+		b := &recordBuf{order: binary.LittleEndian}
+		b.u32(uint32(len(w.meta.CmdLine)))
+		for _, arg := range w.meta.CmdLine {
+			b.u32(uint32(len(arg) + 1))
+			b.cstring(arg)
+		}
+		feats = append(feats, featureSec{featureCmdline, b.buf})
+	}
+	if w.meta.Compression.Type != 0 {
+		b := &recordBuf{order: binary.LittleEndian}
+		b.u32(w.meta.Compression.Version)
+		b.u32(uint32(w.meta.Compression.Type))
+		b.u32(w.meta.Compression.Level)
+		b.u32(w.meta.Compression.Ratio)
+		b.u32(w.meta.Compression.MMapLen)
+		feats = append(feats, featureSec{featureCompressed, b.buf})
+	}
+	return feats
+}
+
+// Close finalizes the perf.data output.
+//
+// In file mode, it writes the feature sections, patches the attr IDs
+// section, and rewrites the file header with the final section
+// sizes. It does not close the underlying io.WriteSeeker.
+//
+// In pipe mode, it writes one recordTypeHeaderFeature record per
+// feature set on w, mirroring the recordTypeHeaderFeature records
+// "perf record -o -" emits at the end of its stream; there is no
+// trailer to patch up. It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.zstdEnc != nil {
+		defer w.zstdEnc.Close()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flushCompressed(); err != nil {
+		return err
+	}
+	// Feature sections (including HEADER_COMPRESSED itself) are
+	// never part of a compressed data block.
+	w.compressBuf = nil
+	if w.pipe {
+		return w.closePipe()
+	}
+	return w.closeFile()
+}
+
+func (w *Writer) closePipe() error {
+	for _, f := range w.features() {
+		b := &recordBuf{order: binary.LittleEndian, buf: make([]byte, 0, 8+len(f.data))}
+		b.u64(uint64(f.bit))
+		b.buf = append(b.buf, f.data...)
+		if err := w.write(recordTypeHeaderFeature, 0, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	dataEnd, err := w.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	dataOff := dataEnd - w.dataLen
+
+	// Write the per-attr ID arrays immediately after the data
+	// section and patch each fileAttr's IDs fileSection to point
+	// at them.
+	attrsOff := int64(binary.Size(fileHeader{}))
+	attrSize := int64(binary.Size(eventAttrVN{}))
+	idsOffs := make([]int64, len(w.attrs))
+	for i := range w.attrs {
+		off, err := w.ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		idsOffs[i] = off
+		if err := binary.Write(w.ws, binary.LittleEndian, attrID(i+1)); err != nil {
+			return err
+		}
+	}
+	idsEnd, err := w.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	for i := range w.attrs {
+		sec := fileSection{Offset: uint64(idsOffs[i]), Size: 8}
+		off := attrsOff + int64(i)*attrSize + attrSize - int64(binary.Size(fileSection{}))
+		if _, err := w.ws.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(w.ws, binary.LittleEndian, &sec); err != nil {
+			return err
+		}
+	}
+
+	// Write feature data and the feature section directory.
+	feats := w.features()
+
+	if _, err := w.ws.Seek(idsEnd, io.SeekStart); err != nil {
+		return err
+	}
+	dirOff := idsEnd
+	dirSize := int64(len(feats)) * int64(binary.Size(fileSection{}))
+	dataStart := dirOff + dirSize
+	var secs []fileSection
+	pos := dataStart
+	for _, f := range feats {
+		if _, err := w.ws.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(w.ws, binary.LittleEndian, f.data); err != nil {
+			return err
+		}
+		secs = append(secs, fileSection{Offset: uint64(pos), Size: uint64(len(f.data))})
+		pos += int64(len(f.data))
+	}
+	if _, err := w.ws.Seek(dirOff, io.SeekStart); err != nil {
+		return err
+	}
+	for _, sec := range secs {
+		if err := binary.Write(w.ws, binary.LittleEndian, &sec); err != nil {
+			return err
+		}
+	}
+
+	// Finally, write the file header.
+	var hdr fileHeader
+	copy(hdr.Magic[:], "PERFILE2")
+	hdr.Size = uint64(binary.Size(hdr))
+	hdr.AttrSize = uint64(attrSize)
+	hdr.Attrs = fileSection{Offset: uint64(attrsOff), Size: uint64(attrSize) * uint64(len(w.attrs))}
+	hdr.Data = fileSection{Offset: uint64(dataOff), Size: uint64(w.dataLen)}
+	for _, f := range feats {
+		hdr.Features[f.bit/64] |= 1 << (uint(f.bit) % 64)
+	}
+	if _, err := w.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(w.ws, binary.LittleEndian, &hdr)
+}
@@ -0,0 +1,467 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perffile
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sectionWriter adapts a bytes.Buffer in to an io.WriteSeeker backed
+// by a growable in-memory slice, for testing Writer without a real
+// file.
+type sectionWriter struct {
+	buf []byte
+	pos int64
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	end := s.pos + int64(len(p))
+	if end > int64(len(s.buf)) {
+		grown := make([]byte, end)
+		copy(grown, s.buf)
+		s.buf = grown
+	}
+	copy(s.buf[s.pos:end], p)
+	s.pos = end
+	return len(p), nil
+}
+
+func (s *sectionWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+		s.pos = offset
+	case 1:
+		s.pos += offset
+	case 2:
+		s.pos = int64(len(s.buf)) + offset
+	}
+	return s.pos, nil
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	w.SetHostname("testhost")
+
+	mmap := &RecordMmap{
+		RecordCommon: RecordCommon{EventAttr: attr, Time: 100},
+		Addr:         0x1000, Len: 0x2000, Filename: "/bin/test",
+	}
+	mmap.PID, mmap.TID = 1, 1
+	if err := w.WriteRecord(mmap); err != nil {
+		t.Fatalf("WriteRecord(mmap): %v", err)
+	}
+
+	sample := &RecordSample{
+		RecordCommon: RecordCommon{EventAttr: attr, Time: 200},
+		IP:           0x1234,
+	}
+	sample.PID, sample.TID = 1, 1
+	if err := w.WriteRecord(sample); err != nil {
+		t.Fatalf("WriteRecord(sample): %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := New(bytes.NewReader(sw.buf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if f.Meta.Hostname != "testhost" {
+		t.Errorf("Hostname = %q, want %q", f.Meta.Hostname, "testhost")
+	}
+
+	var gotMmap, gotSample int
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordMmap:
+			gotMmap++
+			if r.Filename != "/bin/test" {
+				t.Errorf("mmap filename = %q, want %q", r.Filename, "/bin/test")
+			}
+		case *RecordSample:
+			gotSample++
+			if r.IP != 0x1234 {
+				t.Errorf("sample IP = %#x, want %#x", r.IP, 0x1234)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if gotMmap != 1 || gotSample != 1 {
+		t.Errorf("got %d mmap, %d sample records; want 1, 1", gotMmap, gotSample)
+	}
+}
+
+// roundTripAttr writes a single sample under attr and returns the
+// EventAttr the reader reconstructs for it, to check that EventAttr
+// fields survive the on-disk encoding round trip.
+func roundTripAttr(t *testing.T, attr *EventAttr) *EventAttr {
+	t.Helper()
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	sample := &RecordSample{RecordCommon: RecordCommon{EventAttr: attr}, IP: 0x1234}
+	sample.PID, sample.TID = 1, 1
+	if err := w.WriteRecord(sample); err != nil {
+		t.Fatalf("WriteRecord(sample): %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := New(bytes.NewReader(sw.buf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if s, ok := rs.Record.(*RecordSample); ok {
+			return s.EventAttr
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	t.Fatalf("no sample record found")
+	return nil
+}
+
+func TestWriterRoundTripHybridPMU(t *testing.T) {
+	// The event encodes a PMU type ID in its upper 32 bits, as on
+	// a hybrid (P-core/E-core) system.
+	attr := &EventAttr{
+		Event:        EventHardware(4<<32 | uint64(EventHardwareCPUCycles)),
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+		SigData:      0xdeadbeef,
+	}
+
+	got := roundTripAttr(t, attr)
+	if typ, ok := got.PMUType(); !ok || typ != 4 {
+		t.Errorf("PMUType() = %d, %v, want 4, true", typ, ok)
+	}
+	if got.HardwareID() != uint64(EventHardwareCPUCycles) {
+		t.Errorf("HardwareID() = %#x, want %#x", got.HardwareID(), uint64(EventHardwareCPUCycles))
+	}
+	if got.SigData != 0xdeadbeef {
+		t.Errorf("SigData = %#x, want 0xdeadbeef", got.SigData)
+	}
+}
+
+func TestWriterRoundTripConfig3(t *testing.T) {
+	// An event type with no decoder round-trips its full
+	// EventGeneric, including config1/config2/config3.
+	attr := &EventAttr{
+		Event:        EventGeneric{Type: EventType(100), ID: 0x42, Config: []uint64{1, 2, 3}}.Decode(),
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}
+
+	got := roundTripAttr(t, attr)
+	if typ, ok := got.PMUType(); ok {
+		t.Errorf("PMUType() = %d, true, want ok=false", typ)
+	}
+	if gotConfig := got.Event.Generic().Config; len(gotConfig) != 3 || gotConfig[0] != 1 || gotConfig[1] != 2 || gotConfig[2] != 3 {
+		t.Errorf("Config = %v, want [1 2 3]", gotConfig)
+	}
+}
+
+func TestWriterRoundTripCompressed(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := w.SetCompression(3); err != nil {
+		t.Fatalf("SetCompression: %v", err)
+	}
+	w.SetHostname("testhost")
+
+	// Large enough to force several mid-stream flushes past
+	// compressFlushThreshold, not just the final flush at Close.
+	const nSamples = 2000
+	for i := 0; i < nSamples; i++ {
+		sample := &RecordSample{
+			RecordCommon: RecordCommon{EventAttr: attr, Time: uint64(i)},
+			IP:           0x1234,
+		}
+		sample.PID, sample.TID = 1, 1
+		if err := w.WriteRecord(sample); err != nil {
+			t.Fatalf("WriteRecord(sample %d): %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := New(bytes.NewReader(sw.buf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if f.Meta.Hostname != "testhost" {
+		t.Errorf("Hostname = %q, want %q", f.Meta.Hostname, "testhost")
+	}
+	if f.Meta.Compression.Type != CompressionZstd {
+		t.Errorf("Compression.Type = %v, want CompressionZstd", f.Meta.Compression.Type)
+	}
+
+	var gotSample int
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		if s, ok := rs.Record.(*RecordSample); ok {
+			gotSample++
+			if s.IP != 0x1234 {
+				t.Errorf("sample IP = %#x, want %#x", s.IP, 0x1234)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if gotSample != nSamples {
+		t.Errorf("got %d sample records, want %d", gotSample, nSamples)
+	}
+}
+
+// TestWriterRoundTripAllRecordTypes writes one record of every type
+// WriteRecord supports (see the Writer doc comment) and checks that
+// each comes back from New with its fields intact.
+func TestWriterRoundTripAllRecordTypes(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	sw := &sectionWriter{}
+	w, err := NewWriter(sw, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	common := func(time uint64) RecordCommon {
+		return RecordCommon{EventAttr: attr, Time: time, PID: 1, TID: 1}
+	}
+
+	records := []Record{
+		&RecordMmap{RecordCommon: common(100), Addr: 0x1000, Len: 0x2000, Filename: "/bin/test"},
+		&RecordComm{RecordCommon: common(200), Comm: "test"},
+		&RecordFork{RecordCommon: common(300), PPID: 2, PTID: 2},
+		&RecordSample{RecordCommon: common(400), IP: 0x1234},
+		&RecordAux{RecordCommon: common(500), Offset: 0x10000, Size: 0x100, Flags: AuxFlagTruncated},
+		&RecordSwitch{RecordCommon: common(600), Out: true},
+		&RecordSwitchCPUWide{RecordCommon: common(700), Out: true, SwitchPID: 3, SwitchTID: 3},
+		&RecordKsymbol{RecordCommon: common(800), Addr: 0x2000, Len: 0x10, KsymType: KsymbolTypeBpf, Name: "bpf_prog"},
+		&RecordExit{RecordCommon: common(900), PPID: 2, PTID: 2},
+	}
+	for _, r := range records {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatalf("WriteRecord(%T): %v", r, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := New(bytes.NewReader(sw.buf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	got := make(map[RecordType]int)
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		got[rs.Record.Type()]++
+		switch r := rs.Record.(type) {
+		case *RecordMmap:
+			if r.Filename != "/bin/test" {
+				t.Errorf("mmap filename = %q, want %q", r.Filename, "/bin/test")
+			}
+		case *RecordComm:
+			if r.Comm != "test" {
+				t.Errorf("comm = %q, want %q", r.Comm, "test")
+			}
+		case *RecordFork:
+			if r.PPID != 2 || r.PTID != 2 {
+				t.Errorf("fork PPID/PTID = %d/%d, want 2/2", r.PPID, r.PTID)
+			}
+		case *RecordSample:
+			if r.IP != 0x1234 {
+				t.Errorf("sample IP = %#x, want %#x", r.IP, 0x1234)
+			}
+		case *RecordAux:
+			if r.Offset != 0x10000 || r.Size != 0x100 || r.Flags != AuxFlagTruncated {
+				t.Errorf("aux = %+v, want Offset=0x10000 Size=0x100 Flags=AuxFlagTruncated", r)
+			}
+		case *RecordSwitch:
+			if !r.Out {
+				t.Errorf("switch Out = false, want true")
+			}
+		case *RecordSwitchCPUWide:
+			if !r.Out || r.SwitchPID != 3 || r.SwitchTID != 3 {
+				t.Errorf("switch CPU-wide = %+v, want Out=true SwitchPID=3 SwitchTID=3", r)
+			}
+		case *RecordKsymbol:
+			if r.Name != "bpf_prog" || r.KsymType != KsymbolTypeBpf {
+				t.Errorf("ksymbol = %+v, want Name=bpf_prog KsymType=KsymbolTypeBpf", r)
+			}
+		case *RecordExit:
+			if r.PPID != 2 || r.PTID != 2 {
+				t.Errorf("exit PPID/PTID = %d/%d, want 2/2", r.PPID, r.PTID)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+
+	wantTypes := []RecordType{
+		RecordTypeMmap, RecordTypeComm, RecordTypeFork, RecordTypeSample,
+		RecordTypeAux, RecordTypeSwitch, RecordTypeSwitchCPUWide,
+		RecordTypeKsymbol, RecordTypeExit,
+	}
+	for _, typ := range wantTypes {
+		if got[typ] != 1 {
+			t.Errorf("got %d records of type %v, want 1", got[typ], typ)
+		}
+	}
+}
+
+func TestPipeWriterRoundTrip(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID | SampleFormatTime,
+	}
+
+	var buf bytes.Buffer
+	w, err := NewPipeWriter(&buf, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewPipeWriter: %v", err)
+	}
+	w.SetHostname("testhost")
+
+	comm := &RecordComm{
+		RecordCommon: RecordCommon{EventAttr: attr, Time: 50},
+		Comm:         "test",
+	}
+	comm.PID, comm.TID = 1, 1
+	if err := w.WriteRecord(comm); err != nil {
+		t.Fatalf("WriteRecord(comm): %v", err)
+	}
+
+	sample := &RecordSample{
+		RecordCommon: RecordCommon{EventAttr: attr, Time: 200},
+		IP:           0x1234,
+	}
+	sample.PID, sample.TID = 1, 1
+	if err := w.WriteRecord(sample); err != nil {
+		t.Fatalf("WriteRecord(sample): %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := NewPipeReader(&buf, PipeReaderOptions{})
+	if err != nil {
+		t.Fatalf("NewPipeReader: %v", err)
+	}
+
+	var gotComm, gotSample int
+	rs := f.Records(RecordsFileOrder)
+	for rs.Next() {
+		switch r := rs.Record.(type) {
+		case *RecordComm:
+			gotComm++
+			if r.Comm != "test" {
+				t.Errorf("comm = %q, want %q", r.Comm, "test")
+			}
+		case *RecordSample:
+			gotSample++
+			if r.IP != 0x1234 {
+				t.Errorf("sample IP = %#x, want %#x", r.IP, 0x1234)
+			}
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+	if gotComm != 1 || gotSample != 1 {
+		t.Errorf("got %d comm, %d sample records; want 1, 1", gotComm, gotSample)
+	}
+	if f.Meta.Hostname != "testhost" {
+		t.Errorf("Hostname = %q, want %q", f.Meta.Hostname, "testhost")
+	}
+}
+
+// TestPipeReaderOnEventAttr checks that PipeReaderOptions.OnEventAttr
+// fires as each recordTypeAttr record is parsed out of the stream,
+// before the record that follows it is returned from Next.
+func TestPipeReaderOnEventAttr(t *testing.T) {
+	attr := &EventAttr{
+		Event:        EventHardware(0),
+		SampleFormat: SampleFormatIP | SampleFormatTID,
+	}
+
+	var buf bytes.Buffer
+	w, err := NewPipeWriter(&buf, []*EventAttr{attr})
+	if err != nil {
+		t.Fatalf("NewPipeWriter: %v", err)
+	}
+
+	sample := &RecordSample{RecordCommon: RecordCommon{EventAttr: attr}, IP: 0x1234}
+	sample.PID, sample.TID = 1, 1
+	if err := w.WriteRecord(sample); err != nil {
+		t.Fatalf("WriteRecord(sample): %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var got []*EventAttr
+	f, err := NewPipeReader(&buf, PipeReaderOptions{
+		OnEventAttr: func(ea *EventAttr) { got = append(got, ea) },
+	})
+	if err != nil {
+		t.Fatalf("NewPipeReader: %v", err)
+	}
+
+	rs := f.Records(RecordsFileOrder)
+	sawSampleAfterAttr := false
+	for rs.Next() {
+		if _, ok := rs.Record.(*RecordSample); ok {
+			sawSampleAfterAttr = len(got) == 1
+		}
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatalf("Records: %v", err)
+	}
+
+	if len(got) != 1 || got[0].SampleFormat != attr.SampleFormat {
+		t.Errorf("OnEventAttr callbacks = %+v, want one call with SampleFormat %v", got, attr.SampleFormat)
+	}
+	if !sawSampleAfterAttr {
+		t.Errorf("RecordSample was returned before OnEventAttr fired for its EventAttr")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aclements/go-perf/perffile"
+)
+
+// CPUInfo describes the microarchitecture of the CPU that recorded a
+// profile, as parsed from the perf.data CPUID header, along with a
+// set of capability flags for that microarchitecture. It's derived
+// purely from the recorded CPUID string, not the host this process
+// happens to run on, so analysis tools get consistent answers
+// regardless of where they're run.
+type CPUInfo struct {
+	// Vendor, Family, Model, and Stepping are parsed from the
+	// CPUID header, such as "GenuineIntel,6,69,1". Vendor is ""
+	// and the rest are 0 if the CPUID header was missing or
+	// couldn't be parsed.
+	Vendor        string
+	Family, Model int
+	Stepping      int
+
+	CPUCapabilities
+}
+
+// CPUCapabilities gives microarchitectural capabilities relevant to
+// interpreting perf samples. Capabilities for unrecognized CPUs are
+// all zero, meaning "unknown" should be assumed rather than "absent".
+type CPUCapabilities struct {
+	// LBRWidth is the number of entries in the Last Branch Record
+	// stack, or 0 if unknown.
+	LBRWidth int
+
+	// HasPEBS indicates this CPU supports precise event-based
+	// sampling.
+	HasPEBS bool
+
+	// HasIntelPT indicates this CPU supports Intel Processor
+	// Trace.
+	HasIntelPT bool
+
+	// HasAMDBRS indicates this CPU supports AMD Branch Sampling,
+	// an LBR-like facility on Zen 4 and later.
+	HasAMDBRS bool
+
+	// BranchFlagsReliable indicates the LBR on this
+	// microarchitecture populates both BranchFlagPredicted and
+	// BranchFlagMispredicted. On some early microarchitectures,
+	// LBR only ever sets BranchFlagMispredicted, which makes a
+	// predicted/mispredicted rate computed from those flags
+	// meaningless.
+	BranchFlagsReliable bool
+}
+
+// ParseCPUID parses a perf.data CPUID header, such as
+// "GenuineIntel,6,69,1" (vendor, family, model, stepping), into a
+// CPUInfo. If cpuid is "" (the header was absent), ParseCPUID returns
+// a zero CPUInfo and no error. CPUCapabilities is filled in from an
+// internal table of known microarchitectures; unrecognized CPUs get a
+// zero CPUCapabilities.
+func ParseCPUID(cpuid string) (CPUInfo, error) {
+	if cpuid == "" {
+		return CPUInfo{}, nil
+	}
+
+	parts := strings.Split(cpuid, ",")
+	if len(parts) != 4 {
+		return CPUInfo{}, fmt.Errorf("malformed CPUID %q: want 4 comma-separated fields", cpuid)
+	}
+	family, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return CPUInfo{}, fmt.Errorf("malformed CPUID %q: bad family: %v", cpuid, err)
+	}
+	model, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil {
+		return CPUInfo{}, fmt.Errorf("malformed CPUID %q: bad model: %v", cpuid, err)
+	}
+	stepping, err := strconv.Atoi(strings.TrimSpace(parts[3]))
+	if err != nil {
+		return CPUInfo{}, fmt.Errorf("malformed CPUID %q: bad stepping: %v", cpuid, err)
+	}
+
+	vendor := strings.TrimSpace(parts[0])
+	return CPUInfo{
+		Vendor:          vendor,
+		Family:          family,
+		Model:           model,
+		Stepping:        stepping,
+		CPUCapabilities: lookupCPUCapabilities(vendor, family, model),
+	}, nil
+}
+
+// NewCPUInfo parses the CPUID header of f, as ParseCPUID. It never
+// returns an error; a malformed or missing CPUID header simply
+// yields a zero CPUInfo, since CPUInfo is advisory and shouldn't
+// block opening a profile.
+func NewCPUInfo(f *perffile.File) CPUInfo {
+	info, _ := ParseCPUID(f.Meta.CPUID)
+	return info
+}
+
+// cpuKey identifies a microarchitecture by vendor, family, and model,
+// the same granularity perf's CPUID header records.
+type cpuKey struct {
+	vendor        string
+	family, model int
+}
+
+// cpuTable maps known microarchitectures to their capabilities. This
+// is the same style of table as Go's internal/cpu uses to recognize
+// specific CPUs, except keyed off the recorded CPUID rather than
+// CPUID instructions executed on the host.
+//
+// This is far from exhaustive; it only covers microarchitectures
+// relevant to the capabilities above. Add entries as needed.
+var cpuTable = map[cpuKey]CPUCapabilities{
+	// Intel Nehalem/Westmere: LBR exists but never sets
+	// BranchFlagPredicted, only BranchFlagMispredicted.
+	{"GenuineIntel", 6, 26}: {LBRWidth: 16, HasPEBS: true},
+	{"GenuineIntel", 6, 30}: {LBRWidth: 16, HasPEBS: true},
+	{"GenuineIntel", 6, 37}: {LBRWidth: 16, HasPEBS: true},
+
+	// Intel Sandy Bridge/Ivy Bridge.
+	{"GenuineIntel", 6, 42}: {LBRWidth: 16, HasPEBS: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 58}: {LBRWidth: 16, HasPEBS: true, BranchFlagsReliable: true},
+
+	// Intel Haswell/Broadwell: adds Intel PT.
+	{"GenuineIntel", 6, 60}: {LBRWidth: 16, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 61}: {LBRWidth: 16, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 69}: {LBRWidth: 16, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 71}: {LBRWidth: 16, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+
+	// Intel Skylake and later client/server: 32-entry LBR.
+	{"GenuineIntel", 6, 78}:  {LBRWidth: 32, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 85}:  {LBRWidth: 32, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 94}:  {LBRWidth: 32, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 142}: {LBRWidth: 32, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+	{"GenuineIntel", 6, 158}: {LBRWidth: 32, HasPEBS: true, HasIntelPT: true, BranchFlagsReliable: true},
+
+	// AMD Zen/Zen2/Zen3 have no LBR at all; BRS arrives in Zen 4.
+	{"AuthenticAMD", 23, 1}:  {HasPEBS: true},
+	{"AuthenticAMD", 23, 49}: {HasPEBS: true},
+	{"AuthenticAMD", 25, 1}:  {HasPEBS: true},
+
+	// AMD Zen 4: Branch Sampling (BRS), a 16-entry LBR-like stack
+	// that, like early Intel LBR, only reliably reports taken
+	// branches, not prediction outcome.
+	{"AuthenticAMD", 25, 97}: {LBRWidth: 16, HasPEBS: true, HasAMDBRS: true},
+}
+
+func lookupCPUCapabilities(vendor string, family, model int) CPUCapabilities {
+	return cpuTable[cpuKey{vendor, family, model}]
+}
+
+// RecommendedBranchSampleType returns a reasonable default
+// branch_sample_type (the set of "perf record -j" filters) for
+// collecting a branch profile on this microarchitecture. Callers
+// should still let the user override this; it's only a starting
+// point.
+func (c CPUCapabilities) RecommendedBranchSampleType() perffile.BranchSampleType {
+	t := perffile.BranchSampleAny
+	if c.LBRWidth > 0 {
+		// This microarchitecture has an LBR stack, so it can
+		// report the originating branch type and (on most
+		// uarchs) whether the branch was mispredicted.
+		t |= perffile.BranchSampleTypeSave
+	}
+	return t
+}
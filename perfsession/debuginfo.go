@@ -0,0 +1,186 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// findDebugFile locates a split debug info file for the binary
+// opened as elff (filename is its path), following the same
+// resolution order as gdb and perf's dso__load_sym: first by the
+// binary's own GNU build ID, then by its .gnu_debuglink. It searches
+// session.DebugRoots (if any), then the perf build-id cache
+// (buildIDDir) and /usr/lib/debug.
+func findDebugFile(session *Session, filename string, elff *elf.File) (string, bool) {
+	roots := debugRoots(session)
+
+	if buildID, ok := buildIDNote(elff); ok && len(buildID) >= 2 {
+		for _, root := range roots {
+			path := fmt.Sprintf("%s/.build-id/%s/%s.debug", root, buildID[:2], buildID[2:])
+			if fileExists(path) {
+				return path, true
+			}
+		}
+	}
+
+	if name, crc, ok := debugLink(elff); ok {
+		dir := filepath.Dir(filename)
+		candidates := []string{
+			filepath.Join(dir, name),
+			filepath.Join(dir, ".debug", name),
+		}
+		for _, root := range roots {
+			candidates = append(candidates, filepath.Join(root, dir, name))
+		}
+		for _, path := range candidates {
+			if crcMatches(path, crc) {
+				return path, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func debugRoots(session *Session) []string {
+	roots := make([]string, 0, len(session.DebugRoots)+2)
+	roots = append(roots, session.DebugRoots...)
+	return append(roots, buildIDDir, "/usr/lib/debug")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func crcMatches(path string, want uint32) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return crc32.ChecksumIEEE(data) == want
+}
+
+// buildIDNote extracts the hex-encoded GNU build ID from elff's
+// .note.gnu.build-id section, if it has one.
+func buildIDNote(elff *elf.File) (string, bool) {
+	sec := elff.Section(".note.gnu.build-id")
+	if sec == nil {
+		return "", false
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", false
+	}
+	for _, n := range parseNotes(elff.ByteOrder, data) {
+		if n.name == "GNU" && n.typ == noteGNUBuildID {
+			return fmt.Sprintf("%x", n.desc), true
+		}
+	}
+	return "", false
+}
+
+// debugLink parses elff's .gnu_debuglink section: a NUL-terminated,
+// 4-byte-padded debug filename followed by its CRC-32 (in elff's
+// byte order).
+func debugLink(elff *elf.File) (name string, crc uint32, ok bool) {
+	sec := elff.Section(".gnu_debuglink")
+	if sec == nil {
+		return "", 0, false
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", 0, false
+	}
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	name = string(data[:i])
+	crcOff := (i + 1 + 3) &^ 3
+	if crcOff+4 > len(data) {
+		return "", 0, false
+	}
+	return name, elff.ByteOrder.Uint32(data[crcOff : crcOff+4]), true
+}
+
+// debugAltLink parses a .gnu_debugaltlink section, as found in a
+// split debug file produced by dwz: a NUL-terminated path to the
+// supplementary ("alt") debug file, followed by its build ID.
+//
+// The returned alt file, if any, is not actually merged in to the
+// DWARF this package loads: Go's debug/dwarf package has no support
+// for DW_FORM_GNU_ref_alt, so cross-references in to it (as used by
+// dwz to dedup common types across binaries) won't resolve. This is
+// surfaced as a log message rather than silently missing data.
+func debugAltLink(elff *elf.File) (path string, buildID string, ok bool) {
+	sec := elff.Section(".gnu_debugaltlink")
+	if sec == nil {
+		return "", "", false
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", "", false
+	}
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", "", false
+	}
+	return string(data[:i]), fmt.Sprintf("%x", data[i+1:]), true
+}
+
+// noteGNUBuildID is NT_GNU_BUILD_ID, the note type the linker gives
+// a .note.gnu.build-id entry.
+const noteGNUBuildID = 3
+
+type elfNote struct {
+	name string
+	typ  uint32
+	desc []byte
+}
+
+// parseNotes decodes the sequence of Elf_Nhdr entries in an ELF
+// SHT_NOTE section's raw data.
+func parseNotes(order binary.ByteOrder, data []byte) []elfNote {
+	var notes []elfNote
+	for len(data) >= 12 {
+		nameSz := order.Uint32(data[0:4])
+		descSz := order.Uint32(data[4:8])
+		typ := order.Uint32(data[8:12])
+		data = data[12:]
+
+		nameEnd := align4(nameSz)
+		if uint64(nameEnd) > uint64(len(data)) {
+			break
+		}
+		name := ""
+		if nameSz > 0 {
+			name = string(data[:nameSz-1]) // drop the NUL terminator
+		}
+		data = data[nameEnd:]
+
+		descEnd := align4(descSz)
+		if uint64(descEnd) > uint64(len(data)) {
+			break
+		}
+		desc := data[:descSz]
+		data = data[descEnd:]
+
+		notes = append(notes, elfNote{name, typ, desc})
+	}
+	return notes
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kallsymsFilename is the name perf gives the kernel's own MMAP
+// record (the "kernel.kallsyms" pseudo-DSO), with or without the
+// trailing "_text"/"_stext" segment name older kernels use. See
+// perf_event__synthesize_kernel_mmap in tools/perf/util/event.c.
+const kallsymsPrefix = "[kernel.kallsyms]"
+
+// isKallsymsFilename reports whether filename names the kernel's own
+// mapping, as opposed to a module or user binary.
+func isKallsymsFilename(filename string) bool {
+	return strings.HasPrefix(filename, kallsymsPrefix)
+}
+
+// kallsymsPath returns the /proc/kallsyms-format file to symbolize
+// the kernel from: session.KallsymsPath if set (for offline analysis
+// of a recording made elsewhere), or the running kernel's own
+// /proc/kallsyms otherwise.
+func kallsymsPath(session *Session) string {
+	if session.KallsymsPath != "" {
+		return session.KallsymsPath
+	}
+	return "/proc/kallsyms"
+}
+
+// newKallsymsExtra parses a kallsyms-format symbol table (either
+// /proc/kallsyms or a copy saved alongside an offline recording) in
+// to a symbolicExtra usable by findIP.
+//
+// It returns an error, rather than a merely-empty table, if the file
+// looks unusable for symbolization: if kptr_restrict (or an
+// unprivileged reader) has zeroed every address, or if the running
+// kernel hides nearly every symbol's real name behind "____" padding
+// instead of exposing it. Both are signs the caller should fall back
+// to vmlinux instead.
+func newKallsymsExtra(path string) (*symbolicExtra, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading kallsyms %s: %s", path, err)
+	}
+	defer f.Close()
+
+	var funcs []funcRange
+	nonZero, hidden := 0, 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil || !isFuncSymType(fields[1]) {
+			continue
+		}
+		name := fields[2]
+		if addr != 0 {
+			nonZero++
+		}
+		if strings.HasPrefix(name, "____") {
+			hidden++
+		}
+		funcs = append(funcs, funcRange{name, addr, addr})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing kallsyms %s: %s", path, err)
+	}
+	if len(funcs) == 0 {
+		return nil, fmt.Errorf("kallsyms %s: no function symbols", path)
+	}
+	if nonZero == 0 {
+		return nil, fmt.Errorf("kallsyms %s: all addresses are zero (kptr_restrict?)", path)
+	}
+	if hidden*2 > len(funcs) {
+		return nil, fmt.Errorf("kallsyms %s: most symbol names are hidden", path)
+	}
+
+	sort.Sort(funcRangeSorter(funcs))
+	for i := range funcs {
+		if i+1 < len(funcs) {
+			funcs[i].highpc = funcs[i+1].lowpc
+		} else {
+			funcs[i].highpc = funcs[i].lowpc + 1
+		}
+	}
+
+	return &symbolicExtra{functab: funcs}, nil
+}
+
+// isFuncSymType reports whether a kallsyms type letter (the second
+// column of /proc/kallsyms) names a function symbol, as opposed to
+// data. See the "nm" man page for the letter meanings; only the
+// text-section letters are useful for IP symbolization.
+func isFuncSymType(t string) bool {
+	switch t {
+	case "t", "T", "w", "W":
+		return true
+	}
+	return false
+}
+
+// vmlinuxCandidates returns the paths, in preference order, to try
+// loading an uncompressed vmlinux from when kallsyms is unavailable
+// or unusable. This mirrors perf's own dso__load_vmlinux_path search,
+// minus the kernel-module-path and cache-dir entries perfsession
+// doesn't track yet.
+func vmlinuxCandidates(session *Session) []string {
+	var out []string
+	if session.VmlinuxPath != "" {
+		out = append(out, session.VmlinuxPath)
+	}
+	if release, err := readOSRelease(); err == nil {
+		out = append(out,
+			"/usr/lib/debug/boot/vmlinux-"+release,
+			"/boot/vmlinux-"+release,
+		)
+	}
+	return out
+}
+
+func readOSRelease() (string, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
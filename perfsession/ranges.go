@@ -4,47 +4,316 @@
 
 package perfsession
 
-import "sort"
-
 // Ranges stores data associated with ranges of uint64 values and
-// supports efficient lookup.
+// supports efficient insertion, point and overlap lookup, and
+// deletion.
+//
+// Unlike a plain sorted list, Ranges permits overlapping ranges, which
+// is needed for things like inlined DWARF ranges, overlapping BPF
+// subprograms, and re-mapped JIT code. It's backed by a left-leaning
+// red-black tree keyed on an entry's low bound, augmented at each node
+// with the maximum high bound anywhere in its subtree, so Add and
+// Delete are O(log N) and point/overlap queries are output-sensitive.
+//
+// The zero value is an empty Ranges.
 type Ranges struct {
-	rs     []rangeEnt
-	sorted bool
+	root *rangeNode
+	// nextSeq orders entries with otherwise identical (lo, hi), so
+	// the tree has a genuine total order even when ranges
+	// overlap or coincide exactly. Without this, the two
+	// entries' relative tree position would be free to flip under
+	// rotation, which would break BST search for one of them.
+	nextSeq uint64
+}
+
+// RangeVal is an entry returned by GetAll and Overlaps.
+type RangeVal struct {
+	Lo, Hi uint64
+	Val    interface{}
 }
 
-type rangeEnt struct {
+type rangeNode struct {
 	lo, hi uint64
+	seq    uint64
+	max    uint64 // max hi of this subtree
 	val    interface{}
+
+	red         bool
+	left, right *rangeNode
 }
 
-// Add inserts val for range [lo, hi).
-//
-// Add is undefined if [lo, hi) overlaps a range already in r.
+// Add inserts val for range [lo, hi). Unlike a plain sorted list,
+// [lo, hi) may overlap, or exactly coincide with, ranges already in
+// r.
 func (r *Ranges) Add(lo, hi uint64, val interface{}) {
-	r.rs = append(r.rs, rangeEnt{lo, hi, val})
-	r.sorted = false
+	seq := r.nextSeq
+	r.nextSeq++
+	r.root = rangeInsert(r.root, lo, hi, seq, val)
+	r.root.red = false
 }
 
-// Get returns the range and the value for the range containing idx.
+// Get returns one range and value containing idx, if any. If several
+// ranges in r overlap idx, Get returns an arbitrary one of them; use
+// GetAll to get all of them.
 func (r *Ranges) Get(idx uint64) (lo, hi uint64, val interface{}, ok bool) {
 	if r == nil {
 		return 0, 0, nil, false
 	}
+	rangeSearch(r.root, idx, idx+1, func(h *rangeNode) bool {
+		lo, hi, val, ok = h.lo, h.hi, h.val, true
+		return true
+	})
+	return
+}
 
-	rs := r.rs
-	if !r.sorted {
-		sort.Slice(rs, func(i, j int) bool {
-			return rs[i].lo < rs[j].lo
-		})
-		r.sorted = true
+// GetAll returns all ranges and values containing idx, in no
+// particular order.
+func (r *Ranges) GetAll(idx uint64) []RangeVal {
+	if r == nil {
+		return nil
 	}
+	return r.Overlaps(idx, idx+1)
+}
 
-	i := sort.Search(len(rs), func(i int) bool {
-		return idx < rs[i].hi
+// Overlaps returns all ranges and values in r that overlap [lo, hi),
+// in no particular order.
+func (r *Ranges) Overlaps(lo, hi uint64) []RangeVal {
+	if r == nil {
+		return nil
+	}
+	var out []RangeVal
+	rangeSearch(r.root, lo, hi, func(h *rangeNode) bool {
+		out = append(out, RangeVal{h.lo, h.hi, h.val})
+		return false
 	})
-	if i < len(rs) && rs[i].lo <= idx && idx < rs[i].hi {
-		return rs[i].lo, rs[i].hi, rs[i].val, true
+	return out
+}
+
+// Delete removes the entry added by Add(lo, hi, val), comparing val
+// with ==. It's a no-op if there's no such entry. val must be a
+// comparable type (as for any use of == on an interface{} value).
+func (r *Ranges) Delete(lo, hi uint64, val interface{}) {
+	if r == nil || r.root == nil {
+		return
+	}
+	n := rangeFind(r.root, lo, hi, val)
+	if n == nil {
+		return
+	}
+	r.root = rangeDelete(r.root, lo, hi, n.seq)
+	if r.root != nil {
+		r.root.red = false
+	}
+}
+
+// rangeSearch visits every node whose range overlaps the query range
+// [qlo, qhi), in ascending order of lo, stopping early if visit
+// returns true. It prunes using the max-hi augmentation: a subtree
+// can only contain an overlapping range if its max hi is > qlo, and
+// the right subtree can only contain one if this node's lo is < qhi
+// (since every range to the right has an even larger lo).
+func rangeSearch(h *rangeNode, qlo, qhi uint64, visit func(h *rangeNode) bool) bool {
+	if h == nil {
+		return false
+	}
+	if h.left != nil && h.left.max > qlo {
+		if rangeSearch(h.left, qlo, qhi, visit) {
+			return true
+		}
+	}
+	if h.lo < qhi && qlo < h.hi {
+		if visit(h) {
+			return true
+		}
+	}
+	if h.lo < qhi {
+		if rangeSearch(h.right, qlo, qhi, visit) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeFind locates the node added by Add(lo, hi, val). Nodes are
+// ordered by (lo, hi, seq), so a node with the same (lo, hi) as the
+// target but a different val isn't necessarily to one side: any
+// number of Adds of that same range may have interleaved on either
+// side of it after rebalancing, so both children have to be searched
+// once (lo, hi) matches.
+func rangeFind(h *rangeNode, lo, hi uint64, val interface{}) *rangeNode {
+	if h == nil {
+		return nil
+	}
+	switch {
+	case lo < h.lo || (lo == h.lo && hi < h.hi):
+		return rangeFind(h.left, lo, hi, val)
+	case lo > h.lo || (lo == h.lo && hi > h.hi):
+		return rangeFind(h.right, lo, hi, val)
+	default:
+		if h.val == val {
+			return h
+		}
+		if n := rangeFind(h.left, lo, hi, val); n != nil {
+			return n
+		}
+		return rangeFind(h.right, lo, hi, val)
+	}
+}
+
+// rangeLess reports whether (lo, hi, seq) sorts before h's key.
+func rangeLess(lo, hi, seq uint64, h *rangeNode) bool {
+	if lo != h.lo {
+		return lo < h.lo
+	}
+	if hi != h.hi {
+		return hi < h.hi
+	}
+	return seq < h.seq
+}
+
+func isRed(h *rangeNode) bool {
+	return h != nil && h.red
+}
+
+func updateMax(h *rangeNode) {
+	m := h.hi
+	if h.left != nil && h.left.max > m {
+		m = h.left.max
+	}
+	if h.right != nil && h.right.max > m {
+		m = h.right.max
+	}
+	h.max = m
+}
+
+func rotateLeft(h *rangeNode) *rangeNode {
+	x := h.right
+	h.right = x.left
+	x.left = h
+	x.red = h.red
+	h.red = true
+	updateMax(h)
+	updateMax(x)
+	return x
+}
+
+func rotateRight(h *rangeNode) *rangeNode {
+	x := h.left
+	h.left = x.right
+	x.right = h
+	x.red = h.red
+	h.red = true
+	updateMax(h)
+	updateMax(x)
+	return x
+}
+
+func flipColors(h *rangeNode) {
+	h.red = !h.red
+	h.left.red = !h.left.red
+	h.right.red = !h.right.red
+}
+
+func rangeInsert(h *rangeNode, lo, hi, seq uint64, val interface{}) *rangeNode {
+	if h == nil {
+		return &rangeNode{lo: lo, hi: hi, seq: seq, max: hi, val: val, red: true}
+	}
+
+	if rangeLess(lo, hi, seq, h) {
+		h.left = rangeInsert(h.left, lo, hi, seq, val)
+	} else {
+		h.right = rangeInsert(h.right, lo, hi, seq, val)
+	}
+
+	if isRed(h.right) && !isRed(h.left) {
+		h = rotateLeft(h)
+	}
+	if isRed(h.left) && isRed(h.left.left) {
+		h = rotateRight(h)
+	}
+	if isRed(h.left) && isRed(h.right) {
+		flipColors(h)
+	}
+	updateMax(h)
+	return h
+}
+
+func moveRedLeft(h *rangeNode) *rangeNode {
+	flipColors(h)
+	if isRed(h.right.left) {
+		h.right = rotateRight(h.right)
+		h = rotateLeft(h)
+		flipColors(h)
+	}
+	return h
+}
+
+func moveRedRight(h *rangeNode) *rangeNode {
+	flipColors(h)
+	if isRed(h.left.left) {
+		h = rotateRight(h)
+		flipColors(h)
+	}
+	return h
+}
+
+func rangeMin(h *rangeNode) *rangeNode {
+	for h.left != nil {
+		h = h.left
+	}
+	return h
+}
+
+func rangeDeleteMin(h *rangeNode) *rangeNode {
+	if h.left == nil {
+		return nil
+	}
+	if !isRed(h.left) && !isRed(h.left.left) {
+		h = moveRedLeft(h)
+	}
+	h.left = rangeDeleteMin(h.left)
+	return rangeFixUp(h)
+}
+
+func rangeFixUp(h *rangeNode) *rangeNode {
+	if isRed(h.right) {
+		h = rotateLeft(h)
+	}
+	if isRed(h.left) && isRed(h.left.left) {
+		h = rotateRight(h)
+	}
+	if isRed(h.left) && isRed(h.right) {
+		flipColors(h)
+	}
+	updateMax(h)
+	return h
+}
+
+// rangeDelete removes the node with the exact key (lo, hi, seq) from
+// the subtree rooted at h, which must contain it.
+func rangeDelete(h *rangeNode, lo, hi, seq uint64) *rangeNode {
+	if rangeLess(lo, hi, seq, h) {
+		if !isRed(h.left) && !isRed(h.left.left) {
+			h = moveRedLeft(h)
+		}
+		h.left = rangeDelete(h.left, lo, hi, seq)
+	} else {
+		if isRed(h.left) {
+			h = rotateRight(h)
+		}
+		if lo == h.lo && hi == h.hi && seq == h.seq && h.right == nil {
+			return nil
+		}
+		if !isRed(h.right) && !isRed(h.right.left) {
+			h = moveRedRight(h)
+		}
+		if lo == h.lo && hi == h.hi && seq == h.seq {
+			m := rangeMin(h.right)
+			h.lo, h.hi, h.seq, h.val = m.lo, m.hi, m.seq, m.val
+			h.right = rangeDeleteMin(h.right)
+		} else {
+			h.right = rangeDelete(h.right, lo, hi, seq)
+		}
 	}
-	return 0, 0, nil, false
+	return rangeFixUp(h)
 }
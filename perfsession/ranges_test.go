@@ -0,0 +1,142 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package perfsession
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+type rangeOracleEnt struct {
+	lo, hi uint64
+	val    interface{}
+}
+
+func rangeOracleOverlaps(oracle []rangeOracleEnt, lo, hi uint64) []RangeVal {
+	var out []RangeVal
+	for _, e := range oracle {
+		if e.lo < hi && lo < e.hi {
+			out = append(out, RangeVal{e.lo, e.hi, e.val})
+		}
+	}
+	return out
+}
+
+func sortRangeVals(rv []RangeVal) {
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Lo != rv[j].Lo {
+			return rv[i].Lo < rv[j].Lo
+		}
+		if rv[i].Hi != rv[j].Hi {
+			return rv[i].Hi < rv[j].Hi
+		}
+		return rv[i].Val.(int) < rv[j].Val.(int)
+	})
+}
+
+// checkRangeInvariants walks the tree checking the red-black and
+// BST-order invariants and the max augmentation, failing t if any is
+// violated.
+func checkRangeInvariants(t *testing.T, h *rangeNode) uint64 {
+	if h == nil {
+		return 0
+	}
+	if isRed(h) && (isRed(h.left) || isRed(h.right)) {
+		t.Fatalf("red node has a red child")
+	}
+	max := h.hi
+	if m := checkRangeInvariants(t, h.left); m > max {
+		max = m
+	}
+	if m := checkRangeInvariants(t, h.right); m > max {
+		max = m
+	}
+	if h.max != max {
+		t.Fatalf("max = %d, want %d", h.max, max)
+	}
+	if h.left != nil && rangeLess(h.lo, h.hi, h.seq, h.left) {
+		t.Fatalf("BST order violated: %v has smaller key than its left child", h)
+	}
+	if h.right != nil && !rangeLess(h.lo, h.hi, h.seq, h.right) {
+		t.Fatalf("BST order violated: %v does not have smaller key than its right child", h)
+	}
+	return max
+}
+
+func checkRangeBlackHeight(t *testing.T, h *rangeNode) int {
+	if h == nil {
+		return 0
+	}
+	l := checkRangeBlackHeight(t, h.left)
+	r := checkRangeBlackHeight(t, h.right)
+	if l != r {
+		t.Fatalf("black height imbalance: %d vs %d", l, r)
+	}
+	if !isRed(h) {
+		l++
+	}
+	return l
+}
+
+// TestRanges does randomized testing of Ranges against a brute-force
+// oracle, with a small key space to force lots of exactly overlapping
+// and exactly coincident ranges.
+func TestRanges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	var r Ranges
+	var oracle []rangeOracleEnt
+	for iter := 0; iter < 10000; iter++ {
+		switch {
+		case iter%3 == 0 || len(oracle) == 0:
+			lo := uint64(rng.Intn(20))
+			hi := lo + uint64(rng.Intn(10)+1)
+			val := iter
+			r.Add(lo, hi, val)
+			oracle = append(oracle, rangeOracleEnt{lo, hi, val})
+
+		case iter%3 == 1:
+			i := rng.Intn(len(oracle))
+			e := oracle[i]
+			r.Delete(e.lo, e.hi, e.val)
+			oracle = append(oracle[:i], oracle[i+1:]...)
+
+		default:
+			lo := uint64(rng.Intn(20))
+			hi := lo + uint64(rng.Intn(10)+1)
+			got, want := r.Overlaps(lo, hi), rangeOracleOverlaps(oracle, lo, hi)
+			sortRangeVals(got)
+			sortRangeVals(want)
+			if !equalRangeVals(got, want) {
+				t.Fatalf("Overlaps(%d, %d) = %v, want %v", lo, hi, got, want)
+			}
+		}
+
+		if r.root != nil {
+			checkRangeInvariants(t, r.root)
+			checkRangeBlackHeight(t, r.root)
+		}
+	}
+
+	for _, e := range oracle {
+		r.Delete(e.lo, e.hi, e.val)
+	}
+	if r.root != nil {
+		t.Fatalf("tree not empty after deleting every entry")
+	}
+}
+
+func equalRangeVals(a, b []RangeVal) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
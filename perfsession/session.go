@@ -4,16 +4,50 @@
 
 package perfsession
 
-import "github.com/aclements/go-perf/perffile"
+import (
+	"sort"
 
-// TODO: Per-TID state.
+	"github.com/aclements/go-perf/perffile"
+)
 
 type Session struct {
 	kernel  *PIDInfo
 	pidInfo map[int]*PIDInfo
 
+	// ksyms holds dynamically loaded or JITed kernel symbols (such
+	// as BPF programs), registered via PERF_RECORD_KSYMBOL events
+	// and sorted by Addr.
+	ksyms []ksym
+
+	// bpfProgs is the set of BPF program IDs with an outstanding
+	// PERF_RECORD_BPF_EVENT load, for which no matching unload has
+	// been seen yet.
+	bpfProgs map[uint32]bool
+
+	// CPUInfo describes the microarchitecture that recorded File,
+	// parsed from its CPUID header. It's the zero CPUInfo if the
+	// header is missing or unrecognized.
+	CPUInfo CPUInfo
+
 	File  *perffile.File
 	Extra map[ExtraKey]interface{}
+
+	// KallsymsPath, if non-empty, overrides /proc/kallsyms as the
+	// source of kernel symbols for Symbolize. Set this when
+	// analyzing a recording made on a different machine, alongside
+	// a kallsyms snapshot saved at capture time.
+	KallsymsPath string
+
+	// VmlinuxPath, if non-empty, is tried before the standard
+	// /boot and /usr/lib/debug search paths when kallsyms is
+	// missing or unusable (e.g. because of kptr_restrict).
+	VmlinuxPath string
+
+	// DebugRoots is a list of sysroots to search for split debug
+	// info, tried in order before the standard build-id cache and
+	// /usr/lib/debug. Set this to analyze a recording against
+	// binaries and debug info copied from another machine.
+	DebugRoots []string
 }
 
 func New(f *perffile.File) *Session {
@@ -27,8 +61,10 @@ func New(f *perffile.File) *Session {
 			// The kernel is implicitly PID -1
 			-1: kernel,
 		},
-		File:  f,
-		Extra: make(map[ExtraKey]interface{}),
+		bpfProgs: make(map[uint32]bool),
+		CPUInfo:  NewCPUInfo(f),
+		File:     f,
+		Extra:    make(map[ExtraKey]interface{}),
 	}
 }
 
@@ -47,42 +83,135 @@ func (s *Session) Update(r perffile.Record) {
 
 	switch r := r.(type) {
 	case *perffile.RecordComm:
-		ensurePID(r.PID).Comm = r.Comm
+		pidInfo := ensurePID(r.PID)
+		// prctl(PR_SET_NAME) (and exec) only renames the calling
+		// thread; the process's Comm (e.g. as seen by ps) is the
+		// name of its PID==TID leader thread.
+		pidInfo.ensureTID(r.TID).Name = r.Comm
+		if r.PID == r.TID {
+			pidInfo.Comm = r.Comm
+		}
 
 	case *perffile.RecordExit:
 		if r.PID == r.TID {
 			delete(s.pidInfo, r.PID)
+		} else if pidInfo, ok := s.pidInfo[r.PID]; ok {
+			// Thread exit.
+			delete(pidInfo.tids, r.TID)
 		}
-		// Otherwise this is thread exit
 
 	case *perffile.RecordFork:
-		if r.PID == r.TID {
+		switch {
+		case r.PID == r.TID:
+			// New process.
 			s.pidInfo[r.PID] = ensurePID(r.PPID).fork(r.PID)
+		case r.PID == r.PPID && r.TID != r.PPID:
+			// Thread creation: a clone() within the same process.
+			ensurePID(r.PID).ensureTID(r.TID)
 		}
-		// Otherwise this is thread creation
 
 	case *perffile.RecordMmap:
 		info := ensurePID(r.PID)
+		info.ensureTID(r.TID)
 		info.munmap(r.Addr, r.Len)
 		info.maps = append(info.maps, &Mmap{make(ForkableExtra), *r})
 
 	case *perffile.RecordSample:
 		// Sometimes (particularly early in sample files), we
 		// see kernel samples before the RecordComm.
-		ensurePID(r.PID)
+		ensurePID(r.PID).ensureTID(r.TID)
+
+	case *perffile.RecordKsymbol:
+		s.updateKsym(r)
+
+	case *perffile.RecordBPFEvent:
+		switch r.EventType {
+		case perffile.BPFEventTypeProgLoad:
+			s.bpfProgs[r.ID] = true
+		case perffile.BPFEventTypeProgUnload:
+			delete(s.bpfProgs, r.ID)
+		}
+	}
+}
+
+// BPFPrograms returns the IDs of the BPF programs currently loaded,
+// according to the PERF_RECORD_BPF_EVENT records seen so far.
+func (s *Session) BPFPrograms() []uint32 {
+	ids := make([]uint32, 0, len(s.bpfProgs))
+	for id := range s.bpfProgs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ksym describes a dynamically loaded or JITed kernel symbol, such as
+// a BPF program or its out-of-line function trampolines, registered
+// via a PERF_RECORD_KSYMBOL event.
+type ksym struct {
+	addr, len uint64
+	name      string
+}
+
+func (s *Session) updateKsym(r *perffile.RecordKsymbol) {
+	i := sort.Search(len(s.ksyms), func(i int) bool { return s.ksyms[i].addr >= r.Addr })
+
+	if r.Flags&perffile.KsymbolFlagUnregister != 0 {
+		if i < len(s.ksyms) && s.ksyms[i].addr == r.Addr {
+			s.ksyms = append(s.ksyms[:i], s.ksyms[i+1:]...)
+		}
+		return
+	}
+
+	sym := ksym{r.Addr, uint64(r.Len), r.Name}
+	if i < len(s.ksyms) && s.ksyms[i].addr == r.Addr {
+		s.ksyms[i] = sym
+		return
+	}
+	s.ksyms = append(s.ksyms, ksym{})
+	copy(s.ksyms[i+1:], s.ksyms[i:])
+	s.ksyms[i] = sym
+}
+
+// lookupKsym returns the name of the dynamically loaded or JITed
+// kernel symbol containing ip, or "", false if ip isn't covered by
+// any symbol registered via PERF_RECORD_KSYMBOL.
+func (s *Session) lookupKsym(ip uint64) (string, bool) {
+	i := sort.Search(len(s.ksyms), func(i int) bool { return ip < s.ksyms[i].addr }) - 1
+	if i < 0 || i >= len(s.ksyms) {
+		return "", false
+	}
+	sym := s.ksyms[i]
+	if ip < sym.addr+sym.len {
+		return sym.name, true
 	}
+	return "", false
 }
 
 func (s *Session) LookupPID(pid int) *PIDInfo {
 	return s.pidInfo[pid]
 }
 
+// LookupTID returns the per-thread state for thread tid within
+// process pid, or nil if pid or tid is unknown.
+func (s *Session) LookupTID(pid, tid int) *TIDInfo {
+	pidInfo, ok := s.pidInfo[pid]
+	if !ok {
+		return nil
+	}
+	return pidInfo.tids[tid]
+}
+
 type PIDInfo struct {
 	Extra ForkableExtra
 
 	Comm   string
 	kernel *PIDInfo
 	maps   []*Mmap
+
+	// tids holds per-thread state for each thread (TID) seen in this
+	// process, keyed by TID. The PID==TID leader thread is not
+	// special-cased here; it gets a TIDInfo like any other thread.
+	tids map[int]*TIDInfo
 }
 
 func (p *PIDInfo) fork(pid int) *PIDInfo {
@@ -90,7 +219,36 @@ func (p *PIDInfo) fork(pid int) *PIDInfo {
 	for i, mmap := range p.maps {
 		maps[i] = mmap.fork(pid)
 	}
-	return &PIDInfo{p.Extra.Fork(pid).(ForkableExtra), p.Comm, p.kernel, maps}
+	// A freshly forked process starts with only its one calling
+	// thread, so tids isn't carried over; Update will populate it as
+	// that thread (PID==TID) is seen again.
+	return &PIDInfo{p.Extra.Fork(pid).(ForkableExtra), p.Comm, p.kernel, maps, nil}
+}
+
+// ensureTID returns the TIDInfo for thread tid, creating it (with
+// Name defaulting to the process's Comm) if this is the first time
+// tid has been seen.
+func (p *PIDInfo) ensureTID(tid int) *TIDInfo {
+	if p.tids == nil {
+		p.tids = make(map[int]*TIDInfo)
+	}
+	t, ok := p.tids[tid]
+	if !ok {
+		t = &TIDInfo{Extra: make(ForkableExtra), Name: p.Comm}
+		p.tids[tid] = t
+	}
+	return t
+}
+
+// TIDInfo holds per-thread state for one thread of a process, such as
+// its thread name (which can differ from the process's Comm, since
+// prctl(PR_SET_NAME) only renames the calling thread) and any
+// per-thread Extra data a sample consumer wants to attach, such as a
+// register or call-stack decode cursor.
+type TIDInfo struct {
+	Extra ForkableExtra
+
+	Name string
 }
 
 func (p *PIDInfo) munmap(addr, mlen uint64) {
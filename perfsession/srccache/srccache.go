@@ -0,0 +1,313 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package srccache provides a shared, concurrency-safe cache of
+// source file lines for tools that annotate perf samples with source
+// code, such as branchstats and prologuer. It centralizes reading,
+// tab expansion, and an LRU eviction policy so each tool doesn't need
+// its own ad-hoc copy, and lets a profile recorded on one machine be
+// annotated on another by falling back to a search path or a
+// debuginfod-style fetcher.
+package srccache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"container/list"
+)
+
+// A Fetcher retrieves the contents of a source file that can't be
+// found on the local filesystem or search path, given its
+// DWARF-recorded path and the build ID of the binary it was compiled
+// into. HTTPFetcher implements this against a debuginfod-style
+// server.
+type Fetcher func(path, buildID string) ([]byte, error)
+
+// HTTPFetcher returns a Fetcher that retrieves source from a
+// debuginfod-style server at baseURL, fetching
+// baseURL/buildid/<buildID>/source/<path>. It returns an error for
+// paths with no known build ID, since a debuginfod server has no
+// other way to locate the source.
+func HTTPFetcher(baseURL string) Fetcher {
+	base := strings.TrimRight(baseURL, "/")
+	return func(path, buildID string) ([]byte, error) {
+		if buildID == "" {
+			return nil, &os.PathError{Op: "fetch", Path: path, Err: errNoBuildID}
+		}
+		url := base + "/buildid/" + buildID + "/source/" + path
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, &os.PathError{Op: "fetch", Path: url, Err: errStatus(resp.Status)}
+		}
+		return io.ReadAll(resp.Body)
+	}
+}
+
+type errStatus string
+
+func (e errStatus) Error() string { return string(e) }
+
+var errNoBuildID = errStatus("no build ID available to fetch source")
+
+// Cache is an LRU-bounded cache of source file contents, safe for
+// concurrent use by multiple goroutines. The zero value is an empty,
+// unbounded Cache with no search path or fetcher; use New to bound
+// its size.
+type Cache struct {
+	maxBytes int
+
+	mu       sync.Mutex
+	curBytes int
+	ll       *list.List // of *cacheEntry, most recently used at front
+	index    map[cacheKey]*list.Element
+
+	searchPath []string
+	fetch      Fetcher
+}
+
+// New creates a Cache that retains at most maxBytes bytes of source
+// text before evicting least-recently-used files. If maxBytes <= 0,
+// the cache is unbounded.
+func New(maxBytes int) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		index:    make(map[cacheKey]*list.Element),
+	}
+}
+
+// SearchPath sets the directories Cache falls back to, in order, for
+// a source file whose recorded path doesn't exist, trying
+// filepath.Join(dir, filepath.Base(path)) in each. This is useful
+// when a profile was recorded on a different machine than it's
+// annotated on.
+func (c *Cache) SearchPath(dirs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.searchPath = append([]string(nil), dirs...)
+}
+
+// SetFetcher sets the Fetcher Cache falls back to when a source file
+// can't be found locally or on the search path. See LinesForBinary
+// for how buildID reaches the fetcher.
+func (c *Cache) SetFetcher(fetcher Fetcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetch = fetcher
+}
+
+// cacheKey identifies a cached file: its path plus a stamp that
+// invalidates the entry if the underlying file changes. For a local
+// file, stamp is its modification time; for a file pulled in by
+// Fetcher, there's no local mtime to check, so stamp is derived from
+// the build ID (or the path, if there's no build ID) and the entry is
+// never invalidated.
+type cacheKey struct {
+	path  string
+	stamp string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	lines []string // tab-expanded; lines[0] is line 1
+	size  int
+	err   error
+}
+
+// Lines returns the tab-expanded source lines [first, last] of path
+// (1-based and inclusive). It's equivalent to
+// LinesForBinary(path, "", first, last).
+func (c *Cache) Lines(path string, first, last int) ([]string, error) {
+	return c.LinesForBinary(path, "", first, last)
+}
+
+// LinesForBinary is like Lines, but also passes buildID, the build ID
+// of the binary path was recorded from (see perffile.BuildIDInfo), to
+// Cache's Fetcher if path can't be found directly or via the search
+// path. This lets annotators working from a DWARF-recorded path that
+// doesn't exist on the current host recover the source from a
+// debuginfod-style server.
+func (c *Cache) LinesForBinary(path, buildID string, first, last int) ([]string, error) {
+	e := c.load(path, buildID)
+	if e.err != nil {
+		return nil, e.err
+	}
+	if first < 1 {
+		first = 1
+	}
+	if last > len(e.lines) {
+		last = len(e.lines)
+	}
+	if first > last {
+		return nil, nil
+	}
+	return e.lines[first-1 : last], nil
+}
+
+func (c *Cache) load(path, buildID string) *cacheEntry {
+	stamp, body, err := c.resolve(path, buildID)
+	key := cacheKey{path, stamp}
+
+	c.mu.Lock()
+	if el, ok := c.index[key]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*cacheEntry)
+		c.mu.Unlock()
+		return e
+	}
+	c.mu.Unlock()
+
+	e := &cacheEntry{key: key, err: err}
+	if err == nil {
+		e.lines = splitLines(body)
+		for _, line := range e.lines {
+			e.size += len(line)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[key]; ok {
+		// Another goroutine loaded this entry first; use it
+		// instead so concurrent loads agree on the cached
+		// value.
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry)
+	}
+	el := c.ll.PushFront(e)
+	c.index[key] = el
+	c.curBytes += e.size
+	c.evict()
+	return e
+}
+
+func (c *Cache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	for c.curBytes > c.maxBytes && c.ll.Len() > 1 {
+		el := c.ll.Back()
+		e := el.Value.(*cacheEntry)
+		c.ll.Remove(el)
+		delete(c.index, e.key)
+		c.curBytes -= e.size
+	}
+}
+
+// resolve reads path's contents, trying path directly, then the
+// search path, then the fetcher, in that order. It returns a stamp
+// suitable for cache invalidation.
+func (c *Cache) resolve(path, buildID string) (stamp string, body []byte, err error) {
+	if body, stamp, err = readLocal(path); err == nil {
+		return stamp, body, nil
+	}
+	firstErr := err
+
+	c.mu.Lock()
+	searchPath := c.searchPath
+	fetch := c.fetch
+	c.mu.Unlock()
+
+	base := filepath.Base(path)
+	for _, dir := range searchPath {
+		if body, stamp, err = readLocal(filepath.Join(dir, base)); err == nil {
+			return stamp, body, nil
+		}
+	}
+
+	if fetch != nil {
+		if body, err = fetch(path, buildID); err == nil {
+			if buildID != "" {
+				return "build:" + buildID, body, nil
+			}
+			return "fetch:" + path, body, nil
+		}
+	}
+
+	return "", nil, firstErr
+}
+
+func readLocal(path string) (body []byte, stamp string, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, fi.ModTime().Format(time.RFC3339Nano), nil
+}
+
+// splitLines splits body into tab-expanded lines, dropping a single
+// trailing empty line left by a final "\n".
+func splitLines(body []byte) []string {
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+	return lines
+}
+
+// tabWidth is the column spacing used to expand tabs, matching the
+// convention most terminals and editors use.
+const tabWidth = 8
+
+func expandTabs(line string) string {
+	if !strings.ContainsRune(line, '\t') {
+		return line
+	}
+	var sb strings.Builder
+	col := 0
+	for _, r := range line {
+		if r == '\t' {
+			n := tabWidth - col%tabWidth
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+		} else {
+			sb.WriteRune(r)
+			col++
+		}
+	}
+	return sb.String()
+}
+
+// CommonPrefix returns the length of the longest byte prefix common
+// to every line in lines, for trimming shared indentation before
+// printing a short source excerpt. It returns 0 for an empty lines.
+func CommonPrefix(lines []string) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	prefix := lines[0]
+	for _, line := range lines[1:] {
+		n := len(prefix)
+		if len(line) < n {
+			n = len(line)
+		}
+		i := 0
+		for i < n && prefix[i] == line[i] {
+			i++
+		}
+		prefix = prefix[:i]
+		if prefix == "" {
+			break
+		}
+	}
+	return len(prefix)
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srccache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTemp(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLines(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTemp(t, dir, "a.go", "one\ntwo\nthree\nfour\n")
+
+	c := New(0)
+	lines, err := c.Lines(path, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"two", "three"}
+	if len(lines) != len(want) || lines[0] != want[0] || lines[1] != want[1] {
+		t.Fatalf("Lines(2, 3) = %v, want %v", lines, want)
+	}
+
+	// Out-of-range bounds clamp rather than error.
+	lines, err = c.Lines(path, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("Lines(0, 100) = %v, want 4 lines", lines)
+	}
+}
+
+func TestLinesMissing(t *testing.T) {
+	c := New(0)
+	if _, err := c.Lines(filepath.Join(t.TempDir(), "missing.go"), 1, 1); err == nil {
+		t.Fatal("want error for missing file")
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	writeTemp(t, dir, "b.go", "hello\n")
+
+	c := New(0)
+	c.SearchPath(dir)
+	lines, err := c.Lines("/nonexistent/path/b.go", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != "hello" {
+		t.Fatalf("Lines via search path = %v, want [hello]", lines)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTemp(t, dir, "a.go", "aaaaaaaaaa\n")
+	b := writeTemp(t, dir, "b.go", "bbbbbbbbbb\n")
+
+	c := New(12)
+	if _, err := c.Lines(a, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lines(b, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	haveA := false
+	for key := range c.index {
+		if key.path == a {
+			haveA = true
+		}
+	}
+	n := c.ll.Len()
+	c.mu.Unlock()
+	if haveA {
+		t.Fatalf("expected a.go to be evicted once b.go was loaded")
+	}
+	if n != 1 {
+		t.Fatalf("cache has %d entries, want 1", n)
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  int
+	}{
+		{nil, 0},
+		{[]string{"abc"}, 3},
+		{[]string{"  foo", "  bar"}, 2},
+		{[]string{"  foo", "bar"}, 0},
+		{[]string{"same", "same"}, 4},
+	}
+	for _, tt := range tests {
+		if got := CommonPrefix(tt.lines); got != tt.want {
+			t.Errorf("CommonPrefix(%q) = %d, want %d", tt.lines, got, tt.want)
+		}
+	}
+}
+
+func TestExpandTabs(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"a\tb", "a       b"},
+		{"\tx", "        x"},
+		{"noop", "noop"},
+	}
+	for _, tt := range tests {
+		if got := expandTabs(tt.in); got != tt.want {
+			t.Errorf("expandTabs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
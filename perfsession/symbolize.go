@@ -14,12 +14,45 @@ import (
 	"sort"
 )
 
+// A Frame is one level of a symbolized call stack: either the
+// function actually executing at an IP, or (if Inlined) one of the
+// functions DWARF records as having been inlined into it.
+type Frame struct {
+	FuncName string
+	File     *dwarf.LineFile
+	Line     int
+	Inlined  bool
+}
+
 type Symbolic struct {
+	// FuncName and Line are redundant with Frames[0] (or the zero
+	// value, if Frames is empty); they're kept for callers written
+	// before Symbolize could see through inlining.
 	FuncName string
 	Line     dwarf.LineEntry
+
+	// Frames is the symbolized inline stack at this IP, innermost
+	// (the function actually executing) first, ending with the
+	// non-inlined function that contains it. It's empty if the IP
+	// couldn't be symbolized at all.
+	Frames []Frame
 }
 
 func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
+	// Dynamically loaded or JITed kernel symbols, such as BPF
+	// programs, aren't backed by an ELF/DWARF mmap, so they're
+	// symbolized from PERF_RECORD_KSYMBOL data instead.
+	if name, ok := session.lookupKsym(ip); ok {
+		out.FuncName = name
+		out.Line = dwarf.LineEntry{}
+		out.Frames = []Frame{{FuncName: name}}
+		return true
+	}
+
+	if mmap == nil {
+		return false
+	}
+
 	s := getSymbolicExtra(session, mmap.Filename)
 	if s == nil {
 		return false
@@ -27,8 +60,10 @@ func Symbolize(session *Session, mmap *Mmap, ip uint64, out *Symbolic) bool {
 	f, l := s.findIP(mmap, ip)
 	if f == nil {
 		out.FuncName = ""
+		out.Frames = nil
 	} else {
 		out.FuncName = f.name
+		out.Frames = s.inlineFrames(f, l, ip)
 	}
 	if l == nil {
 		out.Line = dwarf.LineEntry{}
@@ -64,7 +99,23 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 
 	// See dso__data_fd in toosl/perf/util/dso.c.
 
-	// TODO: Handle kernel symbols. See dso__find_kallsyms.
+	// The kernel's own mapping isn't a real file we can elf.Open;
+	// symbolize it from kallsyms instead, falling back to vmlinux
+	// if kallsyms is missing or looks unusable (e.g. kptr_restrict).
+	// See dso__find_kallsyms.
+	if isKallsymsFilename(filename) {
+		extra, err := newKallsymsExtra(kallsymsPath(session))
+		if err != nil {
+			log.Println(err)
+			for _, vmlinux := range vmlinuxCandidates(session) {
+				if extra, err = newSymbolicExtra(session, vmlinux); err == nil {
+					break
+				}
+			}
+		}
+		tables[filename] = extra
+		return extra
+	}
 
 	// Try build ID cache first.
 	//
@@ -76,7 +127,7 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 	for _, bid := range bids {
 		if bid.Filename == filename {
 			nfilename := fmt.Sprintf("%s/.build-id/%.2s/%s", buildIDDir, bid.BuildID, bid.BuildID.String()[2:])
-			extra, err = newSymbolicExtra(nfilename)
+			extra, err = newSymbolicExtra(session, nfilename)
 			if err == nil {
 				break
 			}
@@ -85,7 +136,7 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 
 	// Try original path.
 	if extra == nil {
-		extra, err = newSymbolicExtra(filename)
+		extra, err = newSymbolicExtra(session, filename)
 		if err != nil {
 			log.Println(err)
 		}
@@ -95,7 +146,7 @@ func getSymbolicExtra(session *Session, filename string) *symbolicExtra {
 	return extra
 }
 
-func newSymbolicExtra(filename string) (*symbolicExtra, error) {
+func newSymbolicExtra(session *Session, filename string) (*symbolicExtra, error) {
 	// Load ELF
 	elff, err := elf.Open(filename)
 	if err != nil {
@@ -103,27 +154,40 @@ func newSymbolicExtra(filename string) (*symbolicExtra, error) {
 	}
 	defer elff.Close()
 
-	// Load DWARF
-	//
-	// TODO: Support build IDs and debug links
+	// Load DWARF, from filename itself if it has .debug_info, or
+	// else from a split debug file found via its build ID or
+	// .gnu_debuglink, per the same resolution order as gdb and
+	// perf's own dso__load_sym.
 	//
 	// TODO: Support DWARF for relocatable objects
-	if elff.Type == elf.ET_EXEC && elff.Section(".debug_info") != nil {
-		dwarff, err := elff.DWARF()
-		if err != nil {
-			return nil, fmt.Errorf("error loading DWARF from %s: %s", filename, err)
+	if elff.Type == elf.ET_EXEC {
+		dwarff, dwarfErr := elff.DWARF()
+		if dwarfErr != nil {
+			if debugFilename, ok := findDebugFile(session, filename, elff); ok {
+				if debugELF, err := elf.Open(debugFilename); err == nil {
+					defer debugELF.Close()
+					dwarff, dwarfErr = debugELF.DWARF()
+					if altPath, altBuildID, ok := debugAltLink(debugELF); ok {
+						log.Printf("%s: has DWZ supplementary file %s (build ID %s); "+
+							"DW_FORM_GNU_ref_alt won't resolve, since debug/dwarf "+
+							"doesn't support supplementary files", debugFilename, altPath, altBuildID)
+					}
+				}
+			}
+		}
+		if dwarfErr == nil {
+			functab, inlineRoots := dwarfFuncTable(dwarff)
+			return &symbolicExtra{
+				functab:     functab,
+				linetab:     dwarfLineTable(dwarff),
+				inlineRoots: inlineRoots,
+			}, nil
 		}
-
-		return &symbolicExtra{
-			dwarfFuncTable(dwarff),
-			dwarfLineTable(dwarff),
-			false,
-		}, nil
 	}
 
 	// Make do with the ELF symbols.
 	funcTable, isReloc := elfFuncTable(filename, elff)
-	return &symbolicExtra{funcTable, nil, isReloc}, nil
+	return &symbolicExtra{functab: funcTable, isReloc: isReloc}, nil
 }
 
 type symbolicExtra struct {
@@ -133,6 +197,58 @@ type symbolicExtra struct {
 	// isReloc indicates that lowpc/highpc in functab are ELF file
 	// offsets rather than virtual addresses.
 	isReloc bool
+
+	// inlineRoots maps a funcRange's lowpc to the top-level
+	// DW_TAG_inlined_subroutines DWARF recorded directly inside
+	// that function, or is nil if dwarfFuncTable found none
+	// (either because nothing was inlined, or because functab came
+	// from ELF symbols rather than DWARF).
+	inlineRoots map[uint64][]*inlineNode
+}
+
+// inlineFrames builds the inline call stack at ip inside f, from
+// s.inlineRoots, innermost first, ending with f itself. l is the
+// line table entry findIP already found for ip, used as the
+// innermost frame's source location (DWARF only records inlined
+// calls' own call sites, not the line executing inside them).
+func (s *symbolicExtra) inlineFrames(f *funcRange, l *dwarf.LineEntry, ip uint64) []Frame {
+	var chain []*inlineNode
+	nodes := s.inlineRoots[f.lowpc]
+	for {
+		var next *inlineNode
+		for _, n := range nodes {
+			if n.contains(ip) {
+				next = n
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		nodes = next.children
+	}
+
+	frames := make([]Frame, 0, len(chain)+1)
+	for i := len(chain) - 1; i >= 0; i-- {
+		frame := Frame{FuncName: chain[i].name, Inlined: true}
+		if i == len(chain)-1 {
+			if l != nil {
+				frame.File, frame.Line = l.File, l.Line
+			}
+		} else {
+			frame.File, frame.Line = chain[i+1].callFile, chain[i+1].callLine
+		}
+		frames = append(frames, frame)
+	}
+
+	outer := Frame{FuncName: f.name}
+	if len(chain) > 0 {
+		outer.File, outer.Line = chain[0].callFile, chain[0].callLine
+	} else if l != nil {
+		outer.File, outer.Line = l.File, l.Line
+	}
+	return append(frames, outer)
 }
 
 func (s *symbolicExtra) findIP(mmap *Mmap, ip uint64) (f *funcRange, l *dwarf.LineEntry) {
@@ -166,30 +282,29 @@ type funcRange struct {
 	lowpc, highpc uint64
 }
 
-func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
+func dwarfFuncTable(dwarff *dwarf.Data) ([]funcRange, map[uint64][]*inlineNode) {
 	// Walk DWARF for functions
 	// TODO: Use .debug_pubnames (not supported by dwarf package)
 	r := dwarff.Reader()
 	out := make([]funcRange, 0)
+	var inlineRoots map[uint64][]*inlineNode
+	var cu *dwarf.Entry
 	for {
 		ent, err := r.Next()
 		if ent == nil || err != nil {
 			break
 		}
-		// TODO: We should process TagInlinedSubroutine, but
-		// apparently gc doesn't produce these.
-		//
-		// TODO: Support DW_AT_ranges.
 	tag:
 		switch ent.Tag {
 		case dwarf.TagSubprogram:
-			r.SkipChildren()
 			name, ok := ent.Val(dwarf.AttrName).(string)
 			if !ok {
+				r.SkipChildren()
 				break
 			}
 			lowpc, ok := ent.Val(dwarf.AttrLowpc).(uint64)
 			if !ok {
+				r.SkipChildren()
 				break
 			}
 			var highpc uint64
@@ -199,11 +314,24 @@ func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
 			case int64:
 				highpc = lowpc + uint64(highpcx)
 			default:
+				r.SkipChildren()
 				break tag
 			}
 			out = append(out, funcRange{name, lowpc, highpc})
 
-		case dwarf.TagCompileUnit, dwarf.TagModule, dwarf.TagNamespace:
+			if ent.Children {
+				if children := walkInlineChildren(r, dwarff, cu); len(children) > 0 {
+					if inlineRoots == nil {
+						inlineRoots = make(map[uint64][]*inlineNode)
+					}
+					inlineRoots[lowpc] = children
+				}
+			}
+
+		case dwarf.TagCompileUnit:
+			cu = ent
+
+		case dwarf.TagModule, dwarf.TagNamespace:
 			break
 
 		default:
@@ -213,7 +341,104 @@ func dwarfFuncTable(dwarff *dwarf.Data) []funcRange {
 
 	sort.Sort(funcRangeSorter(out))
 
-	return out
+	return out, inlineRoots
+}
+
+// An inlineNode is one DW_TAG_inlined_subroutine: a function DWARF
+// records as having been inlined into its parent (either another
+// inlineNode, for nested inlining, or a top-level funcRange).
+type inlineNode struct {
+	name     string
+	ranges   []pcRange
+	callFile *dwarf.LineFile
+	callLine int
+	children []*inlineNode
+}
+
+func (n *inlineNode) contains(ip uint64) bool {
+	for _, r := range n.ranges {
+		if r.lowpc <= ip && ip < r.highpc {
+			return true
+		}
+	}
+	return false
+}
+
+type pcRange struct {
+	lowpc, highpc uint64
+}
+
+// walkInlineChildren consumes ent's children (the reader must be
+// positioned just after an entry with Children == true) and returns
+// every DW_TAG_inlined_subroutine found among them, at any depth of
+// intervening lexical blocks: callers only care about PC
+// containment, not DWARF's block-scoping structure. cu is the
+// enclosing compile unit, needed to resolve DW_AT_call_file.
+func walkInlineChildren(r *dwarf.Reader, dwarff *dwarf.Data, cu *dwarf.Entry) []*inlineNode {
+	var out []*inlineNode
+	for {
+		ent, err := r.Next()
+		if ent == nil || err != nil || ent.Tag == 0 {
+			return out
+		}
+
+		if ent.Tag != dwarf.TagInlinedSubroutine {
+			if ent.Children {
+				out = append(out, walkInlineChildren(r, dwarff, cu)...)
+			}
+			continue
+		}
+
+		node := &inlineNode{}
+		if rngs, err := dwarff.Ranges(ent); err == nil {
+			for _, rg := range rngs {
+				node.ranges = append(node.ranges, pcRange{rg[0], rg[1]})
+			}
+		}
+		if off, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+			node.name = resolveOriginName(dwarff, off)
+		}
+		if cl, ok := ent.Val(dwarf.AttrCallLine).(int64); ok {
+			node.callLine = int(cl)
+		}
+		if cf, ok := ent.Val(dwarf.AttrCallFile).(int64); ok && cu != nil {
+			node.callFile = lineReaderFileAt(dwarff, cu, cf)
+		}
+		if ent.Children {
+			node.children = walkInlineChildren(r, dwarff, cu)
+		}
+
+		if len(node.ranges) > 0 {
+			out = append(out, node)
+		}
+	}
+}
+
+// resolveOriginName looks up the Name of the DWARF entry at off,
+// which an inlined subroutine's DW_AT_abstract_origin points to.
+func resolveOriginName(dwarff *dwarf.Data, off dwarf.Offset) string {
+	r := dwarff.Reader()
+	r.Seek(off)
+	ent, err := r.Next()
+	if err != nil || ent == nil {
+		return ""
+	}
+	name, _ := ent.Val(dwarf.AttrName).(string)
+	return name
+}
+
+// lineReaderFileAt resolves a DW_AT_call_file index (relative to the
+// compile unit cu) to the LineFile it names.
+func lineReaderFileAt(dwarff *dwarf.Data, cu *dwarf.Entry, fileIdx int64) *dwarf.LineFile {
+	lr, err := dwarff.LineReader(cu)
+	if err != nil || lr == nil {
+		return nil
+	}
+	files := lr.Files()
+	if fileIdx < 0 || int(fileIdx) >= len(files) {
+		return nil
+	}
+	return files[fileIdx]
 }
 
 func elfFuncTable(filename string, elff *elf.File) (out []funcRange, isReloc bool) {